@@ -49,7 +49,7 @@ func main() {
 
 	if err := app.RunWithArgsAndID(os.Args[1:], id, b); err != nil {
 		fmt.Fprintln(os.Stderr, err)
-		os.Exit(1)
+		os.Exit(app.ExitCode(err))
 	}
 
 }
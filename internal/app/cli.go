@@ -22,10 +22,30 @@ type RunContext struct {
 	OutRoot           string
 	NoDownload        bool
 	DryRun            bool
+	VideoPolicy       string
+	ImageSize         string
+	ImageFormat       string
+	PathTemplate      string
+	Dedupe            bool
+	EmbedMeta         bool
+	Mtime             bool
+	Archive           string
+	Storage           string
+	Rate              string
+	RateSchedule      string
+	MaxTotal          string
+	MaxUser           string
+	MinFree           string
+	Resume            bool
+	Command           string
+	Target            string
+	Args              []string
 }
 
 type RunMode int
 
+const usageText = "Usage:\n  xdl [-q|-d] [-resume] [-video policy] [-image size] [-image-format list] [-template path] [-dedupe] [-embed-meta] [-mtime] [-archive zip|tar.zst] [-storage s3://bucket/prefix] [-rate 5MB/s] [-rate-schedule windows] [-max-total-bytes size] [-max-user-bytes size] [-min-free size] <username> [more_usernames...]\n  xdl [-q|-d] -dedupe\n  xdl [-q|-d] retry-failed <run-dir>\n  xdl [-q|-d] verify <dir>\n  xdl db [user=NAME] [type=image|video] [status=done|failed] [since=DATE] [until=DATE]\n  xdl db stats|import [dir]\n\nExamples:\n  xdl google\n  xdl google nasa\n  xdl -d google\n  xdl -video maxh=720 google\n  xdl -resume google\n  xdl -rate 2MB/s -rate-schedule \"22:00-07:00=off\" google\n  xdl -max-total-bytes 50GB -min-free 5GB google nasa\n  xdl -archive tar.zst google\n  xdl -storage s3://archive/xdl google\n  xdl -template \"{user}/{date:2006/01}/{tweet_id}_{index}.{ext}\" google\n  xdl retry-failed xDownloads/google"
+
 func p9() string {
 	p0, e0 := os.Executable()
 	if e0 != nil || strings.TrimSpace(p0) == "" {
@@ -75,18 +95,45 @@ func parseArgs(a0 []string, p0 string, p1 []byte) (RunContext, error) {
 	var (
 		v0 bool
 		v1 bool
+		v2 string
+		v3 string
+		v4 string
+		v5 bool
+		v6 string
+		v7 bool
+		v8 string
+		v9 string
+		w0 string
+		w1 string
+		w2 string
+		w3 bool
+		w4 bool
+		w5 string
+		w6 string
 	)
 
 	z0 := flag.NewFlagSet("xdl", flag.ContinueOnError)
 	z0.SetOutput(io.Discard)
 	z0.BoolVar(&v0, "q", false, "Quiet mode")
 	z0.BoolVar(&v1, "d", false, "Debug mode")
+	z0.BoolVar(&v5, "resume", false, "Resume the latest run folder for each user")
+	z0.StringVar(&v2, "video", "", "Video variant policy: best, worst, maxh=N, maxw=N, bitrate=N, hls")
+	z0.StringVar(&v3, "image", "", "Image size: orig, 4096x4096, large, medium")
+	z0.StringVar(&v4, "image-format", "", "Image formats to try: jpg, png, webp (comma separated)")
+	z0.StringVar(&v6, "template", "", "Output path template relative to the run folder")
+	z0.StringVar(&v8, "rate", "", "Bandwidth limit for media downloads, e.g. 5MB/s or 20Mbps")
+	z0.StringVar(&v9, "rate-schedule", "", "Rate windows in local time, e.g. 09:00-18:00=1MB/s,22:00-07:00=off")
+	z0.StringVar(&w0, "max-total-bytes", "", "Stop the run after this much has been downloaded, e.g. 50GB")
+	z0.StringVar(&w1, "max-user-bytes", "", "Stop a user after this much has been downloaded for them")
+	z0.StringVar(&w2, "min-free", "", "Stop when free space on the output drive would drop below this, e.g. 2GB")
+	z0.BoolVar(&w3, "embed-meta", false, "Write the source tweet, author, date, text and alt text into downloaded images and videos")
+	z0.BoolVar(&w4, "mtime", false, "Set file and folder modification times to the tweet time")
+	z0.StringVar(&w5, "archive", "", "Write finished files into a zip or tar.zst volume in the run folder")
+	z0.StringVar(&w6, "storage", "", "Where finished files go: local, or s3://bucket/prefix")
+	z0.BoolVar(&v7, "dedupe", false, "Store files once by SHA-256 and link them into each run; alone, dedupe the existing archive")
 
 	if e0 := z0.Parse(a1); e0 != nil {
-		return RunContext{}, fmt.Errorf(
-			"Invalid arguments: %v\n\nUsage:\n  xdl [-q|-d] <username> [more_usernames...]\n\nExamples:\n  xdl google\n  xdl google nasa\n  xdl -d google",
-			e0,
-		)
+		return RunContext{}, &userError{msg: fmt.Sprintf("Invalid arguments: %v\n\n%s", e0, usageText), err: errUsage}
 	}
 
 	u0 := make([]string, 0, len(z0.Args()))
@@ -98,20 +145,54 @@ func parseArgs(a0 []string, p0 string, p1 []byte) (RunContext, error) {
 		u0 = append(u0, u2)
 	}
 
-	if len(u0) == 0 {
-		return RunContext{}, fmt.Errorf(
-			"Missing username.\n\nUsage:\n  xdl [-q|-d] <username> [more_usernames...]\n\nExamples:\n  xdl google\n  xdl google nasa\n  xdl -d google",
-		)
+	c1, t1 := "", ""
+	var g1 []string
+	if len(u0) > 0 && u0[0] == "db" {
+		c1, g1 = u0[0], u0[1:]
+		u0 = nil
+	}
+	if len(u0) > 0 && (u0[0] == "retry-failed" || u0[0] == "verify") {
+		if len(u0) != 2 {
+			return RunContext{}, &userError{msg: u0[0] + " needs exactly one folder.\n\n" + usageText, err: errUsage}
+		}
+		c1, t1 = u0[0], u0[1]
+		u0 = nil
+	}
+
+	if len(u0) == 0 && c1 == "" && v7 {
+		c1 = "dedupe"
+	}
+
+	if len(u0) == 0 && c1 == "" {
+		return RunContext{}, &userError{msg: "Missing username.\n\n" + usageText, err: errUsage}
 	}
 
 	r0 := RunContext{
-		Users:      u0,
-		Mode:       ModeVerbose,
-		RunID:      p0,
-		RunSeed:    p1,
-		OutRoot:    "xDownloads",
-		NoDownload: false,
-		DryRun:     false,
+		Users:        u0,
+		Mode:         ModeVerbose,
+		RunID:        p0,
+		RunSeed:      p1,
+		OutRoot:      "xDownloads",
+		NoDownload:   false,
+		DryRun:       false,
+		VideoPolicy:  strings.TrimSpace(v2),
+		ImageSize:    strings.TrimSpace(v3),
+		ImageFormat:  strings.TrimSpace(v4),
+		PathTemplate: strings.TrimSpace(v6),
+		Dedupe:       v7,
+		EmbedMeta:    w3,
+		Mtime:        w4,
+		Archive:      strings.TrimSpace(w5),
+		Storage:      strings.TrimSpace(w6),
+		Rate:         strings.TrimSpace(v8),
+		RateSchedule: strings.TrimSpace(v9),
+		MaxTotal:     strings.TrimSpace(w0),
+		MaxUser:      strings.TrimSpace(w1),
+		MinFree:      strings.TrimSpace(w2),
+		Resume:       v5,
+		Command:      c1,
+		Target:       t1,
+		Args:         g1,
 	}
 
 	if v1 {
@@ -126,7 +207,9 @@ func parseArgs(a0 []string, p0 string, p1 []byte) (RunContext, error) {
 
 	if r0.Mode == ModeDebug {
 		m0 := "multi"
-		if len(r0.Users) == 1 && strings.TrimSpace(r0.Users[0]) != "" {
+		if r0.Command != "" {
+			m0 = r0.Command
+		} else if len(r0.Users) == 1 && strings.TrimSpace(r0.Users[0]) != "" {
 			m0 = r0.Users[0]
 		}
 
@@ -0,0 +1,202 @@
+package app
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/ghostlawless/xdl/internal/index"
+	"github.com/ghostlawless/xdl/internal/log"
+	"github.com/ghostlawless/xdl/internal/utils"
+)
+
+func openIndex(r0 RunContext) *index.DB {
+	x0, e0 := index.Open(index.Path(r0.OutRoot))
+	if e0 != nil {
+		log.LogError("index", "archive index unreadable, continuing with what loaded: "+e0.Error())
+	}
+	return x0
+}
+
+func syncIndex(r0 RunContext, x0 *index.DB, d0 ...string) {
+	if x0 == nil {
+		return
+	}
+	for _, d1 := range d0 {
+		n0, e0 := x0.ImportRun(r0.OutRoot, d1)
+		if e0 != nil {
+			log.LogError("index", d1+": "+e0.Error())
+			continue
+		}
+		if r0.Mode == ModeDebug {
+			log.LogInfo("index", fmt.Sprintf("synced %s: %d record(s) changed", d1, n0))
+		}
+	}
+	if e1 := x0.Flush(); e1 != nil {
+		log.LogError("index", "save failed: "+e1.Error())
+	}
+}
+
+func syncExistingIndex(r0 RunContext, d0 ...string) {
+	if _, e0 := os.Stat(index.Path(r0.OutRoot)); e0 != nil {
+		return
+	}
+	syncIndex(r0, openIndex(r0), d0...)
+}
+
+func runDB(r0 RunContext) error {
+	a0 := r0.Args
+	c1 := ""
+	if len(a0) > 0 && (a0[0] == "import" || a0[0] == "stats") {
+		c1, a0 = a0[0], a0[1:]
+	}
+
+	x0 := openIndex(r0)
+
+	if c1 == "import" {
+		d0 := r0.OutRoot
+		if len(a0) > 1 {
+			return &userError{msg: "db import takes at most one folder.\n\n" + usageText, err: errUsage}
+		}
+		if len(a0) == 1 {
+			d0 = a0[0]
+		}
+		d0 = filepath.Clean(d0)
+		if !utils.DirExists(d0) {
+			return &userError{msg: fmt.Sprintf("Folder not found: %s", d0), err: errUsage}
+		}
+		n0, n1, e0 := x0.ImportTree(d0)
+		if e1 := x0.Flush(); e1 != nil && e0 == nil {
+			e0 = e1
+		}
+		if e0 != nil {
+			log.LogError("index", e0.Error())
+			return fmt.Errorf("Import of %s failed: %v", d0, e0)
+		}
+		if r0.Mode != ModeQuiet {
+			utils.PrintSuccess("Imported %d run folder(s) from %s; %d record(s) added or updated (%d total).", n0, d0, n1, x0.Len())
+		}
+		return nil
+	}
+
+	q0, e0 := parseIndexQuery(a0)
+	if e0 != nil {
+		return &userError{msg: e0.Error() + "\n\n" + usageText, err: errUsage}
+	}
+
+	if c1 == "stats" {
+		printIndexStats(x0.Stats(q0))
+		return nil
+	}
+
+	l0 := x0.Find(q0)
+	w0 := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w0, "DATE\tUSER\tTWEET\tMEDIA\tTYPE\tSTATUS\tSIZE\tFILE")
+	for _, r1 := range l0 {
+		t1 := "-"
+		if t2 := r1.Posted(); !t2.IsZero() {
+			t1 = t2.Format("2006-01-02")
+		}
+		fmt.Fprintf(w0, "%s\t%s\t%s\t%s\t%s\t%s\t%d\t%s\n",
+			t1, r1.User, dash(r1.TweetID), dash(r1.MediaID), r1.Type, r1.Status, r1.Size, dash(r1.File))
+	}
+	_ = w0.Flush()
+	if r0.Mode == ModeVerbose {
+		utils.PrintInfo("%d item(s)", len(l0))
+	}
+	return nil
+}
+
+func parseIndexQuery(a0 []string) (index.Query, error) {
+	var q0 index.Query
+	for _, a1 := range a0 {
+		k0, v0, ok := strings.Cut(a1, "=")
+		if !ok || strings.TrimSpace(v0) == "" {
+			return q0, fmt.Errorf("Invalid filter %q (expected key=value).", a1)
+		}
+		v0 = strings.TrimSpace(v0)
+		switch strings.ToLower(strings.TrimSpace(k0)) {
+		case "user":
+			q0.User = v0
+		case "type":
+			q0.Type = v0
+		case "status":
+			q0.Status = v0
+		case "since":
+			t0, ok := parseIndexDate(v0, false)
+			if !ok {
+				return q0, fmt.Errorf("Invalid date %q (use YYYY, YYYY-MM or YYYY-MM-DD).", v0)
+			}
+			q0.Since = t0
+		case "until":
+			t0, ok := parseIndexDate(v0, true)
+			if !ok {
+				return q0, fmt.Errorf("Invalid date %q (use YYYY, YYYY-MM or YYYY-MM-DD).", v0)
+			}
+			q0.Until = t0
+		default:
+			return q0, fmt.Errorf("Unknown filter %q (use user, type, status, since or until).", k0)
+		}
+	}
+	return q0, nil
+}
+
+func parseIndexDate(s string, end bool) (time.Time, bool) {
+	for _, f0 := range []struct {
+		layout  string
+		y, m, d int
+	}{
+		{"2006-01-02", 0, 0, 1},
+		{"2006-01", 0, 1, 0},
+		{"2006", 1, 0, 0},
+	} {
+		t0, e0 := time.Parse(f0.layout, s)
+		if e0 != nil {
+			continue
+		}
+		if end {
+			t0 = t0.AddDate(f0.y, f0.m, f0.d)
+		}
+		return t0, true
+	}
+	return time.Time{}, false
+}
+
+func printIndexStats(s0 index.Stats) {
+	mb := func(n int64) float64 { return float64(n) / 1024.0 / 1024.0 }
+	fmt.Printf("Total: %d item(s), %.2f MB\n", s0.Total.Items, mb(s0.Total.Bytes))
+	for _, g0 := range []struct {
+		name string
+		m    map[string]index.Stat
+	}{
+		{"user", s0.ByUser},
+		{"type", s0.ByType},
+		{"status", s0.ByStatus},
+	} {
+		if len(g0.m) == 0 {
+			continue
+		}
+		k0 := make([]string, 0, len(g0.m))
+		for k1 := range g0.m {
+			k0 = append(k0, k1)
+		}
+		sort.Strings(k0)
+		fmt.Printf("\nBy %s:\n", g0.name)
+		w0 := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		for _, k1 := range k0 {
+			fmt.Fprintf(w0, "  %s\t%d\t%.2f MB\n", dash(k1), g0.m[k1].Items, mb(g0.m[k1].Bytes))
+		}
+		_ = w0.Flush()
+	}
+}
+
+func dash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,70 @@
+package app
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/ghostlawless/xdl/internal/config"
+	"github.com/ghostlawless/xdl/internal/downloader"
+	"github.com/ghostlawless/xdl/internal/log"
+	"github.com/ghostlawless/xdl/internal/utils"
+)
+
+func openStore(r0 RunContext, c0 *config.EssentialsConfig) (*downloader.Store, error) {
+	if c0.Media.Dedupe == "" || c0.Media.Dedupe == "off" {
+		return nil, nil
+	}
+	return downloader.OpenStore(downloader.StorePath(r0.OutRoot), c0.Media.Dedupe)
+}
+
+func runDedupe(r0 RunContext, c0 *config.EssentialsConfig) error {
+	d0 := filepath.Clean(r0.OutRoot)
+	if !utils.DirExists(d0) {
+		return &userError{msg: fmt.Sprintf("Folder not found: %s", d0), err: errUsage}
+	}
+
+	s0, e0 := openStore(r0, c0)
+	if e0 != nil {
+		log.LogError("dedupe", e0.Error())
+		return fmt.Errorf("Could not open the content store: %v", e0)
+	}
+
+	if r0.Mode == ModeVerbose {
+		utils.PrintInfo("Hashing %s into %s (%s)", d0, s0.Root, s0.Link)
+	}
+
+	p0, e1 := downloader.DedupeArchive(d0, s0)
+	if e1 != nil {
+		log.LogError("dedupe", e1.Error())
+		return fmt.Errorf("Dedupe failed for %s: %v", d0, e1)
+	}
+
+	syncExistingIndex(r0, downloader.FindRunDirs(d0)...)
+
+	rp := downloader.DedupeReportPath(d0)
+	if e2 := p0.Save(rp); e2 != nil {
+		log.LogError("dedupe", "report save failed: "+e2.Error())
+	}
+
+	if r0.Mode == ModeDebug {
+		log.LogInfo("dedupe", fmt.Sprintf(
+			"root=%s files=%d unique=%d duplicate_groups=%d linked=%d saved=%d errors=%d",
+			d0, p0.Files, p0.Unique, len(p0.Groups), p0.Linked, p0.SavedBytes, len(p0.Errors),
+		))
+		for _, x0 := range p0.Errors {
+			log.LogError("dedupe", x0)
+		}
+	}
+
+	if r0.Mode == ModeVerbose {
+		mb := float64(p0.SavedBytes) / 1024.0 / 1024.0
+		utils.PrintSuccess(
+			"Dedupe done — files:%d unique:%d linked:%d (%.2f MB saved); report: %s",
+			p0.Files, p0.Unique, p0.Linked, mb, rp,
+		)
+		if len(p0.Errors) > 0 {
+			utils.PrintWarn("%d file(s) could not be stored; see %s", len(p0.Errors), rp)
+		}
+	}
+	return nil
+}
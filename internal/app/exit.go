@@ -0,0 +1,59 @@
+package app
+
+import (
+	"errors"
+
+	"github.com/ghostlawless/xdl/internal/downloader"
+	"github.com/ghostlawless/xdl/internal/scraper"
+)
+
+const (
+	ExitOK              = 0
+	ExitFailure         = 1
+	ExitUsage           = 2
+	ExitNotFound        = 3
+	ExitSuspended       = 4
+	ExitProtected       = 5
+	ExitWithheld        = 6
+	ExitRateLimited     = 7
+	ExitAuthExpired     = 8
+	ExitFeatureMismatch = 9
+	ExitStorage         = 10
+)
+
+var errUsage = errors.New("usage")
+
+type userError struct {
+	msg string
+	err error
+}
+
+func (e *userError) Error() string { return e.msg }
+
+func (e *userError) Unwrap() error { return e.err }
+
+func ExitCode(err error) int {
+	switch {
+	case err == nil:
+		return ExitOK
+	case errors.Is(err, errUsage):
+		return ExitUsage
+	case errors.Is(err, scraper.ErrNotFound):
+		return ExitNotFound
+	case errors.Is(err, scraper.ErrSuspended):
+		return ExitSuspended
+	case errors.Is(err, scraper.ErrProtected):
+		return ExitProtected
+	case errors.Is(err, scraper.ErrWithheld):
+		return ExitWithheld
+	case errors.Is(err, scraper.ErrRateLimited):
+		return ExitRateLimited
+	case errors.Is(err, scraper.ErrAuthExpired):
+		return ExitAuthExpired
+	case errors.Is(err, scraper.ErrFeatureMismatch):
+		return ExitFeatureMismatch
+	case errors.Is(err, downloader.ErrQuota):
+		return ExitStorage
+	}
+	return ExitFailure
+}
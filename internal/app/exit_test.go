@@ -0,0 +1,37 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/ghostlawless/xdl/internal/downloader"
+	"github.com/ghostlawless/xdl/internal/scraper"
+)
+
+func TestExitCode(t *testing.T) {
+	lookup := func(k error) error { return &scraper.LookupError{Kind: k, Target: "@bob"} }
+	tests := []struct {
+		err  error
+		want int
+	}{
+		{nil, ExitOK},
+		{errors.New("boom"), ExitFailure},
+		{&userError{msg: "Invalid -rate", err: errUsage}, ExitUsage},
+		{lookup(scraper.ErrNotFound), ExitNotFound},
+		{lookup(scraper.ErrSuspended), ExitSuspended},
+		{lookup(scraper.ErrProtected), ExitProtected},
+		{lookup(scraper.ErrWithheld), ExitWithheld},
+		{lookup(scraper.ErrRateLimited), ExitRateLimited},
+		{lookup(scraper.ErrAuthExpired), ExitAuthExpired},
+		{lookup(scraper.ErrFeatureMismatch), ExitFeatureMismatch},
+		{fmt.Errorf("user @bob: %w", lookup(scraper.ErrSuspended)), ExitSuspended},
+		{&userError{msg: "Stopped", err: lookup(scraper.ErrRateLimited)}, ExitRateLimited},
+		{fmt.Errorf("run for @bob: %w", downloader.ErrQuota), ExitStorage},
+	}
+	for _, tt := range tests {
+		if got := ExitCode(tt.err); got != tt.want {
+			t.Errorf("ExitCode(%v) = %d, want %d", tt.err, got, tt.want)
+		}
+	}
+}
@@ -1,9 +1,13 @@
 package app
 
 import (
+	"fmt"
 	"net"
 	"net/http"
 	"time"
+
+	"github.com/ghostlawless/xdl/internal/config"
+	"github.com/ghostlawless/xdl/internal/httpx"
 )
 
 func buildAPIClient(x0 time.Duration) *http.Client {
@@ -30,7 +34,25 @@ func buildAPIClient(x0 time.Duration) *http.Client {
 
 }
 
-func buildDownloadClient() *http.Client {
+func buildBandwidth(r0 RunContext, c0 *config.EssentialsConfig) (*httpx.Bandwidth, error) {
+	if r0.Rate != "" {
+		c0.Runtime.RateLimit = r0.Rate
+	}
+	if r0.RateSchedule != "" {
+		c0.Runtime.RateSchedule = r0.RateSchedule
+	}
+	b0, e0 := httpx.ParseRate(c0.Runtime.RateLimit)
+	if e0 != nil {
+		return nil, &userError{msg: fmt.Sprintf("Invalid rate limit: %v", e0), err: errUsage}
+	}
+	w0, e1 := httpx.ParseSchedule(c0.Runtime.RateSchedule)
+	if e1 != nil {
+		return nil, &userError{msg: fmt.Sprintf("Invalid rate schedule: %v", e1), err: errUsage}
+	}
+	return httpx.NewBandwidth(b0, w0), nil
+}
+
+func buildDownloadClient(b0 *httpx.Bandwidth) *http.Client {
 	a0 := &http.Transport{
 		Proxy:                 http.ProxyFromEnvironment,
 		ForceAttemptHTTP2:     true,
@@ -46,6 +68,6 @@ func buildDownloadClient() *http.Client {
 		}).DialContext,
 	}
 
-	return &http.Client{Transport: a0, Timeout: 0}
+	return &http.Client{Transport: b0.Wrap(a0), Timeout: 0}
 
 }
@@ -1,15 +1,21 @@
 package app
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/ghostlawless/xdl/internal/config"
 	"github.com/ghostlawless/xdl/internal/downloader"
+	"github.com/ghostlawless/xdl/internal/httpx"
 	"github.com/ghostlawless/xdl/internal/log"
 	"github.com/ghostlawless/xdl/internal/runtime"
 	"github.com/ghostlawless/xdl/internal/scraper"
+	"github.com/ghostlawless/xdl/internal/storage"
 	"github.com/ghostlawless/xdl/internal/utils"
 )
 
@@ -62,6 +68,7 @@ type scanResult struct {
 	TotalMedia  int
 	TotalImages int
 	TotalVideos int
+	End         scraper.ScanEnd
 }
 
 type downloadStats struct {
@@ -69,46 +76,54 @@ type downloadStats struct {
 	Skipped    int
 	Failed     int
 	Bytes      int64
+	Workers    int
 }
 
-func newPageProgressCallback(
-	r0 RunContext,
-	u0 string,
-	p0 int,
-	n0 int,
-) func(downloader.ProgressEvent) {
-	if n0 <= 0 {
-		return nil
-	}
+type runProgress struct {
+	mu    sync.Mutex
+	page  int
+	total int
+	a     int
+	b     int
+	c     int
+	d     int64
+	e     int
+}
+
+func (x0 *runProgress) grow(p0, n0 int) {
+	x0.mu.Lock()
+	x0.page = p0
+	x0.total += n0
+	x0.mu.Unlock()
+}
 
-	type x1 struct {
-		a int
-		b int
-		c int
-		d int64
-		e int
+func newRunProgress(r0 RunContext, u0 string, b0 *httpx.Bandwidth) (*runProgress, func(downloader.ProgressEvent)) {
+	x0 := &runProgress{}
+
+	count := func(ev downloader.ProgressEvent) (int, int) {
+		switch ev.Kind {
+		case downloader.ProgressKindDownloaded:
+			x0.a++
+			x0.d += ev.Size
+		case downloader.ProgressKindSkipped:
+			x0.b++
+		case downloader.ProgressKindFailed:
+			x0.c++
+		}
+		return x0.a + x0.b + x0.c, x0.total
 	}
-	x0 := &x1{}
 
 	switch r0.Mode {
 	case ModeVerbose:
-		return func(ev downloader.ProgressEvent) {
+		return x0, func(ev downloader.ProgressEvent) {
 			if globalControl.ShouldQuit() {
 				return
 			}
+			x0.mu.Lock()
+			defer x0.mu.Unlock()
 
-			switch ev.Kind {
-			case downloader.ProgressKindDownloaded:
-				x0.a++
-				x0.d += ev.Size
-			case downloader.ProgressKindSkipped:
-				x0.b++
-			case downloader.ProgressKindFailed:
-				x0.c++
-			}
-
-			k0 := x0.a + x0.b + x0.c
-			if k0 <= 0 {
+			k0, n0 := count(ev)
+			if k0 <= 0 || n0 <= 0 {
 				return
 			}
 
@@ -132,68 +147,215 @@ func newPageProgressCallback(
 			defer termMu.Unlock()
 
 			fmt.Printf(
-				"\rxdl @%s%s  page %d  [%s] %3.0f%%  %d/%d  (ok:%d skip:%d fail:%d)",
-				u0, sfx, p0, bar, pct, k0, n0,
-				x0.a, x0.b, x0.c,
+				"\rxdl @%s%s  page %d  [%s] %3.0f%%  %d/%d  (ok:%d skip:%d fail:%d)  %-10s",
+				u0, sfx, x0.page, bar, pct, k0, n0,
+				x0.a, x0.b, x0.c, httpx.FormatRate(b0.Throughput()),
 			)
 		}
 
 	case ModeDebug:
-		return func(ev downloader.ProgressEvent) {
-			switch ev.Kind {
-			case downloader.ProgressKindDownloaded:
-				x0.a++
-				x0.d += ev.Size
-			case downloader.ProgressKindSkipped:
-				x0.b++
-			case downloader.ProgressKindFailed:
-				x0.c++
-			}
+		return x0, func(ev downloader.ProgressEvent) {
+			x0.mu.Lock()
+			defer x0.mu.Unlock()
 
-			k0 := x0.a + x0.b + x0.c
-			if k0 <= 0 {
+			k0, n0 := count(ev)
+			if k0 <= 0 || n0 <= 0 {
 				return
 			}
 
 			x0.e++
-			emit := false
-			if n0 <= 50 {
-				emit = true
-			} else if x0.e%10 == 0 || k0 == n0 {
-				emit = true
-			}
-			if !emit {
+			if n0 > 50 && x0.e%10 != 0 && k0 != n0 {
 				return
 			}
 
-			f0 := float64(k0) / float64(n0)
-			if f0 < 0 {
-				f0 = 0
-			}
-			if f0 > 1 {
-				f0 = 1
-			}
-			pct := int(f0*100 + 0.5)
-
-			msg := fmt.Sprintf(
-				"progress user=%s page=%d done=%d/%d (%d%%) ok=%d skip=%d fail=%d bytes=%d",
-				u0,
-				p0,
-				k0,
-				n0,
-				pct,
-				x0.a,
-				x0.b,
-				x0.c,
-				x0.d,
-			)
-			log.LogInfo("download", msg)
+			pct := int(float64(k0)/float64(n0)*100 + 0.5)
+			log.LogInfo("download", fmt.Sprintf(
+				"progress user=%s page=%d done=%d/%d (%d%%) ok=%d skip=%d fail=%d bytes=%d rate=%.0fB/s",
+				u0, x0.page, k0, n0, pct, x0.a, x0.b, x0.c, x0.d, b0.Throughput(),
+			))
 		}
 
 	default:
-		return nil
+		return x0, nil
 	}
+}
 
+const (
+	finalRetryDelay = 5 * time.Second
+	pipelineDepth   = 2
+)
+
+func writeFailedReport(r0 RunContext, d0 string, kf *downloader.Checkpoint) {
+	n0, e0 := downloader.WriteFailedReport(d0, kf)
+	if e0 != nil {
+		log.LogError("download", "failed report: "+e0.Error())
+		return
+	}
+	if n0 > 0 && r0.Mode == ModeVerbose {
+		utils.PrintWarn("%d item(s) failed; see %s or run: xdl retry-failed %s", n0, downloader.FailedReportPath(d0), d0)
+	}
+}
+
+// forgetFailed drops cached TweetDetail lookups for failed items so the
+// next run resolves their URLs again instead of reusing a dead one.
+func forgetFailed(x0 *runShared, kf *downloader.Checkpoint) {
+	f0 := kf.FailedItems()
+	if len(f0) == 0 {
+		return
+	}
+	for _, it := range f0 {
+		x0.tdCache.Forget(it.TweetID)
+	}
+	if e0 := x0.tdCache.Save(); e0 != nil {
+		log.LogError("media", "TweetDetail cache save failed: "+e0.Error())
+	}
+}
+
+func retryFailedCycle(r0 RunContext, h1 *http.Client, c0 *config.EssentialsConfig, u1 string, o1 downloader.Options, s0 *downloadStats) {
+	if r0.Mode == ModeVerbose {
+		utils.PrintInfo("Retrying %d failed download(s) for @%s", s0.Failed, u1)
+	}
+
+	sum, err := downloader.RetryFailed(h1, c0, o1)
+	if err != nil {
+		log.LogError("download", "final retry cycle: "+err.Error())
+		if !errors.Is(err, downloader.ErrQuota) {
+			return
+		}
+	}
+
+	s0.Downloaded += sum.Downloaded
+	s0.Skipped += sum.Skipped
+	s0.Bytes += sum.TotalBytes
+	s0.Failed -= sum.Recovered
+	if s0.Failed < 0 {
+		s0.Failed = 0
+	}
+
+	if r0.Mode == ModeDebug {
+		log.LogInfo("download", fmt.Sprintf(
+			"final retry cycle user=%s attempted=%d recovered=%d still_failed=%d",
+			u1, sum.Recovered+sum.Failed, sum.Recovered, sum.Failed,
+		))
+	}
+}
+
+func scanEndMessage(u1 string, x1 *scraper.ScanEndError) string {
+	switch x1.Reason {
+	case "rate_limited":
+		return fmt.Sprintf(
+			"X kept rate limiting the media scan for @%s at page %d. Media found so far was downloaded; run again later with -resume to continue.",
+			u1, x1.Pages,
+		)
+	case "parse_error":
+		return fmt.Sprintf(
+			"The media scan for @%s stopped at page %d because the response could not be parsed. Run with -d to generate logs.",
+			u1, x1.Pages,
+		)
+	}
+	if x1.Status > 0 {
+		return fmt.Sprintf(
+			"The media scan for @%s stopped at page %d (HTTP %d). Media found so far was downloaded; run again with -resume to continue.",
+			u1, x1.Pages, x1.Status,
+		)
+	}
+	return fmt.Sprintf("The media scan for @%s stopped at page %d: %v", u1, x1.Pages, x1.Err)
+}
+
+func loadRunState(r0 RunContext, u1, mp, kp string) (*downloader.Manifest, *downloader.Checkpoint) {
+	if !r0.Resume {
+		return downloader.NewManifest(u1, r0.RunID), downloader.NewCheckpoint(u1, r0.RunID, nil)
+	}
+
+	mf, e0 := downloader.LoadManifest(mp)
+	if e0 != nil {
+		if !os.IsNotExist(e0) {
+			log.LogError("download", "manifest unreadable, starting fresh: "+e0.Error())
+		}
+		mf = downloader.NewManifest(u1, r0.RunID)
+	}
+
+	kf, e1 := downloader.LoadCheckpoint(kp)
+	if e1 != nil {
+		if !os.IsNotExist(e1) {
+			log.LogError("download", "checkpoint unreadable, starting fresh: "+e1.Error())
+		}
+		kf = downloader.NewCheckpoint(u1, r0.RunID, nil)
+	} else if r0.Mode == ModeDebug {
+		d, s, f := kf.CompletedCount()
+		log.LogInfo("download", fmt.Sprintf("resuming %s: done=%d skipped=%d failed=%d", kp, d, s, f))
+	}
+
+	return mf, kf
+}
+
+func openArchive(r0 RunContext, c0 *config.EssentialsConfig, d0 string) (*downloader.Archive, error) {
+	if r0.DryRun || c0.Media.Archive == "" {
+		return nil, nil
+	}
+	return downloader.OpenArchive(d0, c0.Media.Archive)
+}
+
+// closeArchive finishes the run's volume and saves the manifest, which now
+// says which volume holds each file.
+func closeArchive(r0 RunContext, a0 *downloader.Archive, mf *downloader.Manifest, mp string) {
+	if a0 == nil {
+		return
+	}
+	n0, e0 := a0.Close(mf)
+	if e0 != nil {
+		log.LogError("download", e0.Error())
+		if r0.Mode == ModeVerbose {
+			utils.PrintWarn("Archive not written: %v. Files were kept in %s and go into the next volume.", e0, a0.Dir)
+		}
+		return
+	}
+	if me := mf.Save(mp); me != nil {
+		log.LogError("download", "manifest save failed: "+me.Error())
+	}
+	if n0 > 0 && r0.Mode == ModeVerbose {
+		utils.PrintInfo("Archived %d file(s) to %s", n0, a0.Path)
+	}
+}
+
+func downloadOptions(
+	r0 RunContext,
+	c0 *config.EssentialsConfig,
+	d0 string,
+	u1 string,
+	kf *downloader.Checkpoint,
+	mf *downloader.Manifest,
+	ip scraper.ImagePolicy,
+	vp scraper.VideoPolicy,
+	tp *downloader.PathTemplate,
+	x0 *runShared,
+	cb func(downloader.ProgressEvent),
+) downloader.Options {
+	return downloader.Options{
+		RunDir:            d0,
+		User:              u1,
+		UserID:            mf.UserID,
+		Template:          tp,
+		MediaMaxBytes:     0,
+		DryRun:            r0.DryRun,
+		Attempts:          3,
+		PerAttemptTimeout: 2 * time.Minute,
+		Progress:          cb,
+		ShouldPause:       globalControl.ShouldPause,
+		ShouldQuit:        globalControl.ShouldQuit,
+		Checkpoint:        kf,
+		CheckpointPath:    downloader.CheckpointPath(d0),
+		Manifest:          mf,
+		Store:             x0.store,
+		Quota:             x0.quota,
+		Storage:           x0.storage,
+		Image:             ip,
+		Video:             vp,
+		Provenance:        c0.Media.EmbedMetadata,
+		Mtime:             c0.Media.SetMtime,
+		Concurrency:       c0.Runtime.DownloadWorkers,
+		MaxConcurrency:    c0.Runtime.MaxDownloadWorkers,
+	}
 }
 
 func scanAndDownloadUserMedia(
@@ -204,86 +366,172 @@ func scanAndDownloadUserMedia(
 	u1 string,
 	d0 string,
 	l0 *runtime.Limiter,
+	x0 *runShared,
 ) (scanResult, downloadStats, error) {
 	a0 := newScanAccumulator(256)
 	s0 := downloadStats{}
 
 	v0 := r0.Mode == ModeVerbose && len(r0.Users) == 1
 
-	f0 := func(p0 int, _ string, m0 []scraper.Media) error {
-		if globalControl.ShouldQuit() {
-			return fmt.Errorf("Stopped by user.")
-		}
-
-		if len(m0) == 0 {
-			return nil
-		}
-
-		a0.Add(m0)
+	mp := downloader.ManifestPath(d0)
+	kp := downloader.CheckpointPath(d0)
+	mf, kf := loadRunState(r0, u1, mp, kp)
+	ip, _ := scraper.ParseImagePolicy(c0.Media.Image, c0.Media.ImageFormat)
+	vp, _ := scraper.ParseVideoPolicy(c0.Media.Video)
+	tp, _ := downloader.ParsePathTemplate(c0.Media.PathTemplate)
+	mf.UserID = u0
+	if storage.IsRemote(x0.storage) {
+		mf.Storage = x0.storage.String()
+	}
+	mf.SetPolicy("video", vp.String())
+	mf.SetPolicy("image", ip.String())
+	mf.SetPolicy("path_template", tp.String())
+
+	av, e6 := openArchive(r0, c0, d0)
+	if e6 != nil {
+		log.LogError("download", e6.Error())
+		return a0.Result(), s0, fmt.Errorf("Could not start the %s archive for @%s: %v", c0.Media.Archive, u1, e6)
+	}
 
-		e0 := scraper.EnrichMediaWithTweetDetail(h0, c0, u1, m0, l0, v0)
-		if len(e0) == 0 {
-			return nil
+	o0 := func(cb func(downloader.ProgressEvent)) downloader.Options {
+		o1 := downloadOptions(r0, c0, d0, u1, kf, mf, ip, vp, tp, x0, cb)
+		o1.Archive = av
+		return o1
+	}
+	w0 := func() {
+		if me := mf.Save(mp); me != nil {
+			log.LogError("download", "manifest save failed: "+me.Error())
 		}
-
-		cb := newPageProgressCallback(r0, u1, p0, len(e0))
-
-		sum, err := downloader.DownloadAllCycles(h1, c0, e0, downloader.Options{
-			RunDir:            d0,
-			User:              u1,
-			MediaMaxBytes:     0,
-			DryRun:            r0.DryRun,
-			Attempts:          3,
-			PerAttemptTimeout: 2 * time.Minute,
-			Progress:          cb,
-			ShouldPause:       globalControl.ShouldPause,
-			ShouldQuit:        globalControl.ShouldQuit,
-		})
-		if err != nil {
-			log.LogError("download", err.Error())
-			return fmt.Errorf("Download failed for @%s. Try again, or run with -d to generate logs.", u1)
+		if ke := kf.Save(kp); ke != nil {
+			log.LogError("download", "checkpoint save failed: "+ke.Error())
 		}
+		saveRemoteState(x0, d0, mf, kf)
+	}
 
-		s0.Downloaded += sum.Downloaded
-		s0.Skipped += sum.Skipped
-		s0.Failed += sum.Failed
-		s0.Bytes += sum.TotalBytes
+	g0, cb := newRunProgress(r0, u1, x0.bw)
+	pl, e0 := downloader.NewPool(h1, c0, o0(cb))
+	if e0 != nil {
+		log.LogError("download", e0.Error())
+		closeArchive(r0, av, mf, mp)
+		return a0.Result(), s0, fmt.Errorf("Download failed for @%s. Try again, or run with -d to generate logs.", u1)
+	}
+	defer closeArchive(r0, av, mf, mp)
 
-		if r0.Mode == ModeDebug {
-			log.LogInfo("download", fmt.Sprintf(
-				"page=%d user=%s ok=%d skip=%d fail=%d bytes=%d cycles=%d",
-				p0, u1,
-				sum.Downloaded,
-				sum.Skipped,
-				sum.Failed,
-				sum.TotalBytes,
-				sum.Cycles,
-			))
+	type scanPage struct {
+		n int
+		m []scraper.Media
+	}
+	pc := make(chan scanPage, pipelineDepth)
+	ec := make(chan error, 1)
+	var st atomic.Bool
+
+	go func() {
+		var e1 error
+		for pg := range pc {
+			if e1 != nil {
+				continue
+			}
+			e2 := scraper.EnrichMediaWithTweetDetail(h0, c0, u1, pg.m, scraper.EnrichOptions{
+				Limiter: l0,
+				Verbose: v0,
+				Cache:   x0.tdCache,
+			})
+			g0.grow(pg.n, len(e2))
+			q0, e3 := pl.Submit(e2)
+			w0()
+			if r0.Mode == ModeDebug {
+				log.LogInfo("download", fmt.Sprintf("page=%d user=%s media=%d queued=%d", pg.n, u1, len(e2), q0))
+			}
+			if e3 != nil {
+				e1 = e3
+				st.Store(true)
+			}
 		}
+		ec <- e1
+	}()
 
-		if globalControl.ShouldQuit() {
-			if r0.Mode == ModeVerbose {
-				termMu.Lock()
-				fmt.Print("\n")
-				termMu.Unlock()
-				utils.PrintWarn("Stopped by user for @%s", u1)
-			}
+	f0 := func(p0 int, _ string, m0 []scraper.Media) error {
+		if globalControl.ShouldQuit() || st.Load() {
 			return fmt.Errorf("Stopped by user.")
 		}
-
-		if r0.Mode == ModeVerbose && cb != nil {
-			termMu.Lock()
-			fmt.Print("\n")
-			termMu.Unlock()
+		if len(m0) == 0 {
+			return nil
 		}
-
+		a0.Add(m0)
+		pc <- scanPage{n: p0, m: m0}
 		return nil
 	}
 
-	if err := scraper.WalkUserMediaPages(h0, c0, u0, u1, v0, l0, f0); err != nil {
-		return a0.Result(), s0, err
+	se, err := scraper.WalkUserMediaPages(h0, c0, u0, u1, v0, l0, f0)
+	close(pc)
+	e4 := <-ec
+	sum := pl.Close()
+	forgetFailed(x0, kf)
+	w0()
+
+	s0.Downloaded += sum.Downloaded
+	s0.Skipped += sum.Skipped
+	s0.Failed += sum.Failed
+	s0.Bytes += sum.TotalBytes
+	s0.Workers = sum.Concurrency
+
+	if r0.Mode == ModeDebug {
+		log.LogInfo("download", fmt.Sprintf(
+			"user=%s ok=%d skip=%d fail=%d held=%d bytes=%d pages=%d concurrency=%d peak=%d",
+			u1, sum.Downloaded, sum.Skipped, sum.Failed, sum.Held, sum.TotalBytes, sum.Cycles, sum.Concurrency, sum.PeakConcurrency,
+		))
+	}
+	if r0.Mode == ModeVerbose && cb != nil && sum.Downloaded+sum.Skipped+sum.Failed > 0 {
+		termMu.Lock()
+		fmt.Print("\n")
+		termMu.Unlock()
+	}
+
+	r1 := a0.Result()
+	r1.End = se
+
+	if globalControl.ShouldQuit() || errors.Is(e4, downloader.ErrAborted) {
+		if r0.Mode == ModeVerbose {
+			utils.PrintWarn("Stopped by user for @%s", u1)
+		}
+		writeFailedReport(r0, d0, kf)
+		syncIndex(r0, x0.index, d0)
+		return r1, s0, fmt.Errorf("Stopped by user.")
+	}
+	if e4 == nil {
+		e4 = x0.quota.Err(u1)
+	}
+	if e5 := quotaStop(r0, u1, e4); e5 != nil {
+		log.LogError("download", e4.Error())
+		writeFailedReport(r0, d0, kf)
+		syncIndex(r0, x0.index, d0)
+		return r1, s0, e5
+	}
+	if e4 != nil {
+		log.LogError("download", e4.Error())
+		writeFailedReport(r0, d0, kf)
+		syncIndex(r0, x0.index, d0)
+		return r1, s0, fmt.Errorf("Download failed for @%s. Try again, or run with -d to generate logs.", u1)
+	}
+
+	if !globalControl.ShouldQuit() && s0.Failed > 0 && !r0.DryRun {
+		time.Sleep(finalRetryDelay)
+		retryFailedCycle(r0, h1, c0, u1, o0(nil), &s0)
+		w0()
+	}
+	writeFailedReport(r0, d0, kf)
+	syncIndex(r0, x0.index, d0)
+	if e5 := quotaStop(r0, u1, x0.quota.Err(u1)); e5 != nil {
+		return r1, s0, e5
+	}
+	if err != nil {
+		var x1 *scraper.ScanEndError
+		if errors.As(err, &x1) {
+			return r1, s0, &userError{msg: scanEndMessage(u1, x1), err: x1}
+		}
+		return r1, s0, err
 	}
 
-	return a0.Result(), s0, nil
+	return r1, s0, nil
 
 }
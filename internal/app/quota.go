@@ -0,0 +1,65 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/ghostlawless/xdl/internal/config"
+	"github.com/ghostlawless/xdl/internal/downloader"
+	"github.com/ghostlawless/xdl/internal/log"
+	"github.com/ghostlawless/xdl/internal/storage"
+	"github.com/ghostlawless/xdl/internal/utils"
+)
+
+// buildQuota sets up the run's limits. With remote storage the free-space
+// watermark applies to the local staging folder only.
+func buildQuota(r0 RunContext, c0 *config.EssentialsConfig, s0 storage.Storage) (*downloader.Quota, error) {
+	if r0.MaxTotal != "" {
+		c0.Runtime.MaxTotalBytes = r0.MaxTotal
+	}
+	if r0.MaxUser != "" {
+		c0.Runtime.MaxUserBytes = r0.MaxUser
+	}
+	if r0.MinFree != "" {
+		c0.Runtime.MinFreeSpace = r0.MinFree
+	}
+	var n0 [3]int64
+	for i0, f0 := range []struct{ name, v string }{
+		{"max total bytes", c0.Runtime.MaxTotalBytes},
+		{"max user bytes", c0.Runtime.MaxUserBytes},
+		{"min free space", c0.Runtime.MinFreeSpace},
+	} {
+		n1, e0 := utils.ParseSize(f0.v)
+		if e0 != nil {
+			return nil, &userError{msg: fmt.Sprintf("Invalid %s: %v", f0.name, e0), err: errUsage}
+		}
+		n0[i0] = n1
+	}
+	_ = utils.EnsureDir(r0.OutRoot)
+	q0 := downloader.NewQuota(r0.OutRoot, n0[0], n0[1], n0[2], storage.IsRemote(s0))
+
+	if r0.Mode == ModeDebug {
+		log.LogInfo("config", fmt.Sprintf("quota: run=%d user=%d min_free=%d free=%d remote=%v", n0[0], n0[1], n0[2], q0.Free(), q0.Remote))
+	}
+	if e1 := q0.Check(0); e1 != nil {
+		log.LogError("download", "preflight: "+e1.Error())
+		return nil, &userError{
+			msg: fmt.Sprintf("Not starting: %v.\n\nFree up space, or lower runtime.min_free_space / -min-free.", e1),
+			err: e1,
+		}
+	}
+	return q0, nil
+}
+
+func quotaStop(r0 RunContext, u1 string, e0 error) error {
+	if !errors.Is(e0, downloader.ErrQuota) {
+		return nil
+	}
+	if r0.Mode == ModeVerbose {
+		utils.PrintWarn("Stopped @%s: %v", u1, e0)
+	}
+	return &userError{
+		msg: fmt.Sprintf("Stopped @%s: %v.\n\nProgress is saved; make room or raise the limit, then run again with -resume.", u1, e0),
+		err: e0,
+	}
+}
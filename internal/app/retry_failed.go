@@ -0,0 +1,124 @@
+package app
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/ghostlawless/xdl/internal/config"
+	"github.com/ghostlawless/xdl/internal/downloader"
+	"github.com/ghostlawless/xdl/internal/log"
+	"github.com/ghostlawless/xdl/internal/runtime"
+	"github.com/ghostlawless/xdl/internal/scraper"
+	"github.com/ghostlawless/xdl/internal/storage"
+	"github.com/ghostlawless/xdl/internal/utils"
+)
+
+func runRetryFailed(r0 RunContext, c0 *config.EssentialsConfig, h0, h1 *http.Client, x0 *runShared) error {
+	t0 := time.Now()
+	d0 := filepath.Clean(r0.Target)
+
+	kf, e0 := downloader.LoadCheckpoint(downloader.CheckpointPath(d0))
+	if e0 != nil {
+		log.LogError("download", "retry-failed: "+e0.Error())
+		return &userError{
+			msg: fmt.Sprintf("No checkpoint found in %s.\n\nPoint retry-failed at a run folder created by xdl (it contains checkpoint.json).", d0),
+			err: e0,
+		}
+	}
+
+	u1 := kf.User
+	f0 := kf.FailedItems()
+	if len(f0) == 0 {
+		if r0.Mode == ModeVerbose {
+			utils.PrintInfo("Nothing to retry in %s", d0)
+		}
+		writeFailedReport(r0, d0, kf)
+		return nil
+	}
+
+	if r0.Mode == ModeVerbose {
+		utils.PrintInfo("Retrying %d failed item(s) for @%s from %s", len(f0), u1, d0)
+	}
+	if r0.Mode == ModeDebug {
+		log.LogInfo("download", fmt.Sprintf("retry-failed dir=%s user=%s items=%d", d0, u1, len(f0)))
+	}
+
+	m0 := make([]scraper.Media, 0, len(f0))
+	for _, it := range f0 {
+		m0 = append(m0, it.Media())
+	}
+
+	l0 := runtime.NewLimiterWith(r0.RunSeed, []byte(strings.TrimSpace(c0.Runtime.LimiterSecret)))
+	m1 := scraper.EnrichMediaWithTweetDetail(h0, c0, u1, m0, scraper.EnrichOptions{
+		Limiter: l0,
+		Verbose: r0.Mode == ModeVerbose,
+		Cache:   x0.tdCache,
+		Force:   true,
+	})
+	kf.Merge(m1)
+
+	mp := downloader.ManifestPath(d0)
+	mf, e1 := downloader.LoadManifest(mp)
+	if e1 != nil {
+		if !os.IsNotExist(e1) {
+			log.LogError("download", "manifest unreadable, starting fresh: "+e1.Error())
+		}
+		mf = downloader.NewManifest(u1, kf.RunID)
+	}
+	if storage.IsRemote(x0.storage) {
+		mf.Storage = x0.storage.String()
+	}
+	ip, _ := scraper.ParseImagePolicy(c0.Media.Image, c0.Media.ImageFormat)
+	vp, _ := scraper.ParseVideoPolicy(c0.Media.Video)
+	t1 := c0.Media.PathTemplate
+	if s1, ok := mf.Policies["path_template"]; ok && r0.PathTemplate == "" {
+		t1 = s1
+	}
+	tp, e3 := downloader.ParsePathTemplate(t1)
+	if e3 != nil {
+		log.LogError("download", "retry-failed: "+e3.Error())
+		tp = nil
+	}
+
+	av, e4 := openArchive(r0, c0, d0)
+	if e4 != nil {
+		log.LogError("download", "retry-failed: "+e4.Error())
+		return fmt.Errorf("Could not start the %s archive in %s: %v", c0.Media.Archive, d0, e4)
+	}
+	o1 := downloadOptions(r0, c0, d0, u1, kf, mf, ip, vp, tp, x0, nil)
+	o1.Archive = av
+	sum, e2 := downloader.RetryFailed(h1, c0, o1)
+	closeArchive(r0, av, mf, mp)
+	forgetFailed(x0, kf)
+
+	if me := mf.Save(mp); me != nil {
+		log.LogError("download", "manifest save failed: "+me.Error())
+	}
+	if ke := kf.Save(downloader.CheckpointPath(d0)); ke != nil {
+		log.LogError("download", "checkpoint save failed: "+ke.Error())
+	}
+	writeFailedReport(r0, d0, kf)
+	saveRemoteState(x0, d0, mf, kf)
+	syncIndex(r0, x0.index, d0)
+
+	if e2 != nil {
+		log.LogError("download", e2.Error())
+		if e5 := quotaStop(r0, u1, e2); e5 != nil {
+			return e5
+		}
+		return fmt.Errorf("Retry failed for @%s. Try again, or run with -d to generate logs.", u1)
+	}
+
+	printRunSummary(r0, u1, t0, scanResult{}, downloadStats{
+		Downloaded: sum.Downloaded,
+		Skipped:    sum.Skipped,
+		Failed:     sum.Failed,
+		Bytes:      sum.TotalBytes,
+		Workers:    sum.Concurrency,
+	})
+	return nil
+}
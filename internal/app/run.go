@@ -2,6 +2,7 @@ package app
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net/http"
 	"path/filepath"
@@ -10,11 +11,45 @@ import (
 	"time"
 
 	"github.com/ghostlawless/xdl/internal/config"
+	"github.com/ghostlawless/xdl/internal/downloader"
+	"github.com/ghostlawless/xdl/internal/httpx"
+	"github.com/ghostlawless/xdl/internal/index"
 	"github.com/ghostlawless/xdl/internal/log"
 	"github.com/ghostlawless/xdl/internal/runtime"
+	"github.com/ghostlawless/xdl/internal/scraper"
+	"github.com/ghostlawless/xdl/internal/storage"
 	"github.com/ghostlawless/xdl/internal/utils"
 )
 
+type runShared struct {
+	tdCache *scraper.TweetDetailCache
+	store   *downloader.Store
+	index   *index.DB
+	bw      *httpx.Bandwidth
+	quota   *downloader.Quota
+	storage storage.Storage
+}
+
+func tweetDetailCachePath(r0 RunContext) string {
+	return filepath.Join(r0.OutRoot, ".xdl", "tweet_detail_cache.jsonl")
+}
+
+func newRunShared(r0 RunContext) *runShared {
+	x0 := &runShared{}
+
+	c0, e0 := scraper.LoadTweetDetailCache(tweetDetailCachePath(r0))
+	if e0 != nil {
+		log.LogError("media", "TweetDetail cache unreadable, starting empty: "+e0.Error())
+	}
+	x0.tdCache = c0
+	x0.index = openIndex(r0)
+	if r0.Mode == ModeDebug {
+		log.LogInfo("media", fmt.Sprintf("TweetDetail cache: %d tweet(s)", c0.Len()))
+	}
+
+	return x0
+}
+
 func runWithContext(r0 RunContext) error {
 	_ = context.Background()
 
@@ -24,6 +59,10 @@ func runWithContext(r0 RunContext) error {
 
 	startKeyboardControlListener(globalControl)
 
+	if r0.Command == "db" {
+		return runDB(r0)
+	}
+
 	p0 := []string{
 		filepath.Join(".", "config", "essentials.json"),
 		filepath.Join(".", "essentials.json"),
@@ -40,6 +79,17 @@ func runWithContext(r0 RunContext) error {
 		c0.Paths.DebugRaw = r0.LogPath
 	}
 
+	if e5 := applyMediaPolicies(r0, c0); e5 != nil {
+		return e5
+	}
+
+	if r0.Command == "verify" {
+		return runVerify(r0, c0)
+	}
+	if r0.Command == "dedupe" {
+		return runDedupe(r0, c0)
+	}
+
 	k0 := strings.TrimSpace(r0.CookiePath)
 	m0 := strings.TrimSpace(c0.Auth.Cookies.AuthToken) == "" || strings.TrimSpace(c0.Auth.Cookies.Ct0) == ""
 
@@ -66,10 +116,44 @@ func runWithContext(r0 RunContext) error {
 
 	t0 := c0.HTTPTimeout()
 	h0 := buildAPIClient(t0)
-	h1 := buildDownloadClient()
+	b0, e7 := buildBandwidth(r0, c0)
+	if e7 != nil {
+		return e7
+	}
+	h1 := buildDownloadClient(b0)
+	x0 := newRunShared(r0)
+	x0.bw = b0
+	s9, e9 := buildStorage(r0, c0)
+	if e9 != nil {
+		return e9
+	}
+	x0.storage = s9
+	if !r0.DryRun {
+		q0, e8 := buildQuota(r0, c0, s9)
+		if e8 != nil {
+			return e8
+		}
+		x0.quota = q0
+	}
+	if r0.Mode == ModeDebug {
+		log.LogInfo("config", fmt.Sprintf("rate limit: %q schedule: %q", c0.Runtime.RateLimit, c0.Runtime.RateSchedule))
+	}
+	if s2, e6 := openStore(r0, c0); e6 != nil {
+		log.LogError("dedupe", "content store disabled: "+e6.Error())
+	} else {
+		x0.store = s2
+	}
+
+	if r0.Mode == ModeVerbose {
+		scraper.SetRateLimitReporter(reportRateLimit)
+	}
+
+	if r0.Command == "retry-failed" {
+		return runRetryFailed(r0, c0, h0, h1, x0)
+	}
 
 	if len(r0.Users) == 1 {
-		return runSingleUser(r0, c0, h0, h1, r0.Users[0])
+		return runSingleUser(r0, c0, h0, h1, r0.Users[0], x0)
 	}
 
 	n0 := len(r0.Users)
@@ -89,7 +173,7 @@ func runWithContext(r0 RunContext) error {
 			s1 <- struct{}{}
 			defer func() { <-s1 }()
 
-			if e3 := runSingleUser(r0, c0, h0, h1, u1); e3 != nil {
+			if e3 := runSingleUser(r0, c0, h0, h1, u1, x0); e3 != nil {
 				q0 <- fmt.Errorf("@%s: %w", u1, e3)
 			}
 		}()
@@ -107,7 +191,69 @@ func runWithContext(r0 RunContext) error {
 	return nil
 
 }
-func runSingleUser(r0 RunContext, c0 *config.EssentialsConfig, h0, h1 *http.Client, u0 string) error {
+func applyMediaPolicies(r0 RunContext, c0 *config.EssentialsConfig) error {
+	if r0.VideoPolicy != "" {
+		c0.Media.Video = r0.VideoPolicy
+	}
+	v0, e0 := scraper.ParseVideoPolicy(c0.Media.Video)
+	if e0 != nil {
+		return &userError{msg: fmt.Sprintf("Invalid video policy: %v", e0), err: errUsage}
+	}
+	c0.Media.Video = v0.String()
+
+	if r0.ImageSize != "" {
+		c0.Media.Image = r0.ImageSize
+	}
+	if r0.ImageFormat != "" {
+		c0.Media.ImageFormat = r0.ImageFormat
+	}
+	i0, e1 := scraper.ParseImagePolicy(c0.Media.Image, c0.Media.ImageFormat)
+	if e1 != nil {
+		return &userError{msg: fmt.Sprintf("Invalid image policy: %v", e1), err: errUsage}
+	}
+	c0.Media.Image = i0.Size
+	c0.Media.ImageFormat = strings.Join(i0.Formats, ",")
+
+	if r0.PathTemplate != "" {
+		c0.Media.PathTemplate = r0.PathTemplate
+	}
+	t0, e2 := downloader.ParsePathTemplate(c0.Media.PathTemplate)
+	if e2 != nil {
+		return &userError{msg: fmt.Sprintf("Invalid path template: %v", e2), err: errUsage}
+	}
+	c0.Media.PathTemplate = t0.String()
+
+	if r0.EmbedMeta {
+		c0.Media.EmbedMetadata = true
+	}
+	if r0.Mtime {
+		c0.Media.SetMtime = true
+	}
+	if r0.Archive != "" {
+		c0.Media.Archive = r0.Archive
+	}
+	a0, e3 := downloader.ParseArchiveFormat(c0.Media.Archive)
+	if e3 != nil {
+		return &userError{msg: fmt.Sprintf("Invalid archive format: %v", e3), err: errUsage}
+	}
+	c0.Media.Archive = a0
+
+	if r0.Dedupe && (c0.Media.Dedupe == "" || c0.Media.Dedupe == "off") {
+		c0.Media.Dedupe = downloader.LinkHard
+	}
+	switch c0.Media.Dedupe {
+	case "", "off", downloader.LinkHard, downloader.LinkSym:
+	default:
+		return &userError{msg: fmt.Sprintf("Invalid media.dedupe %q (use off, hardlink or symlink)", c0.Media.Dedupe), err: errUsage}
+	}
+
+	if r0.Mode == ModeDebug {
+		log.LogInfo("config", "video policy: "+c0.Media.Video+" | image policy: "+i0.String()+" | path template: "+t0.String())
+	}
+	return nil
+}
+
+func runSingleUser(r0 RunContext, c0 *config.EssentialsConfig, h0, h1 *http.Client, u0 string, x0 *runShared) error {
 	t0 := time.Now()
 	l0 := runtime.NewLimiterWith(r0.RunSeed, []byte(strings.TrimSpace(c0.Runtime.LimiterSecret)))
 
@@ -133,8 +279,12 @@ func runSingleUser(r0 RunContext, c0 *config.EssentialsConfig, h0, h1 *http.Clie
 		return e1
 	}
 
-	a0, b0, e2 := scanAndDownloadUserMedia(r0, c0, h0, h1, i0, u0, d0, l0)
+	a0, b0, e2 := scanAndDownloadUserMedia(r0, c0, h0, h1, i0, u0, d0, l0, x0)
 	if e2 != nil {
+		var x1 *scraper.ScanEndError
+		if errors.As(e2, &x1) {
+			printRunSummary(r0, u0, t0, a0, b0)
+		}
 		return e2
 	}
 
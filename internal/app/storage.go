@@ -0,0 +1,81 @@
+package app
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/ghostlawless/xdl/internal/config"
+	"github.com/ghostlawless/xdl/internal/downloader"
+	"github.com/ghostlawless/xdl/internal/log"
+	"github.com/ghostlawless/xdl/internal/storage"
+	"github.com/ghostlawless/xdl/internal/utils"
+)
+
+func buildStorage(r0 RunContext, c0 *config.EssentialsConfig) (storage.Storage, error) {
+	s0 := &c0.Storage
+	switch v0 := r0.Storage; {
+	case v0 == "":
+	case v0 == "local":
+		s0.Backend = "local"
+	case strings.HasPrefix(v0, "s3://"):
+		b0, p0, _ := strings.Cut(strings.TrimPrefix(v0, "s3://"), "/")
+		s0.Backend, s0.S3.Bucket, s0.S3.Prefix = "s3", b0, p0
+	default:
+		return nil, &userError{msg: fmt.Sprintf("Invalid -storage %q (use local or s3://bucket/prefix)", v0), err: errUsage}
+	}
+
+	switch strings.ToLower(strings.TrimSpace(s0.Backend)) {
+	case "", "local":
+		return storage.NewLocal(r0.OutRoot), nil
+	case "s3":
+	default:
+		return nil, &userError{msg: fmt.Sprintf("Invalid storage.backend %q (use local or s3)", s0.Backend), err: errUsage}
+	}
+
+	if c0.Media.Archive != "" || c0.Media.SetMtime || (c0.Media.Dedupe != "" && c0.Media.Dedupe != "off") {
+		return nil, &userError{msg: "-archive, -mtime and -dedupe work on local files and cannot be combined with S3 storage.", err: errUsage}
+	}
+	n0, e0 := utils.ParseSize(s0.S3.PartSize)
+	if e0 != nil {
+		return nil, &userError{msg: fmt.Sprintf("Invalid storage.s3.part_size: %v", e0), err: errUsage}
+	}
+	o0 := storage.S3Config{
+		Endpoint:     first(s0.S3.Endpoint, os.Getenv("AWS_ENDPOINT_URL_S3"), os.Getenv("AWS_ENDPOINT_URL")),
+		Region:       first(s0.S3.Region, os.Getenv("AWS_REGION"), os.Getenv("AWS_DEFAULT_REGION")),
+		Bucket:       s0.S3.Bucket,
+		Prefix:       s0.S3.Prefix,
+		AccessKey:    first(s0.S3.AccessKey, os.Getenv("AWS_ACCESS_KEY_ID")),
+		SecretKey:    first(s0.S3.SecretKey, os.Getenv("AWS_SECRET_ACCESS_KEY")),
+		SessionToken: first(s0.S3.SessionToken, os.Getenv("AWS_SESSION_TOKEN")),
+		PartSize:     n0,
+	}
+	x0, e1 := storage.NewS3(o0)
+	if e1 != nil {
+		return nil, &userError{msg: fmt.Sprintf("Cannot use S3 storage: %v", e1), err: errUsage}
+	}
+	if r0.Mode == ModeDebug {
+		log.LogInfo("config", fmt.Sprintf("storage: %s endpoint=%q region=%q part_size=%d", x0, o0.Endpoint, o0.Region, n0))
+	}
+	return x0, nil
+}
+
+func first(v ...string) string {
+	for _, s := range v {
+		if s = strings.TrimSpace(s); s != "" {
+			return s
+		}
+	}
+	return ""
+}
+
+// saveRemoteState copies the run's state files next to its media when
+// files go to remote storage.
+func saveRemoteState(x0 *runShared, d0 string, mf *downloader.Manifest, kf *downloader.Checkpoint) {
+	if !storage.IsRemote(x0.storage) {
+		return
+	}
+	if e0 := downloader.SaveRunState(x0.storage, d0, mf, kf); e0 != nil {
+		log.LogError("storage", "state upload failed: "+e0.Error())
+	}
+}
@@ -1,6 +1,7 @@
 package app
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
 	"path/filepath"
@@ -32,6 +33,15 @@ func prepareRunOutputDir(r0 RunContext, _ *config.EssentialsConfig, u0 string, _
 		return "", e0
 	}
 
+	if r0.Resume {
+		if p2 := latestRunDir(r0.OutRoot, u0); p2 != "" {
+			if r0.Mode == ModeVerbose {
+				utils.PrintInfo("Resuming in: %s", p2)
+			}
+			return p2, nil
+		}
+	}
+
 	if utils.DirExists(p0) {
 		i0 := 1
 		for {
@@ -59,6 +69,21 @@ func prepareRunOutputDir(r0 RunContext, _ *config.EssentialsConfig, u0 string, _
 	return p0, nil
 }
 
+func latestRunDir(o0, u0 string) string {
+	p0 := filepath.Join(o0, u0)
+	if !utils.DirExists(p0) {
+		return ""
+	}
+	for i0 := 1; i0 <= 9999; i0++ {
+		p1 := filepath.Join(o0, fmt.Sprintf("%s_%03d", u0, i0))
+		if !utils.DirExists(p1) {
+			break
+		}
+		p0 = p1
+	}
+	return p0
+}
+
 func resolveUserID(r0 RunContext, c0 *config.EssentialsConfig, h0 *http.Client, u0 string, _ *spinner) (string, error) {
 	i0, e0 := scraper.FetchUserID(h0, c0, u0)
 	if e0 != nil {
@@ -68,10 +93,7 @@ func resolveUserID(r0 RunContext, c0 *config.EssentialsConfig, h0 *http.Client,
 			return "", fmt.Errorf("user lookup failed for @%s: %w", u0, e0)
 		}
 
-		return "", fmt.Errorf(
-			"Could not load @%s.\n\nFix:\n  1) Make sure you are logged in to x.com in your browser\n  2) Export cookies as JSON and save to config/cookies.json\n  3) Run xdl again\n\nTip: run with -d to generate logs.",
-			u0,
-		)
+		return "", &userError{msg: lookupMessage(u0, e0), err: e0}
 	}
 
 	if r0.Mode == ModeDebug {
@@ -81,15 +103,54 @@ func resolveUserID(r0 RunContext, c0 *config.EssentialsConfig, h0 *http.Client,
 	return i0, nil
 }
 
+func lookupMessage(u0 string, e0 error) string {
+	var l0 *scraper.LookupError
+	m0 := ""
+	if errors.As(e0, &l0) && l0.Message != "" {
+		m0 = "\n\nX says: " + l0.Message
+	}
+
+	switch {
+	case errors.Is(e0, scraper.ErrNotFound):
+		return fmt.Sprintf("@%s does not exist. Check the spelling and try again.", u0)
+	case errors.Is(e0, scraper.ErrSuspended):
+		return fmt.Sprintf("@%s is suspended; its media cannot be downloaded.%s", u0, m0)
+	case errors.Is(e0, scraper.ErrProtected):
+		return fmt.Sprintf(
+			"@%s is protected and the logged-in account does not follow it.\n\nFix:\n  1) Follow @%s from the account whose cookies xdl uses\n  2) Wait for the request to be approved\n  3) Run xdl again",
+			u0, u0,
+		)
+	case errors.Is(e0, scraper.ErrWithheld):
+		return fmt.Sprintf("@%s is withheld in your country.%s", u0, m0)
+	case errors.Is(e0, scraper.ErrRateLimited):
+		return fmt.Sprintf("X is rate limiting requests while loading @%s. Wait a few minutes and run xdl again.", u0)
+	case errors.Is(e0, scraper.ErrFeatureMismatch):
+		return fmt.Sprintf(
+			"X rejected the request for @%s because the GraphQL feature flags are out of date.%s\n\nFix: update the features in config/essentials.json, or update xdl.",
+			u0, m0,
+		)
+	case errors.Is(e0, scraper.ErrAuthExpired):
+		return fmt.Sprintf(
+			"Your X session has expired while loading @%s.\n\nFix:\n  1) Log in to x.com in your browser again\n  2) Export cookies as JSON and save to config/cookies.json\n  3) Run xdl again",
+			u0,
+		)
+	}
+
+	return fmt.Sprintf(
+		"Could not load @%s.\n\nFix:\n  1) Make sure you are logged in to x.com in your browser\n  2) Export cookies as JSON and save to config/cookies.json\n  3) Run xdl again\n\nTip: run with -d to generate logs.",
+		u0,
+	)
+}
+
 func printRunSummary(r0 RunContext, u0 string, t0 time.Time, s0 scanResult, d0 downloadStats) {
 	if r0.Mode == ModeDebug {
 		log.LogInfo("media", fmt.Sprintf(
-			"media found: %d (images:%d videos:%d)",
-			s0.TotalMedia, s0.TotalImages, s0.TotalVideos,
+			"media found: %d (images:%d videos:%d) scan_end=%s pages=%d",
+			s0.TotalMedia, s0.TotalImages, s0.TotalVideos, s0.End.Reason, s0.End.Pages,
 		))
 		log.LogInfo("download", fmt.Sprintf(
-			"done: ok=%d skipped=%d failed=%d bytes=%d",
-			d0.Downloaded, d0.Skipped, d0.Failed, d0.Bytes,
+			"done: ok=%d skipped=%d failed=%d bytes=%d concurrency=%d",
+			d0.Downloaded, d0.Skipped, d0.Failed, d0.Bytes, d0.Workers,
 		))
 		log.LogInfo("main", fmt.Sprintf(
 			"xdl[%s] exit [%.2fs] user=%s",
@@ -99,14 +160,51 @@ func printRunSummary(r0 RunContext, u0 string, t0 time.Time, s0 scanResult, d0 d
 	}
 
 	if r0.Mode == ModeVerbose {
+		if m0 := scanEndNote(s0.End); m0 != "" {
+			utils.PrintWarn("Scan for @%s %s", u0, m0)
+		}
 		mb := float64(d0.Bytes) / 1024.0 / 1024.0
+		w0 := ""
+		if d0.Workers > 0 {
+			w0 = fmt.Sprintf(", %d parallel", d0.Workers)
+		}
 		utils.PrintSuccess(
-			"Done @%s — ok:%d skip:%d fail:%d (%.2f MB, %.2fs)",
-			u0, d0.Downloaded, d0.Skipped, d0.Failed, mb, time.Since(t0).Seconds(),
+			"Done @%s — ok:%d skip:%d fail:%d (%.2f MB, %.2fs%s)",
+			u0, d0.Downloaded, d0.Skipped, d0.Failed, mb, time.Since(t0).Seconds(), w0,
 		)
 	}
 }
 
+func scanEndNote(e0 scraper.ScanEnd) string {
+	switch e0.Reason {
+	case "", "no_next_cursor", "aborted":
+		return ""
+	case "no_progress":
+		return fmt.Sprintf("ended at page %d: the last pages returned no new media", e0.Pages)
+	case "repeat_cursor":
+		return fmt.Sprintf("ended at page %d: X returned a cursor that was already seen", e0.Pages)
+	case "max_pages":
+		return fmt.Sprintf("ended at the page limit (%d)", e0.Pages)
+	case "rate_limited":
+		return fmt.Sprintf("ended at page %d: rate limited by X", e0.Pages)
+	case "http_error":
+		return fmt.Sprintf("ended at page %d: request failed", e0.Pages)
+	case "parse_error":
+		return fmt.Sprintf("ended at page %d: response could not be parsed", e0.Pages)
+	}
+	return fmt.Sprintf("ended at page %d (%s)", e0.Pages, e0.Reason)
+}
+
+func reportRateLimit(op string, left time.Duration) {
+	termMu.Lock()
+	defer termMu.Unlock()
+	if left <= 0 {
+		fmt.Printf("\r%s\r", strings.Repeat(" ", 72))
+		return
+	}
+	fmt.Printf("\rRate limited by X (%s), resuming in %-10s", op, left.String())
+}
+
 var termMu sync.Mutex
 
 type interactiveControl struct{}
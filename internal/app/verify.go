@@ -0,0 +1,71 @@
+package app
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/ghostlawless/xdl/internal/config"
+	"github.com/ghostlawless/xdl/internal/downloader"
+	"github.com/ghostlawless/xdl/internal/log"
+	"github.com/ghostlawless/xdl/internal/utils"
+)
+
+func runVerify(r0 RunContext, c0 *config.EssentialsConfig) error {
+	d0 := filepath.Clean(r0.Target)
+	if !utils.DirExists(d0) {
+		return &userError{msg: fmt.Sprintf("Folder not found: %s", d0), err: errUsage}
+	}
+
+	l0 := downloader.FindRunDirs(d0)
+	if len(l0) == 0 {
+		return &userError{
+			msg: fmt.Sprintf("No xdl run folders found in %s.\n\nPoint verify at a run folder (it contains manifest.json) or at the output root.", d0),
+			err: errUsage,
+		}
+	}
+
+	s0, e1 := buildStorage(r0, c0)
+	if e1 != nil {
+		return e1
+	}
+
+	n0, n1, n2 := 0, 0, 0
+	for _, d1 := range l0 {
+		v0, e0 := downloader.VerifyRun(d1, s0)
+		if e0 != nil {
+			log.LogError("verify", d1+": "+e0.Error())
+			return fmt.Errorf("Could not verify %s: %v", d1, e0)
+		}
+		n0 += v0.Checked
+		n1 += v0.Corrupt
+		n2 += v0.Requeued
+
+		if r0.Mode == ModeDebug {
+			log.LogInfo("verify", fmt.Sprintf("dir=%s checked=%d ok=%d corrupt=%d requeued=%d", d1, v0.Checked, v0.OK, v0.Corrupt, v0.Requeued))
+			for _, i0 := range v0.Issues {
+				log.LogInfo("verify", fmt.Sprintf("corrupt file=%s key=%s reason=%s", i0.File, i0.Key, i0.Reason))
+			}
+		}
+		if r0.Mode != ModeVerbose {
+			continue
+		}
+		if v0.Corrupt == 0 {
+			utils.PrintSuccess("%s: %d file(s) ok", d1, v0.Checked)
+			continue
+		}
+		utils.PrintWarn("%s: %d of %d file(s) corrupt", d1, v0.Corrupt, v0.Checked)
+		for _, i0 := range v0.Issues {
+			fmt.Printf("  %s: %s\n", i0.File, i0.Reason)
+		}
+		if v0.Requeued > 0 {
+			utils.PrintInfo("Queued %d item(s) for download; run: xdl retry-failed %s", v0.Requeued, d1)
+		}
+	}
+
+	syncExistingIndex(r0, l0...)
+
+	if n1 > 0 {
+		return fmt.Errorf("%d of %d file(s) failed verification (%d queued for retry).", n1, n0, n2)
+	}
+	return nil
+}
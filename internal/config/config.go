@@ -52,10 +52,45 @@ type PathsSection struct {
 }
 
 type RuntimeSection struct {
-	DebugEnabled   bool   `json:"debug_enabled"`
-	TimeoutSeconds int    `json:"timeout_seconds"`
-	MaxRetries     int    `json:"max_retries"`
-	LimiterSecret  string `json:"limiter_secret"`
+	DebugEnabled       bool   `json:"debug_enabled"`
+	TimeoutSeconds     int    `json:"timeout_seconds"`
+	MaxRetries         int    `json:"max_retries"`
+	LimiterSecret      string `json:"limiter_secret"`
+	EnrichWorkers      int    `json:"enrich_workers"`
+	DownloadWorkers    int    `json:"download_workers"`
+	MaxDownloadWorkers int    `json:"max_download_workers"`
+	RateLimit          string `json:"rate_limit"`
+	RateSchedule       string `json:"rate_schedule"`
+	MaxTotalBytes      string `json:"max_total_bytes"`
+	MaxUserBytes       string `json:"max_user_bytes"`
+	MinFreeSpace       string `json:"min_free_space"`
+}
+
+type MediaSection struct {
+	Video         string `json:"video"`
+	Image         string `json:"image"`
+	ImageFormat   string `json:"image_format"`
+	PathTemplate  string `json:"path_template"`
+	Dedupe        string `json:"dedupe"`
+	EmbedMetadata bool   `json:"embed_metadata"`
+	SetMtime      bool   `json:"set_mtime"`
+	Archive       string `json:"archive"`
+}
+
+type S3Section struct {
+	Endpoint     string `json:"endpoint"`
+	Region       string `json:"region"`
+	Bucket       string `json:"bucket"`
+	Prefix       string `json:"prefix"`
+	AccessKey    string `json:"access_key"`
+	SecretKey    string `json:"secret_key"`
+	SessionToken string `json:"session_token"`
+	PartSize     string `json:"part_size"`
+}
+
+type StorageSection struct {
+	Backend string    `json:"backend"`
+	S3      S3Section `json:"s3"`
 }
 
 type XSection struct {
@@ -70,6 +105,8 @@ type EssentialsConfig struct {
 	Features FeaturesSection   `json:"features"`
 	Paths    PathsSection      `json:"paths"`
 	Runtime  RuntimeSection    `json:"runtime"`
+	Media    MediaSection      `json:"media"`
+	Storage  StorageSection    `json:"storage"`
 }
 
 func LoadEssentialsWithFallback(paths []string) (*EssentialsConfig, error) {
@@ -134,6 +171,20 @@ func (c *EssentialsConfig) HTTPTimeout() time.Duration {
 	return time.Duration(c.Runtime.TimeoutSeconds) * time.Second
 }
 
+func (c *EssentialsConfig) MaxRetries() int {
+	if c == nil || c.Runtime.MaxRetries < 0 {
+		return 3
+	}
+	return c.Runtime.MaxRetries
+}
+
+func (c *EssentialsConfig) EnrichWorkers() int {
+	if c == nil || c.Runtime.EnrichWorkers <= 0 {
+		return 4
+	}
+	return c.Runtime.EnrichWorkers
+}
+
 func (c *EssentialsConfig) GraphQLURL(key string) (string, error) {
 	if c == nil {
 		return "", fmt.Errorf("nil config")
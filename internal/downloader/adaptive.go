@@ -0,0 +1,172 @@
+package downloader
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ghostlawless/xdl/internal/log"
+)
+
+const (
+	tuneStart    = 4
+	tuneMax      = 16
+	tuneWindow   = 3 * time.Second
+	tuneCooldown = 5 * time.Second
+	tuneProbe    = 3
+)
+
+// tuner caps the number of downloads in flight with AIMD: the limit grows by
+// one while throughput keeps improving and is halved on timeouts, 429s and
+// 5xx responses. A fixed Options.Concurrency disables it.
+type tuner struct {
+	mu    sync.Mutex
+	cv    *sync.Cond
+	fixed bool
+	dbg   bool
+	max   int
+	lim   int
+	act   int
+	peak  int
+
+	ws   time.Time
+	wb   int64
+	wn   int
+	wl   time.Duration
+	rate float64
+	lat  time.Duration
+	flat int
+	cool time.Time
+}
+
+func newTuner(opt Options, dbg bool) *tuner {
+	t := &tuner{dbg: dbg, max: opt.MaxConcurrency}
+	t.cv = sync.NewCond(&t.mu)
+	if opt.Concurrency > 0 {
+		t.fixed = true
+		t.max = opt.Concurrency
+		t.lim = opt.Concurrency
+	} else {
+		if t.max <= 0 {
+			t.max = tuneMax
+		}
+		t.lim = tuneStart
+		if t.lim > t.max {
+			t.lim = t.max
+		}
+	}
+	t.peak = t.lim
+	return t
+}
+
+func (t *tuner) acquire() {
+	t.mu.Lock()
+	for t.act >= t.lim {
+		t.cv.Wait()
+	}
+	t.act++
+	t.mu.Unlock()
+}
+
+func (t *tuner) release() {
+	t.mu.Lock()
+	t.act--
+	t.mu.Unlock()
+	t.cv.Broadcast()
+}
+
+// observe feeds a finished download into the current window and adjusts the
+// limit once the window is long enough to compare with the previous one.
+func (t *tuner) observe(n int64, d time.Duration) {
+	if t == nil || t.fixed {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	if t.ws.IsZero() {
+		t.ws = now.Add(-d)
+	}
+	t.wb += n
+	t.wn++
+	t.wl += d
+	el := now.Sub(t.ws)
+	if el < tuneWindow || t.wn < t.lim {
+		return
+	}
+	r := float64(t.wb) / el.Seconds()
+	l := t.wl / time.Duration(t.wn)
+	switch {
+	case t.rate == 0 || r > t.rate*1.05:
+		t.flat = 0
+		t.set(t.lim+1, fmt.Sprintf("throughput %.0f B/s", r))
+	case r < t.rate*0.8:
+		t.set(t.lim-1, fmt.Sprintf("throughput fell to %.0f B/s", r))
+	case t.lat > 0 && l > t.lat*3/2:
+		t.set(t.lim-1, fmt.Sprintf("latency rose to %s", l.Round(time.Millisecond)))
+	default:
+		t.flat++
+		if t.flat >= tuneProbe {
+			t.flat = 0
+			t.set(t.lim+1, "probe")
+		}
+	}
+	t.rate, t.lat = r, l
+	t.ws, t.wb, t.wn, t.wl = now, 0, 0, 0
+}
+
+// congested halves the limit, at most once per cooldown so one burst of
+// errors across all workers counts as a single signal.
+func (t *tuner) congested(why string) {
+	if t == nil || t.fixed {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	if now.Before(t.cool) {
+		return
+	}
+	t.cool = now.Add(tuneCooldown)
+	t.set(t.lim/2, why)
+	t.rate, t.lat, t.flat = 0, 0, 0
+	t.ws, t.wb, t.wn, t.wl = time.Time{}, 0, 0, 0
+}
+
+func (t *tuner) set(n int, why string) {
+	if n < 1 {
+		n = 1
+	}
+	if n > t.max {
+		n = t.max
+	}
+	if n == t.lim {
+		return
+	}
+	if t.dbg {
+		log.LogInfo("download", fmt.Sprintf("concurrency %d -> %d (%s)", t.lim, n, why))
+	}
+	t.lim = n
+	if n > t.peak {
+		t.peak = n
+	}
+	t.cv.Broadcast()
+}
+
+func (t *tuner) limits() (int, int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.lim, t.peak
+}
+
+func congestionOf(st int, err error) string {
+	switch {
+	case st == 429:
+		return "429 Too Many Requests"
+	case st >= 500:
+		return fmt.Sprintf("HTTP %d", st)
+	case st == 408 || (st < 400 && isTemp(err)):
+		return "timeout or connection error"
+	}
+	return ""
+}
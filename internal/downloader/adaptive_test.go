@@ -0,0 +1,125 @@
+package downloader
+
+import (
+	"testing"
+	"time"
+)
+
+// window feeds one full measuring window moving total bytes, with each
+// download taking lat.
+func window(tn *tuner, total int64, lat time.Duration) {
+	tn.ws = time.Now().Add(-4 * time.Second)
+	k := tn.lim
+	for i := 0; i < k; i++ {
+		tn.observe(total/int64(k), lat)
+	}
+}
+
+func TestTunerObserve(t *testing.T) {
+	tn := newTuner(Options{MaxConcurrency: 8}, false)
+	const ms = time.Millisecond
+	steps := []struct {
+		name  string
+		total int64
+		lat   time.Duration
+		want  int
+	}{
+		{"first window grows", 4 << 20, 100 * ms, 5},
+		{"faster grows", 6 << 20, 100 * ms, 6},
+		{"flat holds", 6 << 20, 100 * ms, 6},
+		{"flat holds again", 6 << 20, 100 * ms, 6},
+		{"third flat window probes", 6 << 20, 100 * ms, 7},
+		{"slower shrinks", 4 << 20, 100 * ms, 6},
+		{"latency rise shrinks", 4 << 20, 300 * ms, 5},
+		{"faster grows", 8 << 20, 300 * ms, 6},
+		{"faster grows", 12 << 20, 300 * ms, 7},
+		{"faster grows", 16 << 20, 300 * ms, 8},
+		{"capped at max", 24 << 20, 300 * ms, 8},
+	}
+	for _, s := range steps {
+		window(tn, s.total, s.lat)
+		if lim, _ := tn.limits(); lim != s.want {
+			t.Fatalf("%s: limit %d, want %d", s.name, lim, s.want)
+		}
+	}
+	if _, peak := tn.limits(); peak != 8 {
+		t.Errorf("peak %d, want 8", peak)
+	}
+
+	// A short window changes nothing.
+	tn.ws = time.Time{}
+	tn.observe(1<<30, 10*ms)
+	if lim, _ := tn.limits(); lim != 8 {
+		t.Errorf("short window moved the limit to %d", lim)
+	}
+}
+
+func TestTunerCongested(t *testing.T) {
+	tn := newTuner(Options{MaxConcurrency: 16}, false)
+	tn.set(9, "test")
+	tn.congested("429")
+	tn.congested("429 again")
+	if lim, _ := tn.limits(); lim != 4 {
+		t.Errorf("limit %d after a burst of errors, want 4", lim)
+	}
+	tn.cool = time.Time{}
+	tn.congested("503")
+	tn.cool = time.Time{}
+	tn.congested("503")
+	tn.cool = time.Time{}
+	tn.congested("503")
+	if lim, _ := tn.limits(); lim != 1 {
+		t.Errorf("limit %d, want it to stop at 1", lim)
+	}
+
+	fx := newTuner(Options{Concurrency: 3, MaxConcurrency: 16}, false)
+	fx.congested("429")
+	window(fx, 1<<30, time.Millisecond)
+	if lim, peak := fx.limits(); lim != 3 || peak != 3 {
+		t.Errorf("fixed limit moved to %d (peak %d)", lim, peak)
+	}
+	if sm := newTuner(Options{MaxConcurrency: 2}, false); sm.lim != 2 {
+		t.Errorf("start limit %d above a max of 2", sm.lim)
+	}
+}
+
+func TestTunerAcquire(t *testing.T) {
+	tn := newTuner(Options{Concurrency: 2}, false)
+	tn.acquire()
+	tn.acquire()
+	got := make(chan struct{})
+	go func() {
+		tn.acquire()
+		close(got)
+	}()
+	select {
+	case <-got:
+		t.Fatal("third download started over a limit of 2")
+	case <-time.After(50 * time.Millisecond):
+	}
+	tn.release()
+	select {
+	case <-got:
+	case <-time.After(time.Second):
+		t.Fatal("release did not wake a waiting download")
+	}
+}
+
+func TestCongestionOf(t *testing.T) {
+	tests := []struct {
+		st   int
+		err  error
+		want bool
+	}{
+		{429, nil, true},
+		{503, nil, true},
+		{408, nil, true},
+		{404, nil, false},
+		{200, nil, false},
+	}
+	for _, tt := range tests {
+		if got := congestionOf(tt.st, tt.err) != ""; got != tt.want {
+			t.Errorf("congestionOf(%d) = %v, want %v", tt.st, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,410 @@
+package downloader
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	ArchiveZip    = "zip"
+	ArchiveTarZst = "tar.zst"
+)
+
+// ParseArchiveFormat normalizes media.archive; "" means loose files.
+func ParseArchiveFormat(s string) (string, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "", "off", "none":
+		return "", nil
+	case "zip":
+		return ArchiveZip, nil
+	case "tar.zst", "tar.zstd", "tzst":
+		return ArchiveTarZst, nil
+	}
+	return "", fmt.Errorf("unknown archive format %q (use zip or tar.zst)", s)
+}
+
+// Archive streams finished files of one run into a volume next to the
+// run's state files. The volume is written as .part and renamed on Close;
+// loose files are only removed after that, so an interrupted run leaves
+// them in place and the next volume picks them up.
+type Archive struct {
+	Dir    string
+	Format string
+	Path   string
+
+	f     *os.File
+	zw    *zip.Writer
+	zs    *zstd.Encoder
+	tw    *tar.Writer
+	names map[string]string
+	q     chan string
+	done  chan struct{}
+
+	qmu  sync.RWMutex
+	shut bool
+
+	mu   sync.Mutex
+	seen map[string]bool
+	err  error
+	told bool
+}
+
+// OpenArchive starts the next volume for dir and adds any media left loose
+// by an earlier run.
+func OpenArchive(dir, format string) (*Archive, error) {
+	format, err := ParseArchiveFormat(format)
+	if err != nil {
+		return nil, err
+	}
+	if format == "" {
+		return nil, nil
+	}
+	n, err := nextVolume(dir, format)
+	if err != nil {
+		return nil, err
+	}
+	a := &Archive{
+		Dir:    dir,
+		Format: format,
+		Path:   volumePath(dir, format, n),
+		names:  make(map[string]string),
+		q:      make(chan string, 64),
+		done:   make(chan struct{}),
+		seen:   make(map[string]bool),
+	}
+	a.f, err = os.OpenFile(a.Path+".part", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	if format == ArchiveZip {
+		a.zw = zip.NewWriter(a.f)
+	} else {
+		if a.zs, err = zstd.NewWriter(a.f); err != nil {
+			a.f.Close()
+			_ = os.Remove(a.Path + ".part")
+			return nil, err
+		}
+		a.tw = tar.NewWriter(a.zs)
+	}
+	go a.run()
+	for _, p := range looseFiles(dir) {
+		if err := a.Add(p); err != nil {
+			a.abort()
+			return nil, err
+		}
+	}
+	return a, nil
+}
+
+func volumePath(dir, format string, n int) string {
+	return filepath.Join(dir, fmt.Sprintf("%s.%03d.%s", filepath.Base(dir), n, format))
+}
+
+// nextVolume returns the number after the highest finished volume and
+// drops .part files left by interrupted runs.
+func nextVolume(dir, format string) (int, error) {
+	es, err := os.ReadDir(dir)
+	if err != nil {
+		return 0, err
+	}
+	pre := filepath.Base(dir) + "."
+	n := 0
+	for _, e := range es {
+		name := e.Name()
+		if !strings.HasPrefix(name, pre) || e.IsDir() {
+			continue
+		}
+		if strings.HasSuffix(name, "."+format+".part") {
+			_ = os.Remove(filepath.Join(dir, name))
+			continue
+		}
+		num, ok := strings.CutSuffix(strings.TrimPrefix(name, pre), "."+format)
+		if !ok {
+			continue
+		}
+		if v, err := strconv.Atoi(num); err == nil && v > n {
+			n = v
+		}
+	}
+	return n + 1, nil
+}
+
+func looseFiles(dir string) []string {
+	var out []string
+	_ = filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if d.IsDir() {
+			if p != dir && (strings.HasSuffix(d.Name(), ".hls") || strings.HasPrefix(d.Name(), ".")) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if isMediaFile(d.Name()) {
+			out = append(out, p)
+		}
+		return nil
+	})
+	return out
+}
+
+// Add queues p for the volume under its path inside the run folder; a single
+// writer goroutine copies queued files in order, so workers only wait when
+// the queue is full. A failed write is reported once by the next Add; the
+// volume is then dropped on Close and later files stay loose.
+func (a *Archive) Add(p string) error {
+	if a == nil {
+		return nil
+	}
+	rel, err := filepath.Rel(a.Dir, p)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return fmt.Errorf("%s is outside the run folder", p)
+	}
+	name := filepath.ToSlash(rel)
+
+	a.mu.Lock()
+	if a.err != nil {
+		err, told := a.err, a.told
+		a.told = true
+		a.mu.Unlock()
+		if told {
+			return nil
+		}
+		return err
+	}
+	if a.seen[name] {
+		a.mu.Unlock()
+		return nil
+	}
+	a.seen[name] = true
+	a.mu.Unlock()
+
+	a.qmu.RLock()
+	defer a.qmu.RUnlock()
+	if a.shut {
+		return errors.New("archive " + filepath.Base(a.Path) + " is closed")
+	}
+	a.q <- p
+	return nil
+}
+
+func (a *Archive) run() {
+	defer close(a.done)
+	for p := range a.q {
+		a.mu.Lock()
+		failed := a.err != nil
+		a.mu.Unlock()
+		if failed {
+			continue
+		}
+		name, _ := filepath.Rel(a.Dir, p)
+		name = filepath.ToSlash(name)
+		if err := a.copyFile(name, p); err != nil {
+			a.mu.Lock()
+			a.err = fmt.Errorf("archive %s: %w", filepath.Base(a.Path), err)
+			a.mu.Unlock()
+			continue
+		}
+		a.names[name] = p
+	}
+}
+
+func (a *Archive) copyFile(name, p string) error {
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	return a.write(name, st.Size(), st.ModTime(), f)
+}
+
+// drain stops the queue and waits for the writer to finish it.
+func (a *Archive) drain() {
+	a.qmu.Lock()
+	if !a.shut {
+		a.shut = true
+		close(a.q)
+	}
+	a.qmu.Unlock()
+	<-a.done
+}
+
+func (a *Archive) write(name string, size int64, mt time.Time, r io.Reader) error {
+	if a.zw != nil {
+		h := &zip.FileHeader{Name: name, Method: zip.Store, Modified: mt}
+		if strings.HasSuffix(name, ".json") {
+			h.Method = zip.Deflate
+		}
+		h.SetMode(0o644)
+		w, err := a.zw.CreateHeader(h)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(w, r)
+		return err
+	}
+	h := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Mode:     0o644,
+		Size:     size,
+		ModTime:  mt,
+	}
+	if err := a.tw.WriteHeader(h); err != nil {
+		return err
+	}
+	n, err := io.Copy(a.tw, r)
+	if err == nil && n != size {
+		err = fmt.Errorf("%s changed while archiving", name)
+	}
+	return err
+}
+
+// Close notes the volume in the manifest entries it holds, appends the
+// manifest and finishes the volume, then removes the archived loose files.
+// A volume with no files is discarded.
+func (a *Archive) Close(mf *Manifest) (int, error) {
+	if a == nil {
+		return 0, nil
+	}
+	a.drain()
+	a.mu.Lock()
+	err := a.err
+	a.mu.Unlock()
+	if err != nil || len(a.names) == 0 {
+		a.abort()
+		return 0, err
+	}
+	vol := filepath.Base(a.Path)
+	if mf != nil {
+		mf.mu.Lock()
+		for i, e := range mf.Entries {
+			if _, ok := a.names[e.File]; ok {
+				mf.Entries[i].Archive = vol
+			}
+		}
+		mf.mu.Unlock()
+	}
+	err = a.finish(mf)
+	if err == nil {
+		err = os.Rename(a.Path+".part", a.Path)
+	}
+	if err != nil {
+		_ = os.Remove(a.Path + ".part")
+		return 0, fmt.Errorf("archive %s: %w", vol, err)
+	}
+	ps := make([]string, 0, len(a.names))
+	for _, p := range a.names {
+		ps = append(ps, p)
+	}
+	sort.Strings(ps)
+	for _, p := range ps {
+		_ = os.Remove(p)
+	}
+	for i := len(ps) - 1; i >= 0; i-- {
+		for d := filepath.Dir(ps[i]); d != a.Dir && strings.HasPrefix(d, a.Dir); d = filepath.Dir(d) {
+			if os.Remove(d) != nil {
+				break
+			}
+		}
+	}
+	return len(ps), nil
+}
+
+func (a *Archive) finish(mf *Manifest) error {
+	if mf != nil {
+		mf.mu.Lock()
+		data, err := json.MarshalIndent(mf, "", "  ")
+		mf.mu.Unlock()
+		if err != nil {
+			return err
+		}
+		if err := a.write("manifest.json", int64(len(data)), mf.UpdatedAt, bytes.NewReader(data)); err != nil {
+			return err
+		}
+	}
+	var err error
+	if a.zw != nil {
+		err = a.zw.Close()
+	} else {
+		err = errors.Join(a.tw.Close(), a.zs.Close())
+	}
+	if err == nil {
+		err = a.f.Sync()
+	}
+	return errors.Join(err, a.f.Close())
+}
+
+func (a *Archive) abort() {
+	a.drain()
+	if a.f != nil {
+		a.f.Close()
+	}
+	_ = os.Remove(a.Path + ".part")
+}
+
+func archiveResult(opt Options, r result) error {
+	for _, p := range r.files() {
+		if err := opt.Archive.Add(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// archiveSizes lists the entries of a finished volume with their sizes.
+func archiveSizes(p string) (map[string]int64, error) {
+	out := make(map[string]int64)
+	if strings.HasSuffix(p, "."+ArchiveZip) {
+		zr, err := zip.OpenReader(p)
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		for _, f := range zr.File {
+			out[f.Name] = int64(f.UncompressedSize64)
+		}
+		return out, nil
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	zs, err := zstd.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+	defer zs.Close()
+	tr := tar.NewReader(zs)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return out, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		out[h.Name] = h.Size
+	}
+}
@@ -0,0 +1,118 @@
+package downloader
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseArchiveFormat(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+		err  bool
+	}{
+		{"", "", false},
+		{"off", "", false},
+		{" None ", "", false},
+		{"ZIP", ArchiveZip, false},
+		{"tar.zst", ArchiveTarZst, false},
+		{"tar.zstd", ArchiveTarZst, false},
+		{"tzst", ArchiveTarZst, false},
+		{"rar", "", true},
+	}
+	for _, tt := range tests {
+		got, err := ParseArchiveFormat(tt.in)
+		if (err != nil) != tt.err || got != tt.want {
+			t.Errorf("ParseArchiveFormat(%q) = %q, %v; want %q, error %v", tt.in, got, err, tt.want, tt.err)
+		}
+	}
+}
+
+func TestNextVolume(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "alice_run")
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{
+		"alice_run.001.zip",
+		"alice_run.007.zip",
+		"alice_run.009.zip.part",
+		"alice_run.012.tar.zst",
+		"alice_run.x.zip",
+		"other.020.zip",
+		"manifest.json",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n, err := nextVolume(dir, ArchiveZip); err != nil || n != 8 {
+		t.Errorf("nextVolume(zip) = %d, %v; want 8", n, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "alice_run.009.zip.part")); !os.IsNotExist(err) {
+		t.Error("leftover .part volume was not removed")
+	}
+	if n, err := nextVolume(dir, ArchiveTarZst); err != nil || n != 13 {
+		t.Errorf("nextVolume(tar.zst) = %d, %v; want 13", n, err)
+	}
+	if _, err := nextVolume(filepath.Join(dir, "missing"), ArchiveZip); err == nil {
+		t.Error("nextVolume accepted a missing folder")
+	}
+}
+
+func TestArchiveVolume(t *testing.T) {
+	for _, format := range []string{ArchiveZip, ArchiveTarZst} {
+		t.Run(format, func(t *testing.T) {
+			dir := filepath.Join(t.TempDir(), "bob_run")
+			if err := os.MkdirAll(filepath.Join(dir, "images"), 0o755); err != nil {
+				t.Fatal(err)
+			}
+			loose := filepath.Join(dir, "images", "1.jpg")
+			fresh := filepath.Join(dir, "2.mp4")
+			os.WriteFile(loose, []byte("jpeg"), 0o644)
+			os.WriteFile(fresh, []byte("video!"), 0o644)
+
+			a, err := OpenArchive(dir, format)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := a.Add(fresh); err != nil {
+				t.Fatal(err)
+			}
+			if err := a.Add(filepath.Join(t.TempDir(), "3.jpg")); err == nil {
+				t.Error("Add accepted a file outside the run folder")
+			}
+			n, err := a.Close(nil)
+			if err != nil || n != 2 {
+				t.Fatalf("Close = %d, %v; want 2 files", n, err)
+			}
+			got, err := archiveSizes(volumePath(dir, format, 1))
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := map[string]int64{"images/1.jpg": 4, "2.mp4": 6}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("volume holds %v, want %v", got, want)
+			}
+			for _, p := range []string{loose, fresh, filepath.Dir(loose)} {
+				if _, err := os.Stat(p); !os.IsNotExist(err) {
+					t.Errorf("%s left behind after Close", p)
+				}
+			}
+
+			// An empty volume is dropped and does not take a number.
+			a, err = OpenArchive(dir, format)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n, err := a.Close(nil); err != nil || n != 0 {
+				t.Errorf("empty Close = %d, %v", n, err)
+			}
+			if n, _ := nextVolume(dir, format); n != 2 {
+				t.Errorf("next volume %d after an empty run, want 2", n)
+			}
+		})
+	}
+}
@@ -7,27 +7,31 @@ import (
 	"errors"
 	"fmt"
 	"hash/fnv"
+	"io"
 	"math/rand"
 	"net"
 	"net/http"
 	"net/url"
-	"os"
 	"path"
 	"path/filepath"
-	"runtime"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/ghostlawless/xdl/internal/config"
 	"github.com/ghostlawless/xdl/internal/httpx"
+	"github.com/ghostlawless/xdl/internal/log"
 	"github.com/ghostlawless/xdl/internal/scraper"
+	"github.com/ghostlawless/xdl/internal/storage"
 	"github.com/ghostlawless/xdl/internal/utils"
 )
 
 type Options struct {
 	RunDir            string
 	User              string
+	UserID            string
+	Template          *PathTemplate
 	MediaMaxBytes     int64
 	DryRun            bool
 	Attempts          int
@@ -36,19 +40,45 @@ type Options struct {
 	ShouldPause       func() bool
 	ShouldQuit        func() bool
 	Checkpoint        *Checkpoint
+	CheckpointPath    string
+	Manifest          *Manifest
+	Store             *Store
+	Quota             *Quota
+	Archive           *Archive
+	Storage           storage.Storage
+	Provenance        bool
+	Mtime             bool
+	Image             scraper.ImagePolicy
+	Video             scraper.VideoPolicy
+
+	SegmentConcurrency int
 
 	Concurrency         int
+	MaxConcurrency      int
 	BatchSize           int
 	JobJitterMax        time.Duration
 	JitterDeterministic bool
+
+	tuner *tuner
+	dirs  *dirTimes
 }
 
+const (
+	maxRetryAfter      = 2 * time.Minute
+	maxProgressRetries = 20
+)
+
 type Summary struct {
 	Downloaded int
 	Skipped    int
 	Failed     int
 	TotalBytes int64
 	Cycles     int
+	Recovered  int
+	Held       int
+
+	Concurrency     int
+	PeakConcurrency int
 }
 
 type ProgressKind int
@@ -66,11 +96,24 @@ type ProgressEvent struct {
 }
 
 type item struct {
-	Idx  int
-	URL  string
-	Type string
-	Size int64
-	Ext  string
+	Idx     int
+	Key     string
+	URL     string
+	Type    string
+	TweetID string
+	MediaID string
+	Pos     int
+	Width   int
+	Height  int
+	Bitrate int
+	Policy  string
+	Size    int64
+	Ext     string
+	Est     int64
+	Author  string
+	Text    string
+	Alt     string
+	Created string
 }
 
 func DownloadAllCycles(cl *http.Client, cf *config.EssentialsConfig, ms []scraper.Media, opt Options) (Summary, error) {
@@ -79,37 +122,35 @@ func DownloadAllCycles(cl *http.Client, cf *config.EssentialsConfig, ms []scrape
 		return s, nil
 	}
 	ds := binsOf(opt.RunDir)
-	for _, d := range ds.all() {
-		if err := utils.EnsureDir(d); err != nil {
-			return s, err
-		}
+	if err := ensureBins(ds, opt); err != nil {
+		return s, err
 	}
 	cp := opt.Checkpoint
 	if cp == nil {
-		cp = NewCheckpoint(opt.User, "", ms)
+		cp = NewCheckpoint(opt.User, "", nil)
 	}
-	it := make([]item, 0, len(cp.Items))
-	for _, v := range cp.Items {
+	cur := cp.Merge(ms)
+	it := make([]item, 0, len(cur))
+	for _, v := range cur {
 		switch v.Status {
 		case CheckpointDone, CheckpointSkipped:
 			s.Skipped++
+			if opt.Progress != nil {
+				opt.Progress(ProgressEvent{User: opt.User, Kind: ProgressKindSkipped, Size: 0})
+			}
 			continue
 		default:
-			ext := httpx.InferExt("", v.URL, v.Type)
-			it = append(it, item{Idx: v.Index, URL: v.URL, Type: v.Type, Size: v.Size, Ext: ext})
+			it = append(it, itemOf(v))
 		}
 	}
 	if len(it) == 0 {
 		return s, nil
 	}
 
-	cc := opt.Concurrency
-	if cc <= 0 {
-		cc = runtime.NumCPU()
-	}
+	opt.shared(cf)
 	bs := opt.BatchSize
 	if bs <= 0 {
-		bs = cc * 2
+		bs = opt.tuner.max * 2
 	}
 
 	pd := make([]item, len(it))
@@ -117,17 +158,17 @@ func DownloadAllCycles(cl *http.Client, cf *config.EssentialsConfig, ms []scrape
 
 	for len(pd) > 0 {
 		if opt.ShouldQuit != nil && opt.ShouldQuit() {
-			return s, errors.New("download aborted by user")
+			return s, ErrAborted
 		}
 		if opt.ShouldPause != nil && opt.ShouldPause() {
 			for opt.ShouldPause != nil && opt.ShouldPause() {
 				if opt.ShouldQuit != nil && opt.ShouldQuit() {
-					return s, errors.New("download aborted by user")
+					return s, ErrAborted
 				}
 				time.Sleep(200 * time.Millisecond)
 			}
 			if opt.ShouldQuit != nil && opt.ShouldQuit() {
-				return s, errors.New("download aborted by user")
+				return s, ErrAborted
 			}
 		}
 
@@ -138,16 +179,86 @@ func DownloadAllCycles(cl *http.Client, cf *config.EssentialsConfig, ms []scrape
 		b := pd[:k]
 		pd = pd[k:]
 
-		ok, sk, fl, by := doBatch(cl, cf, b, ds, opt, cp)
-		s.Downloaded += ok
-		s.Skipped += sk
-		s.Failed += fl
-		s.TotalBytes += by
+		t := doBatch(cl, cf, b, ds, opt, cp)
+		s.Downloaded += t.ok
+		s.Skipped += t.sk
+		s.Failed += t.fl
+		s.Held += t.hd
+		s.TotalBytes += t.by
 		s.Cycles++
+		if err := opt.Quota.Err(opt.User); err != nil {
+			s.Concurrency, s.PeakConcurrency = opt.tuner.limits()
+			return s, err
+		}
 	}
+	s.Concurrency, s.PeakConcurrency = opt.tuner.limits()
 	return s, nil
 }
 
+func RetryFailed(cl *http.Client, cf *config.EssentialsConfig, opt Options) (Summary, error) {
+	s := Summary{}
+	cp := opt.Checkpoint
+	if cp == nil || opt.DryRun {
+		return s, nil
+	}
+	fs := cp.FailedItems()
+	if len(fs) == 0 {
+		return s, nil
+	}
+	ds := binsOf(opt.RunDir)
+	if err := ensureBins(ds, opt); err != nil {
+		return s, err
+	}
+	it := make([]item, 0, len(fs))
+	for _, v := range fs {
+		it = append(it, itemOf(v))
+	}
+	opt.JobJitterMax = 0
+	opt.shared(cf)
+	t := doBatch(cl, cf, it, ds, opt, cp)
+	s.Downloaded = t.ok
+	s.Skipped = t.sk
+	s.Failed = t.fl
+	s.Held = t.hd
+	s.TotalBytes = t.by
+	s.Cycles = 1
+	s.Recovered = t.ok + t.sk
+	s.Concurrency, s.PeakConcurrency = opt.tuner.limits()
+	return s, opt.Quota.Err(opt.User)
+}
+
+// shared sets up the state every worker of one download run uses.
+func (opt *Options) shared(cf *config.EssentialsConfig) {
+	if opt.tuner == nil {
+		opt.tuner = newTuner(*opt, cf.Runtime.DebugEnabled)
+	}
+	if opt.dirs == nil {
+		opt.dirs = newDirTimes()
+	}
+}
+
+func itemOf(v CheckpointItem) item {
+	return item{
+		Idx:     v.Index,
+		Key:     v.Key,
+		URL:     v.URL,
+		Type:    v.Type,
+		TweetID: v.TweetID,
+		MediaID: v.MediaID,
+		Pos:     v.Position,
+		Width:   v.Width,
+		Height:  v.Height,
+		Bitrate: v.Bitrate,
+		Policy:  v.Policy,
+		Size:    v.Size,
+		Ext:     httpx.InferExt("", v.URL, v.Type),
+		Author:  v.Author,
+		Text:    v.Text,
+		Alt:     v.Alt,
+		Created: v.Created,
+	}
+}
+
 type bins struct {
 	I string
 	V string
@@ -164,98 +275,191 @@ func (sd bins) all() []string {
 	return []string{sd.I, sd.V}
 }
 
-func doBatch(cl *http.Client, cf *config.EssentialsConfig, b []item, ds bins, opt Options, cp *Checkpoint) (ok, sk, fl int, by int64) {
+func ensureBins(ds bins, opt Options) error {
+	if opt.Template != nil {
+		return nil
+	}
+	for _, d := range ds.all() {
+		if err := utils.EnsureDir(d); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type tally struct {
+	ok, sk, fl, hd int
+	by             int64
+}
+
+func doBatch(cl *http.Client, cf *config.EssentialsConfig, b []item, ds bins, opt Options, cp *Checkpoint) tally {
 	var wg sync.WaitGroup
 	wg.Add(len(b))
 
-	cc := opt.Concurrency
-	if cc <= 0 {
-		cc = runtime.NumCPU()
-	}
-	sem := make(chan struct{}, cc)
+	opt.shared(cf)
+	tn := opt.tuner
 
 	var mu sync.Mutex
+	var t tally
 	for _, it := range b {
 		it := it
-		sem <- struct{}{}
+		tn.acquire()
 		go func() {
 			defer wg.Done()
-			defer func() { <-sem }()
-
-			if d := calcJobJitter(it, opt); d > 0 {
-				if err := waitDurationWithControls(d, opt); err != nil {
-					mu.Lock()
-					fl++
-					if cp != nil {
-						cp.MarkByURL(it.URL, CheckpointFailed, 0)
-					}
-					mu.Unlock()
-					return
-				}
-			}
-
-			if opt.ShouldQuit != nil && opt.ShouldQuit() {
-				mu.Lock()
-				fl++
-				if cp != nil {
-					cp.MarkByURL(it.URL, CheckpointFailed, 0)
-				}
-				mu.Unlock()
-				return
-			}
+			defer tn.release()
+			runItem(cl, cf, it, ds, opt, cp, &mu, &t)
+		}()
+	}
+	wg.Wait()
+	return t
+}
 
-			r := doOne(cl, cf, it, ds, opt)
+func runItem(cl *http.Client, cf *config.EssentialsConfig, it item, ds bins, opt Options, cp *Checkpoint, mu *sync.Mutex, t *tally) {
+	if d := calcJobJitter(it, opt); d > 0 {
+		if err := waitDurationWithControls(d, opt); err != nil {
 			mu.Lock()
-			defer mu.Unlock()
-			if r.err != nil {
-				fl++
-				if cp != nil {
-					cp.MarkByURL(it.URL, CheckpointFailed, 0)
-				}
-				if opt.Progress != nil {
-					opt.Progress(ProgressEvent{User: opt.User, Kind: ProgressKindFailed, Size: 0})
-				}
-				return
+			t.fl++
+			if cp != nil {
+				cp.MarkByKey(it.Key, CheckpointFailed, 0)
 			}
-			if r.skipped {
-				sk++
-				if cp != nil {
-					cp.MarkByURL(it.URL, CheckpointSkipped, r.size)
-				}
-				if opt.Progress != nil {
-					opt.Progress(ProgressEvent{User: opt.User, Kind: ProgressKindSkipped, Size: 0})
-				}
-				return
+			mu.Unlock()
+			return
+		}
+	}
+
+	if opt.ShouldQuit != nil && opt.ShouldQuit() {
+		mu.Lock()
+		t.fl++
+		if cp != nil {
+			cp.MarkByKey(it.Key, CheckpointFailed, 0)
+		}
+		mu.Unlock()
+		return
+	}
+
+	q := opt.Quota
+	if opt.DryRun {
+		q = nil
+	}
+	est, disk := estimateOf(it), onDisk(it, opt)
+	if q.reserve(opt.User, est, disk) != nil {
+		mu.Lock()
+		t.hd++
+		mu.Unlock()
+		return
+	}
+
+	t0 := time.Now()
+	r := doOne(cl, cf, it, ds, opt)
+	var got int64
+	if r.ok && !r.skipped {
+		opt.tuner.observe(r.size, time.Since(t0))
+		if opt.Provenance && !opt.DryRun && r.path != "" {
+			// The hash is taken from the bytes as downloaded, so the same
+			// media from two tweets is still recognised as one.
+			hashResult(&r)
+			embedProvenance(cf, it, opt, &r)
+		}
+		got = r.size
+	}
+	q.settle(opt.User, est, got, disk)
+	if storage.IsRemote(opt.Storage) && !opt.DryRun && r.err == nil && r.path != "" && !r.remote {
+		if err := publishResult(opt, &r); err != nil {
+			r.err = err
+		}
+	}
+	if r.ok && r.path != "" && !r.remote {
+		storeResult(opt, it, &r)
+	}
+	if opt.Mtime && !opt.DryRun && r.err == nil && r.path != "" && !r.remote {
+		stampResult(cf, it, opt, r)
+	}
+	if opt.Archive != nil && !opt.DryRun && r.err == nil && r.path != "" && !r.remote {
+		if err := archiveResult(opt, r); err != nil {
+			if isNoSpace(err) {
+				r.err = err
+			} else {
+				log.LogError("download", err.Error())
 			}
-			ok++
-			by += r.size
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if isNoSpace(r.err) {
+		q.trip("disk full: " + r.err.Error())
+		if q != nil {
+			t.hd++
 			if cp != nil {
-				cp.MarkByURL(it.URL, CheckpointDone, r.size)
-			}
-			if opt.Progress != nil {
-				opt.Progress(ProgressEvent{User: opt.User, Kind: ProgressKindDownloaded, Size: r.size})
+				cp.MarkByKey(it.Key, CheckpointPending, 0)
 			}
-		}()
+			return
+		}
+	}
+	recordManifest(opt, it, r)
+	if r.err != nil {
+		t.fl++
+		if cp != nil {
+			cp.MarkFailure(it.Key, r.err.Error(), statusOf(r.err))
+		}
+		if opt.Progress != nil {
+			opt.Progress(ProgressEvent{User: opt.User, Kind: ProgressKindFailed, Size: 0})
+		}
+		return
+	}
+	if r.skipped {
+		t.sk++
+		if cp != nil {
+			cp.MarkByKey(it.Key, CheckpointSkipped, r.size)
+		}
+		if opt.Progress != nil {
+			opt.Progress(ProgressEvent{User: opt.User, Kind: ProgressKindSkipped, Size: 0})
+		}
+		return
+	}
+	t.ok++
+	t.by += r.size
+	if cp != nil {
+		cp.MarkByKey(it.Key, CheckpointDone, r.size)
+	}
+	if opt.Progress != nil {
+		opt.Progress(ProgressEvent{User: opt.User, Kind: ProgressKindDownloaded, Size: r.size})
 	}
-	wg.Wait()
-	return
 }
 
 type result struct {
 	ok      bool
 	skipped bool
 	size    int64
+	path    string
+	url     string
+	variant string
+	verify  string
+	sum     string
+	audio   string
+	remote  bool
+	meta    bool
+	linked  bool
 	err     error
 }
 
+// files lists the result's file and the separate HLS audio track, if any.
+func (r result) files() []string {
+	if r.audio == "" {
+		return []string{r.path}
+	}
+	return []string{r.path, r.audio}
+}
+
 func doOne(cl *http.Client, cf *config.EssentialsConfig, it item, ds bins, opt Options) result {
-	dst := pick(it, ds)
-	_ = utils.EnsureDir(dst)
-	base := baseFrom(it.URL)
-	if base == "" {
-		base = sh(it.URL)
+	variants, ext := kindOf(it, opt)
+	exts := []string{ext}
+	switch {
+	case variants:
+		exts = opt.Image.Formats
+	case ext == "m3u8":
+		exts = []string{"mp4", "ts"}
 	}
-	base = utils.SanitizeFilename(base)
+	dst, base := placeOf(it, ds, opt, exts...)
 	if opt.DryRun || opt.MediaMaxBytes > 0 {
 		_, sz, _, st, err := httpx.Head(cl, it.URL, cf.X.Network)
 		if err != nil {
@@ -272,22 +476,107 @@ func doOne(cl *http.Client, cf *config.EssentialsConfig, it item, ds bins, opt O
 			return result{ok: true, size: sz}
 		}
 	}
-	ext := it.Ext
-	if ext == "" {
-		ext = httpx.InferExt("", it.URL, it.Type)
-	}
 	fn := base
 	if ext != "" && !strings.HasSuffix(strings.ToLower(fn), "."+ext) {
 		fn += "." + ext
 	}
 	full := filepath.Join(dst, fn)
-	if st, err := os.Stat(full); err == nil && st.Size() > 0 {
-		return result{skipped: true, size: st.Size()}
+	if !staged(variants, ext, opt) {
+		return doStored(cl, cf, it, full, opt)
+	}
+	if storage.IsRemote(opt.Storage) && cf.Runtime.DebugEnabled {
+		log.LogInfo("download", fmt.Sprintf("%s is built in %s before upload", it.Key, opt.RunDir))
+	}
+	_ = utils.EnsureDir(dst)
+	if variants {
+		return doImageVariants(cl, cf, it, dst, base, opt)
+	}
+	if ext == "m3u8" {
+		return doHLS(cl, cf, it, dst, base, opt)
+	}
+	return doStaged(cl, cf, it, full, opt)
+}
+
+// staged reports whether an item has to be built in the run folder rather
+// than written straight to storage: image variants are compared side by
+// side, HLS is assembled from segments, and embedded metadata rewrites the
+// finished file. publishResult uploads staged files to remote storage.
+func staged(variants bool, ext string, opt Options) bool {
+	return variants || ext == "m3u8" || (opt.Provenance && storage.IsRemote(opt.Storage))
+}
+
+// kindOf reports whether it is saved as several image formats, and its
+// extension.
+func kindOf(it item, opt Options) (bool, string) {
+	variants := it.Type == "image" && len(opt.Image.Formats) > 1 && isTwimg(it.URL)
+	ext := it.Ext
+	if ext == "" {
+		ext = httpx.InferExt("", it.URL, it.Type)
+	}
+	return variants, ext
+}
+
+// onDisk reports whether it takes space on the local drive while it is
+// downloaded.
+func onDisk(it item, opt Options) bool {
+	if !storage.IsRemote(opt.Storage) {
+		return true
+	}
+	variants, ext := kindOf(it, opt)
+	return staged(variants, ext, opt)
+}
+
+// doStaged fetches a single file into the run folder for a remote run that
+// embeds metadata.
+func doStaged(cl *http.Client, cf *config.EssentialsConfig, it item, full string, opt Options) result {
+	if n, vs, ok := existingVerified(full); ok {
+		return result{skipped: true, size: n, path: full, verify: vs}
 	}
-	req, err := http.NewRequest(http.MethodGet, it.URL, nil)
+	n, sum, err := fetchWithRetry(cl, cf, it.URL, full, opt)
 	if err != nil {
 		return result{err: err}
 	}
+	vs, err := verifyDownloaded(full)
+	if err != nil {
+		return result{err: err, verify: vs}
+	}
+	return result{ok: true, size: n, path: full, verify: vs, sum: sum}
+}
+
+// fetchWithRetry downloads raw to the local file full, resuming from its
+// .part file.
+func fetchWithRetry(cl *http.Client, cf *config.EssentialsConfig, raw, full string, opt Options) (int64, string, error) {
+	p, err := storage.OpenPart(full)
+	if err != nil {
+		return 0, "", err
+	}
+	return fetchPart(cl, cf, raw, full, p, opt)
+}
+
+// fetchPart fills p from raw with the shared retry policy and commits it.
+// A part that still failed is kept for the next run.
+func fetchPart(cl *http.Client, cf *config.EssentialsConfig, raw, full string, p storage.Part, opt Options) (int64, string, error) {
+	n, sum, err := retryFetch(cf, raw, full, opt, func(rq *http.Request, to time.Duration) (int64, int, string, error) {
+		return httpx.DownloadToPartWithTimeout(cl, rq, p, opt.MediaMaxBytes, to)
+	})
+	if err != nil {
+		_ = p.Close()
+		return n, "", err
+	}
+	if err := p.Commit(); err != nil {
+		return n, "", err
+	}
+	return n, sum, nil
+}
+
+// retryFetch runs get with the shared retry policy. get reports how many
+// bytes it kept, so an attempt that got further than the last one is not
+// counted against the limit.
+func retryFetch(cf *config.EssentialsConfig, raw, full string, opt Options, get func(*http.Request, time.Duration) (int64, int, string, error)) (int64, string, error) {
+	req, err := http.NewRequest(http.MethodGet, raw, nil)
+	if err != nil {
+		return 0, "", err
+	}
 	cf.BuildRequestHeaders(req, cf.X.Network)
 	req.Header.Set("Accept", "*/*")
 	at := opt.Attempts
@@ -298,30 +587,110 @@ func doOne(cl *http.Client, cf *config.EssentialsConfig, it item, ds bins, opt O
 	if to <= 0 {
 		to = 2 * time.Minute
 	}
-	var n int64
+	var n, prev int64
 	var st int
+	var sum string
 	var last error
+	ext := 0
 	for i := 0; i < at; i++ {
-		n, st, last = httpx.DownloadToFileWithTimeout(cl, req, full, opt.MediaMaxBytes, to)
+		n, st, sum, last = get(req, to)
 		if last == nil {
-			return result{ok: true, size: n}
+			return n, sum, nil
 		}
-		if isTemp(last) {
-			sl := backoff(i)
-			if cf.Runtime.DebugEnabled {
-				meta := fmt.Sprintf("RETRY a=%d sleep=%s status=%d url=%s err=%v\n", i+1, sl, st, it.URL, last)
-				_, _ = utils.SaveTimestamped(cf.Paths.Debug, "err_download_meta", "txt", []byte(meta))
-			}
-			time.Sleep(sl)
+		if w := congestionOf(st, last); w != "" {
+			opt.tuner.congested(w)
+		}
+		if n > prev && ext < maxProgressRetries && isTemp(last) {
+			prev = n
+			ext++
+			i--
 			continue
 		}
-		break
+		sl, ok := retryDelay(i, st, last)
+		if !ok || i == at-1 {
+			break
+		}
+		if cf.Runtime.DebugEnabled {
+			meta := fmt.Sprintf("RETRY a=%d sleep=%s status=%d url=%s err=%v\n", i+1, sl, st, raw, last)
+			_, _ = utils.SaveTimestamped(cf.Paths.Debug, "err_download_meta", "txt", []byte(meta))
+		}
+		if waitDurationWithControls(sl, opt) != nil {
+			break
+		}
 	}
 	if cf.Runtime.DebugEnabled {
-		meta := fmt.Sprintf("DOWNLOAD_ERROR\nSTATUS: %d\nURL: %s\nDEST: %s\nERR: %v\n", st, it.URL, full, last)
+		meta := fmt.Sprintf("DOWNLOAD_ERROR\nSTATUS: %d\nURL: %s\nDEST: %s\nERR: %v\n", st, raw, full, last)
 		_, _ = utils.SaveTimestamped(cf.Paths.Debug, "err_download_meta", "txt", []byte(meta))
 	}
-	return result{err: last}
+	return n, "", last
+}
+
+func recordManifest(opt Options, it item, r result) {
+	if opt.Manifest == nil {
+		return
+	}
+	e := ManifestEntry{
+		Key:      it.Key,
+		TweetID:  it.TweetID,
+		MediaID:  it.MediaID,
+		Position: it.Pos,
+		Type:     it.Type,
+		URL:      it.URL,
+		Size:     r.size,
+		Width:    it.Width,
+		Height:   it.Height,
+		Bitrate:  it.Bitrate,
+		Policy:   it.Policy,
+		Variant:  r.variant,
+		Verify:   r.verify,
+		SHA256:   r.sum,
+		Meta:     r.meta,
+	}
+	if r.url != "" {
+		e.URL = r.url
+	}
+	if e.Variant == "" {
+		e.Variant = describeVariant(it)
+	}
+	if r.path != "" {
+		e.File = runRel(opt.RunDir, r.path)
+	}
+	if r.audio != "" {
+		e.Audio = runRel(opt.RunDir, r.audio)
+	}
+	switch {
+	case r.err != nil:
+		e.Status = CheckpointFailed
+	case r.skipped:
+		e.Status = CheckpointSkipped
+	default:
+		e.Status = CheckpointDone
+	}
+	opt.Manifest.Record(e)
+}
+
+func runRel(dir, p string) string {
+	if rel, err := filepath.Rel(dir, p); err == nil {
+		return filepath.ToSlash(rel)
+	}
+	return p
+}
+
+func describeVariant(it item) string {
+	if it.Type == "image" && isTwimg(it.URL) {
+		if v := imageVariantOf(it.URL); v != "" {
+			return v
+		}
+	}
+	switch {
+	case it.Width > 0 && it.Height > 0 && it.Bitrate > 0:
+		return fmt.Sprintf("%dx%d@%d", it.Width, it.Height, it.Bitrate)
+	case it.Width > 0 && it.Height > 0:
+		return fmt.Sprintf("%dx%d", it.Width, it.Height)
+	case it.Bitrate > 0:
+		return fmt.Sprintf("@%d", it.Bitrate)
+	}
+	return ""
 }
 
 func pick(it item, ds bins) string {
@@ -367,11 +736,56 @@ func isTemp(err error) bool {
 			return true
 		}
 	}
-	if errors.Is(err, context.DeadlineExceeded) {
+	if errors.Is(err, context.DeadlineExceeded) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNABORTED) ||
+		errors.Is(err, syscall.EPIPE) {
 		return true
 	}
 	e := strings.ToLower(err.Error())
-	return strings.Contains(e, "timeout") || strings.Contains(e, "deadline")
+	return strings.Contains(e, "timeout") ||
+		strings.Contains(e, "deadline") ||
+		strings.Contains(e, "connection reset") ||
+		strings.Contains(e, "broken pipe") ||
+		strings.Contains(e, "unexpected eof")
+}
+
+func statusOf(err error) int {
+	var se *httpx.StatusError
+	if errors.As(err, &se) {
+		return se.Status
+	}
+	return 0
+}
+
+func isRetryStatus(st int) bool {
+	switch st {
+	case http.StatusRequestTimeout, http.StatusTooEarly, http.StatusTooManyRequests,
+		http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+func retryDelay(i, st int, err error) (time.Duration, bool) {
+	if err == nil {
+		return 0, false
+	}
+	if errors.Is(err, httpx.ErrResumeMismatch) {
+		return 0, true
+	}
+	if !isRetryStatus(st) && (st >= 300 || !isTemp(err)) {
+		return 0, false
+	}
+	var se *httpx.StatusError
+	if errors.As(err, &se) && se.RetryAfter > 0 {
+		if se.RetryAfter > maxRetryAfter {
+			return maxRetryAfter, true
+		}
+		return se.RetryAfter, true
+	}
+	return backoff(i), true
 }
 
 func backoff(i int) time.Duration {
@@ -0,0 +1,501 @@
+package downloader
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/ghostlawless/xdl/internal/config"
+	"github.com/ghostlawless/xdl/internal/httpx"
+	"github.com/ghostlawless/xdl/internal/log"
+	"github.com/ghostlawless/xdl/internal/scraper"
+	"github.com/ghostlawless/xdl/internal/utils"
+)
+
+type hlsVariant struct {
+	uri       string
+	bandwidth int
+	width     int
+	height    int
+	codecs    string
+	audio     string
+}
+
+// muxed reports whether the rendition carries its own audio rather than
+// pointing at a separate AUDIO group.
+func (v hlsVariant) muxed() bool {
+	return v.audio == "" && strings.Contains(strings.ToLower(v.codecs), "mp4a")
+}
+
+type hlsRendition struct {
+	typ   string
+	group string
+	uri   string
+	def   bool
+}
+
+type hlsPlaylist struct {
+	master     bool
+	variants   []hlsVariant
+	renditions []hlsRendition
+	initURI    string
+	segments   []string
+}
+
+func (p *hlsPlaylist) ext() string {
+	if p.initURI != "" {
+		return "mp4"
+	}
+	for _, s := range p.segments {
+		u := strings.ToLower(strings.SplitN(s, "?", 2)[0])
+		if strings.HasSuffix(u, ".m4s") || strings.HasSuffix(u, ".mp4") {
+			return "mp4"
+		}
+	}
+	return "ts"
+}
+
+func (p *hlsPlaylist) audioFor(group string) string {
+	if group == "" {
+		return ""
+	}
+	first := ""
+	for _, r := range p.renditions {
+		if r.typ != "AUDIO" || r.group != group || r.uri == "" {
+			continue
+		}
+		if r.def {
+			return r.uri
+		}
+		if first == "" {
+			first = r.uri
+		}
+	}
+	return first
+}
+
+func parseM3U8(b []byte, base *url.URL) (*hlsPlaylist, error) {
+	sc := bufio.NewScanner(bytes.NewReader(b))
+	sc.Buffer(make([]byte, 0, 64*1024), 4<<20)
+
+	resolve := func(ref string) string {
+		ref = strings.TrimSpace(ref)
+		if ref == "" || base == nil {
+			return ref
+		}
+		u, err := url.Parse(ref)
+		if err != nil {
+			return ref
+		}
+		return base.ResolveReference(u).String()
+	}
+
+	pl := &hlsPlaylist{}
+	header := false
+	var pending *hlsVariant
+
+	for sc.Scan() {
+		l := strings.TrimSpace(sc.Text())
+		if l == "" {
+			continue
+		}
+		if !header {
+			if !strings.HasPrefix(l, "#EXTM3U") {
+				return nil, errors.New("not an m3u8 playlist")
+			}
+			header = true
+			continue
+		}
+		switch {
+		case strings.HasPrefix(l, "#EXT-X-STREAM-INF:"):
+			a := parseHLSAttrs(strings.TrimPrefix(l, "#EXT-X-STREAM-INF:"))
+			v := hlsVariant{audio: a["AUDIO"], codecs: a["CODECS"]}
+			v.bandwidth, _ = strconv.Atoi(a["BANDWIDTH"])
+			if w, h, ok := strings.Cut(a["RESOLUTION"], "x"); ok {
+				v.width, _ = strconv.Atoi(w)
+				v.height, _ = strconv.Atoi(h)
+			}
+			pending = &v
+			pl.master = true
+		case strings.HasPrefix(l, "#EXT-X-MEDIA:"):
+			a := parseHLSAttrs(strings.TrimPrefix(l, "#EXT-X-MEDIA:"))
+			pl.renditions = append(pl.renditions, hlsRendition{
+				typ:   strings.ToUpper(a["TYPE"]),
+				group: a["GROUP-ID"],
+				uri:   resolve(a["URI"]),
+				def:   strings.EqualFold(a["DEFAULT"], "YES"),
+			})
+		case strings.HasPrefix(l, "#EXT-X-MAP:"):
+			a := parseHLSAttrs(strings.TrimPrefix(l, "#EXT-X-MAP:"))
+			if _, ok := a["BYTERANGE"]; ok {
+				return nil, errors.New("byte-range HLS init segments are not supported")
+			}
+			pl.initURI = resolve(a["URI"])
+		case strings.HasPrefix(l, "#EXT-X-KEY:"):
+			a := parseHLSAttrs(strings.TrimPrefix(l, "#EXT-X-KEY:"))
+			if m := strings.ToUpper(a["METHOD"]); m != "" && m != "NONE" {
+				return nil, fmt.Errorf("encrypted HLS (%s) is not supported", m)
+			}
+		case strings.HasPrefix(l, "#EXT-X-BYTERANGE:"):
+			return nil, errors.New("byte-range HLS segments are not supported")
+		case strings.HasPrefix(l, "#"):
+			continue
+		default:
+			if pending != nil {
+				pending.uri = resolve(l)
+				pl.variants = append(pl.variants, *pending)
+				pending = nil
+				continue
+			}
+			pl.segments = append(pl.segments, resolve(l))
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	if !header {
+		return nil, errors.New("empty m3u8 playlist")
+	}
+	if pl.master && len(pl.variants) == 0 {
+		return nil, errors.New("master playlist has no variants")
+	}
+	if !pl.master && len(pl.segments) == 0 {
+		return nil, errors.New("media playlist has no segments")
+	}
+	return pl, nil
+}
+
+func parseHLSAttrs(s string) map[string]string {
+	out := make(map[string]string)
+	for len(s) > 0 {
+		eq := strings.IndexByte(s, '=')
+		if eq < 0 {
+			break
+		}
+		k := strings.TrimSpace(s[:eq])
+		s = s[eq+1:]
+		var v string
+		if strings.HasPrefix(s, "\"") {
+			end := strings.IndexByte(s[1:], '"')
+			if end < 0 {
+				v, s = s[1:], ""
+			} else {
+				v, s = s[1:end+1], s[end+2:]
+			}
+			if i := strings.IndexByte(s, ','); i >= 0 {
+				s = s[i+1:]
+			} else {
+				s = ""
+			}
+		} else if i := strings.IndexByte(s, ','); i >= 0 {
+			v, s = s[:i], s[i+1:]
+		} else {
+			v, s = s, ""
+		}
+		out[strings.ToUpper(k)] = v
+	}
+	return out
+}
+
+func fetchPlaylist(cl *http.Client, cf *config.EssentialsConfig, raw string) (*hlsPlaylist, error) {
+	base, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodGet, raw, nil)
+	if err != nil {
+		return nil, err
+	}
+	cf.BuildRequestHeaders(req, cf.X.Network)
+	req.Header.Set("Accept", "application/vnd.apple.mpegurl, application/x-mpegurl, */*;q=0.1")
+	b, st, err := httpx.DoRequestWithOptions(cl, req, httpx.RequestOptions{
+		MaxBytes: 4 << 20,
+		Decode:   true,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("fetch playlist (status %d): %w", st, err)
+	}
+	return parseM3U8(b, base)
+}
+
+func pickHLSVariant(vs []hlsVariant, p scraper.VideoPolicy) (hlsVariant, bool) {
+	if len(vs) == 0 {
+		return hlsVariant{}, false
+	}
+	// Renditions with audio in the same stream need no separate track, so
+	// they win whenever the playlist offers any.
+	var mx []hlsVariant
+	for _, v := range vs {
+		if v.muxed() {
+			mx = append(mx, v)
+		}
+	}
+	if len(mx) > 0 {
+		vs = mx
+	}
+	cands := make([]scraper.VideoVariant, 0, len(vs))
+	for _, v := range vs {
+		cands = append(cands, scraper.VideoVariant{
+			URL:         v.uri,
+			ContentType: "application/x-mpegURL",
+			Bitrate:     v.bandwidth,
+			Width:       v.width,
+			Height:      v.height,
+		})
+	}
+	p.PreferHLS = false
+	sel, ok := scraper.SelectVideoVariant(cands, 0, 0, p)
+	if !ok {
+		return hlsVariant{}, false
+	}
+	for _, v := range vs {
+		if v.uri == sel.URL {
+			return v, true
+		}
+	}
+	return hlsVariant{}, false
+}
+
+func doHLS(cl *http.Client, cf *config.EssentialsConfig, it item, dst, base string, opt Options) result {
+	for _, ext := range []string{"mp4", "ts"} {
+		full := filepath.Join(dst, base+"."+ext)
+		if n, vs, ok := existingVerified(full); ok {
+			return result{skipped: true, size: n, path: full, verify: vs, audio: existingAudio(dst, base)}
+		}
+	}
+
+	pl, err := fetchPlaylist(cl, cf, it.URL)
+	if err != nil {
+		return result{err: err}
+	}
+
+	mediaURL := it.URL
+	audioURL := ""
+	variant := "hls"
+	if pl.master {
+		v, ok := pickHLSVariant(pl.variants, opt.Video)
+		if !ok {
+			return result{err: errors.New("no usable HLS rendition")}
+		}
+		mediaURL = v.uri
+		audioURL = pl.audioFor(v.audio)
+		if v.width > 0 && v.height > 0 {
+			variant = fmt.Sprintf("hls %dx%d@%d", v.width, v.height, v.bandwidth)
+		} else if v.bandwidth > 0 {
+			variant = fmt.Sprintf("hls @%d", v.bandwidth)
+		}
+		pl, err = fetchPlaylist(cl, cf, mediaURL)
+		if err != nil {
+			return result{err: err}
+		}
+		if pl.master {
+			return result{err: errors.New("nested HLS master playlist")}
+		}
+	}
+
+	full := filepath.Join(dst, base+"."+pl.ext())
+	work := full + ".hls"
+
+	n, err := downloadHLSTrack(cl, cf, it.Key, "video", mediaURL, pl, work, full, opt)
+	if err != nil {
+		return result{err: err}
+	}
+	vs, err := verifyDownloaded(full)
+	if err != nil {
+		return result{err: err, verify: vs}
+	}
+
+	af := ""
+	if audioURL != "" {
+		ap, err := fetchPlaylist(cl, cf, audioURL)
+		if err != nil {
+			return result{err: fmt.Errorf("audio playlist: %w", err)}
+		}
+		ae := "m4a"
+		if ap.ext() == "ts" {
+			ae = "aac.ts"
+		}
+		af = hlsAudioPath(dst, base, ae)
+		if _, err := downloadHLSTrack(cl, cf, it.Key, "audio", audioURL, ap, work, af, opt); err != nil {
+			return result{err: fmt.Errorf("audio track: %w", err)}
+		}
+		if avs, err := verifyDownloaded(af); err != nil {
+			return result{err: fmt.Errorf("audio track: %w", err), verify: avs}
+		}
+		variant += " +audio"
+		log.LogInfo("download", fmt.Sprintf("%s has its audio in a separate track, saved as %s", filepath.Base(full), filepath.Base(af)))
+	}
+
+	_ = os.RemoveAll(work)
+	return result{ok: true, size: n, path: full, variant: variant, verify: vs, audio: af}
+}
+
+func hlsAudioPath(dst, base, ext string) string {
+	return filepath.Join(dst, base+".audio."+ext)
+}
+
+// existingAudio finds the audio track an earlier run saved next to base.
+func existingAudio(dst, base string) string {
+	for _, ext := range []string{"m4a", "aac.ts"} {
+		if st, err := os.Stat(hlsAudioPath(dst, base, ext)); err == nil && st.Size() > 0 {
+			return hlsAudioPath(dst, base, ext)
+		}
+	}
+	return ""
+}
+
+func downloadHLSTrack(
+	cl *http.Client,
+	cf *config.EssentialsConfig,
+	key, track, plURL string,
+	pl *hlsPlaylist,
+	work, out string,
+	opt Options,
+) (int64, error) {
+	if st, err := os.Stat(out); err == nil && st.Size() > 0 {
+		return st.Size(), nil
+	}
+
+	dir := filepath.Join(work, track)
+	if err := utils.EnsureDir(dir); err != nil {
+		return 0, err
+	}
+
+	uris := make([]string, 0, len(pl.segments)+1)
+	if pl.initURI != "" {
+		uris = append(uris, pl.initURI)
+	}
+	uris = append(uris, pl.segments...)
+	total := len(uris)
+
+	segPath := func(i int) string {
+		return filepath.Join(dir, fmt.Sprintf("%05d%s", i, path.Ext(strings.SplitN(path.Base(uris[i]), "?", 2)[0])))
+	}
+
+	cp := opt.Checkpoint
+	prev := cp.SegmentState(key, track)
+	if prev.Playlist != "" && (prev.Playlist != plURL || prev.Total != total) {
+		_ = os.RemoveAll(dir)
+		if err := utils.EnsureDir(dir); err != nil {
+			return 0, err
+		}
+	}
+
+	todo := make([]int, 0, total)
+	for i := range uris {
+		if st, err := os.Stat(segPath(i)); err == nil && st.Size() > 0 {
+			cp.MarkSegment(key, track, plURL, total, i)
+			continue
+		}
+		todo = append(todo, i)
+	}
+	if cf.Runtime.DebugEnabled {
+		log.LogInfo("download", fmt.Sprintf("hls %s %s: %d segment(s), %d to fetch", key, track, total, len(todo)))
+	}
+
+	wk := opt.SegmentConcurrency
+	if wk <= 0 {
+		wk = 4
+	}
+	if wk > len(todo) {
+		wk = len(todo)
+	}
+
+	jc := make(chan int)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var first error
+	fetched := 0
+
+	for w := 0; w < wk; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jc {
+				mu.Lock()
+				stop := first != nil
+				mu.Unlock()
+				if stop || (opt.ShouldQuit != nil && opt.ShouldQuit()) {
+					continue
+				}
+				_, _, err := fetchWithRetry(cl, cf, uris[i], segPath(i), opt)
+				mu.Lock()
+				if err != nil {
+					if first == nil {
+						first = fmt.Errorf("segment %d/%d: %w", i+1, total, err)
+					}
+					mu.Unlock()
+					continue
+				}
+				cp.MarkSegment(key, track, plURL, total, i)
+				fetched++
+				save := opt.CheckpointPath != "" && fetched%10 == 0
+				mu.Unlock()
+				if save {
+					_ = cp.Save(opt.CheckpointPath)
+				}
+			}
+		}()
+	}
+	for _, i := range todo {
+		jc <- i
+	}
+	close(jc)
+	wg.Wait()
+
+	if opt.CheckpointPath != "" && fetched > 0 {
+		_ = cp.Save(opt.CheckpointPath)
+	}
+	if first != nil {
+		return 0, first
+	}
+	if opt.ShouldQuit != nil && opt.ShouldQuit() {
+		return 0, errors.New("download aborted by user")
+	}
+
+	return concatSegments(out, total, segPath)
+}
+
+func concatSegments(out string, total int, segPath func(int) string) (int64, error) {
+	tmp := out + ".part"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	if err != nil {
+		return 0, err
+	}
+	var n int64
+	for i := 0; i < total; i++ {
+		in, err := os.Open(segPath(i))
+		if err != nil {
+			f.Close()
+			_ = os.Remove(tmp)
+			return 0, err
+		}
+		c, err := io.Copy(f, in)
+		in.Close()
+		if err != nil {
+			f.Close()
+			_ = os.Remove(tmp)
+			return 0, err
+		}
+		n += c
+	}
+	if err := f.Close(); err != nil {
+		_ = os.Remove(tmp)
+		return 0, err
+	}
+	if err := os.Rename(tmp, out); err != nil {
+		_ = os.Remove(tmp)
+		return 0, err
+	}
+	return n, nil
+}
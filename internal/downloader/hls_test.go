@@ -0,0 +1,176 @@
+package downloader
+
+import (
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/ghostlawless/xdl/internal/scraper"
+)
+
+func TestParseHLSAttrs(t *testing.T) {
+	tests := []struct {
+		in   string
+		want map[string]string
+	}{
+		{"", map[string]string{}},
+		{"BANDWIDTH=1280000", map[string]string{"BANDWIDTH": "1280000"}},
+		{
+			`BANDWIDTH=2176000,RESOLUTION=1280x720,CODECS="mp4a.40.2,avc1.640020",AUDIO="aud-128"`,
+			map[string]string{"BANDWIDTH": "2176000", "RESOLUTION": "1280x720", "CODECS": "mp4a.40.2,avc1.640020", "AUDIO": "aud-128"},
+		},
+		{`type=AUDIO, group-id="a" ,DEFAULT=YES`, map[string]string{"TYPE": "AUDIO", "GROUP-ID": "a", "DEFAULT": "YES"}},
+		{`URI="init.mp4"`, map[string]string{"URI": "init.mp4"}},
+		{`URI="unterminated`, map[string]string{"URI": "unterminated"}},
+		{`METHOD=NONE,garbage`, map[string]string{"METHOD": "NONE"}},
+	}
+	for _, tt := range tests {
+		if got := parseHLSAttrs(tt.in); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseHLSAttrs(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestParseM3U8(t *testing.T) {
+	base, _ := url.Parse("https://video.twimg.com/ext_tw_video/1/pu/pl/master.m3u8?tag=12")
+
+	tests := []struct {
+		name string
+		in   string
+		want *hlsPlaylist
+		ext  string
+		err  string
+	}{
+		{
+			name: "master with audio group",
+			in: `#EXTM3U
+#EXT-X-INDEPENDENT-SEGMENTS
+#EXT-X-MEDIA:NAME="Audio",TYPE=AUDIO,GROUP-ID="audio-128000",AUTOSELECT=YES,URI="/ext_tw_video/1/pu/pl/mp4a/128000/a.m3u8"
+#EXT-X-STREAM-INF:AVERAGE-BANDWIDTH=800000,BANDWIDTH=950000,RESOLUTION=640x360,CODECS="avc1.4D401E",AUDIO="audio-128000"
+
+/ext_tw_video/1/pu/pl/640x360/v.m3u8
+#EXT-X-STREAM-INF:BANDWIDTH=2500000,RESOLUTION=1280x720,CODECS="mp4a.40.2,avc1.640020"
+720/v.m3u8
+`,
+			want: &hlsPlaylist{
+				master: true,
+				variants: []hlsVariant{
+					{uri: "https://video.twimg.com/ext_tw_video/1/pu/pl/640x360/v.m3u8", bandwidth: 950000, width: 640, height: 360, codecs: "avc1.4D401E", audio: "audio-128000"},
+					{uri: "https://video.twimg.com/ext_tw_video/1/pu/pl/720/v.m3u8", bandwidth: 2500000, width: 1280, height: 720, codecs: "mp4a.40.2,avc1.640020"},
+				},
+				renditions: []hlsRendition{
+					{typ: "AUDIO", group: "audio-128000", uri: "https://video.twimg.com/ext_tw_video/1/pu/pl/mp4a/128000/a.m3u8"},
+				},
+			},
+			ext: "ts",
+		},
+		{
+			name: "fragmented mp4 media playlist",
+			in: `#EXTM3U
+#EXT-X-TARGETDURATION:3
+#EXT-X-MAP:URI="/v/init.mp4"
+#EXTINF:3.000,
+/v/0.m4s
+#EXTINF:1.500,
+https://cdn.example/v/1.m4s?x=1
+#EXT-X-ENDLIST
+`,
+			want: &hlsPlaylist{
+				initURI:  "https://video.twimg.com/v/init.mp4",
+				segments: []string{"https://video.twimg.com/v/0.m4s", "https://cdn.example/v/1.m4s?x=1"},
+			},
+			ext: "mp4",
+		},
+		{
+			name: "transport stream media playlist",
+			in:   "#EXTM3U\n#EXT-X-KEY:METHOD=NONE\n#EXTINF:3,\nseg0.ts\n#EXTINF:3,\nseg1.ts\n",
+			want: &hlsPlaylist{
+				segments: []string{"https://video.twimg.com/ext_tw_video/1/pu/pl/seg0.ts", "https://video.twimg.com/ext_tw_video/1/pu/pl/seg1.ts"},
+			},
+			ext: "ts",
+		},
+		{name: "not a playlist", in: "<html></html>\n", err: "not an m3u8 playlist"},
+		{name: "empty", in: "\n\n", err: "empty m3u8 playlist"},
+		{name: "encrypted", in: "#EXTM3U\n#EXT-X-KEY:METHOD=AES-128,URI=\"k\"\nseg0.ts\n", err: "encrypted HLS (AES-128)"},
+		{name: "byte-range segment", in: "#EXTM3U\n#EXT-X-BYTERANGE:100@0\nseg0.ts\n", err: "byte-range HLS segments"},
+		{name: "byte-range init", in: "#EXTM3U\n#EXT-X-MAP:URI=\"i.mp4\",BYTERANGE=\"100@0\"\n", err: "byte-range HLS init"},
+		{name: "master without variants", in: "#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=1\n", err: "master playlist has no variants"},
+		{name: "media without segments", in: "#EXTM3U\n#EXT-X-ENDLIST\n", err: "media playlist has no segments"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseM3U8([]byte(tt.in), base)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("err = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseM3U8 =\n%+v\nwant\n%+v", got, tt.want)
+			}
+			if e := got.ext(); e != tt.ext {
+				t.Errorf("ext = %q, want %q", e, tt.ext)
+			}
+		})
+	}
+}
+
+func TestHLSAudioFor(t *testing.T) {
+	pl := &hlsPlaylist{renditions: []hlsRendition{
+		{typ: "SUBTITLES", group: "a", uri: "subs.m3u8", def: true},
+		{typ: "AUDIO", group: "a", uri: "first.m3u8"},
+		{typ: "AUDIO", group: "a", uri: "default.m3u8", def: true},
+		{typ: "AUDIO", group: "b", uri: "other.m3u8"},
+		{typ: "AUDIO", group: "c"},
+	}}
+	tests := []struct{ group, want string }{
+		{"a", "default.m3u8"},
+		{"b", "other.m3u8"},
+		{"c", ""},
+		{"", ""},
+		{"missing", ""},
+	}
+	for _, tt := range tests {
+		if got := pl.audioFor(tt.group); got != tt.want {
+			t.Errorf("audioFor(%q) = %q, want %q", tt.group, got, tt.want)
+		}
+	}
+}
+
+func TestPickHLSVariant(t *testing.T) {
+	split := []hlsVariant{
+		{uri: "360", bandwidth: 900000, width: 640, height: 360, codecs: "avc1", audio: "aud"},
+		{uri: "1080", bandwidth: 6000000, width: 1920, height: 1080, codecs: "avc1", audio: "aud"},
+	}
+	mixed := append([]hlsVariant{
+		{uri: "480m", bandwidth: 1500000, width: 854, height: 480, codecs: "mp4a.40.2,avc1"},
+		{uri: "720m", bandwidth: 2500000, width: 1280, height: 720, codecs: "avc1,MP4A.40.2"},
+	}, split...)
+	best := scraper.VideoPolicy{Mode: scraper.VideoModeBest}
+
+	tests := []struct {
+		name string
+		vs   []hlsVariant
+		p    scraper.VideoPolicy
+		want string
+		ok   bool
+	}{
+		{"none", nil, best, "", false},
+		{"separate audio only", split, best, "1080", true},
+		{"muxed wins over higher split", mixed, best, "720m", true},
+		{"muxed capped by height", mixed, scraper.VideoPolicy{Mode: scraper.VideoModeBest, MaxHeight: 480}, "480m", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := pickHLSVariant(tt.vs, tt.p)
+			if ok != tt.ok || got.uri != tt.want {
+				t.Errorf("pickHLSVariant = %q, %v; want %q, %v", got.uri, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
@@ -0,0 +1,94 @@
+package downloader
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ghostlawless/xdl/internal/config"
+	"github.com/ghostlawless/xdl/internal/log"
+	"github.com/ghostlawless/xdl/internal/scraper"
+	"github.com/ghostlawless/xdl/internal/storage"
+)
+
+func doImageVariants(cl *http.Client, cf *config.EssentialsConfig, it item, dst, base string, opt Options) result {
+	fs := opt.Image.Formats
+	for _, f := range fs {
+		full := filepath.Join(dst, base+"."+f)
+		if n, vs, ok := existingVerified(full); ok {
+			return result{skipped: true, size: n, path: full, verify: vs}
+		}
+	}
+
+	type cand struct {
+		f    string
+		path string
+		url  string
+		sum  string
+		n    int64
+	}
+	var best *cand
+	var last error
+
+	for _, f := range fs {
+		u := scraper.ImageURL(it.URL, "", f)
+		tmp := filepath.Join(dst, base+"."+f+".candidate")
+		n, sum, err := fetchWithRetry(cl, cf, u, tmp, opt)
+		if err != nil {
+			storage.RemovePart(tmp)
+			last = err
+			continue
+		}
+		if vr := VerifyFile(tmp, 0); !vr.OK() {
+			_ = os.Remove(tmp)
+			last = fmt.Errorf("invalid %s image for %s: %s", f, it.Key, vr.Reason)
+			continue
+		}
+		if best == nil || n > best.n {
+			if best != nil {
+				_ = os.Remove(best.path)
+			}
+			best = &cand{f: f, path: tmp, url: u, sum: sum, n: n}
+		} else {
+			_ = os.Remove(tmp)
+		}
+	}
+
+	if best == nil {
+		return result{err: last}
+	}
+
+	full := filepath.Join(dst, base+"."+best.f)
+	if err := os.Rename(best.path, full); err != nil {
+		_ = os.Remove(best.path)
+		return result{err: err}
+	}
+	if cf.Runtime.DebugEnabled {
+		log.LogInfo("download", fmt.Sprintf("image %s: kept %s (%d bytes) of %s", it.Key, best.f, best.n, strings.Join(fs, ",")))
+	}
+	return result{ok: true, size: best.n, path: full, url: best.url, variant: imageVariantOf(best.url), verify: VerifyOK, sum: best.sum}
+}
+
+func isTwimg(raw string) bool {
+	u, err := url.Parse(raw)
+	if err != nil || u == nil {
+		return false
+	}
+	return strings.Contains(strings.ToLower(u.Host), "twimg.com")
+}
+
+func imageVariantOf(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil || u == nil {
+		return ""
+	}
+	q := u.Query()
+	name, format := q.Get("name"), q.Get("format")
+	if format == "" {
+		return name
+	}
+	return name + "/" + format
+}
@@ -0,0 +1,242 @@
+package downloader
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ghostlawless/xdl/internal/storage"
+)
+
+const manifestVersion = 1
+
+type ManifestEntry struct {
+	Key       string           `json:"key"`
+	TweetID   string           `json:"tweet_id,omitempty"`
+	MediaID   string           `json:"media_id,omitempty"`
+	Position  int              `json:"position"`
+	Type      string           `json:"type"`
+	URL       string           `json:"url"`
+	File      string           `json:"file,omitempty"`
+	Audio     string           `json:"audio,omitempty"`
+	Archive   string           `json:"archive,omitempty"`
+	Size      int64            `json:"size"`
+	Width     int              `json:"width,omitempty"`
+	Height    int              `json:"height,omitempty"`
+	Bitrate   int              `json:"bitrate,omitempty"`
+	Policy    string           `json:"policy,omitempty"`
+	Variant   string           `json:"variant,omitempty"`
+	Verify    string           `json:"verify,omitempty"`
+	SHA256    string           `json:"sha256,omitempty"`
+	Meta      bool             `json:"embedded_metadata,omitempty"`
+	Status    CheckpointStatus `json:"status"`
+	UpdatedAt time.Time        `json:"updated_at"`
+}
+
+type Manifest struct {
+	Version   int               `json:"version"`
+	User      string            `json:"user"`
+	UserID    string            `json:"user_id,omitempty"`
+	RunID     string            `json:"run_id"`
+	Storage   string            `json:"storage,omitempty"`
+	Policies  map[string]string `json:"policies,omitempty"`
+	CreatedAt time.Time         `json:"created_at"`
+	UpdatedAt time.Time         `json:"updated_at"`
+	Entries   []ManifestEntry   `json:"entries"`
+
+	mu       sync.Mutex
+	keyIndex map[string]int
+	claims   map[string]string
+}
+
+func NewManifest(user, runID string) *Manifest {
+	t := time.Now().UTC()
+	return &Manifest{
+		Version:   manifestVersion,
+		User:      user,
+		RunID:     runID,
+		Policies:  make(map[string]string),
+		CreatedAt: t,
+		UpdatedAt: t,
+		keyIndex:  make(map[string]int),
+		claims:    make(map[string]string),
+	}
+}
+
+func (m *Manifest) SetPolicy(name, value string) {
+	if m == nil || name == "" {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.Policies == nil {
+		m.Policies = make(map[string]string)
+	}
+	m.Policies[name] = value
+}
+
+func (m *Manifest) Record(e ManifestEntry) {
+	if m == nil || e.Key == "" {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.keyIndex == nil || m.claims == nil {
+		m.buildIndex()
+	}
+	e.UpdatedAt = time.Now().UTC()
+	if e.File != "" {
+		m.claims[claimKey(e.File, "")] = e.Key
+	}
+	i, ok := m.keyIndex[e.Key]
+	if !ok {
+		if i, ok = m.keyIndex["url:"+e.URL]; ok {
+			delete(m.keyIndex, "url:"+e.URL)
+			m.keyIndex[e.Key] = i
+		}
+	}
+	if ok {
+		m.Entries[i] = e
+	} else {
+		m.keyIndex[e.Key] = len(m.Entries)
+		m.Entries = append(m.Entries, e)
+	}
+	m.UpdatedAt = e.UpdatedAt
+}
+
+func (m *Manifest) Lookup(key string) (ManifestEntry, bool) {
+	if m == nil {
+		return ManifestEntry{}, false
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.keyIndex == nil {
+		m.buildIndex()
+	}
+	i, ok := m.keyIndex[key]
+	if !ok {
+		return ManifestEntry{}, false
+	}
+	return m.Entries[i], true
+}
+
+// Claim reserves stem.ext for key for each of exts, stem being relative to
+// the run folder, and returns the stem to use. A _N suffix is added while
+// another item owns any of those files.
+func (m *Manifest) Claim(stem, key string, exts ...string) string {
+	if m == nil {
+		return stem
+	}
+	if len(exts) == 0 {
+		exts = []string{""}
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.keyIndex == nil || m.claims == nil {
+		m.buildIndex()
+	}
+next:
+	for i := 1; ; i++ {
+		c := stem
+		if i > 1 {
+			c = fmt.Sprintf("%s_%d", stem, i)
+		}
+		for _, e := range exts {
+			if o, ok := m.claims[claimKey(c, e)]; ok && o != key {
+				continue next
+			}
+		}
+		for _, e := range exts {
+			m.claims[claimKey(c, e)] = key
+		}
+		return c
+	}
+}
+
+func (m *Manifest) Snapshot() []ManifestEntry {
+	if m == nil {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := make([]ManifestEntry, len(m.Entries))
+	copy(out, m.Entries)
+	return out
+}
+
+func (m *Manifest) buildIndex() {
+	m.keyIndex = make(map[string]int, len(m.Entries))
+	m.claims = make(map[string]string, len(m.Entries))
+	for i, e := range m.Entries {
+		if e.Key == "" {
+			continue
+		}
+		m.keyIndex[e.Key] = i
+		if e.File != "" {
+			m.claims[claimKey(e.File, "")] = e.Key
+		}
+	}
+}
+
+func (m *Manifest) Save(path string) error {
+	if m == nil {
+		return errors.New("nil manifest")
+	}
+	if path == "" {
+		return errors.New("empty manifest path")
+	}
+	return m.SaveTo(storage.NewLocal(filepath.Dir(path)), filepath.Base(path))
+}
+
+func (m *Manifest) SaveTo(st storage.Storage, name string) error {
+	if m == nil {
+		return errors.New("nil manifest")
+	}
+	m.mu.Lock()
+	data, err := json.MarshalIndent(m, "", "  ")
+	m.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return storage.WriteFile(st, name, data)
+}
+
+func LoadManifest(path string) (*Manifest, error) {
+	if path == "" {
+		return nil, errors.New("empty manifest path")
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var m Manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, err
+	}
+	if m.Version <= 0 {
+		m.Version = manifestVersion
+	}
+	if m.Policies == nil {
+		m.Policies = make(map[string]string)
+	}
+	m.buildIndex()
+	return &m, nil
+}
+
+// claimKey is the canonical form of a claimed file: its full path inside
+// the run folder with its extension, lower-cased.
+func claimKey(stem, ext string) string {
+	if ext != "" {
+		stem += "." + ext
+	}
+	return strings.ToLower(stem)
+}
+
+func ManifestPath(runDir string) string {
+	return filepath.Join(runDir, "manifest.json")
+}
@@ -0,0 +1,183 @@
+package downloader
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/ghostlawless/xdl/internal/config"
+	"github.com/ghostlawless/xdl/internal/log"
+	"github.com/ghostlawless/xdl/internal/scraper"
+)
+
+var ErrAborted = errors.New("download aborted by user")
+
+// Pool is a long-lived set of download workers fed by Submit, so a slow file
+// only occupies one worker instead of holding back the next page.
+type Pool struct {
+	cl  *http.Client
+	cf  *config.EssentialsConfig
+	opt Options
+	ds  bins
+	cp  *Checkpoint
+
+	jobs chan item
+	wg   sync.WaitGroup
+	cm   sync.RWMutex
+
+	mu     sync.Mutex
+	t      tally
+	queued map[string]bool
+	subs   int
+	closed bool
+}
+
+func NewPool(cl *http.Client, cf *config.EssentialsConfig, opt Options) (*Pool, error) {
+	ds := binsOf(opt.RunDir)
+	if err := ensureBins(ds, opt); err != nil {
+		return nil, err
+	}
+	cp := opt.Checkpoint
+	if cp == nil {
+		cp = NewCheckpoint(opt.User, "", nil)
+	}
+	opt.shared(cf)
+	tn := opt.tuner
+	qs := opt.BatchSize
+	if qs <= 0 {
+		qs = tn.max * 2
+	}
+	p := &Pool{
+		cl:     cl,
+		cf:     cf,
+		opt:    opt,
+		ds:     ds,
+		cp:     cp,
+		jobs:   make(chan item, qs),
+		queued: make(map[string]bool),
+	}
+	p.wg.Add(tn.max)
+	for i := 0; i < tn.max; i++ {
+		go p.work()
+	}
+	return p, nil
+}
+
+func (p *Pool) work() {
+	defer p.wg.Done()
+	tn := p.opt.tuner
+	for {
+		tn.acquire()
+		it, ok := <-p.jobs
+		if !ok {
+			tn.release()
+			return
+		}
+		for p.opt.ShouldPause != nil && p.opt.ShouldPause() && !p.quit() {
+			time.Sleep(200 * time.Millisecond)
+		}
+		runItem(p.cl, p.cf, it, p.ds, p.opt, p.cp, &p.mu, &p.t)
+		tn.release()
+		p.mu.Lock()
+		delete(p.queued, it.Key)
+		p.mu.Unlock()
+	}
+}
+
+// Submit records ms in the checkpoint and queues the items that still need
+// downloading. It blocks while the queue is full. When a Quota is set, the
+// batch is sized up first and refused if it would not fit on disk.
+func (p *Pool) Submit(ms []scraper.Media) (int, error) {
+	if len(ms) == 0 {
+		return 0, nil
+	}
+	p.cm.RLock()
+	defer p.cm.RUnlock()
+	if p.closed {
+		return 0, errors.New("submit on closed pool")
+	}
+	if err := p.opt.Quota.Err(p.opt.User); err != nil {
+		return 0, err
+	}
+	cur := p.cp.Merge(ms)
+	todo := make([]item, 0, len(cur))
+	p.mu.Lock()
+	for _, v := range cur {
+		switch {
+		case v.Status == CheckpointDone || v.Status == CheckpointSkipped:
+			p.t.sk++
+			if p.opt.Progress != nil {
+				p.opt.Progress(ProgressEvent{User: p.opt.User, Kind: ProgressKindSkipped, Size: 0})
+			}
+			continue
+		case p.queued[v.Key]:
+			continue
+		}
+		p.queued[v.Key] = true
+		todo = append(todo, itemOf(v))
+	}
+	p.subs++
+	p.mu.Unlock()
+
+	if p.opt.Quota != nil && !p.opt.DryRun && len(todo) > 0 {
+		need := sizeUp(p.cl, p.cf, todo)
+		if p.cf.Runtime.DebugEnabled {
+			log.LogInfo("download", fmt.Sprintf("preflight user=%s items=%d need=%d free=%d", p.opt.User, len(todo), need, p.opt.Quota.Free()))
+		}
+		if err := p.opt.Quota.Check(need); err != nil {
+			p.unqueue(todo)
+			return 0, err
+		}
+	}
+
+	for i, it := range todo {
+		if p.quit() {
+			p.unqueue(todo[i:])
+			return i, ErrAborted
+		}
+		p.jobs <- it
+	}
+	return len(todo), nil
+}
+
+func (p *Pool) unqueue(its []item) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, it := range its {
+		delete(p.queued, it.Key)
+	}
+}
+
+func (p *Pool) quit() bool {
+	return p.opt.ShouldQuit != nil && p.opt.ShouldQuit()
+}
+
+func (p *Pool) Summary() Summary {
+	lim, pk := p.opt.tuner.limits()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return Summary{
+		Downloaded:      p.t.ok,
+		Skipped:         p.t.sk,
+		Failed:          p.t.fl,
+		Held:            p.t.hd,
+		TotalBytes:      p.t.by,
+		Cycles:          p.subs,
+		Concurrency:     lim,
+		PeakConcurrency: pk,
+	}
+}
+
+// Close stops accepting work, waits for queued items and returns the totals.
+func (p *Pool) Close() Summary {
+	p.cm.Lock()
+	if !p.closed {
+		p.closed = true
+		close(p.jobs)
+	}
+	p.cm.Unlock()
+	p.wg.Wait()
+	return p.Summary()
+}
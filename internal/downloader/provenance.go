@@ -0,0 +1,47 @@
+package downloader
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/ghostlawless/xdl/internal/config"
+	"github.com/ghostlawless/xdl/internal/log"
+	"github.com/ghostlawless/xdl/internal/provenance"
+)
+
+func provenanceOf(it item, opt Options) provenance.Info {
+	a := it.Author
+	if a == "" {
+		a = opt.User
+	}
+	return provenance.Info{
+		URL:     provenance.TweetURL(a, it.TweetID),
+		Author:  a,
+		TweetID: it.TweetID,
+		MediaID: it.MediaID,
+		Created: it.posted(),
+		Text:    it.Text,
+		Alt:     it.Alt,
+	}
+}
+
+// embedProvenance tags a freshly downloaded file with its tweet. Failures
+// only cost the metadata; the download itself still counts.
+func embedProvenance(cf *config.EssentialsConfig, it item, opt Options, r *result) {
+	err := provenance.Embed(r.path, provenanceOf(it, opt))
+	if errors.Is(err, provenance.ErrUnsupported) {
+		return
+	}
+	if err != nil {
+		log.LogError("download", fmt.Sprintf("metadata %s: %v", r.path, err))
+		return
+	}
+	if fi, err := os.Stat(r.path); err == nil {
+		r.size = fi.Size()
+	}
+	r.meta = true
+	if cf.Runtime.DebugEnabled {
+		log.LogInfo("download", "metadata written to "+r.path)
+	}
+}
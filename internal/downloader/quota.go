@@ -0,0 +1,257 @@
+package downloader
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/ghostlawless/xdl/internal/config"
+	"github.com/ghostlawless/xdl/internal/httpx"
+	"github.com/ghostlawless/xdl/internal/utils"
+)
+
+var ErrQuota = errors.New("storage limit reached")
+
+type QuotaError struct {
+	Reason string
+}
+
+func (e *QuotaError) Error() string { return e.Reason }
+
+func (e *QuotaError) Is(t error) bool { return t == ErrQuota }
+
+const (
+	freeCheckEvery = 2 * time.Second
+	estimateHeads  = 8
+	estImage       = 400 << 10
+	estVideo       = 12 << 20
+	estVideoSecs   = 60
+)
+
+// Quota is shared by every download of a run. It counts the bytes written
+// and refuses new downloads once a byte limit or the free-space watermark
+// would be crossed; refused items stay pending in the checkpoint. The limits
+// are checked against each item's estimated size before it is downloaded
+// and corrected by the real size afterwards, so a run can end slightly past
+// them.
+//
+// With Remote set Root is only the staging folder: the watermark covers the
+// files built there before upload, not what is streamed to the bucket.
+type Quota struct {
+	Root    string
+	RunMax  int64
+	UserMax int64
+	MinFree int64
+	Remote  bool
+
+	mu    sync.Mutex
+	run   int64
+	users map[string]int64
+	held  int64
+	free  int64
+	at    time.Time
+	err   error
+	uerr  map[string]error
+}
+
+func NewQuota(root string, runMax, userMax, minFree int64, remote bool) *Quota {
+	return &Quota{
+		Root:    root,
+		RunMax:  runMax,
+		UserMax: userMax,
+		MinFree: minFree,
+		Remote:  remote,
+		users:   make(map[string]int64),
+		uerr:    make(map[string]error),
+	}
+}
+
+// Err reports why downloads for user were stopped, if they were.
+func (q *Quota) Err(user string) error {
+	if q == nil {
+		return nil
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.err != nil {
+		return q.err
+	}
+	return q.uerr[user]
+}
+
+// Free returns the free space on the output filesystem, or -1 when unknown.
+func (q *Quota) Free() int64 {
+	if q == nil {
+		return -1
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	f, ok := q.freeLocked(true)
+	if !ok {
+		return -1
+	}
+	return f
+}
+
+func (q *Quota) freeLocked(force bool) (int64, bool) {
+	if force || time.Since(q.at) > freeCheckEvery {
+		f, err := utils.FreeSpace(q.Root)
+		if err != nil {
+			q.free, q.at = -1, time.Now()
+			return 0, false
+		}
+		q.free, q.at = f, time.Now()
+	}
+	return q.free, q.free >= 0
+}
+
+// Check is the preflight for a batch of about need bytes. It fails, and
+// stops the run, when they would not fit above the watermark. Staged files
+// of a remote run are removed once uploaded, so there only the watermark
+// itself is checked.
+func (q *Quota) Check(need int64) error {
+	if q == nil {
+		return nil
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.err != nil {
+		return q.err
+	}
+	if q.Remote {
+		need = 0
+	}
+	f, ok := q.freeLocked(true)
+	if ok && f-q.held-need < q.MinFree {
+		q.err = &QuotaError{Reason: q.lowDisk(f, need)}
+	}
+	return q.err
+}
+
+func (q *Quota) lowDisk(f, need int64) string {
+	if need <= 0 {
+		return fmt.Sprintf("only %s free on %s (minimum %s)", utils.FormatSize(f), q.Root, utils.FormatSize(q.MinFree))
+	}
+	return fmt.Sprintf("about %s more needed but only %s free on %s (minimum %s)",
+		utils.FormatSize(need), utils.FormatSize(f), q.Root, utils.FormatSize(q.MinFree))
+}
+
+// reserve counts n bytes against the limits before a download; disk says
+// whether they are written to Root and so count against the watermark.
+func (q *Quota) reserve(user string, n int64, disk bool) error {
+	if q == nil {
+		return nil
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.err != nil {
+		return q.err
+	}
+	if e := q.uerr[user]; e != nil {
+		return e
+	}
+	if q.RunMax > 0 && q.run+n > q.RunMax {
+		q.err = &QuotaError{Reason: fmt.Sprintf("run limit of %s reached", utils.FormatSize(q.RunMax))}
+		return q.err
+	}
+	if q.UserMax > 0 && q.users[user]+n > q.UserMax {
+		q.uerr[user] = &QuotaError{Reason: fmt.Sprintf("per-user limit of %s reached", utils.FormatSize(q.UserMax))}
+		return q.uerr[user]
+	}
+	if disk {
+		if f, ok := q.freeLocked(false); ok && f-q.held-n < q.MinFree {
+			q.err = &QuotaError{Reason: q.lowDisk(f-q.held, n)}
+			return q.err
+		}
+		q.held += n
+	}
+	q.run += n
+	q.users[user] += n
+	return nil
+}
+
+// settle replaces a reservation of est bytes with the got bytes written.
+func (q *Quota) settle(user string, est, got int64, disk bool) {
+	if q == nil {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.run += got - est
+	q.users[user] += got - est
+	if disk {
+		q.held -= est
+	}
+}
+
+func (q *Quota) trip(reason string) {
+	if q == nil {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.err == nil {
+		q.err = &QuotaError{Reason: reason}
+	}
+}
+
+func isNoSpace(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, syscall.ENOSPC) {
+		return true
+	}
+	e := strings.ToLower(err.Error())
+	return strings.Contains(e, "no space left") || strings.Contains(e, "not enough space on the disk")
+}
+
+func estimateOf(it item) int64 {
+	if it.Est > 0 {
+		return it.Est
+	}
+	if it.Size > 0 {
+		return it.Size
+	}
+	if it.Type == "video" {
+		if it.Bitrate > 0 {
+			return int64(it.Bitrate) / 8 * estVideoSecs
+		}
+		return estVideo
+	}
+	if it.Width > 0 && it.Height > 0 {
+		return int64(it.Width) * int64(it.Height) / 3
+	}
+	return estImage
+}
+
+// sizeUp fills Est for items without a known size: the first few get a HEAD
+// request, the rest fall back to estimateOf.
+func sizeUp(cl *http.Client, cf *config.EssentialsConfig, its []item) int64 {
+	var wg sync.WaitGroup
+	k := 0
+	for i := range its {
+		if its[i].Size > 0 || k >= estimateHeads || strings.Contains(its[i].URL, ".m3u8") {
+			continue
+		}
+		k++
+		wg.Add(1)
+		go func(it *item) {
+			defer wg.Done()
+			if _, sz, _, _, err := httpx.Head(cl, it.URL, cf.X.Network); err == nil && sz > 0 {
+				it.Est = sz
+			}
+		}(&its[i])
+	}
+	wg.Wait()
+	var n int64
+	for i := range its {
+		its[i].Est = estimateOf(its[i])
+		n += its[i].Est
+	}
+	return n
+}
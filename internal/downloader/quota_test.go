@@ -0,0 +1,84 @@
+package downloader
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestQuotaReserveSettle(t *testing.T) {
+	q := NewQuota(t.TempDir(), 1500, 600, 0, false)
+
+	steps := []struct {
+		user string
+		n    int64
+		got  int64
+		err  bool
+	}{
+		{"a", 400, 300, false},
+		{"a", 300, 300, false},
+		{"a", 1, 0, true},
+		{"b", 300, 300, false},
+	}
+	for i, s := range steps {
+		err := q.reserve(s.user, s.n, true)
+		if (err != nil) != s.err {
+			t.Fatalf("%d: reserve(%s, %d) = %v, want error %v", i, s.user, s.n, err, s.err)
+		}
+		if err != nil {
+			if !errors.Is(err, ErrQuota) {
+				t.Errorf("%d: err = %v, want ErrQuota", i, err)
+			}
+			continue
+		}
+		q.settle(s.user, s.n, s.got, true)
+	}
+	if q.run != 900 || q.users["a"] != 600 || q.users["b"] != 300 || q.held != 0 {
+		t.Errorf("run=%d a=%d b=%d held=%d; want 900, 600, 300, 0", q.run, q.users["a"], q.users["b"], q.held)
+	}
+	if q.Err("a") == nil || q.Err("b") != nil {
+		t.Errorf("Err(a) = %v, Err(b) = %v; want only a stopped", q.Err("a"), q.Err("b"))
+	}
+	if err := q.reserve("c", 700, true); err == nil || q.Err("b") == nil {
+		t.Errorf("reserve past the run limit = %v, want the run stopped", err)
+	}
+}
+
+func TestQuotaWatermark(t *testing.T) {
+	dir := t.TempDir()
+	free := NewQuota(dir, 0, 0, 0, false).Free()
+	if free < 1<<20 {
+		t.Skip("free space unknown or too low")
+	}
+	wm := free - 1<<20
+
+	tests := []struct {
+		name   string
+		remote bool
+		need   int64
+		check  bool
+		n      int64
+		disk   bool
+		ok     bool
+	}{
+		{"local fits", false, 0, true, 1 << 10, true, true},
+		{"local past the watermark", false, 0, true, 2 << 20, true, false},
+		{"streamed to remote", true, 0, true, 2 << 20, false, true},
+		{"staged for remote", true, 0, true, 2 << 20, true, false},
+		{"local batch preflight", false, 2 << 20, false, 0, true, false},
+		{"remote batch preflight", true, 2 << 20, true, 2 << 20, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := NewQuota(dir, 0, 0, wm, tt.remote)
+			if err := q.Check(tt.need); (err == nil) != tt.check {
+				t.Fatalf("Check(%d) = %v, want ok %v", tt.need, err, tt.check)
+			}
+			if !tt.check {
+				return
+			}
+			if err := q.reserve("a", tt.n, tt.disk); (err == nil) != tt.ok {
+				t.Errorf("reserve(%d, disk=%v) = %v, want ok %v", tt.n, tt.disk, err, tt.ok)
+			}
+		})
+	}
+}
@@ -0,0 +1,126 @@
+package downloader
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"github.com/ghostlawless/xdl/internal/config"
+	"github.com/ghostlawless/xdl/internal/httpx"
+	"github.com/ghostlawless/xdl/internal/storage"
+)
+
+// objectName is the storage name of p, a path inside the run folder: the
+// run folder's name followed by p's path inside it.
+func objectName(runDir, p string) string {
+	rel, err := filepath.Rel(runDir, p)
+	if err != nil {
+		rel = filepath.Base(p)
+	}
+	return path.Join(filepath.Base(runDir), filepath.ToSlash(rel))
+}
+
+// runStorage is where single-file downloads go: the configured remote
+// storage, or a local folder holding the run folder so that object names
+// match paths on disk.
+func runStorage(opt Options) storage.Storage {
+	if storage.IsRemote(opt.Storage) {
+		return opt.Storage
+	}
+	return storage.NewLocal(filepath.Dir(opt.RunDir))
+}
+
+// doStored downloads a single file straight into the run's storage. A local
+// folder resumes an interrupted download from its .part file; remote
+// storage is streamed from the first byte on every attempt.
+func doStored(cl *http.Client, cf *config.EssentialsConfig, it item, full string, opt Options) result {
+	st := runStorage(opt)
+	name := objectName(opt.RunDir, full)
+	p, local := storage.LocalPath(st, name)
+	if local && opt.Template == nil {
+		adoptLegacy(it, p)
+	}
+	if ok, err := st.Exists(name); err == nil && ok {
+		if local {
+			if n, vs, ok := existingVerified(p); ok {
+				return result{skipped: true, size: n, path: p, verify: vs}
+			}
+		} else if fi, err := st.Stat(name); err == nil && fi.Size > 0 {
+			return result{skipped: true, size: fi.Size, path: full, remote: true}
+		}
+	}
+	if rs, ok := st.(storage.Resumer); ok && local {
+		pt, err := rs.Resume(name)
+		if err != nil {
+			return result{err: err}
+		}
+		n, sum, err := fetchPart(cl, cf, it.URL, full, pt, opt)
+		if err != nil {
+			return result{err: err}
+		}
+		vs, err := verifyDownloaded(p)
+		if err != nil {
+			return result{err: err, verify: vs}
+		}
+		return result{ok: true, size: n, path: p, verify: vs, sum: sum}
+	}
+	var vs string
+	n, sum, err := retryFetch(cf, it.URL, name, opt, func(rq *http.Request, to time.Duration) (int64, int, string, error) {
+		w, err := st.Create(name)
+		if err != nil {
+			return 0, 0, "", err
+		}
+		var sc streamCheck
+		n, code, sum, err := httpx.DownloadToWriterWithTimeout(cl, rq, &teeWriter{w, &sc}, opt.MediaMaxBytes, to)
+		if err == nil {
+			vr := sc.result(name)
+			vs = vr.String()
+			if !vr.OK() {
+				err = fmt.Errorf("integrity check failed for %s: %s", path.Base(name), vr.Reason)
+			}
+		}
+		if err != nil {
+			_ = w.Abort()
+			return 0, code, "", err
+		}
+		if err := w.Commit(); err != nil {
+			return 0, code, "", err
+		}
+		return n, code, sum, nil
+	})
+	if err != nil {
+		return result{err: err, verify: vs}
+	}
+	return result{ok: true, size: n, path: full, verify: vs, sum: sum, remote: !local}
+}
+
+type teeWriter struct {
+	w  storage.Writer
+	sc *streamCheck
+}
+
+func (t *teeWriter) Write(p []byte) (int, error) {
+	n, err := t.w.Write(p)
+	t.sc.Write(p[:n])
+	return n, err
+}
+
+// publishResult uploads a file that had to be built locally (HLS, image
+// variants, embedded metadata) with its sidecars, then removes the local
+// copies.
+func publishResult(opt Options, r *result) error {
+	ps := r.files()
+	for _, p := range ps {
+		if err := storage.Upload(opt.Storage, objectName(opt.RunDir, p), p); err != nil {
+			return fmt.Errorf("upload %s: %w", filepath.Base(p), err)
+		}
+	}
+	for _, p := range ps {
+		_ = os.Remove(p)
+	}
+	r.remote = true
+	return nil
+}
@@ -0,0 +1,75 @@
+package downloader
+
+import (
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"time"
+
+	"github.com/ghostlawless/xdl/internal/storage"
+)
+
+type FailedEntry struct {
+	Key      string `json:"key"`
+	TweetID  string `json:"tweet_id,omitempty"`
+	MediaID  string `json:"media_id,omitempty"`
+	Type     string `json:"type"`
+	URL      string `json:"url"`
+	Error    string `json:"error,omitempty"`
+	Status   int    `json:"status,omitempty"`
+	Attempts int    `json:"attempts,omitempty"`
+}
+
+type FailedReport struct {
+	User        string        `json:"user"`
+	RunID       string        `json:"run_id"`
+	GeneratedAt time.Time     `json:"generated_at"`
+	Items       []FailedEntry `json:"items"`
+}
+
+func FailedReportPath(runDir string) string {
+	return filepath.Join(runDir, "failed.json")
+}
+
+func WriteFailedReport(runDir string, cp *Checkpoint) (int, error) {
+	return writeFailedReport(storage.NewLocal(runDir), filepath.Base(FailedReportPath(runDir)), cp)
+}
+
+func writeFailedReport(st storage.Storage, name string, cp *Checkpoint) (int, error) {
+	fs := cp.FailedItems()
+	if len(fs) == 0 {
+		return 0, st.Remove(name)
+	}
+	r := FailedReport{
+		User:        cp.User,
+		RunID:       cp.RunID,
+		GeneratedAt: time.Now().UTC(),
+		Items:       make([]FailedEntry, 0, len(fs)),
+	}
+	for _, it := range fs {
+		r.Items = append(r.Items, FailedEntry{
+			Key:      it.Key,
+			TweetID:  it.TweetID,
+			MediaID:  it.MediaID,
+			Type:     it.Type,
+			URL:      it.URL,
+			Error:    it.Error,
+			Status:   it.HTTP,
+			Attempts: it.Attempts,
+		})
+	}
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return 0, err
+	}
+	return len(r.Items), storage.WriteFile(st, name, data)
+}
+
+// SaveRunState copies the run's manifest, checkpoint and failed report to
+// st next to its files, so remote storage holds a complete run.
+func SaveRunState(st storage.Storage, runDir string, mf *Manifest, cp *Checkpoint) error {
+	e0 := mf.SaveTo(st, objectName(runDir, ManifestPath(runDir)))
+	e1 := cp.SaveTo(st, objectName(runDir, CheckpointPath(runDir)))
+	_, e2 := writeFailedReport(st, objectName(runDir, FailedReportPath(runDir)), cp)
+	return errors.Join(e0, e1, e2)
+}
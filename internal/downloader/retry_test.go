@@ -0,0 +1,68 @@
+package downloader
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/ghostlawless/xdl/internal/httpx"
+)
+
+func TestRetryAfter(t *testing.T) {
+	tests := []struct {
+		v        string
+		min, max time.Duration
+	}{
+		{"", 0, 0},
+		{"30", 30 * time.Second, 30 * time.Second},
+		{"0", 0, 0},
+		{"-5", 0, 0},
+		{"soon", 0, 0},
+		{time.Now().Add(90 * time.Second).UTC().Format(http.TimeFormat), 85 * time.Second, 90 * time.Second},
+		{time.Now().Add(-time.Minute).UTC().Format(http.TimeFormat), 0, 0},
+	}
+	for _, tt := range tests {
+		h := http.Header{}
+		if tt.v != "" {
+			h.Set("Retry-After", tt.v)
+		}
+		if got := httpx.RetryAfter(h); got < tt.min || got > tt.max {
+			t.Errorf("RetryAfter(%q) = %s, want %s to %s", tt.v, got, tt.min, tt.max)
+		}
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	status := func(st int, ra time.Duration) error { return &httpx.StatusError{Status: st, RetryAfter: ra} }
+	tests := []struct {
+		name     string
+		i, st    int
+		err      error
+		retry    bool
+		min, max time.Duration
+	}{
+		{"no error", 0, 200, nil, false, 0, 0},
+		{"not found", 0, 404, status(404, 0), false, 0, 0},
+		{"forbidden", 0, 403, status(403, 0), false, 0, 0},
+		{"429 honours Retry-After", 0, 429, status(429, 7*time.Second), true, 7 * time.Second, 7 * time.Second},
+		{"Retry-After is capped", 0, 503, status(503, time.Hour), true, maxRetryAfter, maxRetryAfter},
+		{"503 backs off", 0, 503, status(503, 0), true, 375 * time.Millisecond, 625 * time.Millisecond},
+		{"backoff grows", 3, 502, status(502, 0), true, 3 * time.Second, 5 * time.Second},
+		{"backoff is capped", 10, 500, status(500, 0), true, 6 * time.Second, 10 * time.Second},
+		{"truncated body", 0, 200, fmt.Errorf("copy: %w", io.ErrUnexpectedEOF), true, 375 * time.Millisecond, 625 * time.Millisecond},
+		{"connection reset", 1, 0, errors.New("read tcp: connection reset by peer"), true, 750 * time.Millisecond, 1250 * time.Millisecond},
+		{"other error", 0, 0, errors.New("bad content type"), false, 0, 0},
+		{"resume mismatch retries at once", 2, 206, fmt.Errorf("resume: %w", httpx.ErrResumeMismatch), true, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, ok := retryDelay(tt.i, tt.st, tt.err)
+			if ok != tt.retry || d < tt.min || d > tt.max {
+				t.Errorf("retryDelay = %s, %v; want %s to %s, %v", d, ok, tt.min, tt.max, tt.retry)
+			}
+		})
+	}
+}
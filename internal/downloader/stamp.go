@@ -0,0 +1,76 @@
+package downloader
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ghostlawless/xdl/internal/config"
+	"github.com/ghostlawless/xdl/internal/log"
+	"github.com/ghostlawless/xdl/internal/scraper"
+)
+
+// posted is the tweet's created_at, or the time in its snowflake ID when the
+// API did not return one.
+func (it item) posted() time.Time {
+	if t, err := time.Parse(time.RFC3339, it.Created); err == nil {
+		return t.UTC()
+	}
+	if t := scraper.SnowflakeTime(it.TweetID); !t.IsZero() {
+		return t
+	}
+	return scraper.SnowflakeTime(it.MediaID)
+}
+
+// dirTimes remembers the newest tweet time stamped on each folder, so a
+// folder shared by several tweets ends up with the latest one.
+type dirTimes struct {
+	mu sync.Mutex
+	m  map[string]time.Time
+}
+
+func newDirTimes() *dirTimes {
+	return &dirTimes{m: make(map[string]time.Time)}
+}
+
+func (d *dirTimes) stamp(root, dir string, t time.Time) {
+	if d == nil {
+		return
+	}
+	rel, err := filepath.Rel(root, dir)
+	if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for ; rel != "." && rel != string(filepath.Separator); rel = filepath.Dir(rel) {
+		p := filepath.Join(root, rel)
+		if cur, ok := d.m[p]; ok && cur.After(t) {
+			t = cur
+		} else {
+			d.m[p] = t
+		}
+		_ = os.Chtimes(p, t, t)
+	}
+}
+
+// stampResult sets the mtime of a downloaded file, its audio track and the
+// folders the path template created for it to the tweet time. Files linked
+// into the store are left alone: their times belong to every link.
+func stampResult(cf *config.EssentialsConfig, it item, opt Options, r result) {
+	t := it.posted()
+	if t.IsZero() {
+		return
+	}
+	for _, p := range r.files() {
+		if opt.Store != nil && (r.linked || p != r.path) {
+			continue
+		}
+		if err := os.Chtimes(p, t, t); err != nil && cf.Runtime.DebugEnabled {
+			log.LogError("download", "mtime "+p+": "+err.Error())
+		}
+	}
+	opt.dirs.stamp(opt.RunDir, filepath.Dir(r.path), t)
+}
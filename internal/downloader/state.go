@@ -5,10 +5,12 @@ import (
 	"errors"
 	"os"
 	"path/filepath"
+	"sort"
+	"sync"
 	"time"
 
 	"github.com/ghostlawless/xdl/internal/scraper"
-	"github.com/ghostlawless/xdl/internal/utils"
+	"github.com/ghostlawless/xdl/internal/storage"
 )
 
 type CheckpointStatus string
@@ -20,14 +22,36 @@ const (
 	CheckpointFailed  CheckpointStatus = "failed"
 )
 
-const checkpointVersion = 1
+const checkpointVersion = 2
+
+type SegmentProgress struct {
+	Playlist string `json:"playlist"`
+	Total    int    `json:"total"`
+	Done     []int  `json:"done"`
+}
 
 type CheckpointItem struct {
-	Index  int              `json:"index"`
-	URL    string           `json:"url"`
-	Type   string           `json:"type"`
-	Status CheckpointStatus `json:"status"`
-	Size   int64            `json:"size"`
+	Index    int                         `json:"index"`
+	Key      string                      `json:"key"`
+	URL      string                      `json:"url"`
+	Type     string                      `json:"type"`
+	TweetID  string                      `json:"tweet_id,omitempty"`
+	MediaID  string                      `json:"media_id,omitempty"`
+	Position int                         `json:"position"`
+	Width    int                         `json:"width,omitempty"`
+	Height   int                         `json:"height,omitempty"`
+	Bitrate  int                         `json:"bitrate,omitempty"`
+	Policy   string                      `json:"policy,omitempty"`
+	Author   string                      `json:"author,omitempty"`
+	Text     string                      `json:"text,omitempty"`
+	Alt      string                      `json:"alt,omitempty"`
+	Created  string                      `json:"created_at,omitempty"`
+	Status   CheckpointStatus            `json:"status"`
+	Size     int64                       `json:"size"`
+	Segments map[string]*SegmentProgress `json:"segments,omitempty"`
+	Error    string                      `json:"last_error,omitempty"`
+	HTTP     int                         `json:"last_status,omitempty"`
+	Attempts int                         `json:"attempts,omitempty"`
 }
 
 type Checkpoint struct {
@@ -37,14 +61,55 @@ type Checkpoint struct {
 	CreatedAt time.Time        `json:"created_at"`
 	UpdatedAt time.Time        `json:"updated_at"`
 	Items     []CheckpointItem `json:"items"`
-	urlIndex  map[string]int   `json:"-"`
+
+	mu       sync.Mutex
+	keyIndex map[string]int
+}
+
+func checkpointItemOf(i int, m scraper.Media) CheckpointItem {
+	return CheckpointItem{
+		Index:    i,
+		Key:      m.Identity(),
+		URL:      m.URL,
+		Type:     m.Type,
+		TweetID:  m.TweetID,
+		MediaID:  m.StableID(),
+		Position: m.Index,
+		Width:    m.Width,
+		Height:   m.Height,
+		Bitrate:  m.Bitrate,
+		Policy:   m.Policy,
+		Author:   m.Author,
+		Text:     m.Text,
+		Alt:      m.Alt,
+		Created:  m.Created,
+		Status:   CheckpointPending,
+	}
+}
+
+func (it CheckpointItem) Media() scraper.Media {
+	return scraper.Media{
+		URL:     it.URL,
+		Type:    it.Type,
+		TweetID: it.TweetID,
+		MediaID: it.MediaID,
+		Index:   it.Position,
+		Width:   it.Width,
+		Height:  it.Height,
+		Bitrate: it.Bitrate,
+		Policy:  it.Policy,
+		Author:  it.Author,
+		Text:    it.Text,
+		Alt:     it.Alt,
+		Created: it.Created,
+	}
 }
 
 func NewCheckpoint(user, runID string, medias []scraper.Media) *Checkpoint {
 	t := time.Now().UTC()
 	items := make([]CheckpointItem, len(medias))
 	for i, m := range medias {
-		items[i] = CheckpointItem{Index: i, URL: m.URL, Type: m.Type, Status: CheckpointPending}
+		items[i] = checkpointItemOf(i, m)
 	}
 	cp := &Checkpoint{
 		Version:   checkpointVersion,
@@ -58,11 +123,19 @@ func NewCheckpoint(user, runID string, medias []scraper.Media) *Checkpoint {
 	return cp
 }
 
+func CheckpointPath(runDir string) string {
+	return filepath.Join(runDir, "checkpoint.json")
+}
+
 func (c *Checkpoint) buildIndex() {
-	c.urlIndex = make(map[string]int, len(c.Items))
+	c.keyIndex = make(map[string]int, len(c.Items))
 	for i, it := range c.Items {
-		if it.URL != "" {
-			c.urlIndex[it.URL] = i
+		if it.Key == "" && it.URL != "" {
+			it.Key = "url:" + it.URL
+			c.Items[i] = it
+		}
+		if it.Key != "" {
+			c.keyIndex[it.Key] = i
 		}
 	}
 }
@@ -71,8 +144,59 @@ func (c *Checkpoint) updateTimestamp() {
 	c.UpdatedAt = time.Now().UTC()
 }
 
-func (c *Checkpoint) MarkByIndex(idx int, status CheckpointStatus, size int64) {
-	if c == nil || idx < 0 || idx >= len(c.Items) {
+func (c *Checkpoint) Merge(medias []scraper.Media) []CheckpointItem {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.keyIndex == nil {
+		c.buildIndex()
+	}
+	out := make([]CheckpointItem, 0, len(medias))
+	for _, m := range medias {
+		k := m.Identity()
+		i, ok := c.keyIndex[k]
+		if !ok {
+			// Checkpoints written before media IDs keyed items by URL.
+			if i, ok = c.keyIndex["url:"+m.URL]; ok {
+				delete(c.keyIndex, "url:"+m.URL)
+				c.keyIndex[k] = i
+			}
+		}
+		if ok {
+			it := c.Items[i]
+			fresh := checkpointItemOf(it.Index, m)
+			fresh.Status = it.Status
+			fresh.Size = it.Size
+			fresh.Error, fresh.HTTP, fresh.Attempts = it.Error, it.HTTP, it.Attempts
+			if fresh.Text == "" && fresh.Author == "" {
+				fresh.Author, fresh.Text = it.Author, it.Text
+			}
+			if fresh.Alt == "" {
+				fresh.Alt = it.Alt
+			}
+			if fresh.Created == "" {
+				fresh.Created = it.Created
+			}
+			if fresh.URL == it.URL {
+				fresh.Segments = it.Segments
+			}
+			c.Items[i] = fresh
+			out = append(out, fresh)
+			continue
+		}
+		it := checkpointItemOf(len(c.Items), m)
+		c.keyIndex[k] = len(c.Items)
+		c.Items = append(c.Items, it)
+		out = append(out, it)
+	}
+	c.updateTimestamp()
+	return out
+}
+
+func (c *Checkpoint) markLocked(idx int, status CheckpointStatus, size int64) {
+	if idx < 0 || idx >= len(c.Items) {
 		return
 	}
 	item := c.Items[idx]
@@ -80,28 +204,118 @@ func (c *Checkpoint) MarkByIndex(idx int, status CheckpointStatus, size int64) {
 	if size >= 0 {
 		item.Size = size
 	}
+	if status == CheckpointDone || status == CheckpointSkipped {
+		item.Segments = nil
+		item.Error = ""
+		item.HTTP = 0
+	}
 	c.Items[idx] = item
 	c.updateTimestamp()
 }
 
-func (c *Checkpoint) MarkByURL(url string, status CheckpointStatus, size int64) {
-	if c == nil || url == "" {
+func (c *Checkpoint) MarkByIndex(idx int, status CheckpointStatus, size int64) {
+	if c == nil {
 		return
 	}
-	if c.urlIndex == nil {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.markLocked(idx, status, size)
+}
+
+func (c *Checkpoint) MarkByKey(key string, status CheckpointStatus, size int64) {
+	if c == nil || key == "" {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.keyIndex == nil {
 		c.buildIndex()
 	}
-	i, ok := c.urlIndex[url]
+	i, ok := c.keyIndex[key]
 	if !ok {
 		return
 	}
-	c.MarkByIndex(i, status, size)
+	c.markLocked(i, status, size)
+}
+
+// MarkFailure records a failed attempt for key and reports whether the
+// checkpoint has such an item.
+func (c *Checkpoint) MarkFailure(key, msg string, status int) bool {
+	if c == nil || key == "" {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.keyIndex == nil {
+		c.buildIndex()
+	}
+	i, ok := c.keyIndex[key]
+	if !ok {
+		return false
+	}
+	c.markLocked(i, CheckpointFailed, 0)
+	item := c.Items[i]
+	item.Error = msg
+	item.HTTP = status
+	item.Attempts++
+	c.Items[i] = item
+	return true
+}
+
+func (c *Checkpoint) SegmentState(key, track string) SegmentProgress {
+	if c == nil {
+		return SegmentProgress{}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	i, ok := c.keyIndex[key]
+	if !ok {
+		return SegmentProgress{}
+	}
+	sp := c.Items[i].Segments[track]
+	if sp == nil {
+		return SegmentProgress{}
+	}
+	out := *sp
+	out.Done = append([]int(nil), sp.Done...)
+	return out
+}
+
+func (c *Checkpoint) MarkSegment(key, track, playlist string, total, seg int) {
+	if c == nil || key == "" {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	i, ok := c.keyIndex[key]
+	if !ok {
+		return
+	}
+	item := c.Items[i]
+	if item.Segments == nil {
+		item.Segments = make(map[string]*SegmentProgress)
+	}
+	sp := item.Segments[track]
+	if sp == nil || sp.Playlist != playlist || sp.Total != total {
+		sp = &SegmentProgress{Playlist: playlist, Total: total}
+		item.Segments[track] = sp
+	}
+	j := sort.SearchInts(sp.Done, seg)
+	if j >= len(sp.Done) || sp.Done[j] != seg {
+		sp.Done = append(sp.Done, 0)
+		copy(sp.Done[j+1:], sp.Done[j:])
+		sp.Done[j] = seg
+	}
+	c.Items[i] = item
+	c.updateTimestamp()
 }
 
 func (c *Checkpoint) PendingItems() []CheckpointItem {
 	if c == nil {
 		return nil
 	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	out := make([]CheckpointItem, 0, len(c.Items))
 	for _, it := range c.Items {
 		if it.Status == CheckpointPending {
@@ -111,10 +325,27 @@ func (c *Checkpoint) PendingItems() []CheckpointItem {
 	return out
 }
 
+func (c *Checkpoint) FailedItems() []CheckpointItem {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	out := make([]CheckpointItem, 0)
+	for _, it := range c.Items {
+		if it.Status == CheckpointFailed {
+			out = append(out, it)
+		}
+	}
+	return out
+}
+
 func (c *Checkpoint) CompletedCount() (done, skipped, failed int) {
 	if c == nil {
 		return
 	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	for _, it := range c.Items {
 		switch it.Status {
 		case CheckpointDone:
@@ -135,16 +366,21 @@ func (c *Checkpoint) Save(path string) error {
 	if path == "" {
 		return errors.New("empty checkpoint path")
 	}
-	c.updateTimestamp()
-	dir := filepath.Dir(path)
-	if err := utils.EnsureDir(dir); err != nil {
-		return err
+	return c.SaveTo(storage.NewLocal(filepath.Dir(path)), filepath.Base(path))
+}
+
+func (c *Checkpoint) SaveTo(st storage.Storage, name string) error {
+	if c == nil {
+		return errors.New("nil checkpoint")
 	}
+	c.mu.Lock()
+	c.updateTimestamp()
 	data, err := json.MarshalIndent(c, "", "  ")
+	c.mu.Unlock()
 	if err != nil {
 		return err
 	}
-	return utils.SaveToFile(path, data)
+	return storage.WriteFile(st, name, data)
 }
 
 func LoadCheckpoint(path string) (*Checkpoint, error) {
@@ -0,0 +1,117 @@
+package downloader
+
+import (
+	"os"
+	"testing"
+
+	"github.com/ghostlawless/xdl/internal/scraper"
+)
+
+func TestCheckpointMergeKeepsFailure(t *testing.T) {
+	ms := []scraper.Media{
+		{URL: "https://video.twimg.com/a.mp4", Type: "video", TweetID: "1", MediaID: "11"},
+		{URL: "https://pbs.twimg.com/media/b.jpg", Type: "image", TweetID: "2", MediaID: "22"},
+	}
+	cp := NewCheckpoint("alice", "r1", ms)
+	if !cp.MarkFailure(ms[0].Identity(), "unacceptable HTTP status: 403", 403) {
+		t.Fatal("MarkFailure found no item")
+	}
+	p := CheckpointPath(t.TempDir())
+	if err := cp.Save(p); err != nil {
+		t.Fatal(err)
+	}
+	cp, err := LoadCheckpoint(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// retry-failed merges the refreshed media before trying again.
+	fresh := ms[0]
+	fresh.URL = "https://video.twimg.com/a2.mp4"
+	cp.Merge([]scraper.Media{fresh})
+
+	tests := []struct {
+		name     string
+		err      string
+		http     int
+		attempts int
+	}{
+		{"after merge", "unacceptable HTTP status: 403", 403, 1},
+		{"after another failure", "timeout", 0, 2},
+	}
+	for _, tt := range tests {
+		if tt.attempts == 2 {
+			cp.MarkFailure(ms[0].Identity(), "timeout", 0)
+		}
+		fs := cp.FailedItems()
+		if len(fs) != 1 {
+			t.Fatalf("%s: %d failed items, want 1", tt.name, len(fs))
+		}
+		f := fs[0]
+		if f.Error != tt.err || f.HTTP != tt.http || f.Attempts != tt.attempts || f.URL != fresh.URL {
+			t.Errorf("%s: got error %q, status %d, attempts %d, url %s; want %q, %d, %d, %s",
+				tt.name, f.Error, f.HTTP, f.Attempts, f.URL, tt.err, tt.http, tt.attempts, fresh.URL)
+		}
+	}
+	if _, _, failed := cp.CompletedCount(); failed != 1 {
+		t.Errorf("%d failed, want 1", failed)
+	}
+	cp.MarkByKey(ms[0].Identity(), CheckpointDone, 10)
+	if it := cp.Items[0]; it.Error != "" || it.HTTP != 0 {
+		t.Errorf("done item kept error %q, status %d", it.Error, it.HTTP)
+	}
+}
+
+func TestCheckpointMergeMigratesURLKeys(t *testing.T) {
+	// A checkpoint from before media IDs: no keys, items found by URL.
+	legacy := `{"version":1,"user":"alice","run_id":"r0","items":[
+{"index":0,"url":"https://video.twimg.com/a.mp4","type":"video","status":"done","size":123},
+{"index":1,"url":"https://pbs.twimg.com/media/b.jpg","type":"image","status":"pending","size":0}]}`
+	p := CheckpointPath(t.TempDir())
+	if err := os.WriteFile(p, []byte(legacy), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cp, err := LoadCheckpoint(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ms := []scraper.Media{
+		{URL: "https://video.twimg.com/a.mp4", Type: "video", TweetID: "1", MediaID: "11"},
+		{URL: "https://pbs.twimg.com/media/b.jpg", Type: "image", TweetID: "2", Key: "3_22"},
+		{URL: "https://pbs.twimg.com/media/c.jpg", Type: "image", TweetID: "3", MediaID: "33"},
+	}
+	for round := 0; round < 2; round++ {
+		cp.Merge(ms)
+		if len(cp.Items) != 3 {
+			t.Fatalf("round %d: %d items, want 3", round, len(cp.Items))
+		}
+	}
+
+	tests := []struct {
+		key    string
+		status CheckpointStatus
+		size   int64
+	}{
+		{"media:11", CheckpointDone, 123},
+		{"media:22", CheckpointPending, 0},
+		{"media:33", CheckpointPending, 0},
+	}
+	for i, tt := range tests {
+		it := cp.Items[i]
+		if it.Key != tt.key || it.Status != tt.status || it.Size != tt.size {
+			t.Errorf("item %d = key %s, %s, %d bytes; want %s, %s, %d", i, it.Key, it.Status, it.Size, tt.key, tt.status, tt.size)
+		}
+	}
+	if n := len(cp.PendingItems()); n != 2 {
+		t.Errorf("%d pending items, want 2", n)
+	}
+
+	// A new URL for a known media ID is the same item.
+	moved := ms[0]
+	moved.URL = "https://video.twimg.com/a-720.mp4"
+	cp.Merge([]scraper.Media{moved})
+	if len(cp.Items) != 3 || cp.Items[0].URL != moved.URL || cp.Items[0].Status != CheckpointDone {
+		t.Errorf("moved URL gave %d items, first %+v", len(cp.Items), cp.Items[0])
+	}
+}
@@ -0,0 +1,286 @@
+package downloader
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ghostlawless/xdl/internal/utils"
+)
+
+const (
+	LinkHard = "hardlink"
+	LinkSym  = "symlink"
+)
+
+type Store struct {
+	Root string
+	Link string
+
+	mu    sync.Mutex
+	dups  int
+	saved int64
+}
+
+func OpenStore(root, link string) (*Store, error) {
+	switch link {
+	case "", LinkHard:
+		link = LinkHard
+	case LinkSym:
+	default:
+		return nil, fmt.Errorf("unknown link mode %q (use hardlink or symlink)", link)
+	}
+	if err := utils.EnsureDir(root); err != nil {
+		return nil, err
+	}
+	return &Store{Root: root, Link: link}, nil
+}
+
+func StorePath(outRoot string) string {
+	return filepath.Join(outRoot, ".xdl", "store")
+}
+
+func (s *Store) object(sum string) string {
+	return filepath.Join(s.Root, sum[:2], sum)
+}
+
+func (s *Store) Stats() (int, int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.dups, s.saved
+}
+
+// Ingest moves p into the store under its SHA-256 and puts a link back at p.
+// It reports whether the content was already stored.
+func (s *Store) Ingest(p, sum string) (string, bool, error) {
+	if sum == "" {
+		var err error
+		if sum, err = utils.FileSHA256(p); err != nil {
+			return "", false, err
+		}
+	}
+	st, err := os.Lstat(p)
+	if err != nil {
+		return sum, false, err
+	}
+	if !st.Mode().IsRegular() {
+		return sum, false, nil
+	}
+	obj := s.object(sum)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if ost, err := os.Stat(obj); err == nil {
+		if os.SameFile(st, ost) {
+			return sum, true, nil
+		}
+		if ost.Size() != st.Size() {
+			return sum, false, fmt.Errorf("store object %s has size %d, file has %d", sum, ost.Size(), st.Size())
+		}
+		tmp := p + ".link"
+		_ = os.Remove(tmp)
+		if err := s.link(obj, tmp); err != nil {
+			return sum, false, err
+		}
+		if err := os.Rename(tmp, p); err != nil {
+			_ = os.Remove(tmp)
+			return sum, false, err
+		}
+		s.dups++
+		s.saved += st.Size()
+		return sum, true, nil
+	}
+
+	if err := utils.EnsureDir(filepath.Dir(obj)); err != nil {
+		return sum, false, err
+	}
+	if err := os.Rename(p, obj); err != nil {
+		return sum, false, err
+	}
+	if err := s.link(obj, p); err != nil {
+		if rerr := os.Rename(obj, p); rerr != nil {
+			return sum, false, errors.Join(err, rerr)
+		}
+		return sum, false, err
+	}
+	return sum, false, nil
+}
+
+func (s *Store) link(obj, p string) error {
+	if s.Link == LinkHard {
+		if err := os.Link(obj, p); err == nil {
+			return nil
+		}
+	}
+	t, err := filepath.Rel(filepath.Dir(p), obj)
+	if err != nil {
+		t = obj
+	}
+	return os.Symlink(t, p)
+}
+
+func hashResult(r *result) {
+	if r.sum == "" {
+		if sum, err := utils.FileSHA256(r.path); err == nil {
+			r.sum = sum
+		}
+	}
+}
+
+// storeResult hashes r and links it into the store. Files with embedded
+// tweet metadata are unique to their tweet and stay out of the store; their
+// hash is the one of the bytes as downloaded.
+func storeResult(opt Options, it item, r *result) {
+	if r.skipped && r.sum == "" && opt.Provenance {
+		if e, ok := opt.Manifest.Lookup(it.Key); ok && e.Meta && e.SHA256 != "" && e.Size == r.size {
+			r.sum, r.meta = e.SHA256, true
+			return
+		}
+	}
+	hashResult(r)
+	if opt.Store == nil || r.sum == "" || r.meta {
+		return
+	}
+	if _, _, err := opt.Store.Ingest(r.path, r.sum); err == nil {
+		r.linked = true
+	}
+	if r.audio != "" {
+		_, _, _ = opt.Store.Ingest(r.audio, "")
+	}
+}
+
+type DedupeGroup struct {
+	SHA256 string   `json:"sha256"`
+	Size   int64    `json:"size"`
+	Files  []string `json:"files"`
+}
+
+type DedupeReport struct {
+	Root        string        `json:"root"`
+	GeneratedAt time.Time     `json:"generated_at"`
+	Files       int           `json:"files"`
+	Unique      int           `json:"unique"`
+	Linked      int           `json:"linked"`
+	SavedBytes  int64         `json:"saved_bytes"`
+	Errors      []string      `json:"errors,omitempty"`
+	Groups      []DedupeGroup `json:"duplicates"`
+}
+
+func DedupeReportPath(outRoot string) string {
+	return filepath.Join(outRoot, ".xdl", "dedupe.json")
+}
+
+func (r *DedupeReport) Save(path string) error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	return utils.SaveToFile(path, data)
+}
+
+// DedupeArchive hashes every media file in the run folders under root into
+// st and records the hashes in each run's manifest.
+func DedupeArchive(root string, st *Store) (DedupeReport, error) {
+	rep := DedupeReport{Root: root, GeneratedAt: time.Now().UTC()}
+	if _, err := os.Stat(root); err != nil {
+		return rep, err
+	}
+	groups := make(map[string]*DedupeGroup)
+	d0, s0 := st.Stats()
+
+	for _, dir := range FindRunDirs(root) {
+		mf, err := LoadManifest(ManifestPath(dir))
+		if err != nil && !os.IsNotExist(err) {
+			rep.Errors = append(rep.Errors, dir+": "+err.Error())
+			mf = nil
+		}
+		sums := make(map[string]string)
+		meta := make(map[string]bool)
+		for _, e := range mf.Snapshot() {
+			if e.Meta {
+				meta[e.File] = true
+			}
+		}
+
+		_ = filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return nil
+			}
+			if d.IsDir() {
+				if p != dir && (strings.HasSuffix(d.Name(), ".hls") || strings.HasPrefix(d.Name(), ".")) {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if !isMediaFile(d.Name()) {
+				return nil
+			}
+			if rr, err := filepath.Rel(dir, p); err == nil && meta[filepath.ToSlash(rr)] {
+				return nil
+			}
+			rel, _ := filepath.Rel(root, p)
+			rel = filepath.ToSlash(rel)
+			sum, _, err := st.Ingest(p, "")
+			if err != nil {
+				rep.Errors = append(rep.Errors, rel+": "+err.Error())
+				return nil
+			}
+			fi, err := os.Stat(p)
+			if err != nil {
+				return nil
+			}
+			rep.Files++
+			g := groups[sum]
+			if g == nil {
+				g = &DedupeGroup{SHA256: sum, Size: fi.Size()}
+				groups[sum] = g
+			}
+			g.Files = append(g.Files, rel)
+			if rr, err := filepath.Rel(dir, p); err == nil {
+				sums[filepath.ToSlash(rr)] = sum
+			}
+			return nil
+		})
+
+		if mf == nil || len(sums) == 0 {
+			continue
+		}
+		for _, e := range mf.Snapshot() {
+			if sum, ok := sums[e.File]; ok && e.SHA256 != sum {
+				e.SHA256 = sum
+				mf.Record(e)
+			}
+		}
+		if err := mf.Save(ManifestPath(dir)); err != nil {
+			rep.Errors = append(rep.Errors, dir+": "+err.Error())
+		}
+	}
+
+	rep.Unique = len(groups)
+	for _, g := range groups {
+		if len(g.Files) > 1 {
+			sort.Strings(g.Files)
+			rep.Groups = append(rep.Groups, *g)
+		}
+	}
+	sort.Slice(rep.Groups, func(i, j int) bool {
+		wi := rep.Groups[i].Size * int64(len(rep.Groups[i].Files)-1)
+		wj := rep.Groups[j].Size * int64(len(rep.Groups[j].Files)-1)
+		if wi != wj {
+			return wi > wj
+		}
+		return rep.Groups[i].SHA256 < rep.Groups[j].SHA256
+	})
+	d1, s1 := st.Stats()
+	rep.Linked = d1 - d0
+	rep.SavedBytes = s1 - s0
+	return rep, nil
+}
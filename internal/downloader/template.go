@@ -0,0 +1,248 @@
+package downloader
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ghostlawless/xdl/internal/log"
+	"github.com/ghostlawless/xdl/internal/utils"
+)
+
+var tplFields = map[string]bool{
+	"user":     true,
+	"user_id":  true,
+	"tweet_id": true,
+	"media_id": true,
+	"type":     true,
+	"dir":      true,
+	"index":    true,
+	"width":    true,
+	"height":   true,
+	"bitrate":  true,
+	"ext":      true,
+	"date":     true,
+	"year":     true,
+	"month":    true,
+	"day":      true,
+}
+
+var tplNumeric = map[string]bool{"index": true, "width": true, "height": true, "bitrate": true}
+
+type tplToken struct {
+	lit   string
+	field string
+	arg   string
+}
+
+type PathTemplate struct {
+	raw  string
+	toks []tplToken
+}
+
+func ParsePathTemplate(s string) (*PathTemplate, error) {
+	s = strings.TrimSpace(strings.ReplaceAll(s, "\\", "/"))
+	if s == "" {
+		return nil, nil
+	}
+	if strings.HasPrefix(s, "/") || filepath.IsAbs(s) || filepath.VolumeName(s) != "" {
+		return nil, fmt.Errorf("template %q must be relative to the run folder", s)
+	}
+	t := &PathTemplate{raw: s}
+	rest := strings.TrimSuffix(s, ".{ext}")
+	for rest != "" {
+		i := strings.IndexAny(rest, "{}")
+		if i < 0 {
+			t.toks = append(t.toks, tplToken{lit: rest})
+			break
+		}
+		if rest[i] == '}' {
+			return nil, fmt.Errorf("template %q: unexpected '}'", s)
+		}
+		if i > 0 {
+			t.toks = append(t.toks, tplToken{lit: rest[:i]})
+		}
+		j := strings.IndexByte(rest[i:], '}')
+		if j < 0 {
+			return nil, fmt.Errorf("template %q: unclosed '{'", s)
+		}
+		f, a, _ := strings.Cut(rest[i+1:i+j], ":")
+		f = strings.TrimSpace(f)
+		if !tplFields[f] {
+			return nil, fmt.Errorf("template %q: unknown field {%s}", s, f)
+		}
+		if a != "" && tplNumeric[f] {
+			if _, err := strconv.Atoi(a); err != nil {
+				return nil, fmt.Errorf("template %q: {%s:%s} needs a numeric width", s, f, a)
+			}
+		}
+		t.toks = append(t.toks, tplToken{field: f, arg: a})
+		rest = rest[i+j+1:]
+	}
+	if len(t.toks) == 0 {
+		return nil, errors.New("template has no file name")
+	}
+	return t, nil
+}
+
+func (t *PathTemplate) String() string {
+	if t == nil {
+		return ""
+	}
+	return t.raw
+}
+
+func (t *PathTemplate) Expand(it item, opt Options) string {
+	var b strings.Builder
+	ts := it.posted()
+	for _, tk := range t.toks {
+		if tk.field == "" {
+			b.WriteString(tk.lit)
+			continue
+		}
+		b.WriteString(tplValue(tk, it, opt, ts))
+	}
+
+	segs := strings.Split(b.String(), "/")
+	out := make([]string, 0, len(segs))
+	for _, sg := range segs {
+		sg = strings.TrimSpace(sg)
+		if sg == "" || sg == "." || sg == ".." {
+			continue
+		}
+		out = append(out, utils.SanitizeFilename(sg))
+	}
+	if len(out) == 0 {
+		return mediaBase(it)
+	}
+	return path.Join(out...)
+}
+
+func tplValue(tk tplToken, it item, opt Options, ts time.Time) string {
+	num := func(n int) string {
+		w, _ := strconv.Atoi(tk.arg)
+		return fmt.Sprintf("%0*d", w, n)
+	}
+	date := func(layout string) string {
+		if ts.IsZero() {
+			return "unknown"
+		}
+		return ts.Format(layout)
+	}
+	orUnknown := func(s string) string {
+		if s == "" {
+			return "unknown"
+		}
+		return s
+	}
+	switch tk.field {
+	case "user":
+		return orUnknown(opt.User)
+	case "user_id":
+		return orUnknown(opt.UserID)
+	case "tweet_id":
+		return orUnknown(it.TweetID)
+	case "media_id":
+		return mediaBase(it)
+	case "type":
+		return orUnknown(it.Type)
+	case "dir":
+		return filepath.Base(pick(it, binsOf("")))
+	case "index":
+		return num(it.Pos + 1)
+	case "width":
+		return num(it.Width)
+	case "height":
+		return num(it.Height)
+	case "bitrate":
+		return num(it.Bitrate)
+	case "ext":
+		return orUnknown(it.Ext)
+	case "date":
+		if tk.arg == "" {
+			return date("2006-01-02")
+		}
+		return date(tk.arg)
+	case "year":
+		return date("2006")
+	case "month":
+		return date("01")
+	case "day":
+		return date("02")
+	}
+	return ""
+}
+
+func mediaBase(it item) string {
+	b := it.MediaID
+	if b == "" {
+		b = baseFrom(it.URL)
+	}
+	if b == "" {
+		b = sh(it.URL)
+	}
+	return utils.SanitizeFilename(b)
+}
+
+// adoptLegacy renames a file saved under its URL basename, as files were
+// named before media IDs, to full so an upgraded run does not fetch it again.
+func adoptLegacy(it item, full string) {
+	if it.MediaID == "" {
+		return
+	}
+	b := utils.SanitizeFilename(baseFrom(it.URL))
+	if b == "" || strings.EqualFold(b, it.MediaID) {
+		return
+	}
+	if ext := path.Ext(full); !strings.HasSuffix(strings.ToLower(b), strings.ToLower(ext)) {
+		b += ext
+	}
+	old := filepath.Join(filepath.Dir(full), b)
+	if old == full {
+		return
+	}
+	if _, err := os.Stat(full); err == nil {
+		return
+	}
+	if st, err := os.Stat(old); err != nil || st.IsDir() || st.Size() == 0 {
+		return
+	}
+	if err := os.Rename(old, full); err == nil {
+		log.LogInfo("download", fmt.Sprintf("renamed %s to %s", b, filepath.Base(full)))
+	}
+}
+
+// placeOf returns the folder and file stem for it. The stem is claimed in
+// the manifest together with every extension the item may be saved with, so
+// two items never share a file and a rerun gets the same name back.
+func placeOf(it item, ds bins, opt Options, exts ...string) (string, string) {
+	var rel string
+	if opt.Template == nil {
+		r, err := filepath.Rel(opt.RunDir, filepath.Join(pick(it, ds), mediaBase(it)))
+		if err != nil {
+			return pick(it, ds), trimExt(mediaBase(it), exts)
+		}
+		rel = filepath.ToSlash(r)
+	} else {
+		rel = opt.Template.Expand(it, opt)
+	}
+	rel = opt.Manifest.Claim(trimExt(rel, exts), it.Key, exts...)
+	full := filepath.Join(opt.RunDir, filepath.FromSlash(rel))
+	return filepath.Dir(full), filepath.Base(full)
+}
+
+// trimExt drops one of exts from the end of a stem that already carries it,
+// as URL basenames do.
+func trimExt(stem string, exts []string) string {
+	for _, e := range exts {
+		if e != "" && len(stem) > len(e)+1 && strings.EqualFold(stem[len(stem)-len(e)-1:], "."+e) {
+			return stem[:len(stem)-len(e)-1]
+		}
+	}
+	return stem
+}
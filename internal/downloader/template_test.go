@@ -0,0 +1,147 @@
+package downloader
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParsePathTemplate(t *testing.T) {
+	tests := []struct {
+		in   string
+		none bool
+		toks int
+		err  string
+	}{
+		{in: "", none: true},
+		{in: "   ", none: true},
+		{in: "{user}/{tweet_id}_{index}", toks: 5},
+		{in: `{year}\{month}\{media_id}.{ext}`, toks: 5},
+		{in: "{index:03}-{width:4}x{height}", toks: 5},
+		{in: "{date:2006/01}/{media_id}", toks: 3},
+		{in: "plain", toks: 1},
+		{in: "/abs/{media_id}", err: "must be relative"},
+		{in: "{user", err: "unclosed '{'"},
+		{in: "user}", err: "unexpected '}'"},
+		{in: "{nope}", err: "unknown field {nope}"},
+		{in: "{index:x}", err: "needs a numeric width"},
+		{in: ".{ext}", err: "no file name"},
+	}
+	for _, tt := range tests {
+		got, err := ParsePathTemplate(tt.in)
+		switch {
+		case tt.err != "":
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("ParsePathTemplate(%q) err = %v, want %q", tt.in, err, tt.err)
+			}
+		case err != nil:
+			t.Errorf("ParsePathTemplate(%q): %v", tt.in, err)
+		case tt.none:
+			if got != nil {
+				t.Errorf("ParsePathTemplate(%q) = %v, want nil", tt.in, got)
+			}
+		case len(got.toks) != tt.toks:
+			t.Errorf("ParsePathTemplate(%q) has %d tokens, want %d", tt.in, len(got.toks), tt.toks)
+		}
+	}
+}
+
+func TestPathTemplateExpand(t *testing.T) {
+	it := item{
+		URL:     "https://pbs.twimg.com/media/Fabc123.jpg?name=orig",
+		Type:    "image",
+		TweetID: "1600000000000000000",
+		MediaID: "1600000000000000001",
+		Pos:     1,
+		Width:   1200,
+		Height:  800,
+		Ext:     "jpg",
+		Created: "2024-03-05T10:20:30Z",
+	}
+	opt := Options{User: "alice", UserID: "42"}
+
+	tests := []struct {
+		tpl  string
+		it   func(item) item
+		want string
+	}{
+		{tpl: "{user}/{tweet_id}_{index}", want: "alice/1600000000000000000_2"},
+		{tpl: "{year}/{month}/{day}/{media_id}.{ext}", want: "2024/03/05/1600000000000000001"},
+		{tpl: "{date}_{index:03}", want: "2024-03-05_002"},
+		{tpl: "{date:200601}/{width:5}x{height}", want: "202403/01200x800"},
+		{tpl: "{user_id}/{type}/{dir}/{ext}", want: "42/image/images/jpg"},
+		{tpl: "{dir}/{media_id}", it: func(i item) item { i.Type, i.URL = "video", "https://video.twimg.com/v.mp4"; return i }, want: "videos/1600000000000000001"},
+		{tpl: "{bitrate}/{media_id}", it: func(i item) item { i.Bitrate = 2176000; return i }, want: "2176000/1600000000000000001"},
+		{tpl: "{media_id}", it: func(i item) item { i.MediaID = ""; return i }, want: "Fabc123.jpg"},
+		{tpl: "{tweet_id}", it: func(i item) item { i.TweetID = ""; return i }, want: "unknown"},
+		{tpl: "{date}", it: func(i item) item { i.Created, i.TweetID, i.MediaID = "", "", ""; return i }, want: "unknown"},
+		{tpl: "{year}", it: func(i item) item { i.Created = ""; return i }, want: "2022"},
+		{tpl: "../{user}/./{media_id}", want: "alice/1600000000000000001"},
+		{tpl: "{user}//{media_id}", want: "alice/1600000000000000001"},
+		{tpl: "a:b*c/{media_id}", want: "a_b_c/1600000000000000001"},
+		{tpl: "..", want: "1600000000000000001"},
+	}
+	for _, tt := range tests {
+		p, err := ParsePathTemplate(tt.tpl)
+		if err != nil {
+			t.Fatalf("ParsePathTemplate(%q): %v", tt.tpl, err)
+		}
+		in := it
+		if tt.it != nil {
+			in = tt.it(in)
+		}
+		if got := p.Expand(in, opt); got != tt.want {
+			t.Errorf("Expand(%q) = %q, want %q", tt.tpl, got, tt.want)
+		}
+	}
+}
+
+func TestTrimExt(t *testing.T) {
+	tests := []struct {
+		stem string
+		exts []string
+		want string
+	}{
+		{"Fabc.jpg", []string{"jpg"}, "Fabc"},
+		{"Fabc.JPG", []string{"png", "jpg"}, "Fabc"},
+		{"Fabc", []string{"jpg"}, "Fabc"},
+		{".jpg", []string{"jpg"}, ".jpg"},
+		{"a/b.mp4", []string{"mp4", "ts"}, "a/b"},
+		{"clip.mp4.ts", []string{"mp4", "ts"}, "clip.mp4"},
+		{"x.jpg", []string{""}, "x.jpg"},
+	}
+	for _, tt := range tests {
+		if got := trimExt(tt.stem, tt.exts); got != tt.want {
+			t.Errorf("trimExt(%q, %v) = %q, want %q", tt.stem, tt.exts, got, tt.want)
+		}
+	}
+}
+
+func TestPlaceOfClaims(t *testing.T) {
+	run := t.TempDir()
+	tp, _ := ParsePathTemplate("{user}/{tweet_id}")
+	mf := NewManifest("alice", "r1")
+	opt := Options{RunDir: run, User: "alice", Template: tp, Manifest: mf}
+	ds := binsOf(run)
+
+	a := item{Key: "t1|m1", TweetID: "1", MediaID: "m1", Type: "image", URL: "https://pbs.twimg.com/media/a.jpg"}
+	b := item{Key: "t1|m2", TweetID: "1", MediaID: "m2", Type: "image", URL: "https://pbs.twimg.com/media/b.jpg"}
+
+	tests := []struct {
+		it   item
+		exts []string
+		want string
+	}{
+		{a, []string{"jpg"}, "alice/1"},
+		{b, []string{"jpg"}, "alice/1_2"},
+		{a, []string{"jpg"}, "alice/1"},
+		{b, []string{"jpg"}, "alice/1_2"},
+	}
+	for i, tt := range tests {
+		dir, stem := placeOf(tt.it, ds, opt, tt.exts...)
+		got, _ := filepath.Rel(run, filepath.Join(dir, stem))
+		if filepath.ToSlash(got) != tt.want {
+			t.Errorf("%d: placeOf(%s) = %q, want %q", i, tt.it.Key, filepath.ToSlash(got), tt.want)
+		}
+	}
+}
@@ -0,0 +1,364 @@
+package downloader
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ghostlawless/xdl/internal/log"
+)
+
+const (
+	VerifyOK      = "ok"
+	VerifyCorrupt = "corrupt"
+)
+
+type VerifyResult struct {
+	Status string
+	Format string
+	Reason string
+}
+
+func (v VerifyResult) OK() bool { return v.Status == VerifyOK }
+
+func (v VerifyResult) String() string {
+	if v.Reason == "" {
+		return v.Status
+	}
+	return v.Status + ": " + v.Reason
+}
+
+func VerifyFile(p string, want int64) VerifyResult {
+	f, err := os.Open(p)
+	if err != nil {
+		return VerifyResult{Status: VerifyCorrupt, Reason: err.Error()}
+	}
+	defer f.Close()
+
+	st, err := f.Stat()
+	if err != nil {
+		return VerifyResult{Status: VerifyCorrupt, Reason: err.Error()}
+	}
+	sz := st.Size()
+	if sz == 0 {
+		return VerifyResult{Status: VerifyCorrupt, Reason: "empty file"}
+	}
+	if want > 0 && sz != want {
+		return VerifyResult{Status: VerifyCorrupt, Reason: fmt.Sprintf("size %d, expected %d", sz, want)}
+	}
+
+	head := make([]byte, 512)
+	n, _ := io.ReadFull(f, head)
+	head = head[:n]
+
+	var ft string
+	var verr error
+	switch {
+	case bytes.HasPrefix(head, []byte{0xFF, 0xD8, 0xFF}):
+		ft, verr = "jpeg", checkImage(f, []byte{0xFF, 0xD9})
+	case bytes.HasPrefix(head, []byte("\x89PNG\r\n\x1a\n")):
+		ft, verr = "png", checkImage(f, []byte("IEND\xaeB`\x82"))
+	case bytes.HasPrefix(head, []byte("GIF87a")), bytes.HasPrefix(head, []byte("GIF89a")):
+		ft, verr = "gif", checkImage(f, []byte{0x3B})
+	case len(head) >= 12 && string(head[0:4]) == "RIFF" && string(head[8:12]) == "WEBP":
+		ft, verr = "webp", checkWebP(head, sz)
+	case len(head) >= 8 && string(head[4:8]) == "ftyp":
+		ft, verr = "mp4", checkMP4(f, sz)
+	case len(head) > 0 && head[0] == 0x47:
+		ft, verr = "ts", checkTS(f, sz)
+	default:
+		ft = strings.TrimPrefix(filepath.Ext(p), ".")
+		verr = fmt.Errorf("unrecognized content (%s)", sniffKind(head))
+	}
+	if verr != nil {
+		return VerifyResult{Status: VerifyCorrupt, Format: ft, Reason: verr.Error()}
+	}
+	return VerifyResult{Status: VerifyOK, Format: ft}
+}
+
+func verifyDownloaded(p string) (string, error) {
+	vr := VerifyFile(p, 0)
+	if vr.OK() {
+		return vr.String(), nil
+	}
+	quarantine(p, vr.Reason)
+	return vr.String(), fmt.Errorf("integrity check failed for %s: %s", filepath.Base(p), vr.Reason)
+}
+
+func existingVerified(p string) (int64, string, bool) {
+	st, err := os.Stat(p)
+	if err != nil || st.Size() <= 0 {
+		return 0, "", false
+	}
+	vr := VerifyFile(p, 0)
+	if !vr.OK() {
+		quarantine(p, vr.Reason)
+		return 0, "", false
+	}
+	return st.Size(), vr.String(), true
+}
+
+// quarantine moves a file that failed verification to <name>.corrupt, so the
+// item is fetched again without throwing away what was there.
+func quarantine(p, reason string) {
+	if err := os.Rename(p, p+".corrupt"); err != nil {
+		log.LogError("download", fmt.Sprintf("%s failed verification (%s) and could not be moved aside: %v", p, reason, err))
+		return
+	}
+	log.LogError("download", fmt.Sprintf("%s failed verification (%s); kept as %s", p, reason, filepath.Base(p)+".corrupt"))
+}
+
+func sniffKind(head []byte) string {
+	t := strings.TrimSpace(strings.ToLower(string(head)))
+	switch {
+	case strings.HasPrefix(t, "<!doctype html"), strings.HasPrefix(t, "<html"):
+		return "html page"
+	case strings.HasPrefix(t, "{"), strings.HasPrefix(t, "["):
+		return "json"
+	case strings.HasPrefix(t, "<?xml"), strings.HasPrefix(t, "<"):
+		return "markup"
+	}
+	return "unknown"
+}
+
+func checkImage(f *os.File, trailer []byte) error {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if _, _, err := image.DecodeConfig(f); err != nil {
+		return fmt.Errorf("decode header: %w", err)
+	}
+	st, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	k := int64(64)
+	if st.Size() < k {
+		k = st.Size()
+	}
+	tail := make([]byte, k)
+	if _, err := f.ReadAt(tail, st.Size()-k); err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	if !bytes.Contains(tail, trailer) {
+		return errors.New("truncated (missing end marker)")
+	}
+	return nil
+}
+
+func checkWebP(head []byte, sz int64) error {
+	if len(head) < 16 {
+		return errors.New("short header")
+	}
+	rs := int64(binary.LittleEndian.Uint32(head[4:8])) + 8
+	if rs > sz {
+		return fmt.Errorf("truncated (riff %d bytes, file %d)", rs, sz)
+	}
+	switch string(head[12:16]) {
+	case "VP8 ", "VP8L", "VP8X":
+		return nil
+	}
+	return fmt.Errorf("unknown webp chunk %q", head[12:16])
+}
+
+func checkMP4(f *os.File, sz int64) error {
+	var off int64
+	seen := make(map[string]bool)
+	hdr := make([]byte, 16)
+	for off < sz {
+		if sz-off < 8 {
+			return fmt.Errorf("trailing %d bytes after last box", sz-off)
+		}
+		if _, err := f.ReadAt(hdr[:8], off); err != nil {
+			return err
+		}
+		bs := int64(binary.BigEndian.Uint32(hdr[0:4]))
+		bt := string(hdr[4:8])
+		switch bs {
+		case 0:
+			bs = sz - off
+		case 1:
+			if _, err := f.ReadAt(hdr[8:16], off+8); err != nil {
+				return err
+			}
+			bs = int64(binary.BigEndian.Uint64(hdr[8:16]))
+		}
+		if bs < 8 {
+			return fmt.Errorf("invalid %q box size %d", bt, bs)
+		}
+		if off+bs > sz {
+			return fmt.Errorf("truncated %q box (%d of %d bytes)", bt, sz-off, bs)
+		}
+		seen[bt] = true
+		off += bs
+	}
+	if !seen["ftyp"] {
+		return errors.New("missing ftyp box")
+	}
+	if !seen["moov"] {
+		return errors.New("missing moov box")
+	}
+	if !seen["mdat"] && !seen["moof"] {
+		return errors.New("missing media data")
+	}
+	return nil
+}
+
+func checkTS(f *os.File, sz int64) error {
+	if sz%188 != 0 {
+		return fmt.Errorf("size %d is not a multiple of 188", sz)
+	}
+	b := []byte{0}
+	for _, off := range []int64{0, 188, sz - 188} {
+		if off < 0 || off >= sz {
+			continue
+		}
+		if _, err := f.ReadAt(b, off); err != nil {
+			return err
+		}
+		if b[0] != 0x47 {
+			return fmt.Errorf("lost sync at offset %d", off)
+		}
+	}
+	return nil
+}
+
+const (
+	streamHead = 64 << 10
+	streamTail = 188
+)
+
+// streamCheck gathers what VerifyFile looks at from content that is streamed
+// to storage instead of written to disk: the head, the tail and, for MP4,
+// the sequence of top-level boxes.
+type streamCheck struct {
+	n    int64
+	head []byte
+	tail []byte
+	next int64
+	box  []byte
+	seen map[string]bool
+	err  error
+}
+
+func (s *streamCheck) Write(p []byte) (int, error) {
+	if k := streamHead - len(s.head); k > 0 {
+		s.head = append(s.head, p[:min(k, len(p))]...)
+	}
+	s.tail = append(s.tail, p[max(0, len(p)-streamTail):]...)
+	if len(s.tail) > streamTail {
+		s.tail = append(s.tail[:0], s.tail[len(s.tail)-streamTail:]...)
+	}
+	s.boxes(p)
+	s.n += int64(len(p))
+	return len(p), nil
+}
+
+func (s *streamCheck) boxes(p []byte) {
+	if s.seen == nil {
+		s.seen = make(map[string]bool)
+	}
+	for s.err == nil && s.next >= 0 {
+		i := s.next + int64(len(s.box)) - s.n
+		if i >= int64(len(p)) {
+			return
+		}
+		need := 8
+		if len(s.box) >= 8 && binary.BigEndian.Uint32(s.box) == 1 {
+			need = 16
+		}
+		s.box = append(s.box, p[i:i+int64(min(need-len(s.box), len(p)-int(i)))]...)
+		if len(s.box) < need || (need == 8 && binary.BigEndian.Uint32(s.box) == 1) {
+			continue
+		}
+		bs := int64(binary.BigEndian.Uint32(s.box))
+		bt := string(s.box[4:8])
+		switch bs {
+		case 0:
+			s.seen[bt] = true
+			s.next, s.box = -1, s.box[:0]
+			return
+		case 1:
+			bs = int64(binary.BigEndian.Uint64(s.box[8:16]))
+		}
+		if bs < 8 {
+			s.err = fmt.Errorf("invalid %q box size %d", bt, bs)
+			return
+		}
+		s.seen[bt] = true
+		s.next += bs
+		s.box = s.box[:0]
+	}
+}
+
+func (s *streamCheck) mp4() error {
+	switch {
+	case s.err != nil:
+		return s.err
+	case s.next > s.n:
+		return fmt.Errorf("truncated box (%d of %d bytes)", s.n, s.next)
+	case len(s.box) > 0:
+		return fmt.Errorf("trailing %d bytes after last box", len(s.box))
+	case !s.seen["ftyp"]:
+		return errors.New("missing ftyp box")
+	case !s.seen["moov"]:
+		return errors.New("missing moov box")
+	case !s.seen["mdat"] && !s.seen["moof"]:
+		return errors.New("missing media data")
+	}
+	return nil
+}
+
+func (s *streamCheck) result(name string) VerifyResult {
+	head, sz := s.head, s.n
+	if sz == 0 {
+		return VerifyResult{Status: VerifyCorrupt, Reason: "empty file"}
+	}
+	img := func(trailer []byte) error {
+		if _, _, err := image.DecodeConfig(bytes.NewReader(head)); err != nil {
+			return fmt.Errorf("decode header: %w", err)
+		}
+		if !bytes.Contains(s.tail[max(0, len(s.tail)-64):], trailer) {
+			return errors.New("truncated (missing end marker)")
+		}
+		return nil
+	}
+	var ft string
+	var verr error
+	switch {
+	case bytes.HasPrefix(head, []byte{0xFF, 0xD8, 0xFF}):
+		ft, verr = "jpeg", img([]byte{0xFF, 0xD9})
+	case bytes.HasPrefix(head, []byte("\x89PNG\r\n\x1a\n")):
+		ft, verr = "png", img([]byte("IEND\xaeB`\x82"))
+	case bytes.HasPrefix(head, []byte("GIF87a")), bytes.HasPrefix(head, []byte("GIF89a")):
+		ft, verr = "gif", img([]byte{0x3B})
+	case len(head) >= 12 && string(head[0:4]) == "RIFF" && string(head[8:12]) == "WEBP":
+		ft, verr = "webp", checkWebP(head, sz)
+	case len(head) >= 8 && string(head[4:8]) == "ftyp":
+		ft, verr = "mp4", s.mp4()
+	case head[0] == 0x47:
+		ft = "ts"
+		switch {
+		case sz%188 != 0:
+			verr = fmt.Errorf("size %d is not a multiple of 188", sz)
+		case len(head) > 188 && head[188] != 0x47, len(s.tail) == streamTail && s.tail[0] != 0x47:
+			verr = errors.New("lost sync")
+		}
+	default:
+		ft = strings.TrimPrefix(filepath.Ext(name), ".")
+		verr = fmt.Errorf("unrecognized content (%s)", sniffKind(head[:min(len(head), 512)]))
+	}
+	if verr != nil {
+		return VerifyResult{Status: VerifyCorrupt, Format: ft, Reason: verr.Error()}
+	}
+	return VerifyResult{Status: VerifyOK, Format: ft}
+}
@@ -0,0 +1,228 @@
+package downloader
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/ghostlawless/xdl/internal/storage"
+)
+
+type VerifyIssue struct {
+	File   string
+	Key    string
+	Reason string
+}
+
+type VerifyReport struct {
+	Dir      string
+	Checked  int
+	OK       int
+	Corrupt  int
+	Requeued int
+	Issues   []VerifyIssue
+}
+
+func IsRunDir(dir string) bool {
+	for _, p := range []string{ManifestPath(dir), CheckpointPath(dir)} {
+		if st, err := os.Stat(p); err == nil && !st.IsDir() {
+			return true
+		}
+	}
+	return false
+}
+
+func FindRunDirs(root string) []string {
+	if IsRunDir(root) {
+		return []string{root}
+	}
+	es, err := os.ReadDir(root)
+	if err != nil {
+		return nil
+	}
+	out := make([]string, 0, len(es))
+	for _, e := range es {
+		if !e.IsDir() {
+			continue
+		}
+		d := filepath.Join(root, e.Name())
+		if IsRunDir(d) {
+			out = append(out, d)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// VerifyRun checks every file the run's manifest lists. Files the manifest
+// places in remote storage are checked by size when st is that storage and
+// skipped otherwise.
+func VerifyRun(dir string, st storage.Storage) (VerifyReport, error) {
+	rep := VerifyReport{Dir: dir}
+
+	mf, err := LoadManifest(ManifestPath(dir))
+	if err != nil && !os.IsNotExist(err) {
+		return rep, err
+	}
+	cp, err := LoadCheckpoint(CheckpointPath(dir))
+	if err != nil && !os.IsNotExist(err) {
+		return rep, err
+	}
+
+	known := make(map[string]bool)
+	vols := make(map[string]map[string]int64)
+	for _, e := range mf.Snapshot() {
+		if e.File == "" || (e.Status != CheckpointDone && e.Status != CheckpointSkipped) {
+			continue
+		}
+		checked := false
+		var bad VerifyResult
+		for _, f := range []string{e.File, e.Audio} {
+			if f == "" {
+				continue
+			}
+			size := e.Size
+			if f != e.File {
+				size = 0
+			}
+			p := filepath.Join(dir, filepath.FromSlash(f))
+			known[filepath.Clean(p)] = true
+			vr, ok := verifyEntryFile(dir, p, f, size, e, mf, st, vols)
+			if !ok {
+				continue
+			}
+			checked = true
+			if !vr.OK() && bad.Status == "" {
+				bad = vr
+				if f != e.File {
+					bad.Reason = "audio track " + vr.Reason
+				}
+			}
+		}
+		if !checked {
+			continue
+		}
+		rep.Checked++
+		if bad.Status == "" {
+			bad = VerifyResult{Status: VerifyOK}
+		}
+		e.Verify = bad.String()
+		if bad.OK() {
+			rep.OK++
+			mf.Record(e)
+			continue
+		}
+		rep.Corrupt++
+		rep.Issues = append(rep.Issues, VerifyIssue{File: e.File, Key: e.Key, Reason: bad.Reason})
+		e.Status = CheckpointFailed
+		mf.Record(e)
+		if cp.MarkFailure(e.Key, "corrupt: "+bad.Reason, 0) {
+			rep.Requeued++
+		}
+	}
+
+	_ = filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if d.IsDir() {
+			if p != dir && (strings.HasSuffix(d.Name(), ".hls") || strings.HasPrefix(d.Name(), ".")) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if known[filepath.Clean(p)] || !isMediaFile(d.Name()) {
+			return nil
+		}
+		rep.Checked++
+		if vr := VerifyFile(p, 0); vr.OK() {
+			rep.OK++
+		} else {
+			rel, _ := filepath.Rel(dir, p)
+			rep.Corrupt++
+			rep.Issues = append(rep.Issues, VerifyIssue{File: filepath.ToSlash(rel), Reason: vr.Reason})
+		}
+		return nil
+	})
+
+	if mf != nil {
+		if err := mf.Save(ManifestPath(dir)); err != nil {
+			return rep, err
+		}
+	}
+	if cp != nil && rep.Requeued > 0 {
+		if err := cp.Save(CheckpointPath(dir)); err != nil {
+			return rep, err
+		}
+		if _, err := WriteFailedReport(dir, cp); err != nil {
+			return rep, err
+		}
+	}
+	return rep, nil
+}
+
+// verifyEntryFile checks one file of a manifest entry where it lives: on
+// disk, in an archive volume or in remote storage. It reports false when the
+// file is in storage other than st and cannot be checked.
+func verifyEntryFile(dir, p, f string, size int64, e ManifestEntry, mf *Manifest, st storage.Storage, vols map[string]map[string]int64) (VerifyResult, bool) {
+	if _, err := os.Stat(p); !os.IsNotExist(err) {
+		return VerifyFile(p, size), true
+	}
+	switch {
+	case mf.Storage != "":
+		if st == nil || st.String() != mf.Storage {
+			return VerifyResult{}, false
+		}
+		return verifyRemote(st, dir, f, size), true
+	case e.Archive != "":
+		return verifyArchived(dir, e.Archive, f, size, vols), true
+	}
+	return VerifyResult{Status: VerifyCorrupt, Reason: "missing"}, true
+}
+
+// verifyArchived checks that an entry is in its volume with the recorded
+// size; the content itself is only checked when the file is on disk.
+func verifyArchived(dir, vol, f string, size int64, vols map[string]map[string]int64) VerifyResult {
+	ls, ok := vols[vol]
+	if !ok {
+		ls, _ = archiveSizes(filepath.Join(dir, vol))
+		vols[vol] = ls
+	}
+	if ls == nil {
+		return VerifyResult{Status: VerifyCorrupt, Reason: "archive " + vol + " unreadable"}
+	}
+	n, ok := ls[f]
+	switch {
+	case !ok:
+		return VerifyResult{Status: VerifyCorrupt, Reason: "missing from " + vol}
+	case size > 0 && n != size:
+		return VerifyResult{Status: VerifyCorrupt, Reason: fmt.Sprintf("size %d in %s, expected %d", n, vol, size)}
+	}
+	return VerifyResult{Status: VerifyOK}
+}
+
+func verifyRemote(st storage.Storage, dir, f string, size int64) VerifyResult {
+	name := objectName(dir, filepath.Join(dir, filepath.FromSlash(f)))
+	fi, err := st.Stat(name)
+	switch {
+	case errors.Is(err, storage.ErrNotExist):
+		return VerifyResult{Status: VerifyCorrupt, Reason: "missing from " + st.String()}
+	case err != nil:
+		return VerifyResult{Status: VerifyCorrupt, Reason: err.Error()}
+	case size > 0 && fi.Size != size:
+		return VerifyResult{Status: VerifyCorrupt, Reason: fmt.Sprintf("size %d in %s, expected %d", fi.Size, st.String(), size)}
+	}
+	return VerifyResult{Status: VerifyOK}
+}
+
+func isMediaFile(name string) bool {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".jpg", ".jpeg", ".png", ".gif", ".webp", ".mp4", ".m4a", ".ts":
+		return true
+	}
+	return false
+}
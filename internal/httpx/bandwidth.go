@@ -0,0 +1,285 @@
+package httpx
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	bwChunk    = 32 * 1024
+	bwWindow   = 5
+	bwMinBurst = 64 * 1024
+)
+
+type RateWindow struct {
+	From  time.Duration
+	To    time.Duration
+	Bytes int64
+}
+
+func (w RateWindow) contains(d time.Duration) bool {
+	if w.From <= w.To {
+		return d >= w.From && d < w.To
+	}
+	return d >= w.From || d < w.To
+}
+
+type bwSample struct {
+	sec   int64
+	bytes int64
+}
+
+// Bandwidth is a token bucket shared by every response body read through
+// Wrap. A zero rate only meters throughput.
+type Bandwidth struct {
+	mu       sync.Mutex
+	rate     int64
+	schedule []RateWindow
+	tokens   float64
+	last     time.Time
+	samples  [bwWindow]bwSample
+	start    time.Time
+}
+
+func NewBandwidth(rate int64, schedule []RateWindow) *Bandwidth {
+	return &Bandwidth{rate: rate, schedule: schedule}
+}
+
+func (b *Bandwidth) RateAt(t time.Time) int64 {
+	if b == nil {
+		return 0
+	}
+	d := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second
+	for _, w := range b.schedule {
+		if w.contains(d) {
+			return w.Bytes
+		}
+	}
+	return b.rate
+}
+
+// take debits n bytes and waits until the bucket covers them, or until ctx
+// is done.
+func (b *Bandwidth) take(ctx context.Context, n int) error {
+	if b == nil || n <= 0 {
+		return nil
+	}
+	b.mu.Lock()
+	now := time.Now()
+	b.meter(now, n)
+	r := b.RateAt(now)
+	if r <= 0 {
+		b.tokens = 0
+		b.last = now
+		b.mu.Unlock()
+		return nil
+	}
+	if !b.last.IsZero() {
+		b.tokens += now.Sub(b.last).Seconds() * float64(r)
+	}
+	burst := float64(r) / 4
+	if burst < bwMinBurst {
+		burst = bwMinBurst
+	}
+	if b.tokens > burst {
+		b.tokens = burst
+	}
+	b.last = now
+	b.tokens -= float64(n)
+	var d time.Duration
+	if b.tokens < 0 {
+		d = time.Duration(-b.tokens / float64(r) * float64(time.Second))
+	}
+	b.mu.Unlock()
+	if d <= 0 {
+		return nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+func (b *Bandwidth) meter(now time.Time, n int) {
+	if b.start.IsZero() {
+		b.start = now
+	}
+	s := now.Unix()
+	i := int(s % bwWindow)
+	if b.samples[i].sec != s {
+		b.samples[i] = bwSample{sec: s}
+	}
+	b.samples[i].bytes += int64(n)
+}
+
+// Throughput returns the average bytes per second over the last few seconds.
+func (b *Bandwidth) Throughput() float64 {
+	if b == nil {
+		return 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.start.IsZero() {
+		return 0
+	}
+	now := time.Now()
+	var sum int64
+	for _, s := range b.samples {
+		if now.Unix()-s.sec < bwWindow {
+			sum += s.bytes
+		}
+	}
+	span := now.Sub(b.start).Seconds()
+	if span > bwWindow {
+		span = bwWindow
+	}
+	if span < 1 {
+		span = 1
+	}
+	return float64(sum) / span
+}
+
+func (b *Bandwidth) Wrap(rt http.RoundTripper) http.RoundTripper {
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+	return &bwTransport{base: rt, bw: b}
+}
+
+type bwTransport struct {
+	base http.RoundTripper
+	bw   *Bandwidth
+}
+
+func (t *bwTransport) RoundTrip(rq *http.Request) (*http.Response, error) {
+	res, err := t.base.RoundTrip(rq)
+	if err != nil || res == nil || res.Body == nil || rq.Method == http.MethodHead {
+		return res, err
+	}
+	res.Body = &bwBody{rc: res.Body, bw: t.bw, ctx: rq.Context()}
+	return res, nil
+}
+
+type bwBody struct {
+	rc  io.ReadCloser
+	bw  *Bandwidth
+	ctx context.Context
+}
+
+func (b *bwBody) Read(p []byte) (int, error) {
+	if len(p) > bwChunk {
+		p = p[:bwChunk]
+	}
+	n, err := b.rc.Read(p)
+	if e := b.bw.take(b.ctx, n); e != nil {
+		return n, e
+	}
+	return n, err
+}
+
+func (b *bwBody) Close() error { return b.rc.Close() }
+
+// ParseRate parses sizes like "5MB/s", "800k", "20Mbit/s" into bytes per
+// second. "", "0", "off" and "unlimited" mean no limit.
+func ParseRate(s string) (int64, error) {
+	v := strings.ToLower(strings.TrimSpace(s))
+	switch v {
+	case "", "0", "off", "none", "unlimited", "full":
+		return 0, nil
+	}
+	v = strings.TrimSuffix(v, "/s")
+	if strings.HasSuffix(v, "bps") {
+		v = strings.TrimSuffix(v, "bps") + "bit"
+	}
+	i := 0
+	for i < len(v) && (v[i] == '.' || (v[i] >= '0' && v[i] <= '9')) {
+		i++
+	}
+	f, err := strconv.ParseFloat(v[:i], 64)
+	if err != nil || f < 0 {
+		return 0, fmt.Errorf("invalid rate %q", s)
+	}
+	mul := 1.0
+	switch strings.TrimSpace(v[i:]) {
+	case "", "b":
+	case "k", "kb", "kib":
+		mul = 1 << 10
+	case "m", "mb", "mib":
+		mul = 1 << 20
+	case "g", "gb", "gib":
+		mul = 1 << 30
+	case "bit":
+		mul = 1.0 / 8
+	case "kbit":
+		mul = 1e3 / 8
+	case "mbit":
+		mul = 1e6 / 8
+	case "gbit":
+		mul = 1e9 / 8
+	default:
+		return 0, fmt.Errorf("invalid rate unit in %q", s)
+	}
+	return int64(f * mul), nil
+}
+
+// ParseSchedule parses "HH:MM-HH:MM=RATE" windows separated by commas, in
+// local time. Windows may wrap past midnight.
+func ParseSchedule(s string) ([]RateWindow, error) {
+	var out []RateWindow
+	for _, part := range strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == ';' }) {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		span, rs, ok := strings.Cut(part, "=")
+		if !ok {
+			return nil, fmt.Errorf("schedule entry %q needs HH:MM-HH:MM=RATE", part)
+		}
+		a, z, ok := strings.Cut(span, "-")
+		if !ok {
+			return nil, fmt.Errorf("schedule entry %q needs HH:MM-HH:MM=RATE", part)
+		}
+		from, err := parseClock(a)
+		if err != nil {
+			return nil, err
+		}
+		to, err := parseClock(z)
+		if err != nil {
+			return nil, err
+		}
+		r, err := ParseRate(rs)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, RateWindow{From: from, To: to, Bytes: r})
+	}
+	return out, nil
+}
+
+func parseClock(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q (use HH:MM)", s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+func FormatRate(bps float64) string {
+	switch {
+	case bps >= 1<<20:
+		return fmt.Sprintf("%.1f MB/s", bps/(1<<20))
+	case bps >= 1<<10:
+		return fmt.Sprintf("%.0f KB/s", bps/(1<<10))
+	}
+	return fmt.Sprintf("%.0f B/s", bps)
+}
@@ -0,0 +1,132 @@
+package httpx
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseRate(t *testing.T) {
+	tests := []struct {
+		in   string
+		want int64
+		err  bool
+	}{
+		{"", 0, false},
+		{"off", 0, false},
+		{"512", 512, false},
+		{"800k", 800 << 10, false},
+		{"5MB/s", 5 << 20, false},
+		{"1.5 GiB", 3 << 29, false},
+		{"20Mbit/s", 2500000, false},
+		{"8Mbps", 1000000, false},
+		{"-1MB", 0, true},
+		{"fast", 0, true},
+		{"5 parsecs", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseRate(tt.in)
+		if (err != nil) != tt.err || got != tt.want {
+			t.Errorf("ParseRate(%q) = %d, %v; want %d, error %v", tt.in, got, err, tt.want, tt.err)
+		}
+	}
+}
+
+func TestScheduleRateAt(t *testing.T) {
+	ws, err := ParseSchedule("09:00-17:30=1MB, 23:00-06:00=off; 12:00-13:00=64k")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := NewBandwidth(5<<20, ws)
+	tests := []struct {
+		at   string
+		want int64
+	}{
+		{"08:59", 5 << 20},
+		{"09:00", 1 << 20},
+		{"12:30", 1 << 20},
+		{"17:30", 5 << 20},
+		{"23:30", 0},
+		{"05:59", 0},
+		{"06:00", 5 << 20},
+	}
+	for _, tt := range tests {
+		at, _ := time.ParseInLocation("15:04", tt.at, time.Local)
+		if got := b.RateAt(at); got != tt.want {
+			t.Errorf("RateAt(%s) = %d, want %d", tt.at, got, tt.want)
+		}
+	}
+	for _, bad := range []string{"09:00-17:00", "9-17=1MB", "09:00-25:00=1MB", "09:00-17:00=fast"} {
+		if _, err := ParseSchedule(bad); err == nil {
+			t.Errorf("ParseSchedule(%q) accepted a bad entry", bad)
+		}
+	}
+}
+
+func TestBandwidthTake(t *testing.T) {
+	tests := []struct {
+		name    string
+		rate    int64
+		n       int
+		timeout time.Duration
+		min     time.Duration
+		max     time.Duration
+		err     error
+	}{
+		{"unlimited", 0, 1 << 20, time.Second, 0, 50 * time.Millisecond, nil},
+		{"within the burst", 1 << 20, 1 << 10, time.Second, 0, 50 * time.Millisecond, nil},
+		{"waits for the deficit", 1 << 20, 256 << 10, time.Second, 200 * time.Millisecond, 1500 * time.Millisecond, nil},
+		{"cancelled wait", 1 << 10, 64 << 10, 50 * time.Millisecond, 0, 500 * time.Millisecond, context.DeadlineExceeded},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := NewBandwidth(tt.rate, nil)
+			// Fill the bucket up to its burst before measuring.
+			b.take(context.Background(), 1)
+			time.Sleep(20 * time.Millisecond)
+
+			ctx, cancel := context.WithTimeout(context.Background(), tt.timeout)
+			defer cancel()
+			t0 := time.Now()
+			err := b.take(ctx, tt.n)
+			d := time.Since(t0)
+			if !errors.Is(err, tt.err) {
+				t.Errorf("take = %v, want %v", err, tt.err)
+			}
+			if d < tt.min || d > tt.max {
+				t.Errorf("take waited %s, want %s to %s", d, tt.min, tt.max)
+			}
+		})
+	}
+}
+
+func TestBandwidthBodyCancel(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, strings.Repeat("x", 256<<10))
+	}))
+	defer srv.Close()
+
+	cl := &http.Client{Transport: NewBandwidth(1<<10, nil).Wrap(nil)}
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	rq, _ := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL, nil)
+	res, err := cl.Do(rq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	t0 := time.Now()
+	_, err = io.Copy(io.Discard, res.Body)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("read = %v, want the context's error", err)
+	}
+	if d := time.Since(t0); d > 2*time.Second {
+		t.Errorf("read returned after %s", d)
+	}
+}
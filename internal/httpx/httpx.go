@@ -3,14 +3,17 @@ package httpx
 import (
 	"compress/gzip"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"hash"
 	"hash/fnv"
 	"io"
 	"net/http"
 	"net/url"
 	"os"
-	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
@@ -23,6 +26,7 @@ type RequestOptions struct {
 	MaxBytes     int64
 	Accept       func(int) bool
 	DebugLogPath string
+	OnResponse   func(int, http.Header)
 }
 
 func ualist() []string {
@@ -85,6 +89,9 @@ func DoRequestWithOptions(cl *http.Client, rq *http.Request, op RequestOptions)
 	defer res.Body.Close()
 
 	st := res.StatusCode
+	if op.OnResponse != nil {
+		op.OnResponse(st, res.Header)
+	}
 
 	if op.Accept == nil {
 		op.Accept = func(s int) bool { return s >= 200 && s < 300 }
@@ -144,77 +151,211 @@ func Head(cl *http.Client, raw, ref string) (http.Header, int64, string, int, er
 	return res.Header.Clone(), res.ContentLength, res.Header.Get("Content-Type"), res.StatusCode, nil
 }
 
-func DownloadToFile(cl *http.Client, rq *http.Request, dst string, max int64) (int64, int, error) {
-	if cl == nil || rq == nil {
-		return 0, 0, errors.New("nil client or request")
+// DownloadToPart appends the body to p. When p already holds bytes from an
+// earlier attempt it asks for the rest with Range and If-Range, and starts
+// over when the server no longer has the same file. The caller commits p.
+func DownloadToPart(cl *http.Client, rq *http.Request, p Part, max int64) (int64, int, string, error) {
+	if cl == nil || rq == nil || p == nil {
+		return 0, 0, "", errors.New("nil client, request or part")
 	}
 	stdh(rq)
 	rq.Header.Set("Referer", "https://x.com/")
+
+	pm, have := resumablePart(p, rq.URL.String())
+	if have > 0 {
+		rq = rq.Clone(rq.Context())
+		rq.Header.Set("Range", fmt.Sprintf("bytes=%d-", have))
+		if v := pm.validator(); v != "" {
+			rq.Header.Set("If-Range", v)
+		}
+	}
+
 	res, err := cl.Do(rq)
 	if err != nil {
-		return 0, 0, err
+		return have, 0, "", err
 	}
 	defer res.Body.Close()
-	if res.StatusCode < 200 || res.StatusCode >= 300 {
+
+	st := res.StatusCode
+	total := int64(-1)
+
+	switch {
+	case have > 0 && st == http.StatusPartialContent:
+		start, tot, ok := parseContentRange(res.Header.Get("Content-Range"))
+		if !ok || start != have || (pm.Total > 0 && tot > 0 && tot != pm.Total) {
+			_, _ = io.Copy(io.Discard, res.Body)
+			_ = p.Reset()
+			return 0, st, "", ErrResumeMismatch
+		}
+		total = tot
+	case have > 0 && st == http.StatusRequestedRangeNotSatisfiable:
+		_, _ = io.Copy(io.Discard, res.Body)
+		if pm.Total > 0 && have == pm.Total {
+			return hashPart(p, have, st)
+		}
+		_ = p.Reset()
+		return 0, st, "", ErrResumeMismatch
+	case st < 200 || st >= 300:
+		_, _ = io.Copy(io.Discard, res.Body)
+		return 0, st, "", &StatusError{Status: st, RetryAfter: RetryAfter(res.Header)}
+	default:
+		if have > 0 {
+			if err := p.Reset(); err != nil {
+				_, _ = io.Copy(io.Discard, res.Body)
+				return 0, st, "", err
+			}
+		}
+		have = 0
+		if res.ContentLength >= 0 {
+			total = res.ContentLength
+		}
+	}
+
+	if ct := strings.ToLower(res.Header.Get("Content-Type")); isErrorContentType(ct) {
 		_, _ = io.Copy(io.Discard, res.Body)
-		return 0, res.StatusCode, fmt.Errorf("unacceptable HTTP status: %d", res.StatusCode)
+		return have, st, "", fmt.Errorf("%w: %s", ErrBadContentType, ct)
 	}
-	dir := filepath.Dir(dst)
-	base := filepath.Base(dst)
-	tmp, err := os.CreateTemp(dir, base+".tmp-*")
+
+	_ = savePartMeta(p, partMeta{
+		URL:          rq.URL.String(),
+		ETag:         res.Header.Get("ETag"),
+		LastModified: res.Header.Get("Last-Modified"),
+		Total:        total,
+	})
+
+	var src io.Reader = res.Body
+	if max > 0 {
+		if have >= max {
+			return hashPart(p, have, st)
+		}
+		src = io.LimitReader(res.Body, max-have)
+	}
+	h := sha256.New()
+	if have > 0 {
+		if err := hashPrefix(h, p, have); err != nil {
+			_, _ = io.Copy(io.Discard, res.Body)
+			return have, st, "", err
+		}
+	}
+	n, err := io.Copy(io.MultiWriter(p, h), src)
+	n += have
+	if err != nil {
+		return n, st, "", err
+	}
+	if total > 0 && n < total && (max <= 0 || n < max) {
+		return n, st, "", io.ErrUnexpectedEOF
+	}
+	return n, st, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// DownloadToWriter streams the body into w. Unlike DownloadToPart it cannot
+// resume, so every attempt starts from the first byte.
+func DownloadToWriter(cl *http.Client, rq *http.Request, w io.Writer, max int64) (int64, int, string, error) {
+	if cl == nil || rq == nil {
+		return 0, 0, "", errors.New("nil client or request")
+	}
+	stdh(rq)
+	rq.Header.Set("Referer", "https://x.com/")
+
+	res, err := cl.Do(rq)
 	if err != nil {
+		return 0, 0, "", err
+	}
+	defer res.Body.Close()
+
+	st := res.StatusCode
+	if st < 200 || st >= 300 {
 		_, _ = io.Copy(io.Discard, res.Body)
-		return 0, res.StatusCode, err
+		return 0, st, "", &StatusError{Status: st, RetryAfter: RetryAfter(res.Header)}
 	}
-	tpath := tmp.Name()
+	if ct := strings.ToLower(res.Header.Get("Content-Type")); isErrorContentType(ct) {
+		_, _ = io.Copy(io.Discard, res.Body)
+		return 0, st, "", fmt.Errorf("%w: %s", ErrBadContentType, ct)
+	}
+
 	var src io.Reader = res.Body
 	if max > 0 {
 		src = io.LimitReader(res.Body, max)
 	}
-	n, cerr := io.Copy(tmp, src)
-	clos := tmp.Close()
-	if cerr != nil {
-		_ = os.Remove(tpath)
-		return n, res.StatusCode, cerr
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(w, h), src)
+	if err != nil {
+		return n, st, "", err
 	}
-	if clos != nil {
-		_ = os.Remove(tpath)
-		return n, res.StatusCode, clos
+	if res.ContentLength > 0 && n < res.ContentLength && (max <= 0 || n < max) {
+		return n, st, "", io.ErrUnexpectedEOF
 	}
-	if _, err := os.Stat(dst); err == nil {
-		_ = os.Remove(dst)
+	return n, st, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func DownloadToWriterWithTimeout(cl *http.Client, rq *http.Request, w io.Writer, max int64, per time.Duration) (int64, int, string, error) {
+	if cl == nil || rq == nil {
+		return 0, 0, "", errors.New("nil client or request")
 	}
-	if err := os.Rename(tpath, dst); err == nil {
-		return n, res.StatusCode, nil
+	if per > 0 {
+		ctx, cancel := context.WithTimeout(rq.Context(), per)
+		defer cancel()
+		rq = rq.Clone(ctx)
 	}
-	in, err := os.Open(tpath)
+	return DownloadToWriter(cl, rq, w, max)
+}
+
+func hashPrefix(h hash.Hash, p Part, n int64) error {
+	f, err := p.Open()
 	if err != nil {
-		_ = os.Remove(tpath)
-		return n, res.StatusCode, err
+		return err
 	}
-	defer in.Close()
-	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
-	if err != nil {
-		_ = os.Remove(tpath)
-		return n, res.StatusCode, err
-	}
-	if _, err := io.Copy(out, in); err != nil {
-		out.Close()
-		_ = os.Remove(dst)
-		_ = os.Remove(tpath)
-		return n, res.StatusCode, err
-	}
-	if err := out.Close(); err != nil {
-		_ = os.Remove(dst)
-		_ = os.Remove(tpath)
-		return n, res.StatusCode, err
-	}
-	_ = os.Remove(tpath)
-	return n, res.StatusCode, nil
+	defer f.Close()
+	_, err = io.CopyN(h, f, n)
+	return err
+}
+
+func hashPart(p Part, n int64, st int) (int64, int, string, error) {
+	h := sha256.New()
+	if err := hashPrefix(h, p, n); err != nil {
+		return n, st, "", err
+	}
+	return n, st, hex.EncodeToString(h.Sum(nil)), nil
 }
 
 var ErrNot2xx = errors.New("non-2xx response")
 
+var ErrBadContentType = errors.New("unexpected content type")
+
+func isErrorContentType(ct string) bool {
+	return strings.HasPrefix(ct, "text/html") ||
+		strings.HasPrefix(ct, "application/json") ||
+		strings.HasPrefix(ct, "text/xml") ||
+		strings.HasPrefix(ct, "application/xml")
+}
+
+type StatusError struct {
+	Status     int
+	RetryAfter time.Duration
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("unacceptable HTTP status: %d", e.Status)
+}
+
+func (e *StatusError) Is(target error) bool { return target == ErrNot2xx }
+
+func RetryAfter(h http.Header) time.Duration {
+	v := strings.TrimSpace(h.Get("Retry-After"))
+	if v == "" {
+		return 0
+	}
+	if n, err := strconv.Atoi(v); err == nil && n > 0 {
+		return time.Duration(n) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
+
 func InferExt(ct, raw, mt string) string {
 	l := strings.ToLower(ct)
 	switch {
@@ -231,6 +372,16 @@ func InferExt(ct, raw, mt string) string {
 	case strings.Contains(l, "image/webp"):
 		return "webp"
 	}
+	if i := strings.IndexByte(raw, '?'); i >= 0 {
+		if q, err := url.ParseQuery(raw[i+1:]); err == nil {
+			switch f := strings.ToLower(q.Get("format")); f {
+			case "jpg", "jpeg":
+				return "jpg"
+			case "png", "webp", "gif":
+				return f
+			}
+		}
+	}
 	u := strings.ToLower(strings.Split(raw, "?")[0])
 	switch {
 	case strings.HasSuffix(u, ".mp4"):
@@ -255,9 +406,9 @@ func InferExt(ct, raw, mt string) string {
 	return ""
 }
 
-func DownloadToFileWithTimeout(cl *http.Client, rq *http.Request, dst string, max int64, per time.Duration) (int64, int, error) {
+func DownloadToPartWithTimeout(cl *http.Client, rq *http.Request, p Part, max int64, per time.Duration) (int64, int, string, error) {
 	if cl == nil || rq == nil {
-		return 0, 0, errors.New("nil client or request")
+		return 0, 0, "", errors.New("nil client or request")
 	}
 	ctx := rq.Context()
 	if per > 0 {
@@ -266,5 +417,5 @@ func DownloadToFileWithTimeout(cl *http.Client, rq *http.Request, dst string, ma
 		defer cancel()
 	}
 	rq = rq.Clone(ctx)
-	return DownloadToFile(cl, rq, dst, max)
+	return DownloadToPart(cl, rq, p, max)
 }
@@ -0,0 +1,87 @@
+package httpx
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+)
+
+var ErrResumeMismatch = errors.New("partial download no longer matches the remote file")
+
+type partMeta struct {
+	URL          string `json:"url"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+	Total        int64  `json:"total"`
+}
+
+func (m partMeta) validator() string {
+	if m.ETag != "" && !strings.HasPrefix(m.ETag, "W/") {
+		return m.ETag
+	}
+	return m.LastModified
+}
+
+// Part is an unfinished download that survives between attempts;
+// storage.Part satisfies it. Its tag holds the validator of the response the
+// bytes came from.
+type Part interface {
+	io.Writer
+	Size() int64
+	Tag() string
+	SetTag(tag string) error
+	Reset() error
+	Open() (io.ReadCloser, error)
+}
+
+func savePartMeta(p Part, m partMeta) error {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return p.SetTag(string(b))
+}
+
+// resumablePart returns what p holds of raw, or empties p when its bytes
+// cannot be trusted to continue.
+func resumablePart(p Part, raw string) (partMeta, int64) {
+	var m partMeta
+	have := p.Size()
+	if have <= 0 {
+		return m, 0
+	}
+	if json.Unmarshal([]byte(p.Tag()), &m) != nil || m.URL != raw || m.validator() == "" ||
+		(m.Total > 0 && have > m.Total) {
+		_ = p.Reset()
+		return partMeta{}, 0
+	}
+	return m, have
+}
+
+func parseContentRange(v string) (start, total int64, ok bool) {
+	v = strings.TrimSpace(v)
+	if !strings.HasPrefix(v, "bytes ") {
+		return 0, 0, false
+	}
+	r, t, found := strings.Cut(strings.TrimPrefix(v, "bytes "), "/")
+	if !found {
+		return 0, 0, false
+	}
+	a, _, found := strings.Cut(r, "-")
+	if !found {
+		return 0, 0, false
+	}
+	start, err := strconv.ParseInt(strings.TrimSpace(a), 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	total = -1
+	if t = strings.TrimSpace(t); t != "*" {
+		if total, err = strconv.ParseInt(t, 10, 64); err != nil {
+			return 0, 0, false
+		}
+	}
+	return start, total, true
+}
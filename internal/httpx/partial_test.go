@@ -0,0 +1,244 @@
+package httpx
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParseContentRange(t *testing.T) {
+	tests := []struct {
+		in           string
+		start, total int64
+		ok           bool
+	}{
+		{"bytes 100-199/200", 100, 200, true},
+		{" bytes 0-0/1 ", 0, 1, true},
+		{"bytes 5-9/*", 5, -1, true},
+		{"bytes 7 - 9 / 10", 7, 10, true},
+		{"bytes */200", 0, 0, false},
+		{"items 0-9/10", 0, 0, false},
+		{"bytes 0-9", 0, 0, false},
+		{"bytes 0/10", 0, 0, false},
+		{"bytes x-9/10", 0, 0, false},
+		{"bytes 0-9/ten", 0, 0, false},
+		{"", 0, 0, false},
+	}
+	for _, tt := range tests {
+		start, total, ok := parseContentRange(tt.in)
+		if ok != tt.ok || (ok && (start != tt.start || total != tt.total)) {
+			t.Errorf("parseContentRange(%q) = %d, %d, %v; want %d, %d, %v", tt.in, start, total, ok, tt.start, tt.total, tt.ok)
+		}
+	}
+}
+
+func TestPartMetaValidator(t *testing.T) {
+	tests := []struct {
+		m    partMeta
+		want string
+	}{
+		{partMeta{ETag: `"abc"`, LastModified: "Mon, 02 Jan 2006 15:04:05 GMT"}, `"abc"`},
+		{partMeta{ETag: `W/"abc"`, LastModified: "Mon, 02 Jan 2006 15:04:05 GMT"}, "Mon, 02 Jan 2006 15:04:05 GMT"},
+		{partMeta{ETag: `W/"abc"`}, ""},
+		{partMeta{}, ""},
+	}
+	for _, tt := range tests {
+		if got := tt.m.validator(); got != tt.want {
+			t.Errorf("%+v.validator() = %q, want %q", tt.m, got, tt.want)
+		}
+	}
+}
+
+// memPart is an in-memory Part.
+type memPart struct {
+	b   []byte
+	tag string
+}
+
+func (p *memPart) Write(b []byte) (int, error) { p.b = append(p.b, b...); return len(b), nil }
+func (p *memPart) Size() int64                 { return int64(len(p.b)) }
+func (p *memPart) Tag() string                 { return p.tag }
+func (p *memPart) SetTag(tag string) error     { p.tag = tag; return nil }
+func (p *memPart) Reset() error                { p.b, p.tag = nil, ""; return nil }
+func (p *memPart) Open() (io.ReadCloser, error) {
+	return io.NopCloser(bytes.NewReader(p.b)), nil
+}
+
+func TestDownloadToPart(t *testing.T) {
+	body := []byte(strings.Repeat("0123456789", 100))
+	const etag = `"v1"`
+
+	// serve answers like a CDN: a Range with a matching If-Range gets 206,
+	// anything else the whole body.
+	serve := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Content-Type", "video/mp4")
+		rg := r.Header.Get("Range")
+		if rg == "" || r.Header.Get("If-Range") != etag {
+			w.Write(body)
+			return
+		}
+		var from int
+		fmt.Sscanf(rg, "bytes=%d-", &from)
+		if from >= len(body) {
+			w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", from, len(body)-1, len(body)))
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write(body[from:])
+	}
+
+	tests := []struct {
+		name    string
+		have    int
+		tag     func(u string) partMeta
+		handler http.HandlerFunc
+		max     int64
+		status  int
+		err     error
+		ranged  bool
+		want    []byte
+	}{
+		{name: "fresh", handler: serve, status: 200, want: body},
+		{
+			name:    "resume with If-Range",
+			have:    400,
+			tag:     func(u string) partMeta { return partMeta{URL: u, ETag: etag, Total: int64(len(body))} },
+			handler: serve, status: 206, ranged: true, want: body,
+		},
+		{
+			name:    "validator changed, server sends everything",
+			have:    400,
+			tag:     func(u string) partMeta { return partMeta{URL: u, ETag: `"old"`, Total: int64(len(body))} },
+			handler: serve, status: 200, ranged: true, want: body,
+		},
+		{
+			name:    "other URL starts over",
+			have:    400,
+			tag:     func(string) partMeta { return partMeta{URL: "https://elsewhere/x", ETag: etag} },
+			handler: serve, status: 200, want: body,
+		},
+		{
+			name:    "weak ETag without Last-Modified starts over",
+			have:    400,
+			tag:     func(u string) partMeta { return partMeta{URL: u, ETag: `W/"v1"`} },
+			handler: serve, status: 200, want: body,
+		},
+		{
+			name:    "already complete",
+			have:    len(body),
+			tag:     func(u string) partMeta { return partMeta{URL: u, ETag: etag, Total: int64(len(body))} },
+			handler: serve, status: 416, ranged: true, want: body,
+		},
+		{
+			name: "416 on an unfinished part",
+			have: 400,
+			tag:  func(u string) partMeta { return partMeta{URL: u, ETag: etag, Total: int64(len(body))} },
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+			},
+			status: 416, err: ErrResumeMismatch, ranged: true,
+		},
+		{
+			name: "Content-Range from the wrong offset",
+			have: 400,
+			tag:  func(u string) partMeta { return partMeta{URL: u, ETag: etag, Total: int64(len(body))} },
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Range", fmt.Sprintf("bytes 0-%d/%d", len(body)-1, len(body)))
+				w.WriteHeader(http.StatusPartialContent)
+				w.Write(body)
+			},
+			status: 206, err: ErrResumeMismatch, ranged: true,
+		},
+		{
+			name: "Content-Range with another total",
+			have: 400,
+			tag:  func(u string) partMeta { return partMeta{URL: u, ETag: etag, Total: int64(len(body))} },
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Range", "bytes 400-499/500")
+				w.WriteHeader(http.StatusPartialContent)
+				w.Write(body[400:500])
+			},
+			status: 206, err: ErrResumeMismatch, ranged: true,
+		},
+		{
+			name: "truncated body",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("ETag", etag)
+				w.Header().Set("Content-Length", fmt.Sprint(len(body)))
+				w.Write(body[:300])
+			},
+			status: 200, err: io.ErrUnexpectedEOF, want: body[:300],
+		},
+		{name: "size cap", handler: serve, max: 250, status: 200, want: body[:250]},
+		{
+			name: "error page",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/html; charset=utf-8")
+				w.Write([]byte("<html>"))
+			},
+			status: 200, err: ErrBadContentType,
+		},
+		{
+			name: "not found",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusNotFound)
+			},
+			status: 404, err: ErrNot2xx,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var ranged bool
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				ranged = r.Header.Get("Range") != ""
+				tt.handler(w, r)
+			}))
+			defer srv.Close()
+			u := srv.URL + "/v.mp4"
+
+			p := &memPart{b: append([]byte(nil), body[:tt.have]...)}
+			if tt.tag != nil {
+				b, _ := json.Marshal(tt.tag(u))
+				p.tag = string(b)
+			}
+			rq, _ := http.NewRequest(http.MethodGet, u, nil)
+			n, st, sum, err := DownloadToPart(srv.Client(), rq, p, tt.max)
+
+			if st != tt.status {
+				t.Errorf("status = %d, want %d", st, tt.status)
+			}
+			if ranged != tt.ranged {
+				t.Errorf("sent Range = %v, want %v", ranged, tt.ranged)
+			}
+			if tt.err != nil {
+				if !errors.Is(err, tt.err) {
+					t.Fatalf("err = %v, want %v", err, tt.err)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if tt.want != nil && !bytes.Equal(p.b, tt.want) {
+				t.Errorf("part holds %d bytes, want %d", len(p.b), len(tt.want))
+			}
+			if tt.err == nil {
+				h := sha256.Sum256(tt.want)
+				if n != int64(len(tt.want)) || sum != hex.EncodeToString(h[:]) {
+					t.Errorf("n, sum = %d, %s; want %d and the hash of the content", n, sum, len(tt.want))
+				}
+			}
+			if errors.Is(tt.err, ErrResumeMismatch) && (len(p.b) != 0 || p.tag != "") {
+				t.Error("part not reset after a resume mismatch")
+			}
+		})
+	}
+}
@@ -0,0 +1,149 @@
+package index
+
+import (
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/ghostlawless/xdl/internal/downloader"
+	"github.com/ghostlawless/xdl/internal/utils"
+)
+
+var runSuffix = regexp.MustCompile(`_\d{3,4}$`)
+
+// ImportRun records the items of one run folder under root. Runs with a
+// manifest are imported from it; older runs are read from images/ and videos/.
+func (db *DB) ImportRun(root, dir string) (int, error) {
+	run, err := filepath.Rel(root, dir)
+	if err != nil {
+		run = filepath.Base(dir)
+	}
+	run = filepath.ToSlash(run)
+
+	mf, err := downloader.LoadManifest(downloader.ManifestPath(dir))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return 0, err
+		}
+		return db.importFiles(run, dir), nil
+	}
+
+	u := mf.User
+	if u == "" {
+		u = runSuffix.ReplaceAllString(filepath.Base(dir), "")
+	}
+	n := 0
+	for _, e := range mf.Snapshot() {
+		r := Record{
+			User:    u,
+			UserID:  mf.UserID,
+			Key:     e.Key,
+			TweetID: e.TweetID,
+			MediaID: e.MediaID,
+			Type:    e.Type,
+			URL:     e.URL,
+			SHA256:  e.SHA256,
+			Size:    e.Size,
+			Status:  string(e.Status),
+			Run:     run,
+		}
+		if e.File != "" {
+			r.File = path.Join(run, e.File)
+		}
+		if db.Put(r) {
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (db *DB) importFiles(run, dir string) int {
+	u := runSuffix.ReplaceAllString(path.Base(run), "")
+	n := 0
+	for sub, typ := range map[string]string{"images": "image", "videos": "video"} {
+		_ = filepath.WalkDir(filepath.Join(dir, sub), func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return nil
+			}
+			if d.IsDir() {
+				if strings.HasSuffix(d.Name(), ".hls") {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			ext := filepath.Ext(d.Name())
+			switch strings.ToLower(ext) {
+			case ".jpg", ".jpeg", ".png", ".gif", ".webp", ".mp4", ".ts":
+			default:
+				return nil
+			}
+			fi, err := d.Info()
+			if err != nil {
+				return nil
+			}
+			rel, _ := filepath.Rel(dir, p)
+			id := strings.TrimSuffix(d.Name(), ext)
+			r := Record{
+				User:   u,
+				Key:    "media:" + id,
+				Type:   typ,
+				File:   path.Join(run, filepath.ToSlash(rel)),
+				Size:   fi.Size(),
+				Status: string(downloader.CheckpointDone),
+				Run:    run,
+			}
+			if isDigits(id) {
+				r.MediaID = id
+			}
+			if db.Put(r) {
+				n++
+			}
+			return nil
+		})
+	}
+	return n
+}
+
+// ImportTree imports every run folder found directly under root.
+func (db *DB) ImportTree(root string) (int, int, error) {
+	if downloader.IsRunDir(root) {
+		n, err := db.ImportRun(filepath.Dir(root), root)
+		return 1, n, err
+	}
+	es, err := os.ReadDir(root)
+	if err != nil {
+		return 0, 0, err
+	}
+	runs, n := 0, 0
+	for _, e := range es {
+		if !e.IsDir() || strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		d := filepath.Join(root, e.Name())
+		if !downloader.IsRunDir(d) && !utils.DirExists(filepath.Join(d, "images")) && !utils.DirExists(filepath.Join(d, "videos")) {
+			continue
+		}
+		k, err := db.ImportRun(root, d)
+		if err != nil {
+			return runs, n, err
+		}
+		runs++
+		n += k
+	}
+	return runs, n, nil
+}
+
+func isDigits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
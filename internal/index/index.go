@@ -0,0 +1,271 @@
+package index
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ghostlawless/xdl/internal/scraper"
+	"github.com/ghostlawless/xdl/internal/utils"
+)
+
+const compactSlack = 1000
+
+type Record struct {
+	User      string    `json:"user"`
+	UserID    string    `json:"user_id,omitempty"`
+	Key       string    `json:"key"`
+	TweetID   string    `json:"tweet_id,omitempty"`
+	MediaID   string    `json:"media_id,omitempty"`
+	Type      string    `json:"type"`
+	URL       string    `json:"url,omitempty"`
+	File      string    `json:"file,omitempty"`
+	SHA256    string    `json:"sha256,omitempty"`
+	Size      int64     `json:"size"`
+	Status    string    `json:"status"`
+	Run       string    `json:"run"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func (r Record) id() string {
+	return strings.ToLower(r.User) + "|" + r.Key
+}
+
+func (r Record) Posted() time.Time {
+	if t := scraper.SnowflakeTime(r.TweetID); !t.IsZero() {
+		return t
+	}
+	return scraper.SnowflakeTime(r.MediaID)
+}
+
+func (r Record) same(o Record) bool {
+	r.UpdatedAt, o.UpdatedAt = time.Time{}, time.Time{}
+	return r == o
+}
+
+// DB is an append-only JSON Lines log of records; the last line for a
+// user/key pair wins, and the log is rewritten once stale lines pile up.
+type DB struct {
+	mu      sync.Mutex
+	path    string
+	lines   int
+	recs    map[string]Record
+	pending []Record
+}
+
+func Path(outRoot string) string {
+	return filepath.Join(outRoot, ".xdl", "index.jsonl")
+}
+
+func Open(path string) (*DB, error) {
+	db := &DB{path: path, recs: make(map[string]Record)}
+	f, err := os.Open(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return db, nil
+		}
+		return db, err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	for sc.Scan() {
+		b := bytes.TrimSpace(sc.Bytes())
+		if len(b) == 0 {
+			continue
+		}
+		db.lines++
+		var r Record
+		if json.Unmarshal(b, &r) != nil || r.Key == "" {
+			continue
+		}
+		db.recs[r.id()] = r
+	}
+	return db, sc.Err()
+}
+
+func (db *DB) Len() int {
+	if db == nil {
+		return 0
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return len(db.recs)
+}
+
+func (db *DB) Put(r Record) bool {
+	if db == nil || r.Key == "" {
+		return false
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if o, ok := db.recs[r.id()]; ok && o.same(r) {
+		return false
+	}
+	r.UpdatedAt = time.Now().UTC()
+	db.recs[r.id()] = r
+	db.pending = append(db.pending, r)
+	return true
+}
+
+func (db *DB) Flush() error {
+	if db == nil || db.path == "" {
+		return nil
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if len(db.pending) == 0 {
+		return nil
+	}
+	if db.lines+len(db.pending) > 2*len(db.recs)+compactSlack {
+		return db.compactLocked()
+	}
+	if err := utils.EnsureDir(filepath.Dir(db.path)); err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, r := range db.pending {
+		if err := enc.Encode(r); err != nil {
+			return err
+		}
+	}
+	f, err := os.OpenFile(db.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	db.lines += len(db.pending)
+	db.pending = db.pending[:0]
+	return nil
+}
+
+func (db *DB) compactLocked() error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, r := range db.sortedLocked() {
+		if err := enc.Encode(r); err != nil {
+			return err
+		}
+	}
+	if err := utils.SaveToFile(db.path, buf.Bytes()); err != nil {
+		return err
+	}
+	db.lines = len(db.recs)
+	db.pending = db.pending[:0]
+	return nil
+}
+
+func (db *DB) sortedLocked() []Record {
+	out := make([]Record, 0, len(db.recs))
+	for _, r := range db.recs {
+		out = append(out, r)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		a, b := out[i], out[j]
+		if !strings.EqualFold(a.User, b.User) {
+			return strings.ToLower(a.User) < strings.ToLower(b.User)
+		}
+		if ta, tb := a.Posted(), b.Posted(); !ta.Equal(tb) {
+			return ta.Before(tb)
+		}
+		return a.Key < b.Key
+	})
+	return out
+}
+
+type Query struct {
+	User   string
+	Type   string
+	Status string
+	Since  time.Time
+	Until  time.Time
+}
+
+func (q Query) match(r Record) bool {
+	if q.User != "" && !strings.EqualFold(strings.TrimPrefix(q.User, "@"), r.User) {
+		return false
+	}
+	if q.Type != "" && !strings.EqualFold(q.Type, r.Type) {
+		return false
+	}
+	if q.Status != "" && !strings.EqualFold(q.Status, r.Status) {
+		return false
+	}
+	if !q.Since.IsZero() || !q.Until.IsZero() {
+		t := r.Posted()
+		if t.IsZero() {
+			return false
+		}
+		if !q.Since.IsZero() && t.Before(q.Since) {
+			return false
+		}
+		if !q.Until.IsZero() && !t.Before(q.Until) {
+			return false
+		}
+	}
+	return true
+}
+
+func (db *DB) Find(q Query) []Record {
+	if db == nil {
+		return nil
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	all := db.sortedLocked()
+	out := all[:0]
+	for _, r := range all {
+		if q.match(r) {
+			out = append(out, r)
+		}
+	}
+	return out
+}
+
+type Stat struct {
+	Items int
+	Bytes int64
+}
+
+type Stats struct {
+	Total    Stat
+	ByUser   map[string]Stat
+	ByType   map[string]Stat
+	ByStatus map[string]Stat
+}
+
+func (db *DB) Stats(q Query) Stats {
+	s := Stats{
+		ByUser:   make(map[string]Stat),
+		ByType:   make(map[string]Stat),
+		ByStatus: make(map[string]Stat),
+	}
+	add := func(m map[string]Stat, k string, n int64) {
+		v := m[k]
+		v.Items++
+		v.Bytes += n
+		m[k] = v
+	}
+	for _, r := range db.Find(q) {
+		s.Total.Items++
+		s.Total.Bytes += r.Size
+		add(s.ByUser, r.User, r.Size)
+		add(s.ByType, r.Type, r.Size)
+		add(s.ByStatus, r.Status, r.Size)
+	}
+	return s
+}
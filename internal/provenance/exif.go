@@ -0,0 +1,255 @@
+package provenance
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sort"
+)
+
+const (
+	tiffASCII     = 2
+	tiffLong      = 4
+	tiffUndefined = 7
+
+	tagImageDescription = 0x010E
+	tagOrientation      = 0x0112
+	tagDateTime         = 0x0132
+	tagArtist           = 0x013B
+	tagExifIFD          = 0x8769
+	tagGPSIFD           = 0x8825
+	tagDateTimeOriginal = 0x9003
+	tagUserComment      = 0x9286
+	tagInteropIFD       = 0xA005
+
+	maxIFDTags = 512
+)
+
+// tiffSizes is the byte size of one value of each TIFF type.
+var tiffSizes = [...]uint32{1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 6: 1, 7: 1, 8: 2, 9: 4, 10: 8, 11: 4, 12: 8, 13: 4}
+
+// subIFDs are the pointer tags whose IFD is carried over from an existing
+// block. Other tags holding offsets (strips, thumbnails, maker notes) cannot
+// be moved safely and are dropped.
+var subIFDs = map[uint16]bool{tagExifIFD: true, tagGPSIFD: true, tagInteropIFD: true}
+
+var offsetTags = map[uint16]bool{0x0111: true, 0x0117: true, 0x0144: true, 0x0145: true, 0x0201: true, 0x0202: true, 0x927C: true}
+
+// tiffTag holds its value in the byte order of the block it is written to;
+// sub is the IFD a pointer tag leads to.
+type tiffTag struct {
+	id  uint16
+	typ uint16
+	val []byte
+	sub []tiffTag
+}
+
+func asciiTag(id uint16, s string) tiffTag {
+	return tiffTag{id: id, typ: tiffASCII, val: append([]byte(s), 0)}
+}
+
+func (t tiffTag) count() uint32 {
+	if int(t.typ) < len(tiffSizes) && tiffSizes[t.typ] > 0 {
+		return uint32(len(t.val)) / tiffSizes[t.typ]
+	}
+	return uint32(len(t.val))
+}
+
+func ifdSize(ts []tiffTag) uint32 {
+	n := uint32(2 + 12*len(ts) + 4)
+	for _, t := range ts {
+		if len(t.val) > 4 {
+			n += uint32(len(t.val)+1) &^ 1
+		}
+	}
+	return n
+}
+
+// treeSize is the size of an IFD and of the IFDs below it.
+func treeSize(ts []tiffTag) uint32 {
+	n := ifdSize(ts)
+	for _, t := range ts {
+		if t.sub != nil {
+			n += treeSize(t.sub)
+		}
+	}
+	return n
+}
+
+// writeTree appends the IFD ts at offset off followed by its sub-IFDs,
+// pointing each pointer tag at its own.
+func writeTree(b *bytes.Buffer, bo binary.ByteOrder, off uint32, ts []tiffTag) {
+	sort.Slice(ts, func(i, j int) bool { return ts[i].id < ts[j].id })
+	next := off + ifdSize(ts)
+	for i := range ts {
+		if ts[i].sub != nil {
+			ts[i].val = make([]byte, 4)
+			bo.PutUint32(ts[i].val, next)
+			next += treeSize(ts[i].sub)
+		}
+	}
+	writeIFD(b, bo, off, ts)
+	for _, t := range ts {
+		if t.sub != nil {
+			writeTree(b, bo, uint32(b.Len()), t.sub)
+		}
+	}
+}
+
+// writeIFD appends one IFD at offset off from the TIFF header, with the
+// values that do not fit in an entry stored right after it.
+func writeIFD(b *bytes.Buffer, bo binary.ByteOrder, off uint32, ts []tiffTag) {
+	data := off + uint32(2+12*len(ts)+4)
+	var tail bytes.Buffer
+	var e [12]byte
+	_ = binary.Write(b, bo, uint16(len(ts)))
+	for _, t := range ts {
+		bo.PutUint16(e[0:], t.id)
+		bo.PutUint16(e[2:], t.typ)
+		bo.PutUint32(e[4:], t.count())
+		clear(e[8:])
+		if len(t.val) <= 4 {
+			copy(e[8:], t.val)
+		} else {
+			bo.PutUint32(e[8:], data+uint32(tail.Len()))
+			tail.Write(t.val)
+			if tail.Len()%2 == 1 {
+				tail.WriteByte(0)
+			}
+		}
+		b.Write(e[:])
+	}
+	_ = binary.Write(b, bo, uint32(0))
+	b.Write(tail.Bytes())
+}
+
+// parseTIFF reads IFD0 of an existing Exif block with the sub-IFDs it
+// points to; the thumbnail IFD that may follow is not kept.
+func parseTIFF(b []byte) (binary.ByteOrder, []tiffTag, bool) {
+	var bo binary.ByteOrder
+	switch {
+	case bytes.HasPrefix(b, []byte("II*\x00")):
+		bo = binary.LittleEndian
+	case bytes.HasPrefix(b, []byte("MM\x00*")):
+		bo = binary.BigEndian
+	default:
+		return nil, nil, false
+	}
+	if len(b) < 8 {
+		return nil, nil, false
+	}
+	ts, ok := readIFD(b, bo, bo.Uint32(b[4:]), 0)
+	return bo, ts, ok
+}
+
+func readIFD(b []byte, bo binary.ByteOrder, off uint32, depth int) ([]tiffTag, bool) {
+	if depth > 2 || uint64(off)+2 > uint64(len(b)) {
+		return nil, false
+	}
+	n := int(bo.Uint16(b[off:]))
+	if n > maxIFDTags || int(off)+2+12*n > len(b) {
+		return nil, false
+	}
+	ts := make([]tiffTag, 0, n)
+	for i := 0; i < n; i++ {
+		e := b[int(off)+2+12*i:]
+		t := tiffTag{id: bo.Uint16(e), typ: bo.Uint16(e[2:])}
+		if offsetTags[t.id] || int(t.typ) >= len(tiffSizes) || tiffSizes[t.typ] == 0 {
+			continue
+		}
+		size := uint64(bo.Uint32(e[4:])) * uint64(tiffSizes[t.typ])
+		if size <= 4 {
+			t.val = append([]byte(nil), e[8:8+size]...)
+		} else {
+			p := uint64(bo.Uint32(e[8:]))
+			if p+size > uint64(len(b)) {
+				return nil, false
+			}
+			t.val = append([]byte(nil), b[p:p+size]...)
+		}
+		if subIFDs[t.id] {
+			if len(t.val) != 4 {
+				continue
+			}
+			sub, ok := readIFD(b, bo, bo.Uint32(t.val), depth+1)
+			if !ok {
+				continue
+			}
+			t.typ, t.sub = tiffLong, sub
+			if t.sub == nil {
+				t.sub = []tiffTag{}
+			}
+		}
+		ts = append(ts, t)
+	}
+	return ts, true
+}
+
+// setTag replaces the tag with t's id in ts, or adds t.
+func setTag(ts []tiffTag, t tiffTag) []tiffTag {
+	for i := range ts {
+		if ts[i].id == t.id {
+			ts[i] = t
+			return ts
+		}
+	}
+	return append(ts, t)
+}
+
+// buildEXIF returns a TIFF block with the description, artist and dates in
+// IFD0 and the source URL as the Exif UserComment. The tags of old, an
+// existing block, are kept unless replaced, in old's byte order; a block
+// that cannot be read yields ok false so that the caller can keep it as is.
+func buildEXIF(in Info, old []byte) ([]byte, bool) {
+	var ifd0, sub []tiffTag
+	if in.Text != "" {
+		ifd0 = append(ifd0, asciiTag(tagImageDescription, clip(in.Text)))
+	}
+	if a := author(in); a != "" {
+		ifd0 = append(ifd0, asciiTag(tagArtist, a))
+	}
+	if !in.Created.IsZero() {
+		d := exifDate(in.Created)
+		ifd0 = append(ifd0, asciiTag(tagDateTime, d))
+		sub = append(sub, asciiTag(tagDateTimeOriginal, d))
+	}
+	if in.URL != "" {
+		sub = append(sub, tiffTag{id: tagUserComment, typ: tiffUndefined, val: append([]byte("ASCII\x00\x00\x00"), in.URL...)})
+	}
+
+	var bo binary.ByteOrder = binary.LittleEndian
+	var ts []tiffTag
+	if len(old) > 0 {
+		b, t, ok := parseTIFF(old)
+		if !ok {
+			return nil, false
+		}
+		bo, ts = b, t
+	}
+	for _, t := range ifd0 {
+		ts = setTag(ts, t)
+	}
+	if len(sub) > 0 {
+		ex := tiffTag{id: tagExifIFD, typ: tiffLong, sub: []tiffTag{}}
+		for _, t := range ts {
+			if t.id == tagExifIFD {
+				ex = t
+			}
+		}
+		for _, t := range sub {
+			ex.sub = setTag(ex.sub, t)
+		}
+		ts = setTag(ts, ex)
+	}
+	if len(ts) == 0 {
+		return nil, true
+	}
+	var b bytes.Buffer
+	if bo == binary.LittleEndian {
+		b.WriteString("II*\x00")
+	} else {
+		b.WriteString("MM\x00*")
+	}
+	_ = binary.Write(&b, bo, uint32(8))
+	writeTree(&b, bo, 8, ts)
+	return b.Bytes(), true
+}
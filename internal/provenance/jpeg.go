@@ -0,0 +1,122 @@
+package provenance
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+var (
+	jpegSOI    = []byte{0xFF, 0xD8}
+	exifHeader = []byte("Exif\x00\x00")
+	xmpHeader  = []byte("http://ns.adobe.com/xap/1.0/\x00")
+)
+
+const (
+	jpegAPP0   = 0xE0
+	jpegAPP1   = 0xE1
+	jpegSOS    = 0xDA
+	maxSegment = 0xFFFF - 2
+)
+
+var errBadJPEG = errors.New("malformed jpeg")
+
+// embedJPEG replaces any Exif and XMP APP1 segments with new ones placed
+// after SOI and JFIF. The new Exif keeps the tags of the first existing one,
+// such as Orientation; one that cannot be read is kept unchanged. Everything
+// from the first SOS on is copied unchanged.
+func embedJPEG(b []byte, in Info) ([]byte, error) {
+	var head, rest [][]byte
+	var exif []byte
+	i := 2
+	for {
+		for i+1 < len(b) && b[i] == 0xFF && b[i+1] == 0xFF {
+			i++
+		}
+		if i+4 > len(b) || b[i] != 0xFF {
+			return nil, errBadJPEG
+		}
+		m := b[i+1]
+		if m == jpegSOS {
+			break
+		}
+		if m == 0x01 || (m >= 0xD0 && m <= 0xD7) {
+			rest = append(rest, b[i:i+2])
+			i += 2
+			continue
+		}
+		n := int(binary.BigEndian.Uint16(b[i+2:]))
+		if n < 2 || i+2+n > len(b) {
+			return nil, errBadJPEG
+		}
+		seg := b[i : i+2+n]
+		body := seg[4:]
+		i += 2 + n
+		switch {
+		case m == jpegAPP1 && bytes.HasPrefix(body, exifHeader):
+			if exif == nil {
+				exif = seg
+			}
+		case m == jpegAPP1 && bytes.HasPrefix(body, xmpHeader):
+		case m == jpegAPP0 && len(rest) == 0:
+			head = append(head, seg)
+		default:
+			rest = append(rest, seg)
+		}
+	}
+
+	x, err := fitXMP(in, maxSegment-len(xmpHeader))
+	if err != nil {
+		return nil, err
+	}
+	var o bytes.Buffer
+	o.Grow(len(b) + len(x) + 1024)
+	o.Write(jpegSOI)
+	for _, s := range head {
+		o.Write(s)
+	}
+	var old []byte
+	if exif != nil {
+		old = exif[4+len(exifHeader):]
+	}
+	switch e, ok := buildEXIF(in, old); {
+	case !ok || len(exifHeader)+len(e) > maxSegment:
+		o.Write(exif)
+	case e != nil:
+		writeSegment(&o, jpegAPP1, exifHeader, e)
+	}
+	writeSegment(&o, jpegAPP1, xmpHeader, x)
+	for _, s := range rest {
+		o.Write(s)
+	}
+	o.Write(b[i:])
+	return o.Bytes(), nil
+}
+
+func writeSegment(o *bytes.Buffer, m byte, hdr, body []byte) {
+	o.WriteByte(0xFF)
+	o.WriteByte(m)
+	_ = binary.Write(o, binary.BigEndian, uint16(2+len(hdr)+len(body)))
+	o.Write(hdr)
+	o.Write(body)
+}
+
+// fitXMP shortens the text fields until the packet fits in max bytes.
+func fitXMP(in Info, max int) ([]byte, error) {
+	for {
+		x := xmpPacket(in)
+		if len(x) <= max {
+			return x, nil
+		}
+		if in.Text == "" && in.Alt == "" {
+			return nil, errors.New("xmp packet too large")
+		}
+		in.Text = half(in.Text)
+		in.Alt = half(in.Alt)
+	}
+}
+
+func half(s string) string {
+	r := []rune(s)
+	return string(r[:len(r)/2])
+}
@@ -0,0 +1,377 @@
+package provenance
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+var errBadMP4 = errors.New("malformed mp4")
+
+const maxBoxRead = 64 << 20
+
+type mp4Box struct {
+	typ  string
+	off  int64
+	hdr  int64
+	size int64
+}
+
+func (b mp4Box) end() int64 { return b.off + b.size }
+
+// readBoxes lists the boxes in r between off and end.
+func readBoxes(r io.ReaderAt, off, end int64) ([]mp4Box, error) {
+	var out []mp4Box
+	var h [16]byte
+	for off+8 <= end {
+		if _, err := r.ReadAt(h[:8], off); err != nil {
+			return nil, err
+		}
+		bx := mp4Box{typ: string(h[4:8]), off: off, hdr: 8, size: int64(binary.BigEndian.Uint32(h[:4]))}
+		switch bx.size {
+		case 0:
+			bx.size = end - off
+		case 1:
+			if _, err := r.ReadAt(h[8:16], off+8); err != nil {
+				return nil, err
+			}
+			bx.hdr = 16
+			bx.size = int64(binary.BigEndian.Uint64(h[8:16]))
+		}
+		if bx.size < bx.hdr || bx.end() > end {
+			return nil, errBadMP4
+		}
+		out = append(out, bx)
+		off = bx.end()
+	}
+	return out, nil
+}
+
+func readBox(r io.ReaderAt, bx mp4Box) ([]byte, error) {
+	if bx.size > maxBoxRead {
+		return nil, fmt.Errorf("%s box too large (%d bytes)", bx.typ, bx.size)
+	}
+	b := make([]byte, bx.size)
+	_, err := r.ReadAt(b, bx.off)
+	return b, err
+}
+
+func mkBox(typ string, parts ...[]byte) []byte {
+	n := 8
+	for _, p := range parts {
+		n += len(p)
+	}
+	b := make([]byte, 8, n)
+	binary.BigEndian.PutUint32(b, uint32(n))
+	copy(b[4:], typ)
+	for _, p := range parts {
+		b = append(b, p...)
+	}
+	return b
+}
+
+func u32(v uint32) []byte {
+	return binary.BigEndian.AppendUint32(nil, v)
+}
+
+func textAtom(typ, s string) []byte {
+	return mkBox(typ, mkBox("data", u32(1), u32(0), []byte(s)))
+}
+
+func freeformAtom(name, s string) []byte {
+	return mkBox("----",
+		mkBox("mean", u32(0), []byte("com.apple.iTunes")),
+		mkBox("name", u32(0), []byte(name)),
+		mkBox("data", u32(1), u32(0), []byte(s)),
+	)
+}
+
+// ilstMeta builds udta/meta with an iTunes-style ilst, which players and
+// asset managers read as title, artist, date and comment.
+func ilstMeta(in Info) []byte {
+	var items [][]byte
+	if in.Text != "" {
+		items = append(items, textAtom("\xa9nam", title(in.Text)), textAtom("desc", title(in.Text)), textAtom("ldes", clip(in.Text)))
+	}
+	if a := author(in); a != "" {
+		items = append(items, textAtom("\xa9ART", a))
+	}
+	if !in.Created.IsZero() {
+		items = append(items, textAtom("\xa9day", in.Created.UTC().Format(time.RFC3339)))
+	}
+	if in.URL != "" {
+		items = append(items, textAtom("\xa9cmt", in.URL))
+	}
+	if in.TweetID != "" {
+		items = append(items, freeformAtom("TWEET_ID", in.TweetID))
+	}
+	if in.MediaID != "" {
+		items = append(items, freeformAtom("MEDIA_ID", in.MediaID))
+	}
+	if in.Alt != "" {
+		items = append(items, freeformAtom("ALT_TEXT", clip(in.Alt)))
+	}
+	hdlr := mkBox("hdlr", u32(0), u32(0), []byte("mdirappl"), make([]byte, 9))
+	return mkBox("meta", u32(0), hdlr, mkBox("ilst", items...))
+}
+
+// title is the first line of the tweet, cut to 255 bytes.
+func title(s string) string {
+	if i := bytes.IndexByte([]byte(s), '\n'); i >= 0 {
+		s = s[:i]
+	}
+	for len(s) > 255 {
+		s = half(s)
+	}
+	return s
+}
+
+// rebuildMoov returns moov with udta/meta replaced by meta.
+func rebuildMoov(moov []byte, hdr int64, meta []byte) ([]byte, error) {
+	r := bytes.NewReader(moov)
+	kids, err := readBoxes(r, hdr, int64(len(moov)))
+	if err != nil {
+		return nil, err
+	}
+	var out [][]byte
+	done := false
+	for _, k := range kids {
+		b := moov[k.off:k.end()]
+		if k.typ != "udta" {
+			out = append(out, b)
+			continue
+		}
+		uk, err := readBoxes(r, k.off+k.hdr, k.end())
+		if err != nil {
+			return nil, err
+		}
+		var parts [][]byte
+		for _, u := range uk {
+			if u.typ != "meta" {
+				parts = append(parts, moov[u.off:u.end()])
+			}
+		}
+		parts = append(parts, meta)
+		out = append(out, mkBox("udta", parts...))
+		done = true
+	}
+	if !done {
+		out = append(out, mkBox("udta", meta))
+	}
+	return mkBox("moov", out...), nil
+}
+
+// shiftOffsets adds d to every absolute file offset in b (a moov, moof or
+// mfra box) that points at or after from.
+func shiftOffsets(b []byte, from, d int64) error {
+	if d == 0 {
+		return nil
+	}
+	r := bytes.NewReader(b)
+	var walk func(off, end int64) error
+	walk = func(off, end int64) error {
+		kids, err := readBoxes(r, off, end)
+		if err != nil {
+			return err
+		}
+		for _, k := range kids {
+			p := b[k.off+k.hdr : k.end()]
+			switch k.typ {
+			case "moov", "trak", "mdia", "minf", "stbl", "moof", "traf", "mfra":
+				if err := walk(k.off+k.hdr, k.end()); err != nil {
+					return err
+				}
+			case "stco":
+				if len(p) < 8 {
+					return errBadMP4
+				}
+				n := int(binary.BigEndian.Uint32(p[4:]))
+				if len(p) < 8+4*n {
+					return errBadMP4
+				}
+				for i := 0; i < n; i++ {
+					q := p[8+4*i:]
+					v := int64(binary.BigEndian.Uint32(q))
+					if v >= from {
+						if v+d > 1<<32-1 {
+							return errors.New("chunk offset overflows stco")
+						}
+						binary.BigEndian.PutUint32(q, uint32(v+d))
+					}
+				}
+			case "co64":
+				if len(p) < 8 {
+					return errBadMP4
+				}
+				n := int(binary.BigEndian.Uint32(p[4:]))
+				if len(p) < 8+8*n {
+					return errBadMP4
+				}
+				for i := 0; i < n; i++ {
+					shift64(p[8+8*i:], from, d)
+				}
+			case "tfhd":
+				if len(p) >= 16 && binary.BigEndian.Uint32(p)&1 != 0 {
+					shift64(p[8:], from, d)
+				}
+			case "tfra":
+				if err := shiftTfra(p, from, d); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	return walk(0, int64(len(b)))
+}
+
+func shift64(q []byte, from, d int64) {
+	if v := int64(binary.BigEndian.Uint64(q)); v >= from {
+		binary.BigEndian.PutUint64(q, uint64(v+d))
+	}
+}
+
+func shiftTfra(p []byte, from, d int64) error {
+	if len(p) < 16 {
+		return errBadMP4
+	}
+	v1 := p[0] == 1
+	ls := binary.BigEndian.Uint32(p[8:])
+	n := int(binary.BigEndian.Uint32(p[12:]))
+	w := 4
+	if v1 {
+		w = 8
+	}
+	ent := 2*w + int(ls>>4&3+1) + int(ls>>2&3+1) + int(ls&3+1)
+	if len(p) < 16+ent*n {
+		return errBadMP4
+	}
+	for i := 0; i < n; i++ {
+		q := p[16+ent*i+w:]
+		if v1 {
+			shift64(q, from, d)
+			continue
+		}
+		if v := int64(binary.BigEndian.Uint32(q)); v >= from {
+			if v+d > 1<<32-1 {
+				return errors.New("fragment offset overflows tfra")
+			}
+			binary.BigEndian.PutUint32(q, uint32(v+d))
+		}
+	}
+	return nil
+}
+
+// embedMP4 rewrites moov with new metadata and streams every other box.
+// moov stays where it was, so fast-start files stay fast-start; offsets that
+// point past it are moved by the size change, unless a following free box
+// can absorb it.
+func embedMP4(p string, in Info) error {
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	top, err := readBoxes(f, 0, fi.Size())
+	if err != nil {
+		return err
+	}
+	mi := -1
+	for i, bx := range top {
+		if bx.typ == "moov" {
+			if mi >= 0 {
+				return errBadMP4
+			}
+			mi = i
+		}
+	}
+	if mi < 0 {
+		return errBadMP4
+	}
+	old, err := readBox(f, top[mi])
+	if err != nil {
+		return err
+	}
+	moov, err := rebuildMoov(old, top[mi].hdr, ilstMeta(in))
+	if err != nil {
+		return err
+	}
+	d := int64(len(moov)) - top[mi].size
+
+	// A free box right after moov can take up the growth.
+	var pad []byte
+	skip := -1
+	if mi+1 < len(top) && (top[mi+1].typ == "free" || top[mi+1].typ == "skip") {
+		if rest := top[mi+1].size - d; rest == 0 || rest >= 8 {
+			skip = mi + 1
+			if rest > 0 {
+				pad = mkBox("free", make([]byte, rest-8))
+			}
+			d = 0
+		}
+	}
+
+	from := top[mi].end()
+	if err := shiftOffsets(moov, from, d); err != nil {
+		return err
+	}
+
+	tmp := p + ".meta"
+	w, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, fi.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	err = writeMP4(w, f, top, mi, skip, moov, pad, from, d)
+	if cerr := w.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	f.Close()
+	if err := os.Rename(tmp, p); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+func writeMP4(w io.Writer, f *os.File, top []mp4Box, mi, skip int, moov, pad []byte, from, d int64) error {
+	for i, bx := range top {
+		switch {
+		case i == mi:
+			if _, err := w.Write(moov); err != nil {
+				return err
+			}
+		case i == skip:
+			if _, err := w.Write(pad); err != nil {
+				return err
+			}
+		case d != 0 && (bx.typ == "moof" || bx.typ == "mfra"):
+			b, err := readBox(f, bx)
+			if err != nil {
+				return err
+			}
+			if err := shiftOffsets(b, from, d); err != nil {
+				return err
+			}
+			if _, err := w.Write(b); err != nil {
+				return err
+			}
+		default:
+			if _, err := io.Copy(w, io.NewSectionReader(f, bx.off, bx.size)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,239 @@
+package provenance
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func u64(v uint64) []byte {
+	return binary.BigEndian.AppendUint64(nil, v)
+}
+
+func stco(vs ...uint32) []byte {
+	parts := [][]byte{u32(0), u32(uint32(len(vs)))}
+	for _, v := range vs {
+		parts = append(parts, u32(v))
+	}
+	return mkBox("stco", parts...)
+}
+
+func co64(vs ...uint64) []byte {
+	parts := [][]byte{u32(0), u32(uint32(len(vs)))}
+	for _, v := range vs {
+		parts = append(parts, u64(v))
+	}
+	return mkBox("co64", parts...)
+}
+
+// tfhd with the base-data-offset flag when base is set.
+func tfhd(base uint64, set bool) []byte {
+	if !set {
+		return mkBox("tfhd", u32(0), u32(1))
+	}
+	return mkBox("tfhd", u32(1), u32(1), u64(base))
+}
+
+// tfra with one-byte traf, trun and sample numbers.
+func tfra(v1 bool, offs ...uint64) []byte {
+	ver := u32(0)
+	if v1 {
+		ver = u32(1 << 24)
+	}
+	parts := [][]byte{ver, u32(1), u32(0), u32(uint32(len(offs)))}
+	for i, o := range offs {
+		if v1 {
+			parts = append(parts, u64(uint64(i)), u64(o))
+		} else {
+			parts = append(parts, u32(uint32(i)), u32(uint32(o)))
+		}
+		parts = append(parts, []byte{1, 1, 1})
+	}
+	return mkBox("tfra", parts...)
+}
+
+func moovWith(table []byte) []byte {
+	return mkBox("moov", mkBox("trak", mkBox("mdia", mkBox("minf", mkBox("stbl", table)))))
+}
+
+// offsets reads back the offsets of the first stco, co64, tfhd or tfra in b.
+func offsets(t *testing.T, b []byte) []uint64 {
+	t.Helper()
+	be := binary.BigEndian
+	for _, typ := range []string{"stco", "co64", "tfhd", "tfra"} {
+		i := bytes.Index(b, []byte(typ))
+		if i < 0 {
+			continue
+		}
+		p := b[i+4:]
+		var out []uint64
+		switch typ {
+		case "stco":
+			for k := 0; k < int(be.Uint32(p[4:])); k++ {
+				out = append(out, uint64(be.Uint32(p[8+4*k:])))
+			}
+		case "co64":
+			for k := 0; k < int(be.Uint32(p[4:])); k++ {
+				out = append(out, be.Uint64(p[8+8*k:]))
+			}
+		case "tfhd":
+			if be.Uint32(p)&1 != 0 {
+				out = append(out, be.Uint64(p[8:]))
+			}
+		case "tfra":
+			v1 := p[0] == 1
+			w := 4
+			if v1 {
+				w = 8
+			}
+			for k := 0; k < int(be.Uint32(p[12:])); k++ {
+				q := p[16+(2*w+3)*k+w:]
+				if v1 {
+					out = append(out, be.Uint64(q))
+				} else {
+					out = append(out, uint64(be.Uint32(q)))
+				}
+			}
+		}
+		return out
+	}
+	return nil
+}
+
+func TestShiftOffsets(t *testing.T) {
+	tests := []struct {
+		name string
+		box  []byte
+		from int64
+		d    int64
+		want []uint64
+		err  bool
+	}{
+		{"stco grows", moovWith(stco(100, 1000, 9000)), 1000, 50, []uint64{100, 1050, 9050}, false},
+		{"stco shrinks", moovWith(stco(100, 1000, 9000)), 1000, -40, []uint64{100, 960, 8960}, false},
+		{"no change", moovWith(stco(100, 1000)), 0, 0, []uint64{100, 1000}, false},
+		{"stco overflow", moovWith(stco(1<<32 - 10)), 0, 20, nil, true},
+		{"co64", moovWith(co64(10, 1<<33, 1<<40)), 1 << 32, 100, []uint64{10, 1<<33 + 100, 1<<40 + 100}, false},
+		{"tfhd with base offset", mkBox("moof", mkBox("traf", tfhd(5000, true))), 4000, 64, []uint64{5064}, false},
+		{"tfhd before from", mkBox("moof", mkBox("traf", tfhd(3000, true))), 4000, 64, []uint64{3000}, false},
+		{"tfhd without base offset", mkBox("moof", mkBox("traf", tfhd(0, false))), 0, 64, nil, false},
+		{"tfra v0", mkBox("mfra", tfra(false, 2000, 8000)), 4000, 16, []uint64{2000, 8016}, false},
+		{"tfra v1", mkBox("mfra", tfra(true, 2000, 1<<35)), 4000, 16, []uint64{2000, 1<<35 + 16}, false},
+		{"tfra v0 overflow", mkBox("mfra", tfra(false, 1<<32-1)), 0, 1, nil, true},
+		{"outside sample tables", mkBox("moov", mkBox("udta", stco(5000))), 0, 50, []uint64{5000}, false},
+		{"truncated stco", moovWith(mkBox("stco", u32(0), u32(3), u32(1))), 0, 8, nil, true},
+		{"truncated tfra", mkBox("mfra", mkBox("tfra", u32(0), u32(1))), 0, 8, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := append([]byte(nil), tt.box...)
+			err := shiftOffsets(b, tt.from, tt.d)
+			if tt.err {
+				if err == nil {
+					t.Fatal("shiftOffsets succeeded, want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := offsets(t, b); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("offsets = %v, want %v", got, tt.want)
+			}
+			if len(b) != len(tt.box) {
+				t.Errorf("box size changed from %d to %d", len(tt.box), len(b))
+			}
+		})
+	}
+}
+
+// testMP4 lays out ftyp, moov (optionally followed by free) and mdat, with
+// the sample table pointing at the mdat payload.
+func testMP4(free int) ([]byte, []byte) {
+	payload := []byte("sample-data-0123456789")
+	ftyp := mkBox("ftyp", []byte("isom"), u32(0), []byte("isomiso2mp41"))
+	var tail []byte
+	if free > 0 {
+		tail = mkBox("free", make([]byte, free-8))
+	}
+	// Size the moov first, then point stco past it and mdat's header.
+	moov := moovWith(stco(0))
+	at := uint32(len(ftyp) + len(moov) + len(tail) + 8)
+	moov = moovWith(stco(at))
+	out := append(append(append(ftyp, moov...), tail...), mkBox("mdat", payload)...)
+	return out, payload
+}
+
+func TestEmbedMP4(t *testing.T) {
+	tests := []struct {
+		name  string
+		free  int
+		moved bool
+	}{
+		{"moov grows and mdat moves", 0, true},
+		{"free box absorbs the growth", 4096, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src, payload := testMP4(tt.free)
+			p := filepath.Join(t.TempDir(), "v.mp4")
+			if err := os.WriteFile(p, src, 0o644); err != nil {
+				t.Fatal(err)
+			}
+			if err := Embed(p, testInfo); err != nil {
+				t.Fatal(err)
+			}
+			b, _ := os.ReadFile(p)
+			top, err := readBoxes(bytes.NewReader(b), 0, int64(len(b)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var moov []byte
+			for _, bx := range top {
+				if bx.typ == "moov" {
+					moov = b[bx.off:bx.end()]
+				}
+			}
+			if !bytes.Contains(moov, []byte("ilst")) || !bytes.Contains(moov, []byte(testInfo.URL)) {
+				t.Fatal("moov has no ilst metadata")
+			}
+			offs := offsets(t, moov)
+			if len(offs) != 1 || !bytes.HasPrefix(b[offs[0]:], payload) {
+				t.Fatalf("stco = %v no longer points at the samples", offs)
+			}
+			if moved := len(b) != len(src); moved != tt.moved {
+				t.Errorf("file size changed = %v, want %v", moved, tt.moved)
+			}
+		})
+	}
+}
+
+func TestEmbedMP4Malformed(t *testing.T) {
+	ftyp := mkBox("ftyp", []byte("isom"), u32(0))
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"no moov", append(ftyp, mkBox("mdat", []byte("x"))...)},
+		{"two moov", append(append(ftyp, moovWith(stco())...), moovWith(stco())...)},
+		{"box past the end", append(ftyp, 0, 0, 1, 0, 'm', 'o', 'o', 'v')},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := filepath.Join(t.TempDir(), "v.mp4")
+			if err := os.WriteFile(p, tt.data, 0o644); err != nil {
+				t.Fatal(err)
+			}
+			if err := Embed(p, testInfo); !errors.Is(err, errBadMP4) {
+				t.Errorf("Embed = %v, want errBadMP4", err)
+			}
+			if b, _ := os.ReadFile(p); !bytes.Equal(b, tt.data) {
+				t.Error("malformed file was rewritten")
+			}
+		})
+	}
+}
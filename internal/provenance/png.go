@@ -0,0 +1,118 @@
+package provenance
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"time"
+)
+
+var pngSig = []byte("\x89PNG\r\n\x1a\n")
+
+const xmpKeyword = "XML:com.adobe.xmp"
+
+var errBadPNG = errors.New("malformed png")
+
+// pngKeys are the text keywords written here; older copies are dropped so
+// embedding twice does not duplicate them.
+var pngKeys = map[string]bool{
+	xmpKeyword:      true,
+	"Author":        true,
+	"Description":   true,
+	"Source":        true,
+	"Creation Time": true,
+}
+
+// embedPNG inserts eXIf and iTXt chunks right after IHDR, the eXIf merged
+// into any existing one as in embedJPEG. Image chunks are copied unchanged.
+func embedPNG(b []byte, in Info) ([]byte, error) {
+	i := len(pngSig)
+	var chunks [][]byte
+	var exif []byte
+	for i < len(b) {
+		if i+12 > len(b) {
+			return nil, errBadPNG
+		}
+		n := int(binary.BigEndian.Uint32(b[i:]))
+		if n < 0 || i+12+n > len(b) {
+			return nil, errBadPNG
+		}
+		c := b[i : i+12+n]
+		i += 12 + n
+		typ := string(c[4:8])
+		if typ == "eXIf" {
+			if exif == nil {
+				exif = c
+			}
+			continue
+		}
+		if (typ == "iTXt" || typ == "tEXt" || typ == "zTXt") && pngKeys[keyword(c[8:8+n])] {
+			continue
+		}
+		chunks = append(chunks, c)
+		if typ == "IEND" {
+			break
+		}
+	}
+	if len(chunks) == 0 || string(chunks[0][4:8]) != "IHDR" {
+		return nil, errBadPNG
+	}
+
+	var o bytes.Buffer
+	o.Grow(len(b) + 4096)
+	o.Write(pngSig)
+	o.Write(chunks[0])
+	var old []byte
+	if exif != nil {
+		old = exif[8 : len(exif)-4]
+	}
+	switch e, ok := buildEXIF(in, old); {
+	case !ok:
+		o.Write(exif)
+	case e != nil:
+		writeChunk(&o, "eXIf", e)
+	}
+	writeChunk(&o, "iTXt", itxt(xmpKeyword, string(xmpPacket(in))))
+	if a := author(in); a != "" {
+		writeChunk(&o, "iTXt", itxt("Author", a))
+	}
+	if in.Text != "" {
+		writeChunk(&o, "iTXt", itxt("Description", in.Text))
+	}
+	if in.URL != "" {
+		writeChunk(&o, "iTXt", itxt("Source", in.URL))
+	}
+	if !in.Created.IsZero() {
+		writeChunk(&o, "iTXt", itxt("Creation Time", in.Created.UTC().Format(time.RFC1123)))
+	}
+	for _, c := range chunks[1:] {
+		o.Write(c)
+	}
+	return o.Bytes(), nil
+}
+
+func keyword(d []byte) string {
+	if k := bytes.IndexByte(d, 0); k >= 0 {
+		return string(d[:k])
+	}
+	return ""
+}
+
+// itxt builds uncompressed iTXt data with no language tag.
+func itxt(key, text string) []byte {
+	d := make([]byte, 0, len(key)+len(text)+5)
+	d = append(d, key...)
+	d = append(d, 0, 0, 0, 0, 0)
+	return append(d, text...)
+}
+
+func writeChunk(o *bytes.Buffer, typ string, data []byte) {
+	_ = binary.Write(o, binary.BigEndian, uint32(len(data)))
+	h := crc32.NewIEEE()
+	h.Write([]byte(typ))
+	h.Write(data)
+	o.WriteString(typ)
+	o.Write(data)
+	_ = binary.Write(o, binary.BigEndian, h.Sum32())
+}
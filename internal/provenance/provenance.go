@@ -0,0 +1,182 @@
+// Package provenance writes where a downloaded file came from into the file
+// itself (XMP and EXIF for images, iTunes-style ilst atoms for MP4) without
+// touching the encoded media.
+package provenance
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+var ErrUnsupported = errors.New("unsupported format")
+
+// Info describes the tweet a media file was downloaded from.
+type Info struct {
+	URL     string
+	Author  string
+	TweetID string
+	MediaID string
+	Created time.Time
+	Text    string
+	Alt     string
+}
+
+const maxText = 16 << 10
+
+func TweetURL(author, tweetID string) string {
+	if tweetID == "" {
+		return ""
+	}
+	if author == "" {
+		author = "i"
+	}
+	return "https://x.com/" + author + "/status/" + tweetID
+}
+
+func (in Info) empty() bool {
+	return in.URL == "" && in.Author == "" && in.Text == "" && in.Alt == "" && in.Created.IsZero()
+}
+
+// Embed rewrites the file at p with in added. The media data is copied
+// byte for byte; only metadata blocks are inserted or replaced.
+func Embed(p string, in Info) error {
+	if in.empty() {
+		return nil
+	}
+	if isMP4(p) {
+		return embedMP4(p, in)
+	}
+	b, err := os.ReadFile(p)
+	if err != nil {
+		return err
+	}
+	var out []byte
+	switch {
+	case bytes.HasPrefix(b, jpegSOI):
+		out, err = embedJPEG(b, in)
+	case bytes.HasPrefix(b, pngSig):
+		out, err = embedPNG(b, in)
+	default:
+		return ErrUnsupported
+	}
+	if err != nil {
+		return err
+	}
+	return replaceFile(p, out)
+}
+
+func isMP4(p string) bool {
+	f, err := os.Open(p)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	var h [8]byte
+	if _, err := io.ReadFull(f, h[:]); err != nil {
+		return false
+	}
+	return string(h[4:8]) == "ftyp"
+}
+
+func replaceFile(p string, b []byte) error {
+	fi, err := os.Stat(p)
+	if err != nil {
+		return err
+	}
+	tmp := p + ".meta"
+	if err := os.WriteFile(tmp, b, fi.Mode().Perm()); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, p); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+func clip(s string) string {
+	if len(s) <= maxText {
+		return s
+	}
+	s = s[:maxText]
+	for len(s) > 0 && !utf8Start(s[len(s)-1]) {
+		s = s[:len(s)-1]
+	}
+	if len(s) > 0 {
+		s = s[:len(s)-1]
+	}
+	return s
+}
+
+func utf8Start(c byte) bool { return c&0xC0 != 0x80 }
+
+func esc(w io.Writer, s string) {
+	_ = xml.EscapeText(w, []byte(s))
+}
+
+// xmpPacket builds the XMP packet shared by every format, using Dublin Core
+// for the basics and IPTC Core for alt text.
+func xmpPacket(in Info) []byte {
+	var b bytes.Buffer
+	b.WriteString("<?xpacket begin=\"\xef\xbb\xbf\" id=\"W5M0MpCehiHzreSzNTczkc9d\"?>\n")
+	b.WriteString("<x:xmpmeta xmlns:x=\"adobe:ns:meta/\">\n")
+	b.WriteString(" <rdf:RDF xmlns:rdf=\"http://www.w3.org/1999/02/22-rdf-syntax-ns#\">\n")
+	b.WriteString("  <rdf:Description rdf:about=\"\"\n")
+	b.WriteString("    xmlns:dc=\"http://purl.org/dc/elements/1.1/\"\n")
+	b.WriteString("    xmlns:xmp=\"http://ns.adobe.com/xap/1.0/\"\n")
+	b.WriteString("    xmlns:xmpRights=\"http://ns.adobe.com/xap/1.0/rights/\"\n")
+	b.WriteString("    xmlns:photoshop=\"http://ns.adobe.com/photoshop/1.0/\"\n")
+	b.WriteString("    xmlns:Iptc4xmpCore=\"http://iptc.org/std/Iptc4xmpCore/1.0/xmlns/\">\n")
+	if a := author(in); a != "" {
+		b.WriteString("   <dc:creator><rdf:Seq><rdf:li>")
+		esc(&b, a)
+		b.WriteString("</rdf:li></rdf:Seq></dc:creator>\n")
+	}
+	if in.Text != "" {
+		b.WriteString("   <dc:description><rdf:Alt><rdf:li xml:lang=\"x-default\">")
+		esc(&b, clip(in.Text))
+		b.WriteString("</rdf:li></rdf:Alt></dc:description>\n")
+	}
+	if in.URL != "" {
+		b.WriteString("   <dc:source>")
+		esc(&b, in.URL)
+		b.WriteString("</dc:source>\n   <xmpRights:WebStatement>")
+		esc(&b, in.URL)
+		b.WriteString("</xmpRights:WebStatement>\n")
+	}
+	if in.MediaID != "" {
+		b.WriteString("   <dc:identifier>")
+		esc(&b, in.MediaID)
+		b.WriteString("</dc:identifier>\n")
+	}
+	if !in.Created.IsZero() {
+		ts := in.Created.UTC().Format(time.RFC3339)
+		fmt.Fprintf(&b, "   <xmp:CreateDate>%s</xmp:CreateDate>\n   <photoshop:DateCreated>%s</photoshop:DateCreated>\n", ts, ts)
+	}
+	if in.Alt != "" {
+		b.WriteString("   <Iptc4xmpCore:AltTextAccessibility><rdf:Alt><rdf:li xml:lang=\"x-default\">")
+		esc(&b, clip(in.Alt))
+		b.WriteString("</rdf:li></rdf:Alt></Iptc4xmpCore:AltTextAccessibility>\n")
+	}
+	b.WriteString("  </rdf:Description>\n </rdf:RDF>\n</x:xmpmeta>\n")
+	b.WriteString("<?xpacket end=\"w\"?>")
+	return b.Bytes()
+}
+
+func exifDate(t time.Time) string {
+	return t.UTC().Format("2006:01:02 15:04:05")
+}
+
+func author(in Info) string {
+	if in.Author == "" {
+		return ""
+	}
+	return "@" + strings.TrimPrefix(in.Author, "@")
+}
@@ -0,0 +1,508 @@
+package provenance
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/xml"
+	"errors"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testInfo = Info{
+	URL:     "https://x.com/alice/status/1600000000000000000",
+	Author:  "alice",
+	TweetID: "1600000000000000000",
+	MediaID: "1600000000000000001",
+	Created: time.Date(2024, 3, 5, 10, 20, 30, 0, time.FixedZone("CET", 3600)),
+	Text:    "sunset <over> the \"bay\" & more",
+	Alt:     "orange sky",
+}
+
+// readEXIF returns the tags of IFD0 and of the Exif and GPS sub-IFDs it
+// points to, with values in the block's byte order.
+func readEXIF(t *testing.T, b []byte) (map[uint16][]byte, map[uint16][]byte, map[uint16][]byte) {
+	t.Helper()
+	var bo binary.ByteOrder
+	switch {
+	case bytes.HasPrefix(b, []byte("II*\x00")):
+		bo = binary.LittleEndian
+	case bytes.HasPrefix(b, []byte("MM\x00*")):
+		bo = binary.BigEndian
+	default:
+		t.Fatalf("not a TIFF header: % x", b[:min(len(b), 8)])
+	}
+	ifd := func(off uint32) map[uint16][]byte {
+		out := make(map[uint16][]byte)
+		n := int(bo.Uint16(b[off:]))
+		prev := -1
+		for i := 0; i < n; i++ {
+			e := b[int(off)+2+12*i:]
+			id, typ, cnt := bo.Uint16(e), bo.Uint16(e[2:]), bo.Uint32(e[4:])
+			if int(id) <= prev {
+				t.Errorf("tag %#x out of order", id)
+			}
+			prev = int(id)
+			size := cnt * tiffSizes[typ]
+			v := e[8 : 8+size]
+			if size > 4 {
+				p := bo.Uint32(e[8:])
+				if p%2 == 1 {
+					t.Errorf("tag %#x value at odd offset %d", id, p)
+				}
+				v = b[p : p+size]
+			}
+			out[id] = v
+		}
+		if next := bo.Uint32(b[int(off)+2+12*n:]); next != 0 {
+			t.Errorf("IFD at %d links to %d, want 0", off, next)
+		}
+		return out
+	}
+	ifd0 := ifd(bo.Uint32(b[4:]))
+	var sub, gps map[uint16][]byte
+	if p, ok := ifd0[tagExifIFD]; ok {
+		sub = ifd(bo.Uint32(p))
+		delete(ifd0, tagExifIFD)
+	}
+	if p, ok := ifd0[tagGPSIFD]; ok {
+		gps = ifd(bo.Uint32(p))
+		delete(ifd0, tagGPSIFD)
+	}
+	return ifd0, sub, gps
+}
+
+func str(m map[uint16][]byte) map[uint16]string {
+	if m == nil {
+		return nil
+	}
+	out := make(map[uint16]string, len(m))
+	for k, v := range m {
+		out[k] = string(v)
+	}
+	return out
+}
+
+// oldEXIF is a big-endian block as a camera writes it, with a maker note
+// that has to go and a GPS IFD that has to stay.
+func oldEXIF() []byte {
+	be := binary.BigEndian
+	ts := []tiffTag{
+		{id: tagOrientation, typ: 3, val: []byte{0, 6}},
+		asciiTag(0x010F, "Canon"),
+		asciiTag(tagArtist, "@old"),
+		{id: 0x927C, typ: tiffUndefined, val: []byte("makernote!")},
+		{id: tagGPSIFD, typ: tiffLong, sub: []tiffTag{{id: 0, typ: 1, val: []byte{2, 3, 0, 0}}}},
+		{id: tagExifIFD, typ: tiffLong, sub: []tiffTag{
+			{id: 0x829A, typ: 5, val: []byte{0, 0, 0, 1, 0, 0, 0, 125}},
+			{id: tagUserComment, typ: tiffUndefined, val: []byte("ASCII\x00\x00\x00old")},
+		}},
+	}
+	var b bytes.Buffer
+	b.WriteString("MM\x00*")
+	_ = binary.Write(&b, be, uint32(8))
+	writeTree(&b, be, 8, ts)
+	return b.Bytes()
+}
+
+func TestBuildEXIF(t *testing.T) {
+	day := "2024:03:05 09:20:30\x00"
+	tests := []struct {
+		name string
+		in   Info
+		ifd0 map[uint16]string
+		sub  map[uint16]string
+	}{
+		{name: "empty", in: Info{}},
+		{
+			name: "everything",
+			in:   testInfo,
+			ifd0: map[uint16]string{
+				tagImageDescription: testInfo.Text + "\x00",
+				tagArtist:           "@alice\x00",
+				tagDateTime:         day,
+			},
+			sub: map[uint16]string{
+				tagDateTimeOriginal: day,
+				tagUserComment:      "ASCII\x00\x00\x00" + testInfo.URL,
+			},
+		},
+		{
+			name: "short value kept in the entry",
+			in:   Info{Author: "@ab"},
+			ifd0: map[uint16]string{tagArtist: "@ab\x00"},
+		},
+		{
+			name: "url only",
+			in:   Info{URL: "https://x.com/i/status/1"},
+			ifd0: map[uint16]string{},
+			sub:  map[uint16]string{tagUserComment: "ASCII\x00\x00\x00https://x.com/i/status/1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, ok := buildEXIF(tt.in, nil)
+			if !ok {
+				t.Fatal("buildEXIF refused an empty block")
+			}
+			if tt.ifd0 == nil {
+				if b != nil {
+					t.Fatalf("buildEXIF = %d bytes, want nil", len(b))
+				}
+				return
+			}
+			ifd0, sub, _ := readEXIF(t, b)
+			if got := str(ifd0); !reflect.DeepEqual(got, tt.ifd0) {
+				t.Errorf("IFD0 = %q, want %q", got, tt.ifd0)
+			}
+			if got := str(sub); !reflect.DeepEqual(got, tt.sub) {
+				t.Errorf("Exif IFD = %q, want %q", got, tt.sub)
+			}
+		})
+	}
+}
+
+func TestBuildEXIFMerge(t *testing.T) {
+	day := "2024:03:05 09:20:30\x00"
+	b, ok := buildEXIF(testInfo, oldEXIF())
+	if !ok {
+		t.Fatal("buildEXIF could not read the old block")
+	}
+	if !bytes.HasPrefix(b, []byte("MM\x00*")) {
+		t.Fatal("byte order of the old block not kept")
+	}
+	ifd0, sub, gps := readEXIF(t, b)
+	want0 := map[uint16]string{
+		tagOrientation:      "\x00\x06",
+		0x010F:              "Canon\x00",
+		tagArtist:           "@alice\x00",
+		tagImageDescription: testInfo.Text + "\x00",
+		tagDateTime:         day,
+	}
+	if got := str(ifd0); !reflect.DeepEqual(got, want0) {
+		t.Errorf("IFD0 = %q, want %q", got, want0)
+	}
+	wantSub := map[uint16]string{
+		0x829A:              "\x00\x00\x00\x01\x00\x00\x00\x7d",
+		tagDateTimeOriginal: day,
+		tagUserComment:      "ASCII\x00\x00\x00" + testInfo.URL,
+	}
+	if got := str(sub); !reflect.DeepEqual(got, wantSub) {
+		t.Errorf("Exif IFD = %q, want %q", got, wantSub)
+	}
+	if got := str(gps); !reflect.DeepEqual(got, map[uint16]string{0: "\x02\x03\x00\x00"}) {
+		t.Errorf("GPS IFD = %q", got)
+	}
+
+	again, _ := buildEXIF(testInfo, b)
+	if !bytes.Equal(again, b) {
+		t.Error("merging into its own output changed the block")
+	}
+	kept, _ := buildEXIF(Info{}, oldEXIF())
+	if ifd0, _, _ := readEXIF(t, kept); string(ifd0[tagOrientation]) != "\x00\x06" {
+		t.Error("block without new tags lost Orientation")
+	}
+
+	for _, bad := range [][]byte{[]byte("XX*\x00\x00\x00\x00\x08"), []byte("II*\x00\xff\x00\x00\x00"), oldEXIF()[:40]} {
+		if _, ok := buildEXIF(testInfo, bad); ok {
+			t.Errorf("buildEXIF(% x) read a broken block", bad)
+		}
+	}
+}
+
+func TestXMPPacket(t *testing.T) {
+	tests := []struct {
+		name   string
+		in     Info
+		has    []string
+		hasNot []string
+	}{
+		{
+			name: "everything",
+			in:   testInfo,
+			has: []string{
+				"<dc:creator><rdf:Seq><rdf:li>@alice</rdf:li>",
+				"sunset &lt;over&gt; the &#34;bay&#34; &amp; more",
+				"<dc:source>https://x.com/alice/status/1600000000000000000</dc:source>",
+				"<xmpRights:WebStatement>https://x.com/alice/status/1600000000000000000</xmpRights:WebStatement>",
+				"<dc:identifier>1600000000000000001</dc:identifier>",
+				"<xmp:CreateDate>2024-03-05T09:20:30Z</xmp:CreateDate>",
+				"<Iptc4xmpCore:AltTextAccessibility><rdf:Alt><rdf:li xml:lang=\"x-default\">orange sky</rdf:li>",
+			},
+		},
+		{
+			name:   "author only",
+			in:     Info{Author: "@bob"},
+			has:    []string{"<rdf:li>@bob</rdf:li>"},
+			hasNot: []string{"dc:description", "dc:source", "xmp:CreateDate", "AltTextAccessibility", "dc:identifier"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			x := xmpPacket(tt.in)
+			d := xml.NewDecoder(bytes.NewReader(x))
+			for {
+				_, err := d.Token()
+				if errors.Is(err, io.EOF) {
+					break
+				}
+				if err != nil {
+					t.Fatalf("packet is not well-formed XML: %v", err)
+				}
+			}
+			for _, s := range tt.has {
+				if !bytes.Contains(x, []byte(s)) {
+					t.Errorf("packet lacks %q", s)
+				}
+			}
+			for _, s := range tt.hasNot {
+				if bytes.Contains(x, []byte(s)) {
+					t.Errorf("packet has %q", s)
+				}
+			}
+		})
+	}
+}
+
+func TestFitXMPAndClip(t *testing.T) {
+	long := Info{Author: "a", Text: strings.Repeat("é", 40000), Alt: strings.Repeat("x", 40000)}
+	x, err := fitXMP(long, maxSegment-len(xmpHeader))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(x) > maxSegment-len(xmpHeader) {
+		t.Errorf("packet is %d bytes, over the segment limit", len(x))
+	}
+	if _, err := fitXMP(Info{Author: strings.Repeat("a", 70000)}, 1000); err == nil {
+		t.Error("fitXMP fit an author that cannot be shortened")
+	}
+
+	tests := []struct {
+		in   string
+		want int
+	}{
+		{"short", 5},
+		{strings.Repeat("a", maxText), maxText},
+		{strings.Repeat("a", maxText+10), maxText - 1},
+		{strings.Repeat("a", maxText-1) + "é", maxText - 1},
+	}
+	for _, tt := range tests {
+		got := clip(tt.in)
+		if len(got) != tt.want || !strings.HasPrefix(tt.in, got) {
+			t.Errorf("clip(%d bytes) = %d bytes, want %d", len(tt.in), len(got), tt.want)
+		}
+	}
+}
+
+// jpegSegments lists the markers before the scan data.
+func jpegSegments(t *testing.T, b []byte) ([]byte, [][]byte) {
+	t.Helper()
+	var ms []byte
+	var app1 [][]byte
+	for i := 2; i+4 <= len(b); {
+		m := b[i+1]
+		ms = append(ms, m)
+		if m == jpegSOS {
+			break
+		}
+		n := int(binary.BigEndian.Uint16(b[i+2:]))
+		if m == jpegAPP1 {
+			app1 = append(app1, b[i+4:i+2+n])
+		}
+		i += 2 + n
+	}
+	return ms, app1
+}
+
+func testJPEG(t *testing.T) []byte {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, 16, 16))
+	for i := range img.Pix {
+		img.Pix[i] = byte(i * 13)
+	}
+	var b bytes.Buffer
+	if err := jpeg.Encode(&b, img, nil); err != nil {
+		t.Fatal(err)
+	}
+	// Add a JFIF APP0 the way cameras and browsers write it.
+	jfif := []byte{0xFF, jpegAPP0, 0, 16, 'J', 'F', 'I', 'F', 0, 1, 1, 0, 0, 1, 0, 1, 0, 0}
+	return append(append(append([]byte(nil), jpegSOI...), jfif...), b.Bytes()[2:]...)
+}
+
+func TestEmbedJPEG(t *testing.T) {
+	src := testJPEG(t)
+	scan0 := scanData(src)
+
+	once, err := embedJPEG(src, testInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	twice, err := embedJPEG(once, Info{Author: "bob"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, b := range map[string][]byte{"once": once, "twice": twice} {
+		ms, app1 := jpegSegments(t, b)
+		if ms[0] != jpegAPP0 || ms[1] != jpegAPP1 {
+			t.Errorf("%s: markers start % x, want APP0 then APP1", name, ms)
+		}
+		var exif, xmp int
+		for _, s := range app1 {
+			switch {
+			case bytes.HasPrefix(s, exifHeader):
+				exif++
+			case bytes.HasPrefix(s, xmpHeader):
+				xmp++
+			}
+		}
+		if exif != 1 || xmp != 1 {
+			t.Errorf("%s: %d Exif and %d XMP segments, want one each", name, exif, xmp)
+		}
+		if !bytes.Equal(scanData(b), scan0) {
+			t.Errorf("%s: scan data changed", name)
+		}
+		if _, err := jpeg.Decode(bytes.NewReader(b)); err != nil {
+			t.Errorf("%s: decode: %v", name, err)
+		}
+	}
+	if bytes.Contains(twice, []byte("@alice")) {
+		t.Error("second embed kept the first author")
+	}
+
+	for _, bad := range [][]byte{jpegSOI, append(append([]byte(nil), jpegSOI...), 0xFF, 0xE1, 0xFF, 0xFF)} {
+		if _, err := embedJPEG(bad, testInfo); err == nil {
+			t.Errorf("embedJPEG(% x) accepted a broken file", bad)
+		}
+	}
+}
+
+func TestEmbedJPEGKeepsExif(t *testing.T) {
+	src := testJPEG(t)
+	with := func(body []byte) []byte {
+		var o bytes.Buffer
+		o.Write(src[:2+18])
+		writeSegment(&o, jpegAPP1, exifHeader, body)
+		o.Write(src[2+18:])
+		return o.Bytes()
+	}
+	broken := []byte("II*\x00\xff\x00\x00\x00")
+
+	tests := []struct {
+		name string
+		in   []byte
+		want func(t *testing.T, exif []byte)
+	}{
+		{"orientation kept", with(oldEXIF()), func(t *testing.T, exif []byte) {
+			ifd0, sub, _ := readEXIF(t, exif)
+			if string(ifd0[tagOrientation]) != "\x00\x06" || string(ifd0[tagArtist]) != "@alice\x00" {
+				t.Errorf("IFD0 = %q", str(ifd0))
+			}
+			if string(sub[tagUserComment]) != "ASCII\x00\x00\x00"+testInfo.URL {
+				t.Errorf("Exif IFD = %q", str(sub))
+			}
+		}},
+		{"unreadable Exif left as is", with(broken), func(t *testing.T, exif []byte) {
+			if !bytes.Equal(exif, broken) {
+				t.Errorf("Exif = % x, want the original", exif)
+			}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := embedJPEG(tt.in, testInfo)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var exif [][]byte
+			_, app1 := jpegSegments(t, b)
+			for _, s := range app1 {
+				if bytes.HasPrefix(s, exifHeader) {
+					exif = append(exif, s[len(exifHeader):])
+				}
+			}
+			if len(exif) != 1 {
+				t.Fatalf("%d Exif segments, want one", len(exif))
+			}
+			tt.want(t, exif[0])
+			if _, err := jpeg.Decode(bytes.NewReader(b)); err != nil {
+				t.Errorf("decode: %v", err)
+			}
+		})
+	}
+}
+
+func scanData(b []byte) []byte {
+	return b[bytes.Index(b, []byte{0xFF, jpegSOS}):]
+}
+
+func TestEmbedPNG(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 8, 8))
+	var b bytes.Buffer
+	if err := png.Encode(&b, img); err != nil {
+		t.Fatal(err)
+	}
+	once, err := embedPNG(b.Bytes(), testInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	twice, err := embedPNG(once, testInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(once, twice) {
+		t.Error("embedding twice changed the file again")
+	}
+	if _, err := png.Decode(bytes.NewReader(once)); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	var types []string
+	for i := len(pngSig); i < len(once); {
+		n := int(binary.BigEndian.Uint32(once[i:]))
+		types = append(types, string(once[i+4:i+8]))
+		i += 12 + n
+	}
+	if types[0] != "IHDR" || types[1] != "eXIf" || types[2] != "iTXt" || types[len(types)-1] != "IEND" {
+		t.Errorf("chunks = %v", types)
+	}
+}
+
+func TestEmbed(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name string
+		data []byte
+		in   Info
+		err  error
+		same bool
+	}{
+		{name: "jpeg", data: testJPEG(t), in: testInfo},
+		{name: "nothing to write", data: testJPEG(t), in: Info{TweetID: "1"}, same: true},
+		{name: "gif", data: []byte("GIF89a...."), in: testInfo, err: ErrUnsupported, same: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := filepath.Join(dir, tt.name)
+			if err := os.WriteFile(p, tt.data, 0o644); err != nil {
+				t.Fatal(err)
+			}
+			if err := Embed(p, tt.in); err != tt.err {
+				t.Fatalf("Embed = %v, want %v", err, tt.err)
+			}
+			got, _ := os.ReadFile(p)
+			if bytes.Equal(got, tt.data) != tt.same {
+				t.Errorf("file changed = %v, want %v", !tt.same, tt.same)
+			}
+			if _, err := os.Stat(p + ".meta"); err == nil {
+				t.Error("temporary file left behind")
+			}
+		})
+	}
+}
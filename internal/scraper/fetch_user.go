@@ -48,7 +48,7 @@ func FetchUserID(cl *http.Client, cf *config.EssentialsConfig, usr string) (stri
 	cf.BuildRequestHeaders(rq, ref)
 	rq.Header.Set("Accept", "application/json, */*;q=0.1")
 
-	b, st, err := httpx.DoRequestWithOptions(cl, rq, httpx.RequestOptions{
+	b, st, err := apiDo(cl, cf, "user_by_screen_name", rq, httpx.RequestOptions{
 		MaxBytes: 2 << 20,
 		Decode:   true,
 	})
@@ -62,9 +62,16 @@ func FetchUserID(cl *http.Client, cf *config.EssentialsConfig, usr string) (stri
 		} else {
 			log.LogError("user", fmt.Sprintf("UserByScreenName failed (status %d). run with -d for details.", st))
 		}
+		if le := classifyLookup("@"+usr, st, b); le != nil {
+			return "", le
+		}
 		return "", err
 	}
 
+	if le := classifyUserPayload("@"+usr, b); le != nil {
+		return "", le
+	}
+
 	var typed userByScreenNameResponse
 	if jerr := json.Unmarshal(b, &typed); jerr == nil && typed.Data.User.Result.RestID != "" {
 		return typed.Data.User.Result.RestID, nil
@@ -77,6 +84,9 @@ func FetchUserID(cl *http.Client, cf *config.EssentialsConfig, usr string) (stri
 		}
 	}
 
+	if le := classifyLookup("@"+usr, st, b); le != nil {
+		return "", le
+	}
 	return "", errors.New("rest_id not found in response")
 }
 
@@ -0,0 +1,185 @@
+package scraper
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+var (
+	ErrNotFound        = errors.New("not found")
+	ErrSuspended       = errors.New("account suspended")
+	ErrProtected       = errors.New("account protected")
+	ErrWithheld        = errors.New("withheld in country")
+	ErrRateLimited     = errors.New("rate limited")
+	ErrAuthExpired     = errors.New("auth expired")
+	ErrFeatureMismatch = errors.New("feature flag mismatch")
+)
+
+type LookupError struct {
+	Kind    error
+	Target  string
+	Status  int
+	Code    int
+	Message string
+}
+
+func (e *LookupError) Error() string {
+	s := fmt.Sprintf("%s: %s", e.Target, e.Kind)
+	if e.Status > 0 {
+		s += fmt.Sprintf(" (status %d)", e.Status)
+	}
+	if e.Code > 0 {
+		s += fmt.Sprintf(" [code %d]", e.Code)
+	}
+	if e.Message != "" {
+		s += ": " + e.Message
+	}
+	return s
+}
+
+func (e *LookupError) Unwrap() error { return e.Kind }
+
+type apiError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type lookupPayload struct {
+	Errors []apiError `json:"errors"`
+}
+
+func apiErrorsOf(b []byte) []apiError {
+	var p lookupPayload
+	if len(b) == 0 || json.Unmarshal(b, &p) != nil {
+		return nil
+	}
+	return p.Errors
+}
+
+func kindOfAPIError(e apiError) error {
+	switch e.Code {
+	case 50, 144, 8, 34:
+		return ErrNotFound
+	case 63, 64:
+		return ErrSuspended
+	case 179, 22:
+		return ErrProtected
+	case 88:
+		return ErrRateLimited
+	case 32, 89, 215, 239, 326, 353:
+		return ErrAuthExpired
+	case 336:
+		return ErrFeatureMismatch
+	}
+	m := strings.ToLower(e.Message)
+	switch {
+	case strings.Contains(m, "features cannot be null"), strings.Contains(m, "feature switch"):
+		return ErrFeatureMismatch
+	case strings.Contains(m, "rate limit"):
+		return ErrRateLimited
+	case strings.Contains(m, "suspended"):
+		return ErrSuspended
+	case strings.Contains(m, "withheld"):
+		return ErrWithheld
+	case strings.Contains(m, "protected"), strings.Contains(m, "not authorized to view"):
+		return ErrProtected
+	case strings.Contains(m, "not found"), strings.Contains(m, "does not exist"):
+		return ErrNotFound
+	case strings.Contains(m, "authenticate"), strings.Contains(m, "csrf"):
+		return ErrAuthExpired
+	}
+	return nil
+}
+
+func kindOfStatus(st int) error {
+	switch st {
+	case http.StatusUnauthorized:
+		return ErrAuthExpired
+	case http.StatusTooManyRequests:
+		return ErrRateLimited
+	case http.StatusNotFound:
+		return ErrNotFound
+	}
+	return nil
+}
+
+func kindOfUnavailable(reason string) error {
+	r := strings.ToLower(reason)
+	switch {
+	case strings.Contains(r, "suspend"):
+		return ErrSuspended
+	case strings.Contains(r, "withheld"):
+		return ErrWithheld
+	case strings.Contains(r, "protect"):
+		return ErrProtected
+	}
+	return ErrNotFound
+}
+
+func classifyLookup(target string, st int, b []byte) error {
+	for _, e := range apiErrorsOf(b) {
+		if k := kindOfAPIError(e); k != nil {
+			return &LookupError{Kind: k, Target: target, Status: st, Code: e.Code, Message: e.Message}
+		}
+	}
+	if k := kindOfStatus(st); k != nil {
+		return &LookupError{Kind: k, Target: target, Status: st}
+	}
+	return nil
+}
+
+type userLookupResult struct {
+	Data struct {
+		User *struct {
+			Result *struct {
+				TypeName    string `json:"__typename"`
+				RestID      string `json:"rest_id"`
+				Reason      string `json:"reason"`
+				Unavailable struct {
+					Text string `json:"text"`
+				} `json:"unavailable_message"`
+				Legacy struct {
+					Protected bool  `json:"protected"`
+					Following *bool `json:"following"`
+				} `json:"legacy"`
+				Relationship struct {
+					Following *bool `json:"following"`
+				} `json:"relationship_perspectives"`
+			} `json:"result"`
+		} `json:"user"`
+	} `json:"data"`
+}
+
+func classifyUserPayload(target string, b []byte) error {
+	var r userLookupResult
+	if json.Unmarshal(b, &r) != nil {
+		return nil
+	}
+	if r.Data.User == nil || r.Data.User.Result == nil {
+		if len(apiErrorsOf(b)) == 0 {
+			return &LookupError{Kind: ErrNotFound, Target: target}
+		}
+		return nil
+	}
+	u := r.Data.User.Result
+	if u.TypeName == "UserUnavailable" {
+		msg := u.Unavailable.Text
+		if msg == "" {
+			msg = u.Reason
+		}
+		return &LookupError{Kind: kindOfUnavailable(u.Reason + " " + msg), Target: target, Message: msg}
+	}
+	if u.Legacy.Protected {
+		f := u.Relationship.Following
+		if f == nil {
+			f = u.Legacy.Following
+		}
+		if f != nil && !*f {
+			return &LookupError{Kind: ErrProtected, Target: target}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package scraper
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestClassifyLookup(t *testing.T) {
+	tests := []struct {
+		name string
+		st   int
+		body string
+		want error
+		msg  string
+	}{
+		{"ok", 200, `{"data":{}}`, nil, ""},
+		{"server error", 500, `oops`, nil, ""},
+		{"unknown code", 400, `{"errors":[{"code":999,"message":"something else"}]}`, nil, ""},
+		{"not found code", 200, `{"errors":[{"code":50,"message":"User not found."}]}`, ErrNotFound, "@bob: not found (status 200) [code 50]: User not found."},
+		{"suspended code", 403, `{"errors":[{"code":63,"message":"User has been suspended."}]}`, ErrSuspended, ""},
+		{"protected code", 403, `{"errors":[{"code":179,"message":"Sorry, you are not authorized to see this status."}]}`, ErrProtected, ""},
+		{"rate limit code", 429, `{"errors":[{"code":88,"message":"Rate limit exceeded"}]}`, ErrRateLimited, ""},
+		{"expired auth code", 403, `{"errors":[{"code":353,"message":"This request requires a matching csrf cookie and header."}]}`, ErrAuthExpired, ""},
+		{"feature code", 400, `{"errors":[{"code":336,"message":"x"}]}`, ErrFeatureMismatch, ""},
+		{"feature message", 400, `{"errors":[{"message":"The following features cannot be null: a, b"}]}`, ErrFeatureMismatch, ""},
+		{"withheld message", 200, `{"errors":[{"message":"Account withheld in DE"}]}`, ErrWithheld, ""},
+		{"first known error wins", 200, `{"errors":[{"code":1,"message":"?"},{"code":64,"message":"suspended"}]}`, ErrSuspended, ""},
+		{"status 401", 401, ``, ErrAuthExpired, "@bob: auth expired (status 401)"},
+		{"status 404", 404, `<html>`, ErrNotFound, ""},
+		{"status 429", 429, ``, ErrRateLimited, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := classifyLookup("@bob", tt.st, []byte(tt.body))
+			if tt.want == nil {
+				if err != nil {
+					t.Fatalf("classifyLookup = %v, want nil", err)
+				}
+				return
+			}
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("classifyLookup = %v, want %v", err, tt.want)
+			}
+			var le *LookupError
+			if !errors.As(err, &le) || le.Target != "@bob" {
+				t.Errorf("classifyLookup = %#v, want a LookupError for @bob", err)
+			}
+			if tt.msg != "" && err.Error() != tt.msg {
+				t.Errorf("Error() = %q, want %q", err.Error(), tt.msg)
+			}
+		})
+	}
+}
+
+func TestClassifyUserPayload(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want error
+	}{
+		{"user", `{"data":{"user":{"result":{"__typename":"User","rest_id":"1","legacy":{}}}}}`, nil},
+		{"empty data", `{"data":{}}`, ErrNotFound},
+		{"errors only", `{"errors":[{"code":50}]}`, nil},
+		{"not json", `<html>`, nil},
+		{"suspended", `{"data":{"user":{"result":{"__typename":"UserUnavailable","reason":"Suspended"}}}}`, ErrSuspended},
+		{"withheld", `{"data":{"user":{"result":{"__typename":"UserUnavailable","unavailable_message":{"text":"Account withheld"}}}}}`, ErrWithheld},
+		{"unavailable", `{"data":{"user":{"result":{"__typename":"UserUnavailable"}}}}`, ErrNotFound},
+		{"protected, not followed", `{"data":{"user":{"result":{"__typename":"User","legacy":{"protected":true},"relationship_perspectives":{"following":false}}}}}`, ErrProtected},
+		{"protected, followed", `{"data":{"user":{"result":{"__typename":"User","legacy":{"protected":true,"following":true}}}}}`, nil},
+		{"protected, unknown", `{"data":{"user":{"result":{"__typename":"User","legacy":{"protected":true}}}}}`, nil},
+	}
+	for _, tt := range tests {
+		err := classifyUserPayload("@bob", []byte(tt.body))
+		if !errors.Is(err, tt.want) {
+			t.Errorf("%s: classifyUserPayload = %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
@@ -17,13 +17,32 @@ import (
 	"github.com/ghostlawless/xdl/internal/utils"
 )
 
-type Media struct {
-	URL     string `json:"url"`
-	Type    string `json:"type"`
-	TweetID string `json:"tweet_id,omitempty"`
+type PageHandler func(page int, cursor string, medias []Media) error
+
+type ScanEnd struct {
+	Reason string
+	Pages  int
+	Cursor string
 }
 
-type PageHandler func(page int, cursor string, medias []Media) error
+type ScanEndError struct {
+	ScanEnd
+	Status int
+	Err    error
+}
+
+func (e *ScanEndError) Error() string {
+	s := fmt.Sprintf("media scan stopped at page %d (%s)", e.Pages, e.Reason)
+	if e.Status > 0 {
+		s += fmt.Sprintf(" status %d", e.Status)
+	}
+	if e.Err != nil {
+		s += ": " + e.Err.Error()
+	}
+	return s
+}
+
+func (e *ScanEndError) Unwrap() error { return e.Err }
 
 func WalkUserMediaPages(
 	cl *http.Client,
@@ -33,12 +52,12 @@ func WalkUserMediaPages(
 	vb bool,
 	lim *xruntime.Limiter,
 	handler PageHandler,
-) error {
+) (ScanEnd, error) {
 	if cl == nil || cf == nil {
-		return errors.New("nil client or config")
+		return ScanEnd{}, errors.New("nil client or config")
 	}
 	if uid == "" {
-		return errors.New("empty userID")
+		return ScanEnd{}, errors.New("empty userID")
 	}
 
 	extractCount := func(b []byte) int {
@@ -83,9 +102,11 @@ func WalkUserMediaPages(
 
 	ep, err := cf.GraphQLURL("user_media")
 	if err != nil {
-		return err
+		return ScanEnd{}, err
 	}
 
+	sel := selectionFor(cf)
+
 	cur := ""
 	pg := 1
 	stg := 0
@@ -102,6 +123,9 @@ func WalkUserMediaPages(
 	ref := strings.TrimRight(cf.X.Network, "/") + "/i/user/" + uid + "/media"
 
 	end := ""
+	pr := 0
+	var endErr error
+	endSt := 0
 
 	totalExpected := -1
 
@@ -129,11 +153,11 @@ func WalkUserMediaPages(
 
 		vj, err := json.Marshal(vars)
 		if cf.Runtime.DebugEnabled && err != nil {
-			return fmt.Errorf("marshal variables: %w", err)
+			return ScanEnd{Pages: pg, Cursor: cur}, fmt.Errorf("marshal variables: %w", err)
 		}
 		fj, err := cf.FeatureJSONFor("user_media")
 		if cf.Runtime.DebugEnabled && err != nil {
-			return fmt.Errorf("get features for user_media: %w", err)
+			return ScanEnd{Pages: pg, Cursor: cur}, fmt.Errorf("get features for user_media: %w", err)
 		}
 
 		q := fmt.Sprintf("%s?variables=%s&features=%s",
@@ -144,12 +168,12 @@ func WalkUserMediaPages(
 
 		rq, gerr := http.NewRequest(http.MethodGet, q, nil)
 		if gerr != nil {
-			return fmt.Errorf("build request: %w", gerr)
+			return ScanEnd{Pages: pg, Cursor: cur}, fmt.Errorf("build request: %w", gerr)
 		}
 		cf.BuildRequestHeaders(rq, ref)
 		rq.Header.Set("Accept", "application/json, */*;q=0.1")
 
-		b, st, reqErr := httpx.DoRequestWithOptions(cl, rq, httpx.RequestOptions{
+		b, st, reqErr := apiDo(cl, cf, "user_media", rq, httpx.RequestOptions{
 			MaxBytes: 8 << 20,
 			Decode:   true,
 			Accept:   func(s int) bool { return s >= 200 && s < 300 },
@@ -167,6 +191,14 @@ func WalkUserMediaPages(
 				log.LogError("media", fmt.Sprintf("UserMedia failed (status %d). run with -d for details.", st))
 			}
 			end = "http_error"
+			endErr = reqErr
+			endSt = st
+			if le := classifyLookup("@"+sn, st, b); le != nil {
+				endErr = le
+				if errors.Is(le, ErrRateLimited) {
+					end = "rate_limited"
+				}
+			}
 			break
 		}
 
@@ -185,7 +217,16 @@ func WalkUserMediaPages(
 			}
 		}
 
-		pms, jerr := fold(b)
+		pms, jerr := fold(b, sel)
+		if jerr != nil && pr < cf.MaxRetries() {
+			d := apiBackoff(pr)
+			pr++
+			log.LogInfo("media", fmt.Sprintf("parse page %d failed (attempt %d/%d): %v; retrying in %s", pg, pr, cf.MaxRetries()+1, jerr, d))
+			if jerr = sleepCtx(rq.Context(), d); jerr == nil {
+				continue
+			}
+		}
+		pr = 0
 		if jerr != nil {
 			if cf.Runtime.DebugEnabled {
 				p, _ := utils.SaveTimestamped(cf.Paths.Debug, "err_user_media_parse", "json", b)
@@ -196,6 +237,7 @@ func WalkUserMediaPages(
 				log.LogError("media", fmt.Sprintf("parse page %d failed.", pg))
 			}
 			end = "parse_error"
+			endErr = jerr
 			break
 		}
 
@@ -204,10 +246,11 @@ func WalkUserMediaPages(
 			if m.URL == "" {
 				continue
 			}
-			if _, dup := seenMedia[m.URL]; dup {
+			k := m.Identity()
+			if _, dup := seenMedia[k]; dup {
 				continue
 			}
-			seenMedia[m.URL] = struct{}{}
+			seenMedia[k] = struct{}{}
 			pageBatch = append(pageBatch, m)
 			if m.Type == "image" {
 				ic++
@@ -269,7 +312,7 @@ func WalkUserMediaPages(
 
 		if handler != nil && len(pageBatch) > 0 {
 			if err := handler(pg, cur, pageBatch); err != nil {
-				return err
+				return ScanEnd{Reason: "aborted", Pages: pg, Cursor: cur}, err
 			}
 		}
 
@@ -308,14 +351,19 @@ func WalkUserMediaPages(
 		pg++
 	}
 
-	if end == "no_progress" || end == "no_next_cursor" || end == "repeat_cursor" || end == "max_pages" {
-		log.LogInfo("media", fmt.Sprintf(
-			"UserMedia endpoint reached its server-side end at page %d. This feed may expose fewer items than the media counter shown in the profile UI.",
-			pg,
-		))
+	se := ScanEnd{Reason: end, Pages: pg, Cursor: cur}
+	log.LogInfo("media", fmt.Sprintf("UserMedia scan ended: reason=%s page=%d total=%d", end, pg, len(seenMedia)))
+
+	switch end {
+	case "http_error", "rate_limited", "parse_error":
+		return se, &ScanEndError{ScanEnd: se, Status: endSt, Err: endErr}
 	}
 
-	return nil
+	log.LogInfo("media", fmt.Sprintf(
+		"UserMedia endpoint reached its server-side end at page %d. This feed may expose fewer items than the media counter shown in the profile UI.",
+		pg,
+	))
+	return se, nil
 }
 
 func buildScanProgressBar(width int, fraction float64) string {
@@ -363,7 +411,7 @@ func GetMediaLinksForUser(cl *http.Client, cf *config.EssentialsConfig, uid stri
 		return nil
 	}
 
-	if err := WalkUserMediaPages(cl, cf, uid, sn, vb, lim, handler); err != nil {
+	if _, err := WalkUserMediaPages(cl, cf, uid, sn, vb, lim, handler); err != nil {
 		return nil, err
 	}
 
@@ -3,12 +3,13 @@ package scraper
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"math/rand"
 	"net/http"
 	"net/url"
+	"path"
 	"strings"
-	"time"
+	"sync"
 
 	"github.com/ghostlawless/xdl/internal/config"
 	"github.com/ghostlawless/xdl/internal/httpx"
@@ -17,13 +18,42 @@ import (
 	"github.com/ghostlawless/xdl/internal/utils"
 )
 
+type EnrichOptions struct {
+	Limiter *xruntime.Limiter
+	Verbose bool
+	Workers int
+	Cache   *TweetDetailCache
+	Force   bool
+}
+
+type enrichStats struct {
+	successTweets  int
+	httpErrors     int
+	unavailable    int
+	parseErrors    int
+	noMediaFound   int
+	updatedImages  int
+	updatedVideos  int
+	unmatched      int
+	typeMismatches int
+	cacheHits      int
+	skippedMedia   int
+}
+
+type tweetDetailResult struct {
+	tid   string
+	media []Media
+	err   error
+}
+
+var errTweetDetailParse = errors.New("tweet detail parse error")
+
 func EnrichMediaWithTweetDetail(
 	cl *http.Client,
 	cf *config.EssentialsConfig,
 	screenName string,
 	medias []Media,
-	lim *xruntime.Limiter,
-	vb bool,
+	opt EnrichOptions,
 ) []Media {
 	if cl == nil || cf == nil {
 		return medias
@@ -37,202 +67,304 @@ func EnrichMediaWithTweetDetail(
 		return medias
 	}
 
+	st := enrichStats{}
+	sel := selectionFor(cf)
+
 	tweetIndex := make(map[string][]int)
+	order := make([]string, 0, len(medias))
 	for i, m := range medias {
 		if m.TweetID == "" {
 			continue
 		}
+		if !opt.Force && !needsTweetDetail(m, sel.image) {
+			st.skippedMedia++
+			continue
+		}
+		if _, ok := tweetIndex[m.TweetID]; !ok {
+			order = append(order, m.TweetID)
+		}
 		tweetIndex[m.TweetID] = append(tweetIndex[m.TweetID], i)
 	}
 
 	totalTweets := len(tweetIndex)
 	if totalTweets == 0 {
+		if cf.Runtime.DebugEnabled && st.skippedMedia > 0 {
+			log.LogInfo("media", fmt.Sprintf("TweetDetail enrichment skipped: %d media already at best quality", st.skippedMedia))
+		}
 		return medias
 	}
 
-	if cf.Runtime.DebugEnabled {
-		log.LogInfo("media", fmt.Sprintf("TweetDetail enrichment for %d tweet(s)", totalTweets))
-	}
-
-	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
 	out := make([]Media, len(medias))
 	copy(out, medias)
 
-	idx := 0
-	attempted := 0
-	successTweets := 0
-	httpErrors := 0
-	parseErrors := 0
-	noMediaFound := 0
-	updatedImages := 0
-	updatedVideos := 0
-
-	for tid, positions := range tweetIndex {
-		idx++
-		attempted++
+	sk := sel.String()
 
-		if lim != nil {
-			lim.SleepBeforeRequest(context.Background(), screenName+"_tweetdetail", 0, idx)
+	jobs := make([]string, 0, totalTweets)
+	for _, tid := range order {
+		if opt.Cache != nil && !opt.Force {
+			if cached, ok := opt.Cache.Get(tid + "|" + sk); ok {
+				st.cacheHits++
+				applyTweetDetail(out, tid, tweetIndex[tid], cached, &st)
+				continue
+			}
 		}
+		jobs = append(jobs, tid)
+	}
 
-		base := 80
-		extra := rnd.Intn(120)
-		step := (idx % 5) * 20
-		jitterMs := base + extra + step
-		time.Sleep(time.Duration(jitterMs) * time.Millisecond)
+	if cf.Runtime.DebugEnabled {
+		log.LogInfo("media", fmt.Sprintf(
+			"TweetDetail enrichment for %d tweet(s) (cached=%d fetch=%d skipped_media=%d)",
+			totalTweets, st.cacheHits, len(jobs), st.skippedMedia,
+		))
+	}
 
-		if cf.Runtime.DebugEnabled && idx%25 == 0 {
-			log.LogInfo("media", fmt.Sprintf(
-				"TweetDetail progress: %d/%d (success=%d http_err=%d parse_err=%d no_media=%d)",
-				idx, totalTweets, successTweets, httpErrors, parseErrors, noMediaFound,
-			))
-		}
+	wk := opt.Workers
+	if wk <= 0 {
+		wk = cf.EnrichWorkers()
+	}
+	if wk > len(jobs) {
+		wk = len(jobs)
+	}
 
-		vars := map[string]any{
-			"focalTweetId":                           tid,
-			"with_rux_injections":                    false,
-			"includePromotedContent":                 false,
-			"withCommunity":                          false,
-			"withQuickPromoteEligibilityTweetFields": false,
-			"withBirdwatchNotes":                     false,
-			"withVoice":                              false,
-			"withV2Timeline":                         true,
-		}
+	jc := make(chan string)
+	rc := make(chan tweetDetailResult)
 
-		vj, _ := json.Marshal(vars)
-		fj, _ := cf.FeatureJSONFor("tweet_detail")
+	var wg sync.WaitGroup
+	for w := 0; w < wk; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for tid := range jc {
+				ms, ferr := fetchTweetDetailMedia(cl, cf, ep, screenName, tid)
+				rc <- tweetDetailResult{tid: tid, media: ms, err: ferr}
+			}
+		}()
+	}
 
-		q := fmt.Sprintf("%s?variables=%s", ep, url.QueryEscape(string(vj)))
-		if fj != "" {
-			q = fmt.Sprintf("%s&features=%s", q, url.QueryEscape(fj))
+	// Jobs are handed out one limiter delay apart, so the workers together
+	// never start requests faster than a single serial caller would.
+	go func() {
+		for i, j := range jobs {
+			if opt.Limiter != nil {
+				opt.Limiter.SleepBeforeRequest(context.Background(), screenName+"_tweetdetail", 0, i+1)
+			}
+			jc <- j
 		}
+		close(jc)
+		wg.Wait()
+		close(rc)
+	}()
 
-		ref := strings.TrimRight(cf.X.Network, "/") + "/" + screenName + "/status/" + tid
-
-		req, rerr := http.NewRequest(http.MethodGet, q, nil)
-		if rerr != nil {
-			httpErrors++
-			if cf.Runtime.DebugEnabled {
-				log.LogError("media", fmt.Sprintf("TweetDetail build request failed for %s: %v", tid, rerr))
-			}
-			continue
+	done := 0
+	for r := range rc {
+		done++
+		if cf.Runtime.DebugEnabled && done%25 == 0 {
+			log.LogInfo("media", fmt.Sprintf(
+				"TweetDetail progress: %d/%d (success=%d http_err=%d parse_err=%d no_media=%d)",
+				done, len(jobs), st.successTweets, st.httpErrors, st.parseErrors, st.noMediaFound,
+			))
 		}
-		cf.BuildRequestHeaders(req, ref)
-		req.Header.Set("Accept", "application/json, */*;q=0.1")
-
-		b, st, herr := httpx.DoRequestWithOptions(cl, req, httpx.RequestOptions{
-			MaxBytes: 8 << 20,
-			Decode:   true,
-			Accept:   func(s int) bool { return s >= 200 && s < 300 },
-		})
-		if herr != nil {
-			httpErrors++
-			if cf.Runtime.DebugEnabled {
-				p, _ := utils.SaveTimestamped(cf.Paths.Debug, "err_tweet_detail", "json", b)
-				meta := fmt.Sprintf(
-					"METHOD: GET\nSTATUS: %d\nTWEET_ID: %s\nURL: %s\n",
-					st, tid, q,
-				)
-				_, _ = utils.SaveTimestamped(cf.Paths.Debug, "err_tweet_detail_meta", "txt", []byte(meta))
-				log.LogError("media", fmt.Sprintf("TweetDetail failed for %s (status %d). see: %s", tid, st, p))
+		if r.err != nil {
+			var le *LookupError
+			if errors.Is(r.err, errTweetDetailParse) {
+				st.parseErrors++
+			} else if errors.As(r.err, &le) && le.Kind != ErrRateLimited && le.Kind != ErrAuthExpired {
+				st.unavailable++
 			} else {
-				log.LogError("media", fmt.Sprintf("TweetDetail failed for %s (status %d).", tid, st))
+				st.httpErrors++
 			}
 			continue
 		}
+		if opt.Cache != nil {
+			opt.Cache.Put(r.tid+"|"+sk, r.media)
+		}
+		applyTweetDetail(out, r.tid, tweetIndex[r.tid], r.media, &st)
+	}
 
-		pageMedia, perr := fold(b)
-		if perr != nil {
-			parseErrors++
-			if cf.Runtime.DebugEnabled {
-				p, _ := utils.SaveTimestamped(cf.Paths.Debug, "err_tweet_detail_parse", "json", b)
-				meta := fmt.Sprintf("PARSE_ERROR: %v\nTWEET_ID: %s\n", perr, tid)
-				_, _ = utils.SaveTimestamped(cf.Paths.Debug, "err_tweet_detail_parse_meta", "txt", []byte(meta))
-				log.LogError("media", fmt.Sprintf("parse TweetDetail for %s failed. see: %s", tid, p))
-			} else {
-				log.LogError("media", fmt.Sprintf("parse TweetDetail for %s failed: %v", tid, perr))
-			}
-			continue
+	if opt.Cache != nil {
+		if err := opt.Cache.Save(); err != nil {
+			log.LogError("media", "TweetDetail cache save failed: "+err.Error())
 		}
+	}
 
-		filtered := make([]Media, 0, len(pageMedia))
-		for _, m := range pageMedia {
-			if m.TweetID == "" || m.TweetID == tid {
-				filtered = append(filtered, m)
-			}
+	if cf.Runtime.DebugEnabled {
+		log.LogInfo("media", fmt.Sprintf(
+			"TweetDetail enrichment summary: tweets=%d attempted=%d cached=%d success=%d no_media=%d http_errors=%d unavailable=%d parse_errors=%d updated_images=%d updated_videos=%d unmatched=%d type_mismatch=%d skipped_media=%d workers=%d",
+			totalTweets, len(jobs), st.cacheHits, st.successTweets, st.noMediaFound, st.httpErrors, st.unavailable, st.parseErrors,
+			st.updatedImages, st.updatedVideos, st.unmatched, st.typeMismatches, st.skippedMedia, wk,
+		))
+	} else if opt.Verbose {
+		if st.updatedImages > 0 || st.updatedVideos > 0 {
+			utils.PrintInfo(
+				"TweetDetail enrichment updated %d image(s) and %d video(s) from %d tweet(s)",
+				st.updatedImages, st.updatedVideos, totalTweets,
+			)
+		}
+		if st.unmatched > 0 || st.typeMismatches > 0 {
+			utils.PrintWarn(
+				"TweetDetail enrichment could not match %d media item(s) by id; original urls kept",
+				st.unmatched+st.typeMismatches,
+			)
 		}
+	}
+	return out
+}
 
-		tdImages := make([]Media, 0, len(filtered))
-		tdVideos := make([]Media, 0, len(filtered))
-		for _, m := range filtered {
-			switch m.Type {
-			case "image":
-				tdImages = append(tdImages, m)
-			case "video":
-				tdVideos = append(tdVideos, m)
-			}
+func fetchTweetDetailMedia(cl *http.Client, cf *config.EssentialsConfig, ep, screenName, tid string) ([]Media, error) {
+	vars := map[string]any{
+		"focalTweetId":                           tid,
+		"with_rux_injections":                    false,
+		"includePromotedContent":                 false,
+		"withCommunity":                          false,
+		"withQuickPromoteEligibilityTweetFields": false,
+		"withBirdwatchNotes":                     false,
+		"withVoice":                              false,
+		"withV2Timeline":                         true,
+	}
+
+	vj, _ := json.Marshal(vars)
+	fj, _ := cf.FeatureJSONFor("tweet_detail")
+
+	q := fmt.Sprintf("%s?variables=%s", ep, url.QueryEscape(string(vj)))
+	if fj != "" {
+		q = fmt.Sprintf("%s&features=%s", q, url.QueryEscape(fj))
+	}
+
+	ref := strings.TrimRight(cf.X.Network, "/") + "/" + screenName + "/status/" + tid
+
+	req, rerr := http.NewRequest(http.MethodGet, q, nil)
+	if rerr != nil {
+		if cf.Runtime.DebugEnabled {
+			log.LogError("media", fmt.Sprintf("TweetDetail build request failed for %s: %v", tid, rerr))
 		}
+		return nil, rerr
+	}
+	cf.BuildRequestHeaders(req, ref)
+	req.Header.Set("Accept", "application/json, */*;q=0.1")
 
-		if len(tdImages) == 0 && len(tdVideos) == 0 {
-			noMediaFound++
-			continue
+	b, st, herr := apiDo(cl, cf, "tweet_detail", req, httpx.RequestOptions{
+		MaxBytes: 8 << 20,
+		Decode:   true,
+		Accept:   func(s int) bool { return s >= 200 && s < 300 },
+	})
+	if herr != nil {
+		if cf.Runtime.DebugEnabled {
+			p, _ := utils.SaveTimestamped(cf.Paths.Debug, "err_tweet_detail", "json", b)
+			meta := fmt.Sprintf(
+				"METHOD: GET\nSTATUS: %d\nTWEET_ID: %s\nURL: %s\n",
+				st, tid, q,
+			)
+			_, _ = utils.SaveTimestamped(cf.Paths.Debug, "err_tweet_detail_meta", "txt", []byte(meta))
+			log.LogError("media", fmt.Sprintf("TweetDetail failed for %s (status %d). see: %s", tid, st, p))
+		} else {
+			log.LogError("media", fmt.Sprintf("TweetDetail failed for %s (status %d).", tid, st))
+		}
+		if le := classifyLookup("tweet "+tid, st, b); le != nil {
+			return nil, le
 		}
+		return nil, herr
+	}
 
-		origImgIdx := make([]int, 0, len(positions))
-		origVidIdx := make([]int, 0, len(positions))
-		for _, pos := range positions {
-			if pos < 0 || pos >= len(out) {
-				continue
-			}
-			switch out[pos].Type {
-			case "image":
-				origImgIdx = append(origImgIdx, pos)
-			case "video":
-				origVidIdx = append(origVidIdx, pos)
-			}
+	pageMedia, perr := fold(b, selectionFor(cf))
+	if perr != nil {
+		if cf.Runtime.DebugEnabled {
+			p, _ := utils.SaveTimestamped(cf.Paths.Debug, "err_tweet_detail_parse", "json", b)
+			meta := fmt.Sprintf("PARSE_ERROR: %v\nTWEET_ID: %s\n", perr, tid)
+			_, _ = utils.SaveTimestamped(cf.Paths.Debug, "err_tweet_detail_parse_meta", "txt", []byte(meta))
+			log.LogError("media", fmt.Sprintf("parse TweetDetail for %s failed. see: %s", tid, p))
+		} else {
+			log.LogError("media", fmt.Sprintf("parse TweetDetail for %s failed: %v", tid, perr))
 		}
+		return nil, fmt.Errorf("%w: %v", errTweetDetailParse, perr)
+	}
 
-		updatedThisTweet := false
+	return pageMedia, nil
+}
 
-		for i := 0; i < len(origImgIdx) && i < len(tdImages); i++ {
-			pos := origImgIdx[i]
-			nu := tdImages[i].URL
-			if nu == "" || nu == out[pos].URL {
-				continue
-			}
-			out[pos].URL = nu
-			updatedImages++
-			updatedThisTweet = true
+func applyTweetDetail(out []Media, tid string, positions []int, pageMedia []Media, st *enrichStats) {
+	tdByID := make(map[string]Media, len(pageMedia))
+	for _, m := range pageMedia {
+		if id := m.StableID(); id != "" {
+			tdByID[id] = m
 		}
+	}
 
-		for i := 0; i < len(origVidIdx) && i < len(tdVideos); i++ {
-			pos := origVidIdx[i]
-			nu := tdVideos[i].URL
-			if nu == "" || nu == out[pos].URL {
-				continue
-			}
-			out[pos].URL = nu
-			updatedVideos++
-			updatedThisTweet = true
-		}
+	if len(tdByID) == 0 {
+		st.noMediaFound++
+		return
+	}
 
-		if updatedThisTweet {
-			successTweets++
-		} else {
-			noMediaFound++
+	updatedThisTweet := false
+
+	for _, pos := range positions {
+		if pos < 0 || pos >= len(out) {
+			continue
+		}
+		cur := out[pos]
+		id := cur.StableID()
+		if id == "" {
+			st.unmatched++
+			log.LogError("media", fmt.Sprintf("TweetDetail mismatch for %s: media at position %d has no id, url kept", tid, cur.Index))
+			continue
+		}
+		nm, ok := tdByID[id]
+		if !ok {
+			st.unmatched++
+			log.LogError("media", fmt.Sprintf("TweetDetail mismatch for %s: media %s not present in response, url kept", tid, id))
+			continue
+		}
+		if nm.Type != cur.Type {
+			st.typeMismatches++
+			log.LogError("media", fmt.Sprintf("TweetDetail mismatch for %s: media %s is %s, response has %s, url kept", tid, id, cur.Type, nm.Type))
+			continue
+		}
+		if cur.Text == "" && cur.Author == "" {
+			out[pos].Author, out[pos].Text = nm.Author, nm.Text
+		}
+		if cur.Alt == "" {
+			out[pos].Alt = nm.Alt
 		}
+		if cur.Created == "" {
+			out[pos].Created = nm.Created
+		}
+		if nm.URL == "" || nm.URL == cur.URL {
+			continue
+		}
+		out[pos].URL = nm.URL
+		switch cur.Type {
+		case "image":
+			st.updatedImages++
+		case "video":
+			st.updatedVideos++
+		}
+		updatedThisTweet = true
 	}
 
-	if cf.Runtime.DebugEnabled {
-		log.LogInfo("media", fmt.Sprintf(
-			"TweetDetail enrichment summary: tweets=%d attempted=%d success=%d no_media=%d http_errors=%d parse_errors=%d updated_images=%d updated_videos=%d",
-			totalTweets, attempted, successTweets, noMediaFound, httpErrors, parseErrors, updatedImages, updatedVideos,
-		))
-	} else if vb && (updatedImages > 0 || updatedVideos > 0) {
-		utils.PrintInfo(
-			"TweetDetail enrichment updated %d image(s) and %d video(s) from %d tweet(s)",
-			updatedImages, updatedVideos, totalTweets,
-		)
+	if updatedThisTweet {
+		st.successTweets++
+	} else {
+		st.noMediaFound++
 	}
-	return out
+}
+
+func needsTweetDetail(m Media, ip ImagePolicy) bool {
+	pu, err := url.Parse(m.URL)
+	if err != nil || pu == nil {
+		return true
+	}
+	switch m.Type {
+	case "image":
+		return pu.Query().Get("name") != ip.Size
+	case "video":
+		ext := strings.ToLower(path.Ext(pu.Path))
+		switch ext {
+		case ".m3u8":
+			// A master playlist already lists every rendition.
+			return false
+		case ".mp4":
+			return m.Bitrate < m.Top
+		}
+		return true
+	}
+	return true
 }
@@ -0,0 +1,93 @@
+package scraper
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestApplyTweetDetail(t *testing.T) {
+	img := func(id, u string) Media { return Media{Type: "image", TweetID: "1", MediaID: id, URL: u} }
+	vid := func(id, u string) Media { return Media{Type: "video", TweetID: "1", MediaID: id, URL: u} }
+
+	tests := []struct {
+		name  string
+		out   []Media
+		pos   []int
+		td    []Media
+		urls  []string
+		stats enrichStats
+	}{
+		{
+			name:  "matched by id, not by order",
+			out:   []Media{img("a", "a-small"), img("b", "b-small")},
+			pos:   []int{0, 1},
+			td:    []Media{img("b", "b-orig"), img("a", "a-orig")},
+			urls:  []string{"a-orig", "b-orig"},
+			stats: enrichStats{successTweets: 1, updatedImages: 2},
+		},
+		{
+			name:  "media key stands in for the id",
+			out:   []Media{vid("9", "v-low")},
+			pos:   []int{0},
+			td:    []Media{{Type: "video", Key: "7_9", URL: "v-high"}},
+			urls:  []string{"v-high"},
+			stats: enrichStats{successTweets: 1, updatedVideos: 1},
+		},
+		{
+			name:  "missing from the response",
+			out:   []Media{img("a", "a-small"), img("c", "c-small")},
+			pos:   []int{0, 1},
+			td:    []Media{img("a", "a-orig"), img("b", "b-orig")},
+			urls:  []string{"a-orig", "c-small"},
+			stats: enrichStats{successTweets: 1, updatedImages: 1, unmatched: 1},
+		},
+		{
+			name:  "type differs",
+			out:   []Media{img("a", "a-small")},
+			pos:   []int{0},
+			td:    []Media{vid("a", "a.mp4")},
+			urls:  []string{"a-small"},
+			stats: enrichStats{noMediaFound: 1, typeMismatches: 1},
+		},
+		{
+			name:  "no id on the page media",
+			out:   []Media{{Type: "image", URL: "x-small"}},
+			pos:   []int{0},
+			td:    []Media{img("a", "a-orig")},
+			urls:  []string{"x-small"},
+			stats: enrichStats{noMediaFound: 1, unmatched: 1},
+		},
+		{
+			name:  "response without ids",
+			out:   []Media{img("a", "a-small")},
+			pos:   []int{0},
+			td:    []Media{{Type: "image", URL: "a-orig"}},
+			urls:  []string{"a-small"},
+			stats: enrichStats{noMediaFound: 1},
+		},
+		{
+			name:  "same url and stray positions",
+			out:   []Media{img("a", "a-orig")},
+			pos:   []int{-1, 0, 5},
+			td:    []Media{img("a", "a-orig")},
+			urls:  []string{"a-orig"},
+			stats: enrichStats{noMediaFound: 1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var st enrichStats
+			applyTweetDetail(tt.out, "1", tt.pos, tt.td, &st)
+			var urls []string
+			for _, m := range tt.out {
+				urls = append(urls, m.URL)
+			}
+			if !reflect.DeepEqual(urls, tt.urls) {
+				t.Errorf("urls = %v, want %v", urls, tt.urls)
+			}
+			if st != tt.stats {
+				t.Errorf("stats = %+v, want %+v", st, tt.stats)
+			}
+		})
+	}
+}
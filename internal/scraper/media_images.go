@@ -0,0 +1,137 @@
+package scraper
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/ghostlawless/xdl/internal/config"
+)
+
+var imageSizes = []string{"orig", "4096x4096", "large", "medium", "small"}
+
+var imageFormats = []string{"jpg", "png", "webp"}
+
+type ImagePolicy struct {
+	Size    string
+	Formats []string
+}
+
+func ParseImagePolicy(size, formats string) (ImagePolicy, error) {
+	p := ImagePolicy{Size: "orig"}
+	size = strings.ToLower(strings.TrimSpace(size))
+	if size != "" {
+		if !containsString(imageSizes, size) {
+			return ImagePolicy{}, fmt.Errorf("unknown image size %q (use %s)", size, strings.Join(imageSizes, ", "))
+		}
+		p.Size = size
+	}
+	for _, f := range strings.Split(strings.ToLower(formats), ",") {
+		f = strings.TrimSpace(f)
+		if f == "jpeg" {
+			f = "jpg"
+		}
+		if f == "" {
+			continue
+		}
+		if !containsString(imageFormats, f) {
+			return ImagePolicy{}, fmt.Errorf("unknown image format %q (use %s)", f, strings.Join(imageFormats, ", "))
+		}
+		if !containsString(p.Formats, f) {
+			p.Formats = append(p.Formats, f)
+		}
+	}
+	return p, nil
+}
+
+func (p ImagePolicy) String() string {
+	s := p.Size
+	if s == "" {
+		s = "orig"
+	}
+	if len(p.Formats) > 0 {
+		s += "/" + strings.Join(p.Formats, ",")
+	}
+	return s
+}
+
+func imagePolicyFor(cf *config.EssentialsConfig) ImagePolicy {
+	if cf == nil {
+		return ImagePolicy{Size: "orig"}
+	}
+	p, err := ParseImagePolicy(cf.Media.Image, cf.Media.ImageFormat)
+	if err != nil {
+		return ImagePolicy{Size: "orig"}
+	}
+	return p
+}
+
+type selection struct {
+	video VideoPolicy
+	image ImagePolicy
+}
+
+func selectionFor(cf *config.EssentialsConfig) selection {
+	return selection{video: videoPolicyFor(cf), image: imagePolicyFor(cf)}
+}
+
+func (s selection) String() string {
+	return "video=" + s.video.String() + ";image=" + s.image.String()
+}
+
+func (p ImagePolicy) primaryFormat() string {
+	if len(p.Formats) == 0 {
+		return ""
+	}
+	return p.Formats[0]
+}
+
+func ImageURL(raw, size, format string) string {
+	if raw == "" {
+		return ""
+	}
+	pu, err := url.Parse(raw)
+	if err != nil {
+		return raw
+	}
+	if !strings.Contains(strings.ToLower(pu.Host), "twimg.com") {
+		return raw
+	}
+	q := pu.Query()
+	if format == "" {
+		format = q.Get("format")
+	}
+	if ext := strings.ToLower(path.Ext(pu.Path)); ext != "" {
+		if format == "" {
+			format = strings.TrimPrefix(ext, ".")
+			if format == "jpeg" {
+				format = "jpg"
+			}
+		}
+		pu.Path = strings.TrimSuffix(pu.Path, path.Ext(pu.Path))
+	}
+	if size == "" {
+		size = q.Get("name")
+	}
+	if size == "" {
+		size = "orig"
+	}
+
+	nq := url.Values{}
+	if format != "" {
+		nq.Set("format", format)
+	}
+	nq.Set("name", size)
+	pu.RawQuery = nq.Encode()
+	return pu.String()
+}
+
+func containsString(xs []string, s string) bool {
+	for _, x := range xs {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
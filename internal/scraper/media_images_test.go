@@ -0,0 +1,64 @@
+package scraper
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseImagePolicy(t *testing.T) {
+	tests := []struct {
+		size, formats string
+		want          ImagePolicy
+		str           string
+		err           string
+	}{
+		{"", "", ImagePolicy{Size: "orig"}, "orig", ""},
+		{" Large ", "", ImagePolicy{Size: "large"}, "large", ""},
+		{"4096x4096", "png", ImagePolicy{Size: "4096x4096", Formats: []string{"png"}}, "4096x4096/png", ""},
+		{"", "JPEG, webp,jpg,,png", ImagePolicy{Size: "orig", Formats: []string{"jpg", "webp", "png"}}, "orig/jpg,webp,png", ""},
+		{"huge", "", ImagePolicy{}, "", "unknown image size"},
+		{"", "jpg,gif", ImagePolicy{}, "", "unknown image format"},
+	}
+	for _, tt := range tests {
+		got, err := ParseImagePolicy(tt.size, tt.formats)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("ParseImagePolicy(%q, %q) err = %v, want %q", tt.size, tt.formats, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseImagePolicy(%q, %q): %v", tt.size, tt.formats, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseImagePolicy(%q, %q) = %+v, want %+v", tt.size, tt.formats, got, tt.want)
+		}
+		if s := got.String(); s != tt.str {
+			t.Errorf("String() = %q, want %q", s, tt.str)
+		}
+	}
+}
+
+func TestImageURL(t *testing.T) {
+	tests := []struct {
+		raw, size, format string
+		want              string
+	}{
+		{"", "orig", "", ""},
+		{"https://pbs.twimg.com/media/Fabc.jpg", "", "", "https://pbs.twimg.com/media/Fabc?format=jpg&name=orig"},
+		{"https://pbs.twimg.com/media/Fabc.jpg", "large", "", "https://pbs.twimg.com/media/Fabc?format=jpg&name=large"},
+		{"https://pbs.twimg.com/media/Fabc.jpeg", "", "", "https://pbs.twimg.com/media/Fabc?format=jpg&name=orig"},
+		{"https://pbs.twimg.com/media/Fabc.jpg", "orig", "png", "https://pbs.twimg.com/media/Fabc?format=png&name=orig"},
+		{"https://pbs.twimg.com/media/Fabc?format=webp&name=small", "", "", "https://pbs.twimg.com/media/Fabc?format=webp&name=small"},
+		{"https://pbs.twimg.com/media/Fabc?format=webp&name=small", "orig", "", "https://pbs.twimg.com/media/Fabc?format=webp&name=orig"},
+		{"https://pbs.twimg.com/media/Fabc", "medium", "", "https://pbs.twimg.com/media/Fabc?name=medium"},
+		{"https://example.com/a.jpg", "orig", "png", "https://example.com/a.jpg"},
+	}
+	for _, tt := range tests {
+		if got := ImageURL(tt.raw, tt.size, tt.format); got != tt.want {
+			t.Errorf("ImageURL(%q, %q, %q) = %q, want %q", tt.raw, tt.size, tt.format, got, tt.want)
+		}
+	}
+}
@@ -2,11 +2,12 @@ package scraper
 
 import (
 	"encoding/json"
-	"net/url"
+	"html"
 	"strings"
+	"time"
 )
 
-func fold(b []byte) ([]Media, error) {
+func fold(b []byte, sel selection) ([]Media, error) {
 	var root any
 	if err := json.Unmarshal(b, &root); err != nil {
 		return nil, err
@@ -15,16 +16,27 @@ func fold(b []byte) ([]Media, error) {
 	out := make([]Media, 0, 64)
 	seen := make(map[string]struct{}, 64)
 
-	collectMedia(root, "", &out, seen)
+	collectMedia(root, tweetMeta{}, -1, sel, &out, seen)
 
 	return out, nil
 }
 
-func collectMedia(v any, currentTweetID string, out *[]Media, seen map[string]struct{}) {
+type tweetMeta struct {
+	id, author, text, created string
+}
+
+func collectMedia(v any, tw tweetMeta, pos int, sel selection, out *[]Media, seen map[string]struct{}) {
 	switch t := v.(type) {
 	case map[string]any:
 		if id, ok := t["rest_id"].(string); ok && id != "" {
-			currentTweetID = id
+			tw.id = id
+			if lg, ok := t["legacy"].(map[string]any); ok {
+				if _, ok := lg["full_text"]; ok {
+					tw.author = tweetAuthor(t)
+					tw.text = tweetText(t, lg)
+					tw.created = tweetCreated(lg)
+				}
+			}
 		}
 
 		if rawURL, ok := t["media_url_https"]; ok {
@@ -43,101 +55,106 @@ func collectMedia(v any, currentTweetID string, out *[]Media, seen map[string]st
 					}
 				}
 
+				ow, oh := originalInfoFromAny(t)
 				urlStr := base
+				w, h, br, top, pol := ow, oh, 0, 0, ""
 				if mediaType == "video" {
-					if vu, _ := bestVideoVariant(t); vu != "" {
-						urlStr = vu
+					vs := variantsFromAny(t)
+					if vv, ok := SelectVideoVariant(vs, ow, oh, sel.video); ok {
+						urlStr = vv.URL
+						w, h, br, top = vv.Width, vv.Height, vv.Bitrate, topBitrate(vs)
+						pol = sel.video.String()
 					}
 				} else {
-					urlStr = normalizeImageURL(base)
+					urlStr = ImageURL(base, sel.image.Size, sel.image.primaryFormat())
+					pol = sel.image.String()
 				}
 
 				if urlStr != "" {
-					if _, dup := seen[urlStr]; !dup {
-						seen[urlStr] = struct{}{}
-						*out = append(*out, Media{
-							URL:     urlStr,
-							Type:    mediaType,
-							TweetID: currentTweetID,
-						})
+					idStr, _ := t["id_str"].(string)
+					key, _ := t["media_key"].(string)
+					idx := pos
+					if idx < 0 {
+						idx = 0
+					}
+					alt, _ := t["ext_alt_text"].(string)
+					m := Media{
+						URL:     urlStr,
+						Type:    mediaType,
+						TweetID: tw.id,
+						MediaID: idStr,
+						Key:     key,
+						Index:   idx,
+						Width:   w,
+						Height:  h,
+						Bitrate: br,
+						Top:     top,
+						Policy:  pol,
+						Author:  tw.author,
+						Text:    tw.text,
+						Alt:     alt,
+						Created: tw.created,
+					}
+					k := m.Identity()
+					if _, dup := seen[k]; !dup {
+						seen[k] = struct{}{}
+						*out = append(*out, m)
 					}
 				}
 			}
 		}
 
 		for _, child := range t {
-			collectMedia(child, currentTweetID, out, seen)
+			collectMedia(child, tw, -1, sel, out, seen)
 		}
 
 	case []any:
-		for _, child := range t {
-			collectMedia(child, currentTweetID, out, seen)
+		for i, child := range t {
+			collectMedia(child, tw, i, sel, out, seen)
 		}
 	}
 }
 
-func normalizeImageURL(u string) string {
-	if u == "" {
-		return ""
-	}
-	pu, err := url.Parse(u)
-	if err != nil {
-		return u
-	}
-	if !strings.Contains(strings.ToLower(pu.Host), "twimg.com") {
-		return u
-	}
-	q := pu.Query()
-	format := q.Get("format")
-
-	nq := url.Values{}
-	if format != "" {
-		nq.Set("format", format)
+func tweetAuthor(t map[string]any) string {
+	ur := dig(t, "core", "user_results", "result")
+	if s, ok := dig(ur, "core")["screen_name"].(string); ok && s != "" {
+		return s
 	}
-	nq.Set("name", "orig")
-	pu.RawQuery = nq.Encode()
-	return pu.String()
+	s, _ := dig(ur, "legacy")["screen_name"].(string)
+	return s
 }
 
-func bestVideoVariant(m map[string]any) (string, int) {
-	vi, ok := m["video_info"].(map[string]any)
-	if !ok {
-		return "", 0
+// tweetText prefers the full note text of long tweets and drops the trailing
+// t.co media link that display_text_range leaves out.
+func tweetText(t, lg map[string]any) string {
+	if s, ok := dig(t, "note_tweet", "note_tweet_results", "result")["text"].(string); ok && s != "" {
+		return s
 	}
-	vs, ok := vi["variants"].([]any)
-	if !ok || len(vs) == 0 {
-		return "", 0
+	s, _ := lg["full_text"].(string)
+	if r, ok := lg["display_text_range"].([]any); ok && len(r) == 2 {
+		a, _ := r[0].(float64)
+		b, _ := r[1].(float64)
+		rs := []rune(s)
+		if a >= 0 && int(b) <= len(rs) && a <= b {
+			s = string(rs[int(a):int(b)])
+		}
 	}
+	return strings.TrimSpace(html.UnescapeString(s))
+}
 
-	bestURL := ""
-	bestBR := -1
-
-	for _, it := range vs {
-		mv, ok := it.(map[string]any)
-		if !ok {
-			continue
-		}
-		ct, _ := mv["content_type"].(string)
-		ct = strings.ToLower(ct)
-		if !strings.Contains(ct, "video/mp4") {
-			continue
-		}
-		u, _ := mv["url"].(string)
-		if u == "" {
-			continue
-		}
-		br := 0
-		if f, ok := mv["bitrate"].(float64); ok {
-			br = int(f)
-		}
-		if br > bestBR {
-			bestBR = br
-			bestURL = u
-		}
+func tweetCreated(lg map[string]any) string {
+	s, _ := lg["created_at"].(string)
+	t, err := time.Parse(time.RubyDate, s)
+	if err != nil {
+		return ""
 	}
+	return t.UTC().Format(time.RFC3339)
+}
 
-	if bestURL == "" {
-		return "", 0
+func dig(v any, keys ...string) map[string]any {
+	m, _ := v.(map[string]any)
+	for _, k := range keys {
+		m, _ = m[k].(map[string]any)
 	}
-	return bestURL, bestBR
+	return m
 }
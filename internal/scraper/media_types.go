@@ -1 +1,65 @@
 package scraper
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Media struct {
+	URL     string `json:"url"`
+	Type    string `json:"type"`
+	TweetID string `json:"tweet_id,omitempty"`
+	MediaID string `json:"media_id,omitempty"`
+	Key     string `json:"media_key,omitempty"`
+	Index   int    `json:"index,omitempty"`
+	Width   int    `json:"width,omitempty"`
+	Height  int    `json:"height,omitempty"`
+	Bitrate int    `json:"bitrate,omitempty"`
+	Top     int    `json:"top_bitrate,omitempty"`
+	Policy  string `json:"policy,omitempty"`
+	Author  string `json:"author,omitempty"`
+	Text    string `json:"text,omitempty"`
+	Alt     string `json:"alt,omitempty"`
+	Created string `json:"created_at,omitempty"`
+}
+
+func (m Media) StableID() string {
+	if m.MediaID != "" {
+		return m.MediaID
+	}
+	if m.Key != "" {
+		if i := strings.IndexByte(m.Key, '_'); i >= 0 && i < len(m.Key)-1 {
+			return m.Key[i+1:]
+		}
+		return m.Key
+	}
+	return ""
+}
+
+func (m Media) Identity() string {
+	if id := m.StableID(); id != "" {
+		return "media:" + id
+	}
+	return "url:" + m.URL
+}
+
+const snowflakeEpoch = 1288834974657
+
+func SnowflakeTime(id string) time.Time {
+	n, err := strconv.ParseUint(strings.TrimSpace(id), 10, 64)
+	if err != nil || n < 1<<32 {
+		return time.Time{}
+	}
+	return time.UnixMilli(int64(n>>22) + snowflakeEpoch).UTC()
+}
+
+func (m Media) Time() time.Time {
+	if t, err := time.Parse(time.RFC3339, m.Created); err == nil {
+		return t.UTC()
+	}
+	if t := SnowflakeTime(m.TweetID); !t.IsZero() {
+		return t
+	}
+	return SnowflakeTime(m.StableID())
+}
@@ -0,0 +1,309 @@
+package scraper
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ghostlawless/xdl/internal/config"
+	"github.com/ghostlawless/xdl/internal/log"
+)
+
+type VideoVariant struct {
+	URL         string `json:"url"`
+	ContentType string `json:"content_type"`
+	Bitrate     int    `json:"bitrate"`
+	Width       int    `json:"width,omitempty"`
+	Height      int    `json:"height,omitempty"`
+}
+
+func (v VideoVariant) IsHLS() bool {
+	ct := strings.ToLower(v.ContentType)
+	if strings.Contains(ct, "mpegurl") {
+		return true
+	}
+	u := strings.ToLower(strings.SplitN(v.URL, "?", 2)[0])
+	return strings.HasSuffix(u, ".m3u8")
+}
+
+func (v VideoVariant) IsMP4() bool {
+	return strings.Contains(strings.ToLower(v.ContentType), "video/mp4")
+}
+
+const (
+	VideoModeBest    = "best"
+	VideoModeWorst   = "worst"
+	VideoModeBitrate = "bitrate"
+)
+
+type VideoPolicy struct {
+	Mode          string
+	MaxWidth      int
+	MaxHeight     int
+	TargetBitrate int
+	PreferHLS     bool
+}
+
+func ParseVideoPolicy(s string) (VideoPolicy, error) {
+	p := VideoPolicy{Mode: VideoModeBest}
+	s = strings.ToLower(strings.TrimSpace(s))
+	if s == "" {
+		return p, nil
+	}
+	for _, tok := range strings.Split(s, ",") {
+		tok = strings.TrimSpace(tok)
+		if tok == "" {
+			continue
+		}
+		k, v, hasV := strings.Cut(tok, "=")
+		switch k {
+		case VideoModeBest, VideoModeWorst:
+			p.Mode = k
+		case "hls":
+			p.PreferHLS = true
+		case "maxh", "maxw", "bitrate":
+			if !hasV {
+				return VideoPolicy{}, fmt.Errorf("video policy %q needs a value", k)
+			}
+			n, err := parsePolicyNumber(v)
+			if err != nil || n <= 0 {
+				return VideoPolicy{}, fmt.Errorf("invalid video policy value %q", tok)
+			}
+			switch k {
+			case "maxh":
+				p.MaxHeight = n
+			case "maxw":
+				p.MaxWidth = n
+			case "bitrate":
+				p.Mode = VideoModeBitrate
+				p.TargetBitrate = n
+			}
+		default:
+			return VideoPolicy{}, fmt.Errorf("unknown video policy %q (use best, worst, maxh=N, maxw=N, bitrate=N, hls)", tok)
+		}
+	}
+	return p, nil
+}
+
+func parsePolicyNumber(v string) (int, error) {
+	v = strings.TrimSpace(strings.ToLower(v))
+	mul := 1
+	switch {
+	case strings.HasSuffix(v, "p"):
+		v = strings.TrimSuffix(v, "p")
+	case strings.HasSuffix(v, "k"):
+		v = strings.TrimSuffix(v, "k")
+		mul = 1000
+	case strings.HasSuffix(v, "m"):
+		v = strings.TrimSuffix(v, "m")
+		mul = 1000000
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, err
+	}
+	return n * mul, nil
+}
+
+func (p VideoPolicy) String() string {
+	parts := make([]string, 0, 4)
+	switch p.Mode {
+	case VideoModeBitrate:
+		parts = append(parts, "bitrate="+strconv.Itoa(p.TargetBitrate))
+	case "":
+		parts = append(parts, VideoModeBest)
+	default:
+		parts = append(parts, p.Mode)
+	}
+	if p.MaxHeight > 0 {
+		parts = append(parts, "maxh="+strconv.Itoa(p.MaxHeight))
+	}
+	if p.MaxWidth > 0 {
+		parts = append(parts, "maxw="+strconv.Itoa(p.MaxWidth))
+	}
+	if p.PreferHLS {
+		parts = append(parts, "hls")
+	}
+	return strings.Join(parts, ",")
+}
+
+func videoPolicyFor(cf *config.EssentialsConfig) VideoPolicy {
+	if cf == nil {
+		return VideoPolicy{Mode: VideoModeBest}
+	}
+	p, err := ParseVideoPolicy(cf.Media.Video)
+	if err != nil {
+		return VideoPolicy{Mode: VideoModeBest}
+	}
+	return p
+}
+
+var variantResRe = regexp.MustCompile(`/(\d{2,5})x(\d{2,5})/`)
+
+func variantResolution(raw string) (int, int) {
+	u := raw
+	if pu, err := url.Parse(raw); err == nil && pu != nil {
+		u = pu.Path
+	}
+	m := variantResRe.FindStringSubmatch(u)
+	if len(m) != 3 {
+		return 0, 0
+	}
+	w, _ := strconv.Atoi(m[1])
+	h, _ := strconv.Atoi(m[2])
+	return w, h
+}
+
+func fillVariantResolution(vs []VideoVariant, origW, origH int) []VideoVariant {
+	out := make([]VideoVariant, 0, len(vs))
+	mp4s := 0
+	for _, v := range vs {
+		if v.IsMP4() {
+			mp4s++
+		}
+	}
+	for _, v := range vs {
+		if v.URL == "" {
+			continue
+		}
+		if v.Width == 0 || v.Height == 0 {
+			v.Width, v.Height = variantResolution(v.URL)
+		}
+		if (v.Width == 0 || v.Height == 0) && origW > 0 && origH > 0 {
+			if v.IsHLS() || (v.IsMP4() && mp4s == 1) {
+				v.Width, v.Height = origW, origH
+			}
+		}
+		out = append(out, v)
+	}
+	return out
+}
+
+func SelectVideoVariant(vs []VideoVariant, origW, origH int, p VideoPolicy) (VideoVariant, bool) {
+	vs = fillVariantResolution(vs, origW, origH)
+
+	var mp4s, hls []VideoVariant
+	for _, v := range vs {
+		switch {
+		case v.IsHLS():
+			hls = append(hls, v)
+		case v.IsMP4():
+			mp4s = append(mp4s, v)
+		}
+	}
+
+	if p.PreferHLS && len(hls) > 0 {
+		return hls[0], true
+	}
+
+	cands := mp4s
+	if len(cands) == 0 {
+		cands = hls
+	}
+	if len(cands) == 0 {
+		return VideoVariant{}, false
+	}
+
+	sort.SliceStable(cands, func(i, j int) bool {
+		if cands[i].Bitrate != cands[j].Bitrate {
+			return cands[i].Bitrate > cands[j].Bitrate
+		}
+		return cands[i].Height > cands[j].Height
+	})
+
+	// Variants of unknown size cannot be held to the limit and are kept.
+	// When nothing fits, the limit is dropped rather than guessing.
+	if p.MaxHeight > 0 || p.MaxWidth > 0 {
+		fit := make([]VideoVariant, 0, len(cands))
+		for _, v := range cands {
+			if p.MaxHeight > 0 && v.Height > p.MaxHeight {
+				continue
+			}
+			if p.MaxWidth > 0 && v.Width > p.MaxWidth {
+				continue
+			}
+			fit = append(fit, v)
+		}
+		if len(fit) == 0 {
+			log.LogInfo("media", fmt.Sprintf("no video variant fits %s, ignoring the size limit", p))
+		} else {
+			cands = fit
+		}
+	}
+
+	switch p.Mode {
+	case VideoModeWorst:
+		return cands[len(cands)-1], true
+	case VideoModeBitrate:
+		best := cands[0]
+		bd := absInt(best.Bitrate - p.TargetBitrate)
+		for _, v := range cands[1:] {
+			if d := absInt(v.Bitrate - p.TargetBitrate); d < bd {
+				best, bd = v, d
+			}
+		}
+		return best, true
+	default:
+		return cands[0], true
+	}
+}
+
+// topBitrate is the highest bitrate among the known variants.
+func topBitrate(vs []VideoVariant) int {
+	n := 0
+	for _, v := range vs {
+		if v.Bitrate > n {
+			n = v.Bitrate
+		}
+	}
+	return n
+}
+
+func absInt(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+func variantsFromAny(m map[string]any) []VideoVariant {
+	vi, ok := m["video_info"].(map[string]any)
+	if !ok {
+		return nil
+	}
+	vs, ok := vi["variants"].([]any)
+	if !ok || len(vs) == 0 {
+		return nil
+	}
+	out := make([]VideoVariant, 0, len(vs))
+	for _, it := range vs {
+		mv, ok := it.(map[string]any)
+		if !ok {
+			continue
+		}
+		v := VideoVariant{}
+		v.URL, _ = mv["url"].(string)
+		v.ContentType, _ = mv["content_type"].(string)
+		if f, ok := mv["bitrate"].(float64); ok {
+			v.Bitrate = int(f)
+		}
+		if v.URL == "" {
+			continue
+		}
+		out = append(out, v)
+	}
+	return out
+}
+
+func originalInfoFromAny(m map[string]any) (int, int) {
+	oi, ok := m["original_info"].(map[string]any)
+	if !ok {
+		return 0, 0
+	}
+	w, _ := oi["width"].(float64)
+	h, _ := oi["height"].(float64)
+	return int(w), int(h)
+}
@@ -0,0 +1,102 @@
+package scraper
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseVideoPolicy(t *testing.T) {
+	tests := []struct {
+		in   string
+		want VideoPolicy
+		str  string
+		err  string
+	}{
+		{"", VideoPolicy{Mode: VideoModeBest}, "best", ""},
+		{"worst", VideoPolicy{Mode: VideoModeWorst}, "worst", ""},
+		{" Best , maxh=720p ", VideoPolicy{Mode: VideoModeBest, MaxHeight: 720}, "best,maxh=720", ""},
+		{"maxw=1280,hls", VideoPolicy{Mode: VideoModeBest, MaxWidth: 1280, PreferHLS: true}, "best,maxw=1280,hls", ""},
+		{"bitrate=2m", VideoPolicy{Mode: VideoModeBitrate, TargetBitrate: 2000000}, "bitrate=2000000", ""},
+		{"bitrate=832k,maxh=480", VideoPolicy{Mode: VideoModeBitrate, TargetBitrate: 832000, MaxHeight: 480}, "bitrate=832000,maxh=480", ""},
+		{"maxh", VideoPolicy{}, "", "needs a value"},
+		{"maxh=0", VideoPolicy{}, "", "invalid video policy value"},
+		{"maxh=tall", VideoPolicy{}, "", "invalid video policy value"},
+		{"smallest", VideoPolicy{}, "", "unknown video policy"},
+	}
+	for _, tt := range tests {
+		got, err := ParseVideoPolicy(tt.in)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("ParseVideoPolicy(%q) err = %v, want %q", tt.in, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseVideoPolicy(%q): %v", tt.in, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseVideoPolicy(%q) = %+v, want %+v", tt.in, got, tt.want)
+		}
+		if s := got.String(); s != tt.str {
+			t.Errorf("ParseVideoPolicy(%q).String() = %q, want %q", tt.in, s, tt.str)
+		}
+	}
+}
+
+func TestSelectVideoVariant(t *testing.T) {
+	const base = "https://video.twimg.com/ext_tw_video/1/pu/vid/avc1/"
+	mp4 := func(res string, br int) VideoVariant {
+		return VideoVariant{URL: base + res + "/v.mp4", ContentType: "video/mp4", Bitrate: br}
+	}
+	hls := VideoVariant{URL: "https://video.twimg.com/ext_tw_video/1/pu/pl/master.m3u8", ContentType: "application/x-mpegURL"}
+	all := []VideoVariant{mp4("480x270", 256000), hls, mp4("1280x720", 2176000), mp4("640x360", 832000)}
+	// Unsized variants come from URLs without a WxH path element.
+	unsized := []VideoVariant{
+		{URL: "https://video.twimg.com/amplify_video/1/vid/hi.mp4", ContentType: "video/mp4", Bitrate: 2176000},
+		{URL: "https://video.twimg.com/amplify_video/1/vid/lo.mp4", ContentType: "video/mp4", Bitrate: 832000},
+	}
+
+	tests := []struct {
+		name string
+		vs   []VideoVariant
+		p    string
+		want string
+		ok   bool
+	}{
+		{"none", nil, "", "", false},
+		{"best", all, "", base + "1280x720/v.mp4", true},
+		{"worst", all, "worst", base + "480x270/v.mp4", true},
+		{"closest bitrate", all, "bitrate=900k", base + "640x360/v.mp4", true},
+		{"height cap", all, "maxh=400", base + "640x360/v.mp4", true},
+		{"width cap with worst", all, "worst,maxw=700", base + "480x270/v.mp4", true},
+		{"prefer hls", all, "hls", hls.URL, true},
+		{"hls only", []VideoVariant{hls}, "", hls.URL, true},
+		{"nothing fits keeps the policy", all, "maxh=144", base + "1280x720/v.mp4", true},
+		{"unknown size is not filtered", unsized, "maxh=480", unsized[0].URL, true},
+		{"unknown size with worst", unsized, "worst,maxh=480", unsized[1].URL, true},
+		{"unknown size kept beside a fitting one", append([]VideoVariant{mp4("640x360", 832000)}, unsized[0]), "maxh=360", unsized[0].URL, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := ParseVideoPolicy(tt.p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, ok := SelectVideoVariant(tt.vs, 0, 0, p)
+			if ok != tt.ok || got.URL != tt.want {
+				t.Errorf("SelectVideoVariant = %q, %v; want %q, %v", got.URL, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+func TestSelectVideoVariantOriginalSize(t *testing.T) {
+	// A single unsized MP4 takes the media's original size.
+	vs := []VideoVariant{{URL: "https://video.twimg.com/tweet_video/x.mp4", ContentType: "video/mp4"}}
+	p := VideoPolicy{Mode: VideoModeBest, MaxHeight: 480}
+	got, ok := SelectVideoVariant(vs, 1920, 1080, p)
+	if !ok || got.Width != 1920 || got.Height != 1080 {
+		t.Errorf("SelectVideoVariant = %+v, %v; want the 1920x1080 original", got, ok)
+	}
+}
@@ -0,0 +1,193 @@
+package scraper
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ghostlawless/xdl/internal/config"
+	"github.com/ghostlawless/xdl/internal/httpx"
+	"github.com/ghostlawless/xdl/internal/log"
+)
+
+const (
+	rateLimitRetries  = 3
+	rateLimitFallback = 60 * time.Second
+	rateLimitMaxWait  = 16 * time.Minute
+)
+
+type rateWindow struct {
+	limit     int
+	remaining int
+	reset     time.Time
+}
+
+type rateLimits struct {
+	mu  sync.Mutex
+	ops map[string]rateWindow
+	rep func(op string, left time.Duration)
+}
+
+var apiRates = &rateLimits{ops: make(map[string]rateWindow)}
+
+func SetRateLimitReporter(fn func(op string, left time.Duration)) {
+	apiRates.mu.Lock()
+	apiRates.rep = fn
+	apiRates.mu.Unlock()
+}
+
+func (r *rateLimits) observe(op string, st int, h http.Header) {
+	w, seen := parseRateHeaders(h)
+	if st == http.StatusTooManyRequests {
+		w.remaining = 0
+		if !w.reset.After(time.Now()) {
+			w.reset = time.Now().Add(retryAfter(h, rateLimitFallback))
+		}
+		seen = true
+	}
+	if !seen {
+		return
+	}
+	r.mu.Lock()
+	r.ops[op] = w
+	r.mu.Unlock()
+}
+
+func (r *rateLimits) blockedUntil(op string) time.Time {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	w, ok := r.ops[op]
+	if !ok || w.remaining > 0 || !w.reset.After(time.Now()) {
+		return time.Time{}
+	}
+	return w.reset
+}
+
+// wait blocks while op's rate limit window is exhausted, or until ctx is
+// done.
+func (r *rateLimits) wait(ctx context.Context, op string) error {
+	t := r.blockedUntil(op)
+	if t.IsZero() {
+		return nil
+	}
+	t = t.Add(time.Second)
+	if d := time.Until(t); d > rateLimitMaxWait {
+		t = time.Now().Add(rateLimitMaxWait)
+	}
+
+	log.LogInfo("api", fmt.Sprintf("%s rate limit exhausted; waiting until %s", op, t.Format(time.RFC3339)))
+
+	r.mu.Lock()
+	rep := r.rep
+	r.mu.Unlock()
+	if rep != nil {
+		defer rep(op, 0)
+	}
+
+	for {
+		left := time.Until(t)
+		if left <= 0 {
+			return nil
+		}
+		if rep != nil {
+			rep(op, left.Round(time.Second))
+		}
+		if left > time.Second {
+			left = time.Second
+		}
+		if err := sleepCtx(ctx, left); err != nil {
+			return err
+		}
+	}
+}
+
+// sleepCtx waits for d, or until ctx is done.
+func sleepCtx(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+func parseRateHeaders(h http.Header) (rateWindow, bool) {
+	if h == nil {
+		return rateWindow{}, false
+	}
+	rs := strings.TrimSpace(h.Get("x-rate-limit-remaining"))
+	if rs == "" {
+		return rateWindow{}, false
+	}
+	w := rateWindow{}
+	w.remaining, _ = strconv.Atoi(rs)
+	w.limit, _ = strconv.Atoi(strings.TrimSpace(h.Get("x-rate-limit-limit")))
+	if s, err := strconv.ParseInt(strings.TrimSpace(h.Get("x-rate-limit-reset")), 10, 64); err == nil && s > 0 {
+		w.reset = time.Unix(s, 0)
+	}
+	return w, true
+}
+
+func retryAfter(h http.Header, def time.Duration) time.Duration {
+	if h == nil {
+		return def
+	}
+	if d := httpx.RetryAfter(h); d > 0 {
+		return d
+	}
+	return def
+}
+
+func apiDo(cl *http.Client, cf *config.EssentialsConfig, op string, rq *http.Request, opt httpx.RequestOptions) ([]byte, int, error) {
+	mr := cf.MaxRetries()
+	rl, tr := 0, 0
+	ctx := rq.Context()
+	for {
+		if err := apiRates.wait(ctx, op); err != nil {
+			return nil, 0, err
+		}
+		opt.OnResponse = func(st int, h http.Header) { apiRates.observe(op, st, h) }
+		b, st, err := httpx.DoRequestWithOptions(cl, rq, opt)
+		switch {
+		case st == http.StatusTooManyRequests:
+			if rl >= rateLimitRetries {
+				return b, st, err
+			}
+			rl++
+			log.LogInfo("api", fmt.Sprintf("%s returned 429 (attempt %d/%d)", op, rl, rateLimitRetries+1))
+			continue
+		case err != nil && retryableAPIStatus(st):
+			if tr >= mr {
+				log.LogError("api", fmt.Sprintf("%s failed after %d attempt(s) (status %d): %v", op, tr+1, st, err))
+				return b, st, err
+			}
+			d := apiBackoff(tr)
+			tr++
+			log.LogInfo("api", fmt.Sprintf("%s attempt %d/%d failed (status %d): %v; retrying in %s", op, tr, mr+1, st, err, d))
+			if e := sleepCtx(ctx, d); e != nil {
+				return b, st, e
+			}
+			continue
+		}
+		return b, st, err
+	}
+}
+
+func retryableAPIStatus(st int) bool {
+	return st == 0 || st >= 500 || (st >= 200 && st < 300)
+}
+
+func apiBackoff(i int) time.Duration {
+	d := time.Second << uint(i)
+	if d > 30*time.Second || d <= 0 {
+		d = 30 * time.Second
+	}
+	return d + time.Duration(rand.Int63n(int64(d/2)))
+}
@@ -0,0 +1,80 @@
+package scraper
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ghostlawless/xdl/internal/config"
+	"github.com/ghostlawless/xdl/internal/httpx"
+)
+
+func TestRateLimitsWait(t *testing.T) {
+	r := &rateLimits{ops: map[string]rateWindow{
+		"open":    {remaining: 5, reset: time.Now().Add(time.Hour)},
+		"expired": {remaining: 0, reset: time.Now().Add(-time.Second)},
+		"blocked": {remaining: 0, reset: time.Now().Add(time.Hour)},
+	}}
+	tests := []struct {
+		op  string
+		err error
+	}{
+		{"unknown", nil},
+		{"open", nil},
+		{"expired", nil},
+		{"blocked", context.DeadlineExceeded},
+	}
+	for _, tt := range tests {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		t0 := time.Now()
+		err := r.wait(ctx, tt.op)
+		cancel()
+		if !errors.Is(err, tt.err) {
+			t.Errorf("wait(%s) = %v, want %v", tt.op, err, tt.err)
+		}
+		if d := time.Since(t0); d > time.Second {
+			t.Errorf("wait(%s) took %s", tt.op, d)
+		}
+	}
+}
+
+func TestAPIDoCancel(t *testing.T) {
+	tests := []struct {
+		name string
+		op   string
+		h    http.HandlerFunc
+	}{
+		{"429 window", "test_429", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("x-rate-limit-remaining", "0")
+			w.Header().Set("x-rate-limit-reset", fmt.Sprint(time.Now().Add(time.Hour).Unix()))
+			w.WriteHeader(http.StatusTooManyRequests)
+		}},
+		{"5xx backoff", "test_5xx", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(tt.h)
+			defer srv.Close()
+			ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+			defer cancel()
+			rq, _ := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL, nil)
+
+			t0 := time.Now()
+			cf := &config.EssentialsConfig{}
+			cf.Runtime.MaxRetries = 3
+			_, _, err := apiDo(srv.Client(), cf, tt.op, rq, httpx.RequestOptions{})
+			if !errors.Is(err, context.DeadlineExceeded) {
+				t.Errorf("apiDo = %v, want the context's error", err)
+			}
+			if d := time.Since(t0); d > 2*time.Second {
+				t.Errorf("apiDo returned after %s", d)
+			}
+		})
+	}
+}
@@ -7,7 +7,6 @@ import (
 	"fmt"
 	"net/http"
 	"net/url"
-	"sort"
 	"strings"
 	"time"
 
@@ -55,17 +54,32 @@ type tweetResult struct {
 
 type legacyMedia struct {
 	IDStr         string `json:"id_str"`
+	MediaKey      string `json:"media_key"`
 	MediaURLHTTPS string `json:"media_url_https"`
 	Type          string `json:"type"`
-	VideoInfo     struct {
-		Variants []struct {
-			URL         string `json:"url"`
-			Bitrate     *int   `json:"bitrate,omitempty"`
-			ContentType string `json:"content_type"`
-		} `json:"variants"`
+	OriginalInfo  struct {
+		Width  int `json:"width"`
+		Height int `json:"height"`
+	} `json:"original_info"`
+	VideoInfo struct {
+		Variants []legacyVariant `json:"variants"`
 	} `json:"video_info"`
 }
 
+type legacyVariant struct {
+	URL         string `json:"url"`
+	Bitrate     *int   `json:"bitrate,omitempty"`
+	ContentType string `json:"content_type"`
+}
+
+func (v legacyVariant) toVariant() VideoVariant {
+	br := 0
+	if v.Bitrate != nil {
+		br = *v.Bitrate
+	}
+	return VideoVariant{URL: v.URL, ContentType: v.ContentType, Bitrate: br}
+}
+
 func GetHighQualityMediaForTweet(
 	cl *http.Client,
 	cf *config.EssentialsConfig,
@@ -168,7 +182,7 @@ func GetHighQualityMediaForTweet(
 		return nil, errors.New("no tweet result in TweetDetail response")
 	}
 
-	return extractBestMediaFromTweet(tweet), nil
+	return extractBestMediaFromTweet(tweet, selectionFor(cf)), nil
 }
 
 func firstTweetResult(td *tweetDetailResponse) *tweetResult {
@@ -190,17 +204,21 @@ func firstTweetResult(td *tweetDetailResponse) *tweetResult {
 	return nil
 }
 
-func extractBestMediaFromTweet(tr *tweetResult) []Media {
+func extractBestMediaFromTweet(tr *tweetResult, sel selection) []Media {
 	if tr == nil {
 		return nil
 	}
 
 	legacy := tr.Legacy
+	tid := tr.RestID
 
 	if tr.Tweet != nil {
 		if len(tr.Tweet.Legacy.ExtendedEntities.Media) > 0 ||
 			len(tr.Tweet.Legacy.Entities.Media) > 0 {
 			legacy = tr.Tweet.Legacy
+			if tr.Tweet.RestID != "" {
+				tid = tr.Tweet.RestID
+			}
 		}
 	}
 
@@ -208,37 +226,52 @@ func extractBestMediaFromTweet(tr *tweetResult) []Media {
 	var out []Media
 
 	merge := func(ms []legacyMedia) {
-		for _, m := range ms {
+		for i, m := range ms {
+			ow, oh := m.OriginalInfo.Width, m.OriginalInfo.Height
+			var md Media
 			switch m.Type {
 			case "photo":
-				u := upgradePhotoURL(m.MediaURLHTTPS)
-				if u == "" {
-					continue
+				md = Media{
+					URL:    ImageURL(m.MediaURLHTTPS, sel.image.Size, sel.image.primaryFormat()),
+					Type:   "image",
+					Width:  ow,
+					Height: oh,
+					Policy: sel.image.String(),
 				}
-				if _, ok := seen[u]; ok {
-					continue
-				}
-				seen[u] = struct{}{}
-				out = append(out, Media{
-					URL:  u,
-					Type: "image",
-				})
 			case "video", "animated_gif":
-				u := bestVideoVariantURL(m.VideoInfo.Variants)
-				if u == "" {
-					continue
+				vs := make([]VideoVariant, 0, len(m.VideoInfo.Variants))
+				for _, v := range m.VideoInfo.Variants {
+					vs = append(vs, v.toVariant())
 				}
-				if _, ok := seen[u]; ok {
+				vv, ok := SelectVideoVariant(vs, ow, oh, sel.video)
+				if !ok {
 					continue
 				}
-				seen[u] = struct{}{}
-				out = append(out, Media{
-					URL:  u,
-					Type: "video",
-				})
+				md = Media{
+					URL:     vv.URL,
+					Type:    "video",
+					Width:   vv.Width,
+					Height:  vv.Height,
+					Bitrate: vv.Bitrate,
+					Top:     topBitrate(vs),
+					Policy:  sel.video.String(),
+				}
 			default:
 				continue
 			}
+			if md.URL == "" {
+				continue
+			}
+			md.TweetID = tid
+			md.MediaID = m.IDStr
+			md.Key = m.MediaKey
+			md.Index = i
+			k := md.Identity()
+			if _, ok := seen[k]; ok {
+				continue
+			}
+			seen[k] = struct{}{}
+			out = append(out, md)
 		}
 	}
 
@@ -247,59 +280,3 @@ func extractBestMediaFromTweet(tr *tweetResult) []Media {
 
 	return out
 }
-
-func upgradePhotoURL(raw string) string {
-	if raw == "" {
-		return ""
-	}
-	u, err := url.Parse(raw)
-	if err != nil {
-		return raw
-	}
-	q := u.Query()
-	if _, ok := q["name"]; ok {
-		q.Set("name", "orig")
-		u.RawQuery = q.Encode()
-		return u.String()
-	}
-	return raw
-}
-
-func bestVideoVariantURL(vs []struct {
-	URL         string `json:"url"`
-	Bitrate     *int   `json:"bitrate,omitempty"`
-	ContentType string `json:"content_type"`
-}) string {
-	if len(vs) == 0 {
-		return ""
-	}
-
-	type candidate struct {
-		url string
-		br  int
-	}
-	var cands []candidate
-
-	for _, v := range vs {
-		if v.URL == "" {
-			continue
-		}
-		if !strings.HasPrefix(v.ContentType, "video/") {
-			continue
-		}
-		br := 0
-		if v.Bitrate != nil {
-			br = *v.Bitrate
-		}
-		cands = append(cands, candidate{url: v.URL, br: br})
-	}
-
-	if len(cands) == 0 {
-		return ""
-	}
-
-	sort.Slice(cands, func(i, j int) bool {
-		return cands[i].br > cands[j].br
-	})
-	return cands[0].url
-}
@@ -0,0 +1,202 @@
+package scraper
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ghostlawless/xdl/internal/utils"
+)
+
+// TweetDetailCacheTTL bounds how long resolved CDN URLs are trusted.
+const TweetDetailCacheTTL = 7 * 24 * time.Hour
+
+// tweetDetailCacheEntry is one line of the cache file. Later lines win; a
+// line without media and fetch time drops the key.
+type tweetDetailCacheEntry struct {
+	Key       string    `json:"key"`
+	Media     []Media   `json:"media,omitempty"`
+	FetchedAt time.Time `json:"fetched_at,omitempty"`
+}
+
+// TweetDetailCache maps tweet ID and selection to resolved media. The file
+// is append-only JSON lines; it is rewritten on load once most lines are
+// stale.
+type TweetDetailCache struct {
+	mu      sync.Mutex
+	path    string
+	ttl     time.Duration
+	entries map[string]tweetDetailCacheEntry
+	pending []tweetDetailCacheEntry
+}
+
+func LoadTweetDetailCache(path string) (*TweetDetailCache, error) {
+	c := &TweetDetailCache{
+		path:    path,
+		ttl:     TweetDetailCacheTTL,
+		entries: make(map[string]tweetDetailCacheEntry),
+	}
+	if path == "" {
+		return c, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return c, nil
+		}
+		return c, err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 0, 64<<10), 16<<20)
+	lines := 0
+	for sc.Scan() {
+		var e tweetDetailCacheEntry
+		if json.Unmarshal(sc.Bytes(), &e) != nil || e.Key == "" {
+			continue
+		}
+		lines++
+		if e.FetchedAt.IsZero() || c.expired(e) {
+			delete(c.entries, e.Key)
+			continue
+		}
+		c.entries[e.Key] = e
+	}
+	if err := sc.Err(); err != nil {
+		return c, err
+	}
+	if lines > 2*len(c.entries)+64 {
+		f.Close()
+		if err := c.compact(); err != nil {
+			return c, err
+		}
+	}
+	return c, nil
+}
+
+func (c *TweetDetailCache) expired(e tweetDetailCacheEntry) bool {
+	return c.ttl > 0 && time.Since(e.FetchedAt) > c.ttl
+}
+
+func (c *TweetDetailCache) Get(key string) ([]Media, bool) {
+	if c == nil || key == "" {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	if c.expired(e) {
+		delete(c.entries, key)
+		return nil, false
+	}
+	out := make([]Media, len(e.Media))
+	copy(out, e.Media)
+	return out, true
+}
+
+func (c *TweetDetailCache) Put(key string, medias []Media) {
+	if c == nil || key == "" {
+		return
+	}
+	kept := make([]Media, 0, len(medias))
+	for _, m := range medias {
+		if m.StableID() == "" {
+			continue
+		}
+		kept = append(kept, m)
+	}
+	e := tweetDetailCacheEntry{Key: key, Media: kept, FetchedAt: time.Now().UTC()}
+	c.mu.Lock()
+	c.entries[key] = e
+	c.pending = append(c.pending, e)
+	c.mu.Unlock()
+}
+
+// Forget drops every cached selection for tweetID, for example after one of
+// its URLs stopped resolving.
+func (c *TweetDetailCache) Forget(tweetID string) {
+	if c == nil || tweetID == "" {
+		return
+	}
+	pre := tweetID + "|"
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for k := range c.entries {
+		if strings.HasPrefix(k, pre) {
+			delete(c.entries, k)
+			c.pending = append(c.pending, tweetDetailCacheEntry{Key: k})
+		}
+	}
+}
+
+func (c *TweetDetailCache) Len() int {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.entries)
+}
+
+// Save appends the entries changed since the last save.
+func (c *TweetDetailCache) Save() error {
+	if c == nil || c.path == "" {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.pending) == 0 {
+		return nil
+	}
+	var b bytes.Buffer
+	if err := encodeCacheLines(&b, c.pending); err != nil {
+		return err
+	}
+	if err := utils.EnsureDir(filepath.Dir(c.path)); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(c.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b.Bytes()); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	c.pending = c.pending[:0]
+	return nil
+}
+
+func (c *TweetDetailCache) compact() error {
+	es := make([]tweetDetailCacheEntry, 0, len(c.entries))
+	for _, e := range c.entries {
+		es = append(es, e)
+	}
+	var b bytes.Buffer
+	if err := encodeCacheLines(&b, es); err != nil {
+		return err
+	}
+	return utils.SaveToFile(c.path, b.Bytes())
+}
+
+func encodeCacheLines(b *bytes.Buffer, es []tweetDetailCacheEntry) error {
+	enc := json.NewEncoder(b)
+	for _, e := range es {
+		if err := enc.Encode(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
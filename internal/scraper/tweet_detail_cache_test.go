@@ -0,0 +1,129 @@
+package scraper
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func cacheFile(t *testing.T, lines ...any) string {
+	t.Helper()
+	var b bytes.Buffer
+	for _, l := range lines {
+		switch v := l.(type) {
+		case string:
+			b.WriteString(v + "\n")
+		default:
+			j, _ := json.Marshal(v)
+			b.Write(append(j, '\n'))
+		}
+	}
+	p := filepath.Join(t.TempDir(), "tweet_detail.jsonl")
+	if err := os.WriteFile(p, b.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func countLines(t *testing.T, p string) int {
+	t.Helper()
+	b, err := os.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bytes.Count(b, []byte("\n"))
+}
+
+func TestTweetDetailCacheLoad(t *testing.T) {
+	now := time.Now().UTC()
+	m := []Media{{Type: "image", MediaID: "11", URL: "https://pbs.twimg.com/media/a.jpg?name=orig"}}
+	entry := func(k string, age time.Duration) tweetDetailCacheEntry {
+		return tweetDetailCacheEntry{Key: k, Media: m, FetchedAt: now.Add(-age)}
+	}
+
+	p := cacheFile(t,
+		entry("1|orig", time.Hour),
+		entry("2|orig", TweetDetailCacheTTL+time.Hour),
+		entry("3|orig", time.Hour),
+		tweetDetailCacheEntry{Key: "3|orig"},
+		"not json",
+		entry("4|orig", 2*TweetDetailCacheTTL),
+		entry("4|orig", time.Minute),
+	)
+	c, err := LoadTweetDetailCache(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		key string
+		ok  bool
+	}{
+		{"1|orig", true},
+		{"2|orig", false},
+		{"3|orig", false},
+		{"4|orig", true},
+		{"5|orig", false},
+	}
+	for _, tt := range tests {
+		got, ok := c.Get(tt.key)
+		if ok != tt.ok || (ok && got[0].URL != m[0].URL) {
+			t.Errorf("Get(%s) = %v, %v; want found %v", tt.key, got, ok, tt.ok)
+		}
+	}
+	if c.Len() != 2 {
+		t.Errorf("Len = %d, want 2", c.Len())
+	}
+	if n := countLines(t, p); n != 7 {
+		t.Errorf("file rewritten to %d lines while mostly live", n)
+	}
+}
+
+func TestTweetDetailCacheCompaction(t *testing.T) {
+	now := time.Now().UTC()
+	var lines []any
+	for i := 0; i < 200; i++ {
+		lines = append(lines, tweetDetailCacheEntry{
+			Key:       fmt.Sprintf("%d|orig", i%5),
+			Media:     []Media{{Type: "image", MediaID: fmt.Sprint(i), URL: fmt.Sprintf("u%d", i)}},
+			FetchedAt: now.Add(-time.Duration(200-i) * time.Minute),
+		})
+	}
+	p := cacheFile(t, lines...)
+	c, err := LoadTweetDetailCache(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := countLines(t, p); n != 5 {
+		t.Errorf("compacted file has %d lines, want 5", n)
+	}
+	if got, ok := c.Get("4|orig"); !ok || got[0].URL != "u199" {
+		t.Errorf("Get(4|orig) = %v, %v; want the last line's media", got, ok)
+	}
+
+	// Changes are appended and survive a reload; Forget leaves a tombstone.
+	c.Put("9|orig", []Media{{Type: "video", MediaID: "9", URL: "v"}, {Type: "image", URL: "no-id"}})
+	c.Forget("4")
+	if err := c.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if n := countLines(t, p); n != 7 {
+		t.Errorf("file has %d lines after save, want 7", n)
+	}
+	c, err = LoadTweetDetailCache(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := c.Get("9|orig"); !ok || len(got) != 1 {
+		t.Errorf("Get(9|orig) = %v, %v; want the one media with an id", got, ok)
+	}
+	if _, ok := c.Get("4|orig"); ok {
+		t.Error("forgotten tweet still cached")
+	}
+	if c.Len() != 5 {
+		t.Errorf("Len = %d, want 5", c.Len())
+	}
+}
@@ -0,0 +1,100 @@
+package storage
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+
+	"github.com/ghostlawless/xdl/internal/utils"
+)
+
+// Local stores objects as files under Root. Writes go to a temporary file
+// in the same folder and are renamed into place on Commit.
+type Local struct {
+	Root string
+}
+
+func NewLocal(root string) *Local {
+	return &Local{Root: root}
+}
+
+func (l *Local) Path(name string) string {
+	return filepath.Join(l.Root, filepath.FromSlash(name))
+}
+
+func (l *Local) String() string { return l.Root }
+
+func (l *Local) Exists(name string) (bool, error) {
+	_, err := l.Stat(name)
+	if errors.Is(err, ErrNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (l *Local) Stat(name string) (Info, error) {
+	st, err := os.Stat(l.Path(name))
+	if err != nil {
+		return Info{}, err
+	}
+	if st.IsDir() {
+		return Info{}, &os.PathError{Op: "stat", Path: l.Path(name), Err: ErrNotExist}
+	}
+	return Info{Size: st.Size(), ModTime: st.ModTime()}, nil
+}
+
+func (l *Local) Remove(name string) error {
+	err := os.Remove(l.Path(name))
+	if errors.Is(err, ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+func (l *Local) Create(name string) (Writer, error) {
+	p := l.Path(name)
+	if err := utils.EnsureDir(filepath.Dir(p)); err != nil {
+		return nil, err
+	}
+	f, err := os.CreateTemp(filepath.Dir(p), filepath.Base(p)+".tmp-*")
+	if err != nil {
+		return nil, err
+	}
+	return &localWriter{f: f, dst: p}, nil
+}
+
+type localWriter struct {
+	f   *os.File
+	dst string
+}
+
+func (w *localWriter) Write(b []byte) (int, error) { return w.f.Write(b) }
+
+func (w *localWriter) Commit() error {
+	tmp := w.f.Name()
+	if err := w.f.Close(); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, w.dst); err == nil {
+		return nil
+	}
+	// Windows will not rename over an existing file.
+	_ = os.Remove(w.dst)
+	if err := os.Rename(tmp, w.dst); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+func (w *localWriter) Abort() error {
+	w.f.Close()
+	return os.Remove(w.f.Name())
+}
+
+// Resume opens the unfinished download for name, kept beside it as a .part
+// file until Commit.
+func (l *Local) Resume(name string) (Part, error) {
+	return OpenPart(l.Path(name))
+}
@@ -0,0 +1,127 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/ghostlawless/xdl/internal/utils"
+)
+
+// Part is an unfinished object that outlives a failed attempt, so the next
+// one can continue from Size instead of the first byte. Tag is an opaque
+// validator the caller keeps with it. Close keeps the part for a later
+// Resume; Commit publishes it and Abort drops it.
+type Part interface {
+	Writer
+	Size() int64
+	Tag() string
+	SetTag(tag string) error
+	Reset() error
+	Open() (io.ReadCloser, error)
+	Close() error
+}
+
+// Resumer is implemented by storages that can keep a Part between attempts
+// and runs.
+type Resumer interface {
+	Resume(name string) (Part, error)
+}
+
+// OpenPart opens the unfinished file for dst, kept next to it as dst.part
+// with its tag in dst.part.json.
+func OpenPart(dst string) (Part, error) {
+	if err := utils.EnsureDir(filepath.Dir(dst)); err != nil {
+		return nil, err
+	}
+	p := &filePart{dst: dst}
+	if st, err := os.Stat(p.path()); err == nil && st.Mode().IsRegular() {
+		p.size = st.Size()
+	}
+	if p.size > 0 {
+		if b, err := os.ReadFile(p.tagPath()); err == nil {
+			p.tag = string(b)
+		}
+	}
+	f, err := os.OpenFile(p.path(), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	p.f = f
+	return p, nil
+}
+
+// RemovePart drops whatever OpenPart left for dst.
+func RemovePart(dst string) {
+	p := &filePart{dst: dst}
+	_ = os.Remove(p.path())
+	_ = os.Remove(p.tagPath())
+}
+
+type filePart struct {
+	dst  string
+	f    *os.File
+	size int64
+	tag  string
+}
+
+func (p *filePart) path() string    { return p.dst + ".part" }
+func (p *filePart) tagPath() string { return p.dst + ".part.json" }
+
+func (p *filePart) Size() int64 { return p.size }
+func (p *filePart) Tag() string { return p.tag }
+
+func (p *filePart) Write(b []byte) (int, error) {
+	n, err := p.f.Write(b)
+	p.size += int64(n)
+	return n, err
+}
+
+func (p *filePart) SetTag(tag string) error {
+	if err := os.WriteFile(p.tagPath(), []byte(tag), 0o644); err != nil {
+		return err
+	}
+	p.tag = tag
+	return nil
+}
+
+func (p *filePart) Reset() error {
+	if err := p.f.Truncate(0); err != nil {
+		return err
+	}
+	p.size, p.tag = 0, ""
+	if err := os.Remove(p.tagPath()); err != nil && !errors.Is(err, ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (p *filePart) Open() (io.ReadCloser, error) {
+	return os.Open(p.path())
+}
+
+func (p *filePart) Close() error {
+	return p.f.Close()
+}
+
+func (p *filePart) Commit() error {
+	if err := p.f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(p.path(), p.dst); err != nil {
+		// Windows will not rename over an existing file.
+		_ = os.Remove(p.dst)
+		if err := os.Rename(p.path(), p.dst); err != nil {
+			return err
+		}
+	}
+	_ = os.Remove(p.tagPath())
+	return nil
+}
+
+func (p *filePart) Abort() error {
+	p.f.Close()
+	RemovePart(p.dst)
+	return nil
+}
@@ -0,0 +1,419 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	MinPartSize     = 5 << 20
+	DefaultPartSize = 8 << 20
+	s3Attempts      = 4
+	maxParts        = 10000
+)
+
+type S3Config struct {
+	Endpoint     string
+	Region       string
+	Bucket       string
+	Prefix       string
+	AccessKey    string
+	SecretKey    string
+	SessionToken string
+	PartSize     int64
+	Client       *http.Client
+}
+
+// S3 stores objects in an S3-compatible bucket. Without an endpoint it talks
+// to AWS with virtual-hosted URLs; a custom endpoint (MinIO, R2, ...) is
+// addressed path-style.
+type S3 struct {
+	cfg  S3Config
+	base *url.URL
+	path bool
+	cl   *http.Client
+}
+
+type S3Error struct {
+	Status  int
+	Code    string
+	Message string
+}
+
+func (e *S3Error) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("s3: HTTP %d", e.Status)
+	}
+	return fmt.Sprintf("s3: %s: %s (HTTP %d)", e.Code, e.Message, e.Status)
+}
+
+func NewS3(c S3Config) (*S3, error) {
+	if c.Bucket == "" {
+		return nil, errors.New("s3: no bucket")
+	}
+	if c.AccessKey == "" || c.SecretKey == "" {
+		return nil, errors.New("s3: missing access key or secret key")
+	}
+	if c.Region == "" {
+		c.Region = "us-east-1"
+	}
+	if c.PartSize <= 0 {
+		c.PartSize = DefaultPartSize
+	}
+	if c.PartSize < MinPartSize {
+		return nil, fmt.Errorf("s3: part size must be at least %d bytes", MinPartSize)
+	}
+	c.Prefix = strings.Trim(c.Prefix, "/")
+	s := &S3{cfg: c, cl: c.Client}
+	if s.cl == nil {
+		s.cl = &http.Client{Timeout: 10 * time.Minute}
+	}
+	ep := c.Endpoint
+	if ep == "" {
+		ep = "https://s3." + c.Region + ".amazonaws.com"
+	} else {
+		s.path = true
+		if !strings.Contains(ep, "://") {
+			ep = "https://" + ep
+		}
+	}
+	u, err := url.Parse(strings.TrimRight(ep, "/"))
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("s3: invalid endpoint %q", c.Endpoint)
+	}
+	if !s.path {
+		u.Host = c.Bucket + "." + u.Host
+	}
+	s.base = u
+	return s, nil
+}
+
+func (s *S3) String() string {
+	if s.cfg.Prefix == "" {
+		return "s3://" + s.cfg.Bucket
+	}
+	return "s3://" + s.cfg.Bucket + "/" + s.cfg.Prefix
+}
+
+func (s *S3) key(name string) string {
+	return path.Join(s.cfg.Prefix, strings.TrimLeft(name, "/"))
+}
+
+func (s *S3) objectURL(key string, q url.Values) *url.URL {
+	u := *s.base
+	p := "/" + key
+	if s.path {
+		p = "/" + s.cfg.Bucket + p
+	}
+	u.Path = p
+	u.RawPath = uriEncode(p, false)
+	u.RawQuery = canonicalQuery(q)
+	return &u
+}
+
+// do sends one signed request, retrying throttling, 5xx and network
+// errors. The body is held in memory so it can be sent again.
+func (s *S3) do(method, key string, q url.Values, body []byte, hdr http.Header) (*http.Response, error) {
+	sum := emptyPayload
+	if len(body) > 0 {
+		sum = sha256Hex(body)
+	}
+	var last error
+	for i := 0; i < s3Attempts; i++ {
+		if i > 0 {
+			time.Sleep(time.Duration(1<<(i-1)) * time.Second)
+		}
+		rq, err := http.NewRequest(method, s.objectURL(key, q).String(), bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		rq.ContentLength = int64(len(body))
+		for k, v := range hdr {
+			rq.Header[k] = v
+		}
+		s.sign(rq, sum, time.Now())
+		res, err := s.cl.Do(rq)
+		if err != nil {
+			last = err
+			var ne net.Error
+			if errors.As(err, &ne) || errors.Is(err, io.ErrUnexpectedEOF) {
+				continue
+			}
+			return nil, err
+		}
+		if res.StatusCode < 300 {
+			return res, nil
+		}
+		last = s3ErrorOf(res)
+		if res.StatusCode != http.StatusTooManyRequests && res.StatusCode < 500 {
+			return nil, last
+		}
+	}
+	return nil, last
+}
+
+func s3ErrorOf(res *http.Response) error {
+	defer res.Body.Close()
+	e := &S3Error{Status: res.StatusCode}
+	b, _ := io.ReadAll(io.LimitReader(res.Body, 64<<10))
+	_ = xml.Unmarshal(b, &struct {
+		Code    *string `xml:"Code"`
+		Message *string `xml:"Message"`
+	}{&e.Code, &e.Message})
+	return e
+}
+
+func (s *S3) Stat(name string) (Info, error) {
+	res, err := s.do(http.MethodHead, s.key(name), nil, nil, nil)
+	if err != nil {
+		var se *S3Error
+		if errors.As(err, &se) && se.Status == http.StatusNotFound {
+			return Info{}, fmt.Errorf("%s: %w", name, ErrNotExist)
+		}
+		return Info{}, err
+	}
+	res.Body.Close()
+	fi := Info{Size: res.ContentLength}
+	if t, err := http.ParseTime(res.Header.Get("Last-Modified")); err == nil {
+		fi.ModTime = t
+	}
+	return fi, nil
+}
+
+func (s *S3) Exists(name string) (bool, error) {
+	_, err := s.Stat(name)
+	if errors.Is(err, ErrNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *S3) Remove(name string) error {
+	res, err := s.do(http.MethodDelete, s.key(name), nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	return nil
+}
+
+// Create streams an object in parts of PartSize, uploading one part while
+// the next is filled. Objects smaller than one part are sent with a single
+// PUT on Commit.
+func (s *S3) Create(name string) (Writer, error) {
+	return &s3Writer{s: s, key: s.key(name), buf: make([]byte, 0, s.cfg.PartSize)}, nil
+}
+
+type s3Writer struct {
+	s     *S3
+	key   string
+	buf   []byte
+	spare []byte
+	id    string
+	tags  []string
+	wg    sync.WaitGroup
+	perr  error
+	err   error
+	done  bool
+}
+
+func (w *s3Writer) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	n := len(p)
+	for len(p) > 0 {
+		k := cap(w.buf) - len(w.buf)
+		if k > len(p) {
+			k = len(p)
+		}
+		w.buf = append(w.buf, p[:k]...)
+		p = p[k:]
+		if len(w.buf) == cap(w.buf) {
+			if err := w.flush(); err != nil {
+				return n - len(p), err
+			}
+		}
+	}
+	return n, nil
+}
+
+// flush hands the full buffer to a background upload after the previous
+// part has finished.
+func (w *s3Writer) flush() error {
+	if err := w.wait(); err != nil {
+		return err
+	}
+	if w.id == "" {
+		id, err := w.s.initUpload(w.key)
+		if err != nil {
+			w.err = err
+			return err
+		}
+		w.id = id
+	}
+	if len(w.tags) >= maxParts {
+		w.err = fmt.Errorf("s3: %s needs more than %d parts; raise the part size", w.key, maxParts)
+		return w.err
+	}
+	if w.spare == nil {
+		w.spare = make([]byte, 0, cap(w.buf))
+	}
+	b := w.buf
+	w.buf, w.spare = w.spare[:0], b
+	n := len(w.tags) + 1
+	w.tags = append(w.tags, "")
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		tag, err := w.s.uploadPart(w.key, w.id, n, b)
+		if err != nil {
+			w.perr = err
+			return
+		}
+		w.tags[n-1] = tag
+	}()
+	return nil
+}
+
+func (w *s3Writer) wait() error {
+	w.wg.Wait()
+	if w.perr != nil && w.err == nil {
+		w.err = w.perr
+	}
+	return w.err
+}
+
+func (w *s3Writer) Commit() error {
+	if w.done {
+		return errors.New("s3: object already committed or aborted")
+	}
+	if err := w.wait(); err != nil {
+		_ = w.Abort()
+		return err
+	}
+	if w.id == "" {
+		w.done = true
+		res, err := w.s.do(http.MethodPut, w.key, nil, w.buf, nil)
+		if err != nil {
+			return err
+		}
+		res.Body.Close()
+		return nil
+	}
+	if len(w.buf) > 0 {
+		tag, err := w.s.uploadPart(w.key, w.id, len(w.tags)+1, w.buf)
+		if err != nil {
+			_ = w.Abort()
+			return err
+		}
+		w.tags = append(w.tags, tag)
+	}
+	w.done = true
+	if err := w.s.completeUpload(w.key, w.id, w.tags); err != nil {
+		_ = w.s.abortUpload(w.key, w.id)
+		return err
+	}
+	return nil
+}
+
+func (w *s3Writer) Abort() error {
+	w.wg.Wait()
+	if w.err == nil {
+		w.err = errors.New("s3: write aborted")
+	}
+	if w.done {
+		return nil
+	}
+	w.done = true
+	if w.id == "" {
+		return nil
+	}
+	return w.s.abortUpload(w.key, w.id)
+}
+
+func (s *S3) initUpload(key string) (string, error) {
+	res, err := s.do(http.MethodPost, key, url.Values{"uploads": {""}}, nil, nil)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	var out struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err := xml.NewDecoder(res.Body).Decode(&out); err != nil {
+		return "", fmt.Errorf("s3: create multipart upload: %w", err)
+	}
+	if out.UploadID == "" {
+		return "", errors.New("s3: create multipart upload returned no upload id")
+	}
+	return out.UploadID, nil
+}
+
+func (s *S3) uploadPart(key, id string, n int, b []byte) (string, error) {
+	q := url.Values{"partNumber": {strconv.Itoa(n)}, "uploadId": {id}}
+	res, err := s.do(http.MethodPut, key, q, b, nil)
+	if err != nil {
+		return "", err
+	}
+	res.Body.Close()
+	tag := res.Header.Get("ETag")
+	if tag == "" {
+		return "", fmt.Errorf("s3: part %d of %s returned no ETag", n, key)
+	}
+	return tag, nil
+}
+
+type completePart struct {
+	PartNumber int
+	ETag       string
+}
+
+func (s *S3) completeUpload(key, id string, tags []string) error {
+	var body struct {
+		XMLName xml.Name       `xml:"CompleteMultipartUpload"`
+		Parts   []completePart `xml:"Part"`
+	}
+	for i, t := range tags {
+		body.Parts = append(body.Parts, completePart{PartNumber: i + 1, ETag: t})
+	}
+	b, err := xml.Marshal(body)
+	if err != nil {
+		return err
+	}
+	hdr := http.Header{"Content-Type": {"application/xml"}}
+	res, err := s.do(http.MethodPost, key, url.Values{"uploadId": {id}}, b, hdr)
+	if err != nil {
+		return err
+	}
+	// S3 can report a failed completion in the body of a 200.
+	rb, err := io.ReadAll(io.LimitReader(res.Body, 64<<10))
+	res.Body.Close()
+	if err != nil {
+		return err
+	}
+	if bytes.Contains(rb, []byte("<Error>")) {
+		return s3ErrorOf(&http.Response{StatusCode: res.StatusCode, Body: io.NopCloser(bytes.NewReader(rb))})
+	}
+	return nil
+}
+
+func (s *S3) abortUpload(key, id string) error {
+	res, err := s.do(http.MethodDelete, key, url.Values{"uploadId": {id}}, nil, nil)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	return nil
+}
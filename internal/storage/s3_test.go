@@ -0,0 +1,319 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+const (
+	testAccessKey = "AKIDTEST"
+	testSecretKey = "test-secret"
+	testBucket    = "bkt"
+)
+
+// fakeS3 is a path-style, MinIO-like bucket that rejects any request whose
+// SigV4 signature it cannot reproduce from what arrived on the wire.
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+	uploads map[string]map[int][]byte
+	calls   []string
+	next    int
+}
+
+func newFakeS3(t *testing.T) (*fakeS3, *httptest.Server) {
+	f := &fakeS3{objects: make(map[string][]byte), uploads: make(map[string]map[int][]byte)}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	return f, srv
+}
+
+func (f *fakeS3) fail(w http.ResponseWriter, st int, code, msg string) {
+	w.WriteHeader(st)
+	fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, msg)
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	if err := checkSigV4(r, body); err != nil {
+		f.fail(w, http.StatusForbidden, "SignatureDoesNotMatch", err.Error())
+		return
+	}
+	key, ok := strings.CutPrefix(r.URL.Path, "/"+testBucket+"/")
+	if !ok {
+		f.fail(w, http.StatusNotFound, "NoSuchBucket", r.URL.Path)
+		return
+	}
+	q := r.URL.Query()
+	id := q.Get("uploadId")
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch {
+	case r.Method == http.MethodPost && q.Has("uploads"):
+		f.next++
+		id = "upload-" + strconv.Itoa(f.next)
+		f.uploads[id] = make(map[int][]byte)
+		f.calls = append(f.calls, "create")
+		fmt.Fprintf(w, "<InitiateMultipartUploadResult><UploadId>%s</UploadId></InitiateMultipartUploadResult>", id)
+	case r.Method == http.MethodPut && id != "":
+		parts, ok := f.uploads[id]
+		if !ok {
+			f.fail(w, http.StatusNotFound, "NoSuchUpload", id)
+			return
+		}
+		n, _ := strconv.Atoi(q.Get("partNumber"))
+		parts[n] = body
+		f.calls = append(f.calls, "part "+strconv.Itoa(n))
+		w.Header().Set("ETag", partETag(n))
+	case r.Method == http.MethodPost && id != "":
+		parts, ok := f.uploads[id]
+		if !ok {
+			f.fail(w, http.StatusNotFound, "NoSuchUpload", id)
+			return
+		}
+		var req struct {
+			Parts []completePart `xml:"Part"`
+		}
+		if err := xml.Unmarshal(body, &req); err != nil || len(req.Parts) != len(parts) {
+			f.fail(w, http.StatusBadRequest, "MalformedXML", "bad part list")
+			return
+		}
+		var obj []byte
+		for i, p := range req.Parts {
+			if p.PartNumber != i+1 || p.ETag != partETag(p.PartNumber) {
+				f.fail(w, http.StatusBadRequest, "InvalidPart", strconv.Itoa(p.PartNumber))
+				return
+			}
+			obj = append(obj, parts[p.PartNumber]...)
+		}
+		delete(f.uploads, id)
+		f.objects[key] = obj
+		f.calls = append(f.calls, "complete")
+		fmt.Fprint(w, "<CompleteMultipartUploadResult></CompleteMultipartUploadResult>")
+	case r.Method == http.MethodDelete && id != "":
+		delete(f.uploads, id)
+		f.calls = append(f.calls, "abort")
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPut:
+		f.objects[key] = body
+		f.calls = append(f.calls, "put")
+	case r.Method == http.MethodHead:
+		b, ok := f.objects[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+	case r.Method == http.MethodDelete:
+		delete(f.objects, key)
+		f.calls = append(f.calls, "delete")
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		f.fail(w, http.StatusMethodNotAllowed, "MethodNotAllowed", r.Method)
+	}
+}
+
+func (f *fakeS3) reset() {
+	f.mu.Lock()
+	f.calls = nil
+	f.mu.Unlock()
+}
+
+func partETag(n int) string {
+	return `"etag-` + strconv.Itoa(n) + `"`
+}
+
+// checkSigV4 rebuilds the canonical request from the request as received
+// and compares the signature the client sent.
+func checkSigV4(r *http.Request, body []byte) error {
+	auth, ok := strings.CutPrefix(r.Header.Get("Authorization"), sigAlgo+" ")
+	if !ok {
+		return errors.New("no SigV4 authorization")
+	}
+	fs := make(map[string]string)
+	for _, f := range strings.Split(auth, ", ") {
+		k, v, _ := strings.Cut(f, "=")
+		fs[k] = v
+	}
+	t := r.Header.Get("X-Amz-Date")
+	if len(t) != len(amzDate) {
+		return fmt.Errorf("bad X-Amz-Date %q", t)
+	}
+	scope := t[:8] + "/us-east-1/s3/aws4_request"
+	if fs["Credential"] != testAccessKey+"/"+scope {
+		return fmt.Errorf("bad credential %q", fs["Credential"])
+	}
+	sum := r.Header.Get("X-Amz-Content-Sha256")
+	if sum != sha256Hex(body) {
+		return errors.New("X-Amz-Content-Sha256 does not match the body")
+	}
+	signed := fs["SignedHeaders"]
+	for _, h := range []string{"host", "x-amz-content-sha256", "x-amz-date"} {
+		if !strings.Contains(";"+signed+";", ";"+h+";") {
+			return fmt.Errorf("%s is not signed", h)
+		}
+	}
+	var ch strings.Builder
+	for _, h := range strings.Split(signed, ";") {
+		v := r.Header.Get(h)
+		if h == "host" {
+			v = r.Host
+		}
+		ch.WriteString(h + ":" + strings.TrimSpace(v) + "\n")
+	}
+	p, _, _ := strings.Cut(r.RequestURI, "?")
+	creq := strings.Join([]string{r.Method, p, canonicalQuery(r.URL.Query()), ch.String(), signed, sum}, "\n")
+	sts := sigAlgo + "\n" + t + "\n" + scope + "\n" + sha256Hex([]byte(creq))
+	k := hmacSHA256([]byte("AWS4"+testSecretKey), t[:8])
+	for _, s := range []string{"us-east-1", "s3", "aws4_request"} {
+		k = hmacSHA256(k, s)
+	}
+	if want := hex.EncodeToString(hmacSHA256(k, sts)); fs["Signature"] != want {
+		return errors.New("signature mismatch")
+	}
+	return nil
+}
+
+func newTestS3(t *testing.T, srv *httptest.Server, secret string) *S3 {
+	t.Helper()
+	s, err := NewS3(S3Config{
+		Endpoint:  srv.URL,
+		Bucket:    testBucket,
+		Prefix:    "/runs/",
+		AccessKey: testAccessKey,
+		SecretKey: secret,
+		PartSize:  MinPartSize,
+		Client:    srv.Client(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func testData(n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(i * 7)
+	}
+	return b
+}
+
+func TestS3Create(t *testing.T) {
+	f, srv := newFakeS3(t)
+	s := newTestS3(t, srv, testSecretKey)
+
+	tests := []struct {
+		name  string
+		obj   string
+		size  int
+		calls []string
+	}{
+		{"empty", "u/empty.txt", 0, []string{"put"}},
+		{"single put", "u/a b+c(1).jpg", 1000, []string{"put"}},
+		{"one full part", "u/one.mp4", MinPartSize, []string{"create", "part 1", "complete"}},
+		{"multipart", "u/ü/big.mp4", 2*MinPartSize + 123, []string{"create", "part 1", "part 2", "part 3", "complete"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f.reset()
+			data := testData(tt.size)
+			w, err := s.Create(tt.obj)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for b := data; len(b) > 0; {
+				n := min(len(b), 300001)
+				if _, err := w.Write(b[:n]); err != nil {
+					t.Fatal(err)
+				}
+				b = b[n:]
+			}
+			if err := w.Commit(); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(f.calls, tt.calls) {
+				t.Errorf("calls = %v, want %v", f.calls, tt.calls)
+			}
+			if got := f.objects["runs/"+tt.obj]; !bytes.Equal(got, data) {
+				t.Errorf("stored %d bytes, want %d", len(got), len(data))
+			}
+			fi, err := s.Stat(tt.obj)
+			if err != nil || fi.Size != int64(tt.size) {
+				t.Errorf("Stat = %+v, %v; want size %d", fi, err, tt.size)
+			}
+		})
+	}
+}
+
+func TestS3Abort(t *testing.T) {
+	f, srv := newFakeS3(t)
+	s := newTestS3(t, srv, testSecretKey)
+
+	w, err := s.Create("u/partial.mp4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(testData(MinPartSize + 10)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Abort(); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"create", "part 1", "abort"}; !reflect.DeepEqual(f.calls, want) {
+		t.Errorf("calls = %v, want %v", f.calls, want)
+	}
+	if len(f.uploads) != 0 || len(f.objects) != 0 {
+		t.Errorf("left %d uploads and %d objects", len(f.uploads), len(f.objects))
+	}
+	if err := w.Commit(); err == nil {
+		t.Error("Commit after Abort succeeded")
+	}
+}
+
+func TestS3ExistsRemove(t *testing.T) {
+	f, srv := newFakeS3(t)
+	s := newTestS3(t, srv, testSecretKey)
+
+	if ok, err := s.Exists("u/x.jpg"); ok || err != nil {
+		t.Fatalf("Exists before write = %v, %v", ok, err)
+	}
+	if _, err := s.Stat("u/x.jpg"); !errors.Is(err, ErrNotExist) {
+		t.Fatalf("Stat of missing object = %v, want ErrNotExist", err)
+	}
+	if err := WriteFile(s, "u/x.jpg", []byte("jpeg")); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := s.Exists("u/x.jpg"); !ok || err != nil {
+		t.Fatalf("Exists after write = %v, %v", ok, err)
+	}
+	if err := s.Remove("u/x.jpg"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := f.objects["runs/u/x.jpg"]; ok {
+		t.Error("object still stored after Remove")
+	}
+}
+
+func TestS3BadSignature(t *testing.T) {
+	_, srv := newFakeS3(t)
+	s := newTestS3(t, srv, "wrong-secret")
+
+	err := WriteFile(s, "u/x.jpg", []byte("jpeg"))
+	var se *S3Error
+	if !errors.As(err, &se) || se.Status != http.StatusForbidden || se.Code != "SignatureDoesNotMatch" {
+		t.Fatalf("WriteFile with a wrong secret = %v, want SignatureDoesNotMatch", err)
+	}
+}
@@ -0,0 +1,112 @@
+package storage
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	sigAlgo      = "AWS4-HMAC-SHA256"
+	amzDate      = "20060102T150405Z"
+	emptyPayload = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+func sha256Hex(b []byte) string {
+	s := sha256.Sum256(b)
+	return hex.EncodeToString(s[:])
+}
+
+func hmacSHA256(key []byte, s string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(s))
+	return h.Sum(nil)
+}
+
+// sign adds AWS Signature Version 4 headers to rq, whose body hashes to sum.
+func (s *S3) sign(rq *http.Request, sum string, now time.Time) {
+	t := now.UTC().Format(amzDate)
+	day := t[:8]
+	rq.Header.Set("X-Amz-Date", t)
+	rq.Header.Set("X-Amz-Content-Sha256", sum)
+	if s.cfg.SessionToken != "" {
+		rq.Header.Set("X-Amz-Security-Token", s.cfg.SessionToken)
+	}
+
+	hs := map[string]string{"host": rq.URL.Host}
+	for k, v := range rq.Header {
+		lk := strings.ToLower(k)
+		if strings.HasPrefix(lk, "x-amz-") || lk == "content-type" || lk == "content-md5" {
+			hs[lk] = strings.TrimSpace(strings.Join(v, ","))
+		}
+	}
+	names := make([]string, 0, len(hs))
+	for k := range hs {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var ch strings.Builder
+	for _, k := range names {
+		ch.WriteString(k + ":" + hs[k] + "\n")
+	}
+	signed := strings.Join(names, ";")
+
+	creq := strings.Join([]string{
+		rq.Method,
+		rq.URL.EscapedPath(),
+		canonicalQuery(rq.URL.Query()),
+		ch.String(),
+		signed,
+		sum,
+	}, "\n")
+	scope := day + "/" + s.cfg.Region + "/s3/aws4_request"
+	sts := sigAlgo + "\n" + t + "\n" + scope + "\n" + sha256Hex([]byte(creq))
+
+	k := hmacSHA256([]byte("AWS4"+s.cfg.SecretKey), day)
+	k = hmacSHA256(k, s.cfg.Region)
+	k = hmacSHA256(k, "s3")
+	k = hmacSHA256(k, "aws4_request")
+	sig := hex.EncodeToString(hmacSHA256(k, sts))
+
+	rq.Header.Set("Authorization", sigAlgo+" Credential="+s.cfg.AccessKey+"/"+scope+", SignedHeaders="+signed+", Signature="+sig)
+}
+
+func canonicalQuery(q url.Values) string {
+	ks := make([]string, 0, len(q))
+	for k := range q {
+		ks = append(ks, k)
+	}
+	sort.Strings(ks)
+	var out []string
+	for _, k := range ks {
+		vs := append([]string(nil), q[k]...)
+		sort.Strings(vs)
+		for _, v := range vs {
+			out = append(out, uriEncode(k, true)+"="+uriEncode(v, true))
+		}
+	}
+	return strings.Join(out, "&")
+}
+
+// uriEncode escapes everything but RFC 3986 unreserved characters, and
+// slashes too when slash is set, as SigV4 requires.
+func uriEncode(s string, slash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c >= 'A' && c <= 'Z', c >= 'a' && c <= 'z', c >= '0' && c <= '9', c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !slash:
+			b.WriteByte(c)
+		default:
+			b.WriteString("%" + strings.ToUpper(hex.EncodeToString([]byte{c})))
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,82 @@
+// Package storage is where finished downloads and run state end up: the
+// local output folder or an S3-compatible bucket.
+package storage
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"time"
+)
+
+var ErrNotExist = fs.ErrNotExist
+
+type Info struct {
+	Size    int64
+	ModTime time.Time
+}
+
+// Storage keeps objects under slash-separated names relative to its root.
+type Storage interface {
+	Exists(name string) (bool, error)
+	Stat(name string) (Info, error)
+	Create(name string) (Writer, error)
+	Remove(name string) error
+	String() string
+}
+
+// Writer receives an object's content. Nothing is visible under the name
+// until Commit; Abort throws the content away.
+type Writer interface {
+	io.Writer
+	Commit() error
+	Abort() error
+}
+
+// LocalPath returns where name lives on disk when st is a local folder.
+func LocalPath(st Storage, name string) (string, bool) {
+	if l, ok := st.(*Local); ok {
+		return l.Path(name), true
+	}
+	return "", false
+}
+
+// IsRemote reports whether st keeps files somewhere other than the local
+// disk, where features that rewrite or link files cannot follow them.
+func IsRemote(st Storage) bool {
+	if st == nil {
+		return false
+	}
+	_, ok := LocalPath(st, "")
+	return !ok
+}
+
+func WriteFile(st Storage, name string, data []byte) error {
+	w, err := st.Create(name)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		_ = w.Abort()
+		return err
+	}
+	return w.Commit()
+}
+
+// Upload copies the local file p to name.
+func Upload(st Storage, name, p string) error {
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w, err := st.Create(name)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, f); err != nil {
+		_ = w.Abort()
+		return err
+	}
+	return w.Commit()
+}
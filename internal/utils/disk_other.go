@@ -0,0 +1,11 @@
+//go:build !linux && !darwin && !freebsd && !windows
+
+package utils
+
+import "errors"
+
+var ErrNoDiskInfo = errors.New("free space is not available on this platform")
+
+func FreeSpace(path string) (int64, error) {
+	return 0, ErrNoDiskInfo
+}
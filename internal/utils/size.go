@@ -0,0 +1,55 @@
+package utils
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ParseSize parses sizes like "500MB", "1.5G" or "2048" (bytes). Units are
+// powers of 1024. "", "0" and "off" mean no limit and return 0.
+func ParseSize(s string) (int64, error) {
+	v := strings.ToLower(strings.TrimSpace(s))
+	switch v {
+	case "", "0", "off", "none", "unlimited":
+		return 0, nil
+	}
+	i := 0
+	for i < len(v) && (v[i] == '.' || (v[i] >= '0' && v[i] <= '9')) {
+		i++
+	}
+	f, err := strconv.ParseFloat(v[:i], 64)
+	if err != nil || f < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	mul := 1.0
+	switch strings.TrimSpace(v[i:]) {
+	case "", "b":
+	case "k", "kb", "kib":
+		mul = 1 << 10
+	case "m", "mb", "mib":
+		mul = 1 << 20
+	case "g", "gb", "gib":
+		mul = 1 << 30
+	case "t", "tb", "tib":
+		mul = 1 << 40
+	default:
+		return 0, fmt.Errorf("invalid size unit in %q", s)
+	}
+	return int64(f * mul), nil
+}
+
+func FormatSize(n int64) string {
+	f := float64(n)
+	switch {
+	case n >= 1<<40:
+		return fmt.Sprintf("%.2f TB", f/(1<<40))
+	case n >= 1<<30:
+		return fmt.Sprintf("%.2f GB", f/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1f MB", f/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.0f KB", f/(1<<10))
+	}
+	return fmt.Sprintf("%d B", n)
+}